@@ -1,20 +1,44 @@
 package abr
 
 import (
+	"context"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
-	"regexp"
 	"strings"
 	"time"
+	"unicode"
 )
 
 type Client struct {
 	guid     string
 	endpoint string
 	timeout  int
+	matcher  *Matcher
+	index    Index
+	http     *http.Client
+}
+
+// Option configures optional Client behaviour.
+type Option func(*Client)
+
+// WithHTTPClient makes the client send requests through hc, so one
+// http.Client can be shared between API clients or pointed at a stub server.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) {
+		c.http = hc
+	}
+}
+
+// WithMatchConfig replaces the default candidate scoring used by Lookup and
+// Match.
+func WithMatchConfig(cfg MatchConfig) Option {
+	return func(c *Client) {
+		c.matcher = NewMatcher(cfg)
+	}
 }
 
 type SearchResultsRecord struct {
@@ -44,30 +68,96 @@ type SearchResultsRecord struct {
 	} `xml:"businessName"`
 	MainName struct {
 		OrganisationName string `xml:"organisationName"`
+		Score            string `xml:"score"`
 	} `xml:"mainName"`
 	MainTradingName struct {
 		OrganisationName string `xml:"organisationName"`
 		Score            string `xml:"score"`
 	} `xml:"mainTradingName"`
+	OtherTradingName struct {
+		OrganisationName string `xml:"organisationName"`
+		Score            string `xml:"score"`
+	} `xml:"otherTradingName"`
 }
 
 type ABRResponse struct {
 	Response struct {
+		Exception         abrException `xml:"exception"`
 		SearchResultsList struct {
 			Records []SearchResultsRecord `xml:"searchResultsRecord"`
 		} `xml:"searchResultsList"`
 	} `xml:"response"`
 }
 
-func NewClient(guid, endpoint string, timeout int) *Client {
-	return &Client{
+// ExceptionError is an exception the ABR web service answered with in place
+// of results, such as an unrecognised authenticationGuid. The ABR sends
+// these with HTTP 200, so they only show up in the body.
+type ExceptionError struct {
+	Code        string
+	Description string
+}
+
+func (e *ExceptionError) Error() string {
+	return fmt.Sprintf("abr exception %s: %s", e.Code, e.Description)
+}
+
+type abrException struct {
+	Description string `xml:"exceptionDescription"`
+	Code        string `xml:"exceptionCode"`
+}
+
+// err is nil when there is no exception, wraps ErrABNNotFound when the ABR
+// simply has no matching record, and is an *ExceptionError otherwise.
+func (e abrException) err() error {
+	desc := strings.TrimSpace(e.Description)
+	code := strings.TrimSpace(e.Code)
+	if desc == "" && code == "" {
+		return nil
+	}
+	lower := strings.ToLower(desc)
+	if strings.Contains(lower, "no record") || strings.Contains(lower, "not a valid abn") {
+		return fmt.Errorf("%w: %s", ErrABNNotFound, desc)
+	}
+	return &ExceptionError{Code: code, Description: desc}
+}
+
+// ResponseError returns the exception an ABR web service payload carries,
+// in the same terms as err: nil, ErrABNNotFound or an *ExceptionError. A
+// body that is not ABR XML is an error too.
+func ResponseError(body []byte) error {
+	var payload struct {
+		Response *struct {
+			Exception abrException `xml:"exception"`
+		} `xml:"response"`
+	}
+	if err := xml.Unmarshal(body, &payload); err != nil {
+		return fmt.Errorf("decode abr response: %w", err)
+	}
+	if payload.Response == nil {
+		return errors.New("decode abr response: no response element")
+	}
+	return payload.Response.Exception.err()
+}
+
+func NewClient(guid, endpoint string, timeout int, opts ...Option) *Client {
+	c := &Client{
 		guid:     guid,
 		endpoint: endpoint,
 		timeout:  timeout,
+		matcher:  NewMatcher(DefaultMatchConfig()),
+	}
+	for _, opt := range opts {
+		opt(c)
 	}
+	if c.http == nil {
+		c.http = &http.Client{
+			Timeout: time.Duration(timeout) * time.Second,
+		}
+	}
+	return c
 }
 
-func (c *Client) searchByName(businessName string) (string, error) {
+func (c *Client) searchByName(ctx context.Context, businessName string) (string, error) {
 	params := url.Values{}
 	params.Set("name", businessName)
 	params.Set("postcode", "")
@@ -83,206 +173,183 @@ func (c *Client) searchByName(businessName string) (string, error) {
 	params.Set("TAS", "Y")
 	params.Set("authenticationGuid", c.guid)
 
-	client := &http.Client{
-		Timeout: time.Duration(c.timeout) * time.Second,
+	body, err := c.get(ctx, c.endpoint+"?"+params.Encode())
+	if err != nil {
+		return "", err
 	}
 
-	resp, err := client.Get(c.endpoint + "?" + params.Encode())
+	return string(body), nil
+}
+
+// get performs a GET against the ABR web service and returns the raw body.
+func (c *Client) get(ctx context.Context, rawURL string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	resp, err := c.http.Do(req)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
+	defer resp.Body.Close()
 
-	return string(body), nil
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("abr returned %d", resp.StatusCode)
+	}
+
+	return io.ReadAll(resp.Body)
+}
+
+// methodURL returns the URL of another ABR web service method next to the
+// configured name search endpoint.
+func (c *Client) methodURL(method string) string {
+	idx := strings.LastIndex(c.endpoint, "/")
+	if idx < 0 {
+		return method
+	}
+	return c.endpoint[:idx+1] + method
 }
 
-func (c *Client) getAllResults(xmlText string) []Result {
+// getAllResults parses a name search response. An exception other than
+// "no records" is returned as an error rather than an empty result, so a bad
+// GUID is not mistaken for a merchant the ABR does not know.
+func (c *Client) getAllResults(xmlText string) ([]Result, error) {
 	if xmlText == "" {
-		return nil
+		return nil, nil
 	}
 
 	var response ABRResponse
-	err := xml.Unmarshal([]byte(xmlText), &response)
-	if err != nil {
-		return nil
+	if err := xml.Unmarshal([]byte(xmlText), &response); err != nil {
+		return nil, fmt.Errorf("decode abr search: %w", err)
+	}
+	if err := response.Response.Exception.err(); err != nil {
+		if errors.Is(err, ErrABNNotFound) {
+			return nil, nil
+		}
+		return nil, err
 	}
 
 	var results []Result
-	abnRegex := regexp.MustCompile(`^\d{11}$`)
 
 	for _, rec := range response.Response.SearchResultsList.Records {
-		abn := strings.TrimSpace(rec.ABN.IdentifierValue)
-		status := strings.TrimSpace(rec.ABN.IdentifierStatus)
-
-		if !abnRegex.MatchString(abn) || status != "Active" {
+		abn, err := ParseABN(rec.ABN.IdentifierValue)
+		if err != nil {
 			continue
 		}
+		status := strings.TrimSpace(rec.ABN.IdentifierStatus)
 
-		acn := strings.TrimSpace(rec.ACN.IdentifierValue)
+		// Drop malformed ACNs rather than passing them downstream
+		acn, _ := ParseACN(rec.ACN.IdentifierValue)
 		state := strings.TrimSpace(rec.MainBusinessPhysicalAddress.StateCode)
-		legalName := strings.TrimSpace(rec.BusinessName.OrganisationName)
 
-		if legalName == "" {
-			legalName = strings.TrimSpace(rec.MainName.OrganisationName)
+		// Each record carries exactly one of the name elements, depending on
+		// which name matched the search
+		names := []struct {
+			nameType string
+			name     string
+			score    string
+		}{
+			{"BN", rec.BusinessName.OrganisationName, rec.BusinessName.Score},
+			{"MN", rec.MainName.OrganisationName, rec.MainName.Score},
+			{"TRD", rec.MainTradingName.OrganisationName, rec.MainTradingName.Score},
+			{"OTN", rec.OtherTradingName.OrganisationName, rec.OtherTradingName.Score},
 		}
-		if legalName == "" {
-			legalName = strings.TrimSpace(rec.MainTradingName.OrganisationName)
+
+		var legalName, score, nameType string
+		for _, n := range names {
+			if strings.TrimSpace(n.name) != "" {
+				legalName = strings.TrimSpace(n.name)
+				score = strings.TrimSpace(n.score)
+				nameType = n.nameType
+				break
+			}
 		}
 
-		score := strings.TrimSpace(rec.BusinessName.Score)
-		if score == "" {
-			score = strings.TrimSpace(rec.MainTradingName.Score)
+		if acn.IsZero() && isCompanyName(legalName) {
+			acn, _ = abn.EmbeddedACN()
 		}
 
 		results = append(results, Result{
-			ABN:       abn,
-			ACN:       acn,
-			State:     state,
-			LegalName: legalName,
-			Score:     score,
+			ABN:        abn,
+			ACN:        acn,
+			State:      state,
+			LegalName:  legalName,
+			Score:      score,
+			Status:     status,
+			NameType:   nameType,
+			EntityType: inferEntityType(legalName),
 		})
 	}
 
-	return results
+	return results, nil
 }
 
-func (c *Client) findBestResult(businessName string, results []Result) Result {
-	if len(results) == 0 {
-		return Result{}
-	}
-
-	searchLower := strings.ToLower(strings.TrimSpace(businessName))
-	searchWords := stringToSet(strings.Fields(searchLower))
-
-	companyKeywords := []string{"pty", "limited", "ltd", "inc", "corporation", "corp", "group", "holding"}
-	unrelatedKeywords := []string{"cleaning", "freight", "toners", "candles", "music", "ads", "dogwash"}
-
-	type scoredResult struct {
-		score  float64
-		result Result
-	}
-
-	var scoredResults []scoredResult
-
-	for _, result := range results {
-		nameLower := strings.ToLower(result.LegalName)
-		resultWords := stringToSet(strings.Fields(nameLower))
-
-		// Must be company entity
-		isCompany := false
-		for _, keyword := range companyKeywords {
-			if strings.Contains(nameLower, keyword) {
-				isCompany = true
-				break
-			}
-		}
-		if !isCompany {
-			continue
-		}
-
-		// Check for common words
-		commonWords := intersection(searchWords, resultWords)
-		if len(commonWords) == 0 {
-			continue
-		}
-
-		// Check for unrelated business type
-		hasUnrelated := false
-		for _, keyword := range unrelatedKeywords {
-			if strings.Contains(nameLower, keyword) {
-				hasUnrelated = true
-				break
-			}
-		}
-		if hasUnrelated && len(commonWords) < 2 {
-			continue
-		}
-
-		// Calculate score
-		scoreValue := 50.0
-		if scoreInt, err := fmt.Sscanf(result.Score, "%f", &scoreValue); err == nil {
-			_ = scoreInt
-		}
-
-		exactMatch := 0.0
-		if searchLower == nameLower {
-			exactMatch = 1000
-		}
+// Match searches the ABR by name and returns every candidate ranked by the
+// client's matcher, best first.
+func (c *Client) Match(ctx context.Context, businessName string) ([]Candidate, error) {
+	return c.MatchWithHints(ctx, businessName, Hints{})
+}
 
-		containsMatch := 0.0
-		if strings.Contains(searchLower, nameLower) || strings.Contains(nameLower, searchLower) {
-			containsMatch = 500
+// MatchWithHints is Match with the ranking refined by what is already known
+// about the merchant, such as its website.
+func (c *Client) MatchWithHints(ctx context.Context, businessName string, hints Hints) ([]Candidate, error) {
+	if results, ok, err := c.searchIndexByName(ctx, businessName); ok {
+		if err != nil {
+			return nil, err
 		}
-
-		wordMatch := float64(len(commonWords)) * 100
-
-		totalScore := exactMatch + containsMatch + wordMatch + scoreValue
-		scoredResults = append(scoredResults, scoredResult{totalScore, result})
+		return c.matcher.RankWithHints(businessName, hints, results), nil
 	}
 
-	if len(scoredResults) == 0 {
-		return Result{}
+	xmlResponse, err := c.searchByName(ctx, businessName)
+	if err != nil {
+		return nil, err
 	}
+	results, err := c.getAllResults(xmlResponse)
+	if err != nil {
+		return nil, err
+	}
+	return c.matcher.RankWithHints(businessName, hints, results), nil
+}
 
-	// Find max score
-	maxScore := scoredResults[0].score
-	maxResult := scoredResults[0].result
-	for _, sr := range scoredResults[1:] {
-		if sr.score > maxScore {
-			maxScore = sr.score
-			maxResult = sr.result
-		}
+// Lookup returns the best matching ABR entity for a business name, or empty
+// values when no candidate clears the match threshold. err is only set when
+// the search itself failed, so a miss can be told from an outage.
+func (c *Client) Lookup(ctx context.Context, businessName string) (abn ABN, acn ACN, state, legalName, score string, err error) {
+	candidates, err := c.Match(ctx, businessName)
+	if err != nil || len(candidates) == 0 || !candidates[0].Accepted {
+		return "", "", "", "", "", err
 	}
 
-	return maxResult
+	best := candidates[0].Result
+	return best.ABN, best.ACN, best.State, best.LegalName, best.Score, nil
 }
 
-func (c *Client) Lookup(businessName string) (abn, acn, state, legalName, score string) {
-	// Simple lookup: just search with the provided name and return the first result
-	xmlResponse, err := c.searchByName(businessName)
+// VerifyABN checks that an ABN is active and, when given, that the legal name
+// and state match the authoritative ABR record.
+func (c *Client) VerifyABN(ctx context.Context, abn, legalName, state string) bool {
+	parsed, err := ParseABN(abn)
 	if err != nil {
-		return
-	}
-
-	allResults := c.getAllResults(xmlResponse)
-	if len(allResults) == 0 {
-		return
+		return false
 	}
 
-	// Return the first result directly without fuzzy matching
-	firstResult := allResults[0]
-	return firstResult.ABN, firstResult.ACN, firstResult.State, firstResult.LegalName, firstResult.Score
-}
-
-// VerifyABN checks if an ABN is valid and matches the given legal name and state
-func (c *Client) VerifyABN(abn, legalName, state string) bool {
-	// Validate ABN format (11 digits)
-	abnRegex := regexp.MustCompile(`^\d{11}$`)
-	if !abnRegex.MatchString(abn) {
+	details, err := c.SearchByABN(ctx, parsed)
+	if err != nil || !details.Active() {
 		return false
 	}
 
-	// Search by the provided legal name to get results
-	xmlResponse, err := c.searchByName(legalName)
-	if err != nil {
+	if state != "" && details.State != state {
 		return false
 	}
 
-	results := c.getAllResults(xmlResponse)
+	if legalName == "" {
+		return true
+	}
 
-	// Look for exact ABN match
-	for _, result := range results {
-		if result.ABN == abn {
-			// Found matching ABN
-			// If state is provided, verify it matches
-			if state != "" && result.State != state {
-				return false
-			}
+	want := NormaliseName(legalName)
+	for _, name := range details.Names() {
+		have := NormaliseName(name)
+		if have == want || strings.Contains(have, want) || strings.Contains(want, have) {
 			return true
 		}
 	}
@@ -291,39 +358,55 @@ func (c *Client) VerifyABN(abn, legalName, state string) bool {
 }
 
 // GetAllResults is a public method for testing
-func (c *Client) GetAllResults(businessName string) []Result {
-	xmlResponse, err := c.searchByName(businessName)
+func (c *Client) GetAllResults(ctx context.Context, businessName string) []Result {
+	xmlResponse, err := c.searchByName(ctx, businessName)
 	if err != nil {
 		fmt.Printf("Error: %v\n", err)
 		return nil
 	}
 	fmt.Printf("XML length: %d\n", len(xmlResponse))
-	return c.getAllResults(xmlResponse)
+	results, err := c.getAllResults(xmlResponse)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+	}
+	return results
 }
 
 type Result struct {
-	ABN       string
-	ACN       string
-	State     string
-	LegalName string
-	Score     string
-	Address   string
+	ABN        ABN
+	ACN        ACN
+	State      string
+	LegalName  string
+	Score      string
+	Address    string
+	Status     string
+	NameType   string
+	EntityType string
 }
 
-func stringToSet(strs []string) map[string]bool {
-	m := make(map[string]bool)
-	for _, s := range strs {
-		m[s] = true
+// NormaliseName lowercases a name and strips punctuation so that
+// "McDonald's Australia Ltd." and "MCDONALDS AUSTRALIA LTD" compare equal.
+func NormaliseName(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			b.WriteRune(r)
+		case unicode.IsSpace(r) || r == '-' || r == '&':
+			b.WriteRune(' ')
+		}
 	}
-	return m
+	return strings.Join(strings.Fields(b.String()), " ")
 }
 
-func intersection(a, b map[string]bool) map[string]bool {
-	result := make(map[string]bool)
-	for key := range a {
-		if b[key] {
-			result[key] = true
+// isCompanyName reports whether a registered name carries a company suffix,
+// which is when an ABN embeds the entity's ACN.
+func isCompanyName(name string) bool {
+	for _, word := range strings.Fields(NormaliseName(name)) {
+		switch word {
+		case "pty", "ltd", "limited", "nl":
+			return true
 		}
 	}
-	return result
+	return false
 }
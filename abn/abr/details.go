@@ -0,0 +1,277 @@
+package abr
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// searchByABNMethod is the ABR web service method that returns the full
+// business entity record for a single ABN, including historical details.
+const searchByABNMethod = "SearchByABNv202001"
+
+// abrDateLayout is the date format used throughout ABR payloads. Open-ended
+// periods are reported as 0001-01-01, which parses to the zero time.
+const abrDateLayout = "2006-01-02"
+
+// ErrABNNotFound is returned when the ABR has no record for the requested ABN.
+var ErrABNNotFound = errors.New("abn not found")
+
+// Period is a date range reported by the ABR. A zero To means the period is
+// still current.
+type Period struct {
+	From time.Time
+	To   time.Time
+}
+
+// Current reports whether the period has not ended.
+func (p Period) Current() bool {
+	return p.To.IsZero()
+}
+
+// StatusPeriod is one entry in an ABN's status history.
+type StatusPeriod struct {
+	Status string
+	Period
+}
+
+// NamePeriod is a business, trading or legal name together with the period
+// it was registered against the ABN.
+type NamePeriod struct {
+	Name string
+	Period
+}
+
+// ABNDetails is the authoritative ABR record for a single ABN.
+type ABNDetails struct {
+	ABN            ABN
+	Status         string
+	StatusHistory  []StatusPeriod
+	EntityTypeCode string
+	EntityType     string
+	ASICNumber     string
+	GST            []Period
+	LegalName      string
+	LegalNames     []NamePeriod
+	BusinessNames  []NamePeriod
+	TradingNames   []NamePeriod
+	State          string
+	Postcode       string
+	LastUpdated    time.Time
+}
+
+// Active reports whether the ABN is currently active.
+func (d ABNDetails) Active() bool {
+	return d.Status == "Active"
+}
+
+// GSTRegistered reports whether the entity is currently registered for GST.
+func (d ABNDetails) GSTRegistered() bool {
+	for _, p := range d.GST {
+		if !p.From.IsZero() && p.Current() {
+			return true
+		}
+	}
+	return false
+}
+
+// Names returns every legal, business and trading name on the record, most
+// relevant first, without duplicates.
+func (d ABNDetails) Names() []string {
+	var names []string
+	seen := make(map[string]bool)
+	add := func(n string) {
+		key := strings.ToLower(strings.TrimSpace(n))
+		if key == "" || seen[key] {
+			return
+		}
+		seen[key] = true
+		names = append(names, strings.TrimSpace(n))
+	}
+
+	add(d.LegalName)
+	for _, group := range [][]NamePeriod{d.LegalNames, d.BusinessNames, d.TradingNames} {
+		for _, n := range group {
+			add(n.Name)
+		}
+	}
+	return names
+}
+
+type abrPeriod struct {
+	EffectiveFrom string `xml:"effectiveFrom"`
+	EffectiveTo   string `xml:"effectiveTo"`
+}
+
+type abrName struct {
+	OrganisationName string `xml:"organisationName"`
+	abrPeriod
+}
+
+type abrPersonName struct {
+	GivenName      string `xml:"givenName"`
+	OtherGivenName string `xml:"otherGivenName"`
+	FamilyName     string `xml:"familyName"`
+	abrPeriod
+}
+
+type businessEntity struct {
+	RecordLastUpdatedDate string `xml:"recordLastUpdatedDate"`
+	ABN                   []struct {
+		IdentifierValue    string `xml:"identifierValue"`
+		IsCurrentIndicator string `xml:"isCurrentIndicator"`
+	} `xml:"ABN"`
+	EntityStatus []struct {
+		EntityStatusCode string `xml:"entityStatusCode"`
+		abrPeriod
+	} `xml:"entityStatus"`
+	ASICNumber string `xml:"ASICNumber"`
+	EntityType struct {
+		EntityTypeCode    string `xml:"entityTypeCode"`
+		EntityDescription string `xml:"entityDescription"`
+	} `xml:"entityType"`
+	GoodsAndServicesTax []abrPeriod     `xml:"goodsAndServicesTax"`
+	MainName            []abrName       `xml:"mainName"`
+	LegalName           []abrPersonName `xml:"legalName"`
+	MainTradingName     []abrName       `xml:"mainTradingName"`
+	OtherTradingName    []abrName       `xml:"otherTradingName"`
+	BusinessName        []abrName       `xml:"businessName"`
+	MainBusinessAddress []struct {
+		StateCode string `xml:"stateCode"`
+		Postcode  string `xml:"postcode"`
+		abrPeriod
+	} `xml:"mainBusinessPhysicalAddress"`
+}
+
+type abnDetailsResponse struct {
+	Response struct {
+		Exception abrException    `xml:"exception"`
+		Entity    *businessEntity `xml:"businessEntity202001"`
+	} `xml:"response"`
+}
+
+// SearchByABN fetches the full ABR record for the given ABN.
+func (c *Client) SearchByABN(ctx context.Context, abn ABN) (*ABNDetails, error) {
+	if !abn.Valid() {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidABN, abn)
+	}
+
+	if details, ok, err := c.searchIndexByABN(ctx, abn); ok {
+		return details, err
+	}
+
+	params := url.Values{}
+	params.Set("searchString", abn.String())
+	params.Set("includeHistoricalDetails", "Y")
+	params.Set("authenticationGuid", c.guid)
+
+	body, err := c.get(ctx, c.methodURL(searchByABNMethod)+"?"+params.Encode())
+	if err != nil {
+		return nil, err
+	}
+	return parseABNDetails(body)
+}
+
+func parseABNDetails(body []byte) (*ABNDetails, error) {
+	var response abnDetailsResponse
+	if err := xml.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf("decode abn details: %w", err)
+	}
+
+	// Only a "no record" exception means the ABN is unknown; anything else,
+	// such as a bad GUID, is an *ExceptionError
+	if err := response.Response.Exception.err(); err != nil {
+		return nil, err
+	}
+	entity := response.Response.Entity
+	if entity == nil {
+		return nil, ErrABNNotFound
+	}
+
+	details := &ABNDetails{
+		EntityTypeCode: strings.TrimSpace(entity.EntityType.EntityTypeCode),
+		EntityType:     strings.TrimSpace(entity.EntityType.EntityDescription),
+		ASICNumber:     strings.TrimSpace(entity.ASICNumber),
+		LastUpdated:    parseABRDate(entity.RecordLastUpdatedDate),
+	}
+
+	for _, a := range entity.ABN {
+		parsed, err := ParseABN(a.IdentifierValue)
+		if err != nil {
+			continue
+		}
+		if details.ABN.IsZero() || a.IsCurrentIndicator == "Y" {
+			details.ABN = parsed
+		}
+	}
+
+	for _, s := range entity.EntityStatus {
+		sp := StatusPeriod{Status: strings.TrimSpace(s.EntityStatusCode), Period: s.period()}
+		details.StatusHistory = append(details.StatusHistory, sp)
+		if sp.Current() {
+			details.Status = sp.Status
+		}
+	}
+
+	for _, g := range entity.GoodsAndServicesTax {
+		details.GST = append(details.GST, g.period())
+	}
+
+	for _, n := range entity.MainName {
+		details.LegalNames = append(details.LegalNames, n.namePeriod())
+	}
+	for _, n := range entity.LegalName {
+		full := strings.Join(strings.Fields(n.GivenName+" "+n.OtherGivenName+" "+n.FamilyName), " ")
+		details.LegalNames = append(details.LegalNames, NamePeriod{Name: full, Period: n.period()})
+	}
+	for _, n := range entity.BusinessName {
+		details.BusinessNames = append(details.BusinessNames, n.namePeriod())
+	}
+	for _, group := range [][]abrName{entity.MainTradingName, entity.OtherTradingName} {
+		for _, n := range group {
+			details.TradingNames = append(details.TradingNames, n.namePeriod())
+		}
+	}
+	details.LegalName = currentName(details.LegalNames)
+
+	for _, a := range entity.MainBusinessAddress {
+		if a.period().Current() || details.State == "" {
+			details.State = strings.TrimSpace(a.StateCode)
+			details.Postcode = strings.TrimSpace(a.Postcode)
+		}
+	}
+
+	return details, nil
+}
+
+func (p abrPeriod) period() Period {
+	return Period{From: parseABRDate(p.EffectiveFrom), To: parseABRDate(p.EffectiveTo)}
+}
+
+func (n abrName) namePeriod() NamePeriod {
+	return NamePeriod{Name: strings.TrimSpace(n.OrganisationName), Period: n.period()}
+}
+
+func currentName(names []NamePeriod) string {
+	for _, n := range names {
+		if n.Current() && n.Name != "" {
+			return n.Name
+		}
+	}
+	if len(names) > 0 {
+		return names[0].Name
+	}
+	return ""
+}
+
+func parseABRDate(s string) time.Time {
+	t, err := time.Parse(abrDateLayout, strings.TrimSpace(s))
+	if err != nil || t.Year() <= 1 {
+		return time.Time{}
+	}
+	return t
+}
@@ -0,0 +1,111 @@
+package abr
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const woolworthsDetails = `<ABRPayloadSearchResults><response><businessEntity202001>
+<recordLastUpdatedDate>2024-03-01</recordLastUpdatedDate>
+<ABN><identifierValue>88000014675</identifierValue><isCurrentIndicator>Y</isCurrentIndicator></ABN>
+<entityStatus><entityStatusCode>Active</entityStatusCode><effectiveFrom>1999-11-01</effectiveFrom><effectiveTo>0001-01-01</effectiveTo></entityStatus>
+<ASICNumber>000014675</ASICNumber>
+<entityType><entityTypeCode>PUB</entityTypeCode><entityDescription>Australian Public Company</entityDescription></entityType>
+<mainName><organisationName>WOOLWORTHS GROUP LIMITED</organisationName><effectiveFrom>2017-12-12</effectiveFrom></mainName>
+</businessEntity202001></response></ABRPayloadSearchResults>`
+
+func exceptionBody(desc string) string {
+	return `<ABRPayloadSearchResults><response><exception><exceptionDescription>` + desc +
+		`</exceptionDescription><exceptionCode>WEBSERVICES</exceptionCode></exception></response></ABRPayloadSearchResults>`
+}
+
+func TestSearchByABN(t *testing.T) {
+	tests := []struct {
+		name         string
+		body         string
+		wantNotFound bool
+		wantExcept   bool
+	}{
+		{name: "record", body: woolworthsDetails},
+		{name: "no record", body: exceptionBody("No records found"), wantNotFound: true},
+		{name: "bad guid", body: exceptionBody("The GUID entered is not recognised as a Registered Party"), wantExcept: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/"+searchByABNMethod || r.URL.Query().Get("searchString") != "88000014675" {
+					t.Errorf("request %s", r.URL)
+				}
+				io.WriteString(w, tt.body)
+			}))
+			defer srv.Close()
+
+			c := NewClient("guid", srv.URL+"/ABRSearchByName", 5)
+			details, err := c.SearchByABN(context.Background(), "88000014675")
+			var exc *ExceptionError
+			switch {
+			case tt.wantNotFound:
+				if !errors.Is(err, ErrABNNotFound) {
+					t.Errorf("err = %v, want ErrABNNotFound", err)
+				}
+			case tt.wantExcept:
+				if !errors.As(err, &exc) || errors.Is(err, ErrABNNotFound) {
+					t.Errorf("err = %v, want an ExceptionError", err)
+				}
+			case err != nil:
+				t.Fatal(err)
+			default:
+				if details.ABN != "88000014675" || details.ASICNumber != "000014675" || !details.Active() || details.EntityTypeCode != "PUB" {
+					t.Errorf("details = %+v", details)
+				}
+			}
+		})
+	}
+}
+
+// stubIndex knows one record.
+type stubIndex struct{ details *ABNDetails }
+
+func (s stubIndex) SearchByName(context.Context, string) ([]Result, error) { return nil, nil }
+
+func (s stubIndex) SearchByABN(_ context.Context, abn ABN) (*ABNDetails, error) {
+	if s.details != nil && abn == s.details.ABN {
+		return s.details, nil
+	}
+	return nil, ErrABNNotFound
+}
+
+func TestSearchByABNIndexOnly(t *testing.T) {
+	c := NewClient("", "", 5, WithIndex(stubIndex{&ABNDetails{ABN: "88000014675", Status: "Active"}}))
+	ctx := context.Background()
+
+	if d, err := c.SearchByABN(ctx, "88000014675"); err != nil || !d.Active() {
+		t.Errorf("indexed ABN = %+v, %v", d, err)
+	}
+	// Missing from the extract is not the same as unknown to the ABR
+	_, err := c.SearchByABN(ctx, "51824753556")
+	if !errors.Is(err, ErrNotInIndex) || errors.Is(err, ErrABNNotFound) {
+		t.Errorf("unindexed ABN gave %v, want ErrNotInIndex", err)
+	}
+}
+
+// brokenIndex fails every search.
+type brokenIndex struct{}
+
+var errIndexDown = errors.New("index down")
+
+func (brokenIndex) SearchByName(context.Context, string) ([]Result, error) { return nil, errIndexDown }
+
+func (brokenIndex) SearchByABN(context.Context, ABN) (*ABNDetails, error) { return nil, errIndexDown }
+
+func TestMatchIndexOnlyError(t *testing.T) {
+	// With no GUID there is no web service to fall back on
+	c := NewClient("", "", 5, WithIndex(brokenIndex{}))
+	if _, err := c.Match(context.Background(), "Woolworths"); !errors.Is(err, errIndexDown) {
+		t.Errorf("err = %v, want the index error", err)
+	}
+}
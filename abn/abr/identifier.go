@@ -0,0 +1,197 @@
+package abr
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	// ErrInvalidABN is returned when a value is not an 11 digit ABN with a
+	// valid modulus-89 checksum.
+	ErrInvalidABN = errors.New("invalid abn")
+	// ErrInvalidACN is returned when a value is not a 9 digit ACN with a valid
+	// modulus-10 check digit.
+	ErrInvalidACN = errors.New("invalid acn")
+)
+
+var abnWeights = [11]int{10, 1, 3, 5, 7, 9, 11, 13, 15, 17, 19}
+
+var acnWeights = [8]int{8, 7, 6, 5, 4, 3, 2, 1}
+
+// ABN is an Australian Business Number in canonical 11 digit form. The zero
+// value means "no ABN"; values obtained from ParseABN are always valid.
+type ABN string
+
+// ACN is an Australian Company Number in canonical 9 digit form. The zero
+// value means "no ACN"; values obtained from ParseACN are always valid.
+type ACN string
+
+// ParseABN accepts an ABN in any common written form ("51 824 753 556",
+// "51-824-753-556", "ABN 51824753556") and returns it in canonical form.
+func ParseABN(s string) (ABN, error) {
+	digits, ok := identifierDigits(s, "ABN")
+	if !ok || len(digits) != 11 {
+		return "", fmt.Errorf("%w: %q", ErrInvalidABN, s)
+	}
+	abn := ABN(digits)
+	if !abn.Valid() {
+		return "", fmt.Errorf("%w: %q fails checksum", ErrInvalidABN, s)
+	}
+	return abn, nil
+}
+
+// ParseACN accepts an ACN in any common written form ("004 085 616",
+// "ACN 004085616") and returns it in canonical form.
+func ParseACN(s string) (ACN, error) {
+	digits, ok := identifierDigits(s, "ACN")
+	if !ok || len(digits) != 9 {
+		return "", fmt.Errorf("%w: %q", ErrInvalidACN, s)
+	}
+	acn := ACN(digits)
+	if !acn.Valid() {
+		return "", fmt.Errorf("%w: %q fails checksum", ErrInvalidACN, s)
+	}
+	return acn, nil
+}
+
+// Valid reports whether the ABN is 11 digits and passes the modulus-89 check.
+func (a ABN) Valid() bool {
+	if len(a) != 11 || !allDigits(string(a)) {
+		return false
+	}
+	sum := 0
+	for i, w := range abnWeights {
+		d := int(a[i] - '0')
+		if i == 0 {
+			d--
+		}
+		sum += d * w
+	}
+	return sum%89 == 0
+}
+
+// IsZero reports whether no ABN is set.
+func (a ABN) IsZero() bool {
+	return a == ""
+}
+
+// String returns the canonical 11 digit form.
+func (a ABN) String() string {
+	return string(a)
+}
+
+// Format renders the ABN in the standard "51 824 753 556" display format.
+func (a ABN) Format() string {
+	if len(a) != 11 {
+		return string(a)
+	}
+	return fmt.Sprintf("%s %s %s %s", a[0:2], a[2:5], a[5:8], a[8:11])
+}
+
+// EmbeddedACN returns the ACN a company ABN is derived from. Company ABNs are
+// the 9 digit ACN prefixed by two check digits, so the result is only
+// meaningful for companies; ok is false when the trailing digits are not a
+// valid ACN.
+func (a ABN) EmbeddedACN() (ACN, bool) {
+	if !a.Valid() {
+		return "", false
+	}
+	acn := ACN(a[2:])
+	if !acn.Valid() {
+		return "", false
+	}
+	return acn, true
+}
+
+// UnmarshalText parses and validates an ABN, so invalid values are rejected
+// when decoding JSON. Empty input decodes to the zero ABN.
+func (a *ABN) UnmarshalText(text []byte) error {
+	if strings.TrimSpace(string(text)) == "" {
+		*a = ""
+		return nil
+	}
+	parsed, err := ParseABN(string(text))
+	if err != nil {
+		return err
+	}
+	*a = parsed
+	return nil
+}
+
+// Valid reports whether the ACN is 9 digits with a correct check digit.
+func (c ACN) Valid() bool {
+	if len(c) != 9 || !allDigits(string(c)) {
+		return false
+	}
+	sum := 0
+	for i, w := range acnWeights {
+		sum += int(c[i]-'0') * w
+	}
+	check := (10 - sum%10) % 10
+	return check == int(c[8]-'0')
+}
+
+// IsZero reports whether no ACN is set.
+func (c ACN) IsZero() bool {
+	return c == ""
+}
+
+// String returns the canonical 9 digit form.
+func (c ACN) String() string {
+	return string(c)
+}
+
+// Format renders the ACN in the standard "004 085 616" display format.
+func (c ACN) Format() string {
+	if len(c) != 9 {
+		return string(c)
+	}
+	return fmt.Sprintf("%s %s %s", c[0:3], c[3:6], c[6:9])
+}
+
+// UnmarshalText parses and validates an ACN. Empty input decodes to the zero
+// ACN.
+func (c *ACN) UnmarshalText(text []byte) error {
+	if strings.TrimSpace(string(text)) == "" {
+		*c = ""
+		return nil
+	}
+	parsed, err := ParseACN(string(text))
+	if err != nil {
+		return err
+	}
+	*c = parsed
+	return nil
+}
+
+// identifierDigits strips an optional label ("ABN", "ACN") and the separators
+// people use when writing identifiers. ok is false if anything other than
+// digits remains.
+func identifierDigits(s, label string) (string, bool) {
+	s = strings.TrimSpace(s)
+	if len(s) >= len(label) && strings.EqualFold(s[:len(label)], label) {
+		s = strings.TrimLeft(s[len(label):], ": ")
+	}
+
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r >= '0' && r <= '9':
+			b.WriteRune(r)
+		case r == ' ' || r == '-' || r == '.' || r == '\u00a0':
+		default:
+			return "", false
+		}
+	}
+	return b.String(), b.Len() > 0
+}
+
+func allDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
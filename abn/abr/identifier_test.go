@@ -0,0 +1,124 @@
+package abr
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestParseABN(t *testing.T) {
+	tests := []struct {
+		in   string
+		want ABN
+		err  bool
+	}{
+		{in: "51824753556", want: "51824753556"},
+		{in: "51 824 753 556", want: "51824753556"},
+		{in: "51-824-753-556", want: "51824753556"},
+		{in: "ABN 51 824 753 556", want: "51824753556"},
+		{in: "abn: 88 000 014 675", want: "88000014675"},
+		{in: "33 051 775 556", want: "33051775556"},
+		{in: "49 004 028 077", want: "49004028077"},
+		{in: "51 824 753 557", err: true}, // checksum
+		{in: "11 111 111 111", err: true}, // checksum
+		{in: "5182475355", err: true},     // 10 digits
+		{in: "518247535560", err: true},   // 12 digits
+		{in: "51 824 753 55a", err: true},
+		{in: "ACN 004 085 616", err: true},
+		{in: "", err: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseABN(tt.in)
+		if tt.err {
+			if !errors.Is(err, ErrInvalidABN) {
+				t.Errorf("ParseABN(%q) = %q, %v; want ErrInvalidABN", tt.in, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("ParseABN(%q) = %q, %v; want %q", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseACN(t *testing.T) {
+	tests := []struct {
+		in   string
+		want ACN
+		err  bool
+	}{
+		{in: "004085616", want: "004085616"},
+		{in: "004 085 616", want: "004085616"},
+		{in: "ACN 000 000 019", want: "000000019"},
+		{in: "010-749-961", want: "010749961"},
+		{in: "000 014 675", want: "000014675"},
+		{in: "004 085 617", err: true}, // check digit
+		{in: "04 085 616", err: true},  // 8 digits
+		{in: "ABN 004 085 616", err: true},
+		{in: "", err: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseACN(tt.in)
+		if tt.err {
+			if !errors.Is(err, ErrInvalidACN) {
+				t.Errorf("ParseACN(%q) = %q, %v; want ErrInvalidACN", tt.in, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("ParseACN(%q) = %q, %v; want %q", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestEmbeddedACN(t *testing.T) {
+	tests := []struct {
+		abn  ABN
+		want ACN
+		ok   bool
+	}{
+		{abn: "88000014675", want: "000014675", ok: true}, // Woolworths Group
+		{abn: "33051775556", want: "051775556", ok: true}, // Telstra
+		{abn: "53004085616", want: "004085616", ok: true},
+		{abn: "51824753556"}, // valid ABN, not a company
+		{abn: "51824753557"}, // invalid ABN
+		{abn: ""},
+	}
+	for _, tt := range tests {
+		got, ok := tt.abn.EmbeddedACN()
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("ABN(%q).EmbeddedACN() = %q, %v; want %q, %v", tt.abn, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	if got := ABN("51824753556").Format(); got != "51 824 753 556" {
+		t.Errorf("ABN.Format() = %q", got)
+	}
+	if got := ACN("004085616").Format(); got != "004 085 616" {
+		t.Errorf("ACN.Format() = %q", got)
+	}
+	if got := ABN("123").Format(); got != "123" {
+		t.Errorf("short ABN.Format() = %q, want it unchanged", got)
+	}
+}
+
+func TestUnmarshalIdentifiers(t *testing.T) {
+	var v struct {
+		ABN ABN `json:"abn"`
+		ACN ACN `json:"acn"`
+	}
+	if err := json.Unmarshal([]byte(`{"abn": "51 824 753 556", "acn": "004 085 616"}`), &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.ABN != "51824753556" || v.ACN != "004085616" {
+		t.Errorf("decoded %q, %q", v.ABN, v.ACN)
+	}
+	if err := json.Unmarshal([]byte(`{"abn": "", "acn": " "}`), &v); err != nil || !v.ABN.IsZero() || !v.ACN.IsZero() {
+		t.Errorf("empty identifiers decoded to %q, %q, %v", v.ABN, v.ACN, err)
+	}
+	if err := json.Unmarshal([]byte(`{"abn": "51 824 753 557"}`), &v); !errors.Is(err, ErrInvalidABN) {
+		t.Errorf("bad checksum decoded with %v", err)
+	}
+}
@@ -0,0 +1,66 @@
+package abr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrNotInIndex is returned by a client with no web service to fall back
+// on for an ABN its index does not hold. Unlike ErrABNNotFound it says
+// nothing about whether the ABN exists: the extract may predate it.
+var ErrNotInIndex = errors.New("abn not in the local index")
+
+// Index answers ABR lookups from a local copy of the register, such as the
+// one package bulk builds from the ABN Bulk Extract.
+type Index interface {
+	SearchByName(ctx context.Context, name string) ([]Result, error)
+	SearchByABN(ctx context.Context, abn ABN) (*ABNDetails, error)
+}
+
+// WithIndex makes the client answer name and ABN lookups from idx. The ABR
+// web service is only called when the index has no answer and the client
+// has an authentication GUID, so an index-only client needs no network.
+func WithIndex(idx Index) Option {
+	return func(c *Client) {
+		c.index = idx
+	}
+}
+
+// online reports whether the client may fall back to the ABR web service.
+func (c *Client) online() bool {
+	return c.guid != "" && c.endpoint != ""
+}
+
+// searchIndexByName returns ok=false when the search should go to the web
+// service instead. Without one to fall back on, an index error is
+// returned as it is.
+func (c *Client) searchIndexByName(ctx context.Context, businessName string) (results []Result, ok bool, err error) {
+	if c.index == nil {
+		return nil, false, nil
+	}
+	results, err = c.index.SearchByName(ctx, businessName)
+	if (err != nil || len(results) == 0) && c.online() {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, true, fmt.Errorf("abr index search %q: %w", businessName, err)
+	}
+	return results, true, nil
+}
+
+// searchIndexByABN returns ok=false when the lookup should go to the web
+// service instead.
+func (c *Client) searchIndexByABN(ctx context.Context, abn ABN) (details *ABNDetails, ok bool, err error) {
+	if c.index == nil {
+		return nil, false, nil
+	}
+	details, err = c.index.SearchByABN(ctx, abn)
+	if err != nil && c.online() {
+		return nil, false, nil
+	}
+	if errors.Is(err, ErrABNNotFound) || (err == nil && details == nil) {
+		return nil, true, fmt.Errorf("%w: %s", ErrNotInIndex, abn)
+	}
+	return details, true, err
+}
@@ -0,0 +1,325 @@
+package abr
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MatchConfig controls how the Matcher ranks ABR candidates. Each weight is
+// the number of points a candidate earns for a perfect score on that feature;
+// the defaults add up to 100.
+type MatchConfig struct {
+	ExactWeight    float64
+	TokenWeight    float64
+	ABRScoreWeight float64
+	EntityWeight   float64
+	ActiveWeight   float64
+
+	// DomainWeight and StateWeight are bonus points, on top of the 100 the
+	// other weights add up to, for candidates that agree with Hints.
+	DomainWeight float64
+	StateWeight  float64
+
+	// Threshold is the minimum total score a candidate needs to be accepted.
+	Threshold float64
+
+	// RequireActive rejects cancelled ABNs regardless of their score. They
+	// are still ranked so callers can see them.
+	RequireActive bool
+
+	// EntityPreference scores each ABR entity type code between 0 and 1.
+	// Codes that are not listed score DefaultEntityScore.
+	EntityPreference   map[string]float64
+	DefaultEntityScore float64
+
+	// IgnoredWords are dropped from both the query and candidate names before
+	// comparing them, so "Coles" matches "Coles Supermarkets Australia Pty Ltd".
+	IgnoredWords []string
+}
+
+// DefaultMatchConfig returns the weights used when no config is supplied.
+func DefaultMatchConfig() MatchConfig {
+	return MatchConfig{
+		ExactWeight:    30,
+		TokenWeight:    35,
+		ABRScoreWeight: 15,
+		EntityWeight:   10,
+		ActiveWeight:   10,
+		DomainWeight:   10,
+		StateWeight:    5,
+		Threshold:      50,
+		RequireActive:  true,
+		EntityPreference: map[string]float64{
+			"PUB": 1.0,
+			"PRV": 0.8,
+			"TRT": 0.3,
+			"IND": 0.1,
+		},
+		DefaultEntityScore: 0.4,
+		IgnoredWords: []string{
+			"pty", "ltd", "limited", "proprietary", "holdings", "holding",
+			"group", "inc", "incorporated", "corporation", "corp", "co",
+			"company", "the", "trustee", "for", "trust", "australia",
+			"australian", "aust", "nl",
+		},
+	}
+}
+
+// Features holds the per-feature points a candidate earned. Each value is
+// the feature's 0..1 score multiplied by its configured weight.
+type Features struct {
+	Exact    float64
+	Token    float64
+	ABRScore float64
+	Entity   float64
+	Active   float64
+	Domain   float64
+	State    float64
+}
+
+// Total sums the feature points.
+func (f Features) Total() float64 {
+	return f.Exact + f.Token + f.ABRScore + f.Entity + f.Active + f.Domain + f.State
+}
+
+// Hints are facts known about the merchant from other sources, such as
+// Brandfetch, that refine the ranking when set.
+type Hints struct {
+	// Domain is the merchant's website, e.g. "woolworths.com.au".
+	Domain string
+	// State is where the merchant is expected to be registered.
+	State string
+}
+
+// Candidate is a scored ABR result.
+type Candidate struct {
+	Result   Result
+	Score    float64
+	Features Features
+	Accepted bool
+}
+
+// Matcher ranks ABR search results against the name that was searched for.
+type Matcher struct {
+	cfg     MatchConfig
+	ignored map[string]bool
+}
+
+// NewMatcher returns a Matcher using cfg.
+func NewMatcher(cfg MatchConfig) *Matcher {
+	ignored := make(map[string]bool, len(cfg.IgnoredWords))
+	for _, w := range cfg.IgnoredWords {
+		ignored[strings.ToLower(w)] = true
+	}
+	return &Matcher{cfg: cfg, ignored: ignored}
+}
+
+// Threshold returns the minimum score for a candidate to be accepted.
+func (m *Matcher) Threshold() float64 {
+	return m.cfg.Threshold
+}
+
+// Rank scores every result against query and returns them best first. When
+// the ABR returns several names for the same ABN only the best scoring one
+// is kept.
+func (m *Matcher) Rank(query string, results []Result) []Candidate {
+	return m.RankWithHints(query, Hints{}, results)
+}
+
+// RankWithHints is Rank with bonus points for candidates whose legal name
+// agrees with hints.Domain and whose state matches hints.State.
+func (m *Matcher) RankWithHints(query string, hints Hints, results []Result) []Candidate {
+	queryTokens := m.coreTokens(query)
+
+	best := make(map[ABN]int)
+	var candidates []Candidate
+	for _, r := range results {
+		cand := m.score(queryTokens, hints, r)
+		if idx, ok := best[r.ABN]; ok {
+			if cand.Score > candidates[idx].Score {
+				candidates[idx] = cand
+			}
+			continue
+		}
+		best[r.ABN] = len(candidates)
+		candidates = append(candidates, cand)
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Score > candidates[j].Score
+	})
+	return candidates
+}
+
+// Best returns the top ranked candidate if it clears the threshold.
+func (m *Matcher) Best(query string, results []Result) (Candidate, bool) {
+	ranked := m.Rank(query, results)
+	if len(ranked) == 0 || !ranked[0].Accepted {
+		return Candidate{}, false
+	}
+	return ranked[0], true
+}
+
+func (m *Matcher) score(queryTokens []string, hints Hints, r Result) Candidate {
+	nameTokens := m.coreTokens(r.LegalName)
+
+	var f Features
+
+	if len(queryTokens) > 0 && strings.Join(queryTokens, "") == strings.Join(nameTokens, "") {
+		f.Exact = m.cfg.ExactWeight
+	}
+
+	f.Token = tokenOverlap(queryTokens, nameTokens) * m.cfg.TokenWeight
+
+	if abrScore, err := strconv.ParseFloat(strings.TrimSpace(r.Score), 64); err == nil {
+		f.ABRScore = clamp01(abrScore/100) * m.cfg.ABRScoreWeight
+	}
+
+	entity := m.cfg.DefaultEntityScore
+	if pref, ok := m.cfg.EntityPreference[r.EntityType]; ok {
+		entity = pref
+	}
+	f.Entity = entity * m.cfg.EntityWeight
+
+	if hints.Domain != "" && m.DomainAgrees(hints.Domain, r.LegalName) {
+		f.Domain = m.cfg.DomainWeight
+	}
+	if hints.State != "" && strings.EqualFold(hints.State, r.State) {
+		f.State = m.cfg.StateWeight
+	}
+
+	active := r.Status == "" || r.Status == "Active"
+	if active {
+		f.Active = m.cfg.ActiveWeight
+	}
+
+	total := f.Total()
+	return Candidate{
+		Result:   r,
+		Score:    total,
+		Features: f,
+		Accepted: total >= m.cfg.Threshold && (active || !m.cfg.RequireActive),
+	}
+}
+
+// DomainAgrees reports whether a website domain names the same business as
+// legalName. The domain's first label is compared with the legal name's
+// core words run together, so "woolworths.com.au" agrees with "Woolworths
+// Group Limited" and "jbhifi.com.au" with "JB Hi-Fi Limited".
+func (m *Matcher) DomainAgrees(domain, legalName string) bool {
+	label := domainLabel(domain)
+	if len(label) < 2 {
+		return false
+	}
+	tokens := m.coreTokens(legalName)
+	joined := strings.Join(tokens, "")
+	if joined == "" {
+		return false
+	}
+
+	switch {
+	case label == joined:
+		return true
+	case len(label) >= 4 && strings.HasPrefix(joined, label):
+		return true
+	case len(joined) >= 4 && strings.HasPrefix(label, joined):
+		return true
+	}
+	for _, t := range tokens {
+		if len(t) >= 4 && t == label {
+			return true
+		}
+	}
+	return false
+}
+
+// domainLabel returns the registrable label of a domain or URL with any
+// hyphens removed: "https://www.jb-hifi.com.au/" gives "jbhifi".
+func domainLabel(domain string) string {
+	d := strings.ToLower(strings.TrimSpace(domain))
+	if i := strings.Index(d, "://"); i >= 0 {
+		d = d[i+3:]
+	}
+	if i := strings.IndexAny(d, "/?#"); i >= 0 {
+		d = d[:i]
+	}
+	d = strings.TrimPrefix(d, "www.")
+	if i := strings.Index(d, "."); i >= 0 {
+		d = d[:i]
+	}
+	return strings.ReplaceAll(d, "-", "")
+}
+
+// coreTokens normalises a name and drops legal suffixes and other words that
+// carry no identifying information.
+func (m *Matcher) coreTokens(name string) []string {
+	var tokens []string
+	for _, t := range strings.Fields(NormaliseName(name)) {
+		if !m.ignored[t] {
+			tokens = append(tokens, t)
+		}
+	}
+	return tokens
+}
+
+// tokenOverlap is the Jaccard similarity of two token lists.
+func tokenOverlap(a, b []string) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+	set := make(map[string]bool, len(a))
+	for _, t := range a {
+		set[t] = true
+	}
+	union := len(set)
+	common := 0
+	seen := make(map[string]bool, len(b))
+	for _, t := range b {
+		if seen[t] {
+			continue
+		}
+		seen[t] = true
+		if set[t] {
+			common++
+		} else {
+			union++
+		}
+	}
+	return float64(common) / float64(union)
+}
+
+func clamp01(v float64) float64 {
+	if v < 0 {
+		return 0
+	}
+	if v > 1 {
+		return 1
+	}
+	return v
+}
+
+// inferEntityType guesses the ABR entity type code from a registered name.
+// Name searches do not return the entity type, but the legal suffix is a
+// reliable signal for the cases the matcher cares about.
+func inferEntityType(name string) string {
+	words := strings.Fields(NormaliseName(name))
+	has := func(w string) bool {
+		for _, x := range words {
+			if x == w {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch {
+	case has("trustee") || has("trust"):
+		return "TRT"
+	case has("pty") || has("proprietary"):
+		return "PRV"
+	case has("limited") || has("ltd") || has("nl"):
+		return "PUB"
+	}
+	return ""
+}
@@ -0,0 +1,194 @@
+package abr
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMatcherRank(t *testing.T) {
+	results := []Result{
+		{ABN: "33051775556", LegalName: "WOOLWORTHS STAFF SOCIAL CLUB", Score: "85", Status: "Active"},
+		{ABN: "88000014675", LegalName: "WOOLWORTHS SUPERMARKETS", Score: "90", Status: "Active"},
+		{ABN: "53004085616", LegalName: "WOOLWORTHS LIMITED", Score: "100", Status: "Cancelled", EntityType: "PUB"},
+		{ABN: "88000014675", LegalName: "WOOLWORTHS GROUP LIMITED", Score: "100", Status: "Active", EntityType: "PUB"},
+	}
+	ranked := NewMatcher(DefaultMatchConfig()).Rank("Woolworths", results)
+
+	want := []struct {
+		abn      ABN
+		name     string
+		score    float64
+		accepted bool
+	}{
+		// exact 30 + token 35 + abr 15 + entity 10 + active 10
+		{"88000014675", "WOOLWORTHS GROUP LIMITED", 100, true},
+		// the same without active, which RequireActive rejects
+		{"53004085616", "WOOLWORTHS LIMITED", 90, false},
+		// token 1/4 of 35 + abr 0.85 of 15 + default entity 4 + active 10
+		{"33051775556", "WOOLWORTHS STAFF SOCIAL CLUB", 35.5, false},
+	}
+	if len(ranked) != len(want) {
+		t.Fatalf("got %d candidates, want %d (one per ABN)", len(ranked), len(want))
+	}
+	for i, w := range want {
+		c := ranked[i]
+		if c.Result.ABN != w.abn || c.Result.LegalName != w.name || !near(c.Score, w.score) || c.Accepted != w.accepted {
+			t.Errorf("rank %d = %s %q %.2f accepted=%v; want %s %q %.2f accepted=%v",
+				i, c.Result.ABN, c.Result.LegalName, c.Score, c.Accepted, w.abn, w.name, w.score, w.accepted)
+		}
+	}
+}
+
+func TestMatcherHints(t *testing.T) {
+	m := NewMatcher(DefaultMatchConfig())
+	r := Result{ABN: "51824753556", LegalName: "JB HI-FI LIMITED", Score: "100", Status: "Active", EntityType: "PUB", State: "VIC"}
+
+	c := m.RankWithHints("JB Hi-Fi", Hints{Domain: "https://www.jb-hifi.com.au/", State: "vic"}, []Result{r})[0]
+	want := Features{Exact: 30, Token: 35, ABRScore: 15, Entity: 10, Active: 10, Domain: 10, State: 5}
+	if c.Features != want || !near(c.Score, 115) {
+		t.Errorf("features = %+v (%.2f), want %+v (115)", c.Features, c.Score, want)
+	}
+
+	c = m.RankWithHints("JB Hi-Fi", Hints{Domain: "harveynorman.com.au", State: "NSW"}, []Result{r})[0]
+	if c.Features.Domain != 0 || c.Features.State != 0 {
+		t.Errorf("disagreeing hints scored %+v", c.Features)
+	}
+}
+
+func TestMatcherConfig(t *testing.T) {
+	cfg := DefaultMatchConfig()
+	cfg.Threshold = 101
+	r := Result{ABN: "88000014675", LegalName: "WOOLWORTHS GROUP LIMITED", Score: "100", Status: "Active", EntityType: "PUB"}
+	if _, ok := NewMatcher(cfg).Best("Woolworths", []Result{r}); ok {
+		t.Error("a 100 point candidate cleared a threshold of 101")
+	}
+
+	cfg = DefaultMatchConfig()
+	cfg.RequireActive = false
+	r.Status = "Cancelled"
+	if _, ok := NewMatcher(cfg).Best("Woolworths", []Result{r}); !ok {
+		t.Error("a cancelled ABN was rejected with RequireActive off")
+	}
+
+	cfg = DefaultMatchConfig()
+	cfg.EntityPreference = map[string]float64{"PUB": 0}
+	c := NewMatcher(cfg).Rank("Woolworths", []Result{r})[0]
+	if c.Features.Entity != 0 {
+		t.Errorf("entity points = %.2f with PUB preferred at 0", c.Features.Entity)
+	}
+
+	if _, ok := NewMatcher(DefaultMatchConfig()).Best("Woolworths", nil); ok {
+		t.Error("Best accepted a candidate from no results")
+	}
+}
+
+func TestInferEntityType(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"WOOLWORTHS GROUP LIMITED", "PUB"},
+		{"Coles Supermarkets Australia Pty Ltd", "PRV"},
+		{"SMITH PROPRIETARY COMPANY", "PRV"},
+		{"THE TRUSTEE FOR THE SMITH FAMILY TRUST", "TRT"},
+		{"ABC Trustee Pty Ltd", "TRT"},
+		{"NORTHERN MINERALS NL", "PUB"},
+		{"John Citizen", ""},
+		{"Ltd.", "PUB"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := inferEntityType(tt.name); got != tt.want {
+			t.Errorf("inferEntityType(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDomainAgrees(t *testing.T) {
+	tests := []struct {
+		domain, name string
+		want         bool
+	}{
+		{"woolworths.com.au", "Woolworths Group Limited", true},
+		{"https://www.jb-hifi.com.au/", "JB Hi-Fi Limited", true},
+		{"coles.com.au", "Coles Supermarkets Australia Pty Ltd", true},
+		{"bigw.com.au", "Big W Pty Ltd", true},
+		{"kmart.com.au", "Wesfarmers Limited", false},
+		{"x.com", "X Pty Ltd", false},
+		{"woolworths.com.au", "Pty Ltd", false},
+	}
+	m := NewMatcher(DefaultMatchConfig())
+	for _, tt := range tests {
+		if got := m.DomainAgrees(tt.domain, tt.name); got != tt.want {
+			t.Errorf("DomainAgrees(%q, %q) = %v, want %v", tt.domain, tt.name, got, tt.want)
+		}
+	}
+}
+
+const searchFound = `<ABRPayloadSearchResults><response><searchResultsList>
+<searchResultsRecord>
+  <ABN><identifierValue>88000014675</identifierValue><identifierStatus>Active</identifierStatus></ABN>
+  <mainName><organisationName>WOOLWORTHS GROUP LIMITED</organisationName><score>100</score></mainName>
+  <mainBusinessPhysicalAddress><stateCode>NSW</stateCode><postcode>2153</postcode></mainBusinessPhysicalAddress>
+</searchResultsRecord>
+</searchResultsList></response></ABRPayloadSearchResults>`
+
+const searchBadGUID = `<ABRPayloadSearchResults><response><exception>
+<exceptionDescription>The GUID entered is not recognised as a Registered Party</exceptionDescription>
+<exceptionCode>WEBSERVICES</exceptionCode>
+</exception></response></ABRPayloadSearchResults>`
+
+const searchNoRecords = `<ABRPayloadSearchResults><response><exception>
+<exceptionDescription>No records found</exceptionDescription>
+<exceptionCode>WEBSERVICES</exceptionCode>
+</exception></response></ABRPayloadSearchResults>`
+
+func TestLookup(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		wantABN ABN
+		wantErr bool
+	}{
+		{name: "found", status: 200, body: searchFound, wantABN: "88000014675"},
+		{name: "no records", status: 200, body: searchNoRecords},
+		{name: "bad guid", status: 200, body: searchBadGUID, wantErr: true},
+		{name: "server error", status: 503, body: "unavailable", wantErr: true},
+		{name: "not xml", status: 200, body: "<html>", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				io.WriteString(w, tt.body)
+			}))
+			defer srv.Close()
+
+			c := NewClient("guid", srv.URL+"/ABRSearchByName", 5)
+			abn, acn, state, legal, _, err := c.Lookup(context.Background(), "Woolworths")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if abn != tt.wantABN {
+				t.Errorf("abn = %q, want %q", abn, tt.wantABN)
+			}
+			if tt.wantABN != "" && (acn != "000014675" || state != "NSW" || legal != "WOOLWORTHS GROUP LIMITED") {
+				t.Errorf("got %q %q %q", acn, state, legal)
+			}
+			var exc *ExceptionError
+			if tt.name == "bad guid" && !errors.As(err, &exc) {
+				t.Errorf("bad guid gave %v, want an *ExceptionError", err)
+			}
+		})
+	}
+}
+
+func near(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
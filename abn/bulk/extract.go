@@ -0,0 +1,200 @@
+// Package bulk ingests the public ABN Bulk Extract into a local Postgres
+// index that abr.Client can query without calling the ABR web service.
+package bulk
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"merchantcache/abn/abr"
+)
+
+// extractDateLayout is the compact date format used by the bulk extract.
+// Missing dates are written as 19000101.
+const extractDateLayout = "20060102"
+
+// Name is one of the names registered against an ABN. Type is the extract's
+// name type code: MN (main name), LGL (individual's legal name), TRD
+// (trading name), BN (business name) or OTN (other name).
+type Name struct {
+	Type string
+	Text string
+}
+
+// Record is a single <ABR> entry from the bulk extract.
+type Record struct {
+	ABN            abr.ABN
+	Status         string
+	StatusFrom     time.Time
+	EntityTypeCode string
+	EntityType     string
+	ASICNumber     string
+	GSTStatus      string
+	GSTFrom        time.Time
+	State          string
+	Postcode       string
+	Names          []Name
+	LastUpdated    time.Time
+}
+
+// LegalName returns the entity's main or legal name.
+func (r Record) LegalName() string {
+	for _, n := range r.Names {
+		if n.Type == "MN" || n.Type == "LGL" {
+			return n.Text
+		}
+	}
+	return ""
+}
+
+// Active reports whether the ABN is active.
+func (r Record) Active() bool {
+	return r.Status == "ACT"
+}
+
+type xmlNonIndividualName struct {
+	Type string `xml:"type,attr"`
+	Text string `xml:"NonIndividualNameText"`
+}
+
+type xmlIndividualName struct {
+	Type       string   `xml:"type,attr"`
+	GivenNames []string `xml:"GivenName"`
+	FamilyName string   `xml:"FamilyName"`
+}
+
+type xmlAddress struct {
+	State    string `xml:"AddressDetails>State"`
+	Postcode string `xml:"AddressDetails>Postcode"`
+}
+
+type xmlEntity struct {
+	NonIndividualName *xmlNonIndividualName `xml:"NonIndividualName"`
+	IndividualName    *xmlIndividualName    `xml:"IndividualName"`
+	BusinessAddress   xmlAddress            `xml:"BusinessAddress"`
+}
+
+type xmlRecord struct {
+	RecordLastUpdatedDate string `xml:"recordLastUpdatedDate,attr"`
+	ABN                   struct {
+		Status     string `xml:"status,attr"`
+		StatusFrom string `xml:"ABNStatusFromDate,attr"`
+		Value      string `xml:",chardata"`
+	} `xml:"ABN"`
+	EntityType struct {
+		Ind  string `xml:"EntityTypeInd"`
+		Text string `xml:"EntityTypeText"`
+	} `xml:"EntityType"`
+	MainEntity  *xmlEntity `xml:"MainEntity"`
+	LegalEntity *xmlEntity `xml:"LegalEntity"`
+	ASICNumber  string     `xml:"ASICNumber"`
+	GST         struct {
+		Status     string `xml:"status,attr"`
+		StatusFrom string `xml:"GSTStatusFromDate,attr"`
+	} `xml:"GST"`
+	OtherEntity []struct {
+		NonIndividualName xmlNonIndividualName `xml:"NonIndividualName"`
+	} `xml:"OtherEntity"`
+}
+
+// Parse stream-decodes a bulk extract file, calling fn for every record
+// with a valid ABN. Records are decoded one at a time so multi-gigabyte
+// files never have to fit in memory. Returning an error from fn stops
+// parsing and returns that error.
+func Parse(r io.Reader, fn func(Record) error) error {
+	dec := xml.NewDecoder(r)
+	for {
+		tok, err := dec.Token()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read extract: %w", err)
+		}
+
+		start, ok := tok.(xml.StartElement)
+		if !ok || start.Name.Local != "ABR" {
+			continue
+		}
+
+		var raw xmlRecord
+		if err := dec.DecodeElement(&raw, &start); err != nil {
+			return fmt.Errorf("decode abr record: %w", err)
+		}
+
+		rec, ok := raw.record()
+		if !ok {
+			continue
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+}
+
+func (x xmlRecord) record() (Record, bool) {
+	abn, err := abr.ParseABN(x.ABN.Value)
+	if err != nil {
+		return Record{}, false
+	}
+
+	rec := Record{
+		ABN:            abn,
+		Status:         strings.TrimSpace(x.ABN.Status),
+		StatusFrom:     parseExtractDate(x.ABN.StatusFrom),
+		EntityTypeCode: strings.TrimSpace(x.EntityType.Ind),
+		EntityType:     strings.TrimSpace(x.EntityType.Text),
+		GSTStatus:      strings.TrimSpace(x.GST.Status),
+		GSTFrom:        parseExtractDate(x.GST.StatusFrom),
+		LastUpdated:    parseExtractDate(x.RecordLastUpdatedDate),
+	}
+
+	if acn, err := abr.ParseACN(x.ASICNumber); err == nil {
+		rec.ASICNumber = acn.String()
+	} else {
+		rec.ASICNumber = strings.TrimSpace(x.ASICNumber)
+	}
+
+	for _, entity := range []*xmlEntity{x.MainEntity, x.LegalEntity} {
+		if entity == nil {
+			continue
+		}
+		if n := entity.NonIndividualName; n != nil {
+			rec.addName(n.Type, n.Text)
+		}
+		if n := entity.IndividualName; n != nil {
+			full := strings.Join(append(append([]string{}, n.GivenNames...), n.FamilyName), " ")
+			rec.addName(n.Type, full)
+		}
+		if rec.State == "" {
+			rec.State = strings.TrimSpace(entity.BusinessAddress.State)
+			rec.Postcode = strings.TrimSpace(entity.BusinessAddress.Postcode)
+		}
+	}
+
+	for _, other := range x.OtherEntity {
+		rec.addName(other.NonIndividualName.Type, other.NonIndividualName.Text)
+	}
+
+	return rec, true
+}
+
+func (r *Record) addName(nameType, text string) {
+	text = strings.Join(strings.Fields(text), " ")
+	if text == "" {
+		return
+	}
+	r.Names = append(r.Names, Name{Type: strings.TrimSpace(nameType), Text: text})
+}
+
+func parseExtractDate(s string) time.Time {
+	t, err := time.Parse(extractDateLayout, strings.TrimSpace(s))
+	if err != nil || t.Year() <= 1900 {
+		return time.Time{}
+	}
+	return t
+}
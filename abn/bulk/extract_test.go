@@ -0,0 +1,84 @@
+package bulk
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	f, err := os.Open("testdata/extract.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var got []Record
+	if err := Parse(f, func(r Record) error {
+		got = append(got, r)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The record with a bad checksum is dropped
+	if len(got) != 3 {
+		t.Fatalf("parsed %d records, want 3", len(got))
+	}
+
+	woolies := got[0]
+	if woolies.ABN != "88000014675" || !woolies.Active() || woolies.EntityTypeCode != "PUB" ||
+		woolies.ASICNumber != "000014675" || woolies.State != "NSW" || woolies.Postcode != "2153" ||
+		woolies.GSTStatus != "ACT" || !woolies.GSTFrom.Equal(date(2000, 7, 1)) ||
+		!woolies.StatusFrom.Equal(date(1999, 11, 1)) || !woolies.LastUpdated.Equal(date(2023, 5, 1)) {
+		t.Errorf("company record = %+v", woolies)
+	}
+	wantNames := []Name{{"MN", "WOOLWORTHS GROUP LIMITED"}, {"TRD", "WOOLWORTHS"}, {"BN", "Woolworths Metro"}}
+	if !reflect.DeepEqual(woolies.Names, wantNames) {
+		t.Errorf("names = %v, want %v", woolies.Names, wantNames)
+	}
+	if woolies.LegalName() != "WOOLWORTHS GROUP LIMITED" {
+		t.Errorf("legal name = %q", woolies.LegalName())
+	}
+
+	jane := got[1]
+	if jane.LegalName() != "JANE MARY CITIZEN" || jane.State != "VIC" || jane.ASICNumber != "" {
+		t.Errorf("individual record = %+v", jane)
+	}
+	if !jane.GSTFrom.IsZero() {
+		t.Errorf("GST from 19000101 parsed as %v, want the zero time", jane.GSTFrom)
+	}
+
+	if got[2].Active() || got[2].Status != "CAN" {
+		t.Errorf("cancelled record = %+v", got[2])
+	}
+}
+
+func TestParseStops(t *testing.T) {
+	f, err := os.Open("testdata/extract.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	stop := errors.New("stop")
+	n := 0
+	err = Parse(f, func(Record) error {
+		n++
+		return stop
+	})
+	if !errors.Is(err, stop) || n != 1 {
+		t.Errorf("Parse returned %v after %d records, want stop after 1", err, n)
+	}
+
+	if err := Parse(strings.NewReader("<Transfer><ABR>"), func(Record) error { return nil }); err == nil {
+		t.Error("truncated extract parsed without error")
+	}
+}
+
+func date(y int, m time.Month, d int) time.Time {
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
@@ -0,0 +1,380 @@
+package bulk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"merchantcache/abn/abr"
+)
+
+// batchSize is how many records are sent to Postgres per round trip.
+const batchSize = 1000
+
+// searchLimit caps the candidates returned by a name search.
+const searchLimit = 25
+
+// Index is a Postgres copy of the ABN register. It implements abr.Index.
+type Index struct {
+	pool *pgxpool.Pool
+}
+
+// Stats summarises an ingest run.
+type Stats struct {
+	Files        int
+	SkippedFiles int
+	Records      int
+	Updated      int
+}
+
+func NewIndex(pool *pgxpool.Pool) *Index {
+	return &Index{pool: pool}
+}
+
+// EnsureSchema creates the index tables if they do not exist.
+func (idx *Index) EnsureSchema(ctx context.Context) error {
+	_, err := idx.pool.Exec(ctx, `
+		create extension if not exists pg_trgm;
+
+		create table if not exists abn_bulk_entities (
+		  abn text primary key,
+		  status text not null,
+		  status_from date,
+		  entity_type_code text,
+		  entity_type text,
+		  asic_number text,
+		  gst_status text,
+		  gst_from date,
+		  state text,
+		  postcode text,
+		  legal_name text,
+		  record_last_updated date,
+		  ingested_at timestamp with time zone default now()
+		);
+
+		create table if not exists abn_bulk_names (
+		  abn text not null references abn_bulk_entities (abn) on delete cascade,
+		  name_type text not null,
+		  name text not null,
+		  name_norm text not null
+		);
+		create index if not exists abn_bulk_names_abn_idx on abn_bulk_names (abn);
+		create index if not exists abn_bulk_names_trgm_idx on abn_bulk_names using gin (name_norm gin_trgm_ops);
+
+		create table if not exists abn_bulk_files (
+		  file_name text primary key,
+		  size_bytes bigint not null,
+		  modified_at timestamp with time zone not null,
+		  records bigint not null,
+		  ingested_at timestamp with time zone default now()
+		);
+	`)
+	return err
+}
+
+// Ingest loads every *.xml extract file in dir. Files already ingested with
+// the same size and modification time are skipped, and records are only
+// rewritten when their recordLastUpdatedDate is newer than the stored copy,
+// so re-running after each weekly publication only touches what changed.
+func (idx *Index) Ingest(ctx context.Context, dir string) (Stats, error) {
+	var stats Stats
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.xml"))
+	if err != nil {
+		return stats, err
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return stats, err
+		}
+
+		done, err := idx.fileIngested(ctx, info)
+		if err != nil {
+			return stats, err
+		}
+		if done {
+			stats.SkippedFiles++
+			continue
+		}
+
+		records, updated, err := idx.ingestFile(ctx, path)
+		stats.Records += records
+		stats.Updated += updated
+		if err != nil {
+			return stats, fmt.Errorf("ingest %s: %w", filepath.Base(path), err)
+		}
+
+		if _, err := idx.pool.Exec(ctx, `
+			insert into abn_bulk_files (file_name, size_bytes, modified_at, records)
+			values ($1, $2, $3, $4)
+			on conflict (file_name) do update set
+				size_bytes = excluded.size_bytes,
+				modified_at = excluded.modified_at,
+				records = excluded.records,
+				ingested_at = now()
+		`, info.Name(), info.Size(), info.ModTime(), records); err != nil {
+			return stats, err
+		}
+		stats.Files++
+	}
+
+	return stats, nil
+}
+
+func (idx *Index) fileIngested(ctx context.Context, info os.FileInfo) (bool, error) {
+	var size int64
+	var modified time.Time
+	err := idx.pool.QueryRow(ctx, `
+		select size_bytes, modified_at from abn_bulk_files where file_name = $1
+	`, info.Name()).Scan(&size, &modified)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return size == info.Size() && modified.Equal(info.ModTime().Truncate(time.Microsecond)), nil
+}
+
+func (idx *Index) ingestFile(ctx context.Context, path string) (records, updated int, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	batch := &pgx.Batch{}
+	flush := func() error {
+		if batch.Len() == 0 {
+			return nil
+		}
+		br := idx.pool.SendBatch(ctx, batch)
+		for i := 0; i < batch.Len(); i++ {
+			var n int
+			if err := br.QueryRow().Scan(&n); err != nil {
+				br.Close()
+				return err
+			}
+			updated += n
+		}
+		batch = &pgx.Batch{}
+		return br.Close()
+	}
+
+	err = Parse(f, func(rec Record) error {
+		records++
+		queueUpsert(batch, rec)
+		if batch.Len() >= batchSize {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return records, updated, err
+	}
+	return records, updated, flush()
+}
+
+func queueUpsert(batch *pgx.Batch, rec Record) {
+	types := make([]string, len(rec.Names))
+	names := make([]string, len(rec.Names))
+	norms := make([]string, len(rec.Names))
+	for i, n := range rec.Names {
+		types[i] = n.Type
+		names[i] = n.Text
+		norms[i] = abr.NormaliseName(n.Text)
+	}
+
+	batch.Queue(`
+		with up as (
+			insert into abn_bulk_entities (
+				abn, status, status_from, entity_type_code, entity_type, asic_number,
+				gst_status, gst_from, state, postcode, legal_name, record_last_updated
+			)
+			values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+			on conflict (abn) do update set
+				status = excluded.status,
+				status_from = excluded.status_from,
+				entity_type_code = excluded.entity_type_code,
+				entity_type = excluded.entity_type,
+				asic_number = excluded.asic_number,
+				gst_status = excluded.gst_status,
+				gst_from = excluded.gst_from,
+				state = excluded.state,
+				postcode = excluded.postcode,
+				legal_name = excluded.legal_name,
+				record_last_updated = excluded.record_last_updated,
+				ingested_at = now()
+			where abn_bulk_entities.record_last_updated is null
+			   or abn_bulk_entities.record_last_updated < excluded.record_last_updated
+			returning abn
+		),
+		del as (
+			delete from abn_bulk_names where abn in (select abn from up)
+		),
+		ins as (
+			insert into abn_bulk_names (abn, name_type, name, name_norm)
+			select up.abn, n.name_type, n.name, n.name_norm
+			from up, unnest($13::text[], $14::text[], $15::text[]) as n(name_type, name, name_norm)
+		)
+		select count(*) from up
+	`, rec.ABN.String(), rec.Status, nullDate(rec.StatusFrom), rec.EntityTypeCode, rec.EntityType,
+		nullIfEmpty(rec.ASICNumber), nullIfEmpty(rec.GSTStatus), nullDate(rec.GSTFrom),
+		nullIfEmpty(rec.State), nullIfEmpty(rec.Postcode), rec.LegalName(), nullDate(rec.LastUpdated),
+		types, names, norms)
+}
+
+// SearchByName returns entities with a name similar to name, using trigram
+// similarity on the normalised name as the score.
+func (idx *Index) SearchByName(ctx context.Context, name string) ([]abr.Result, error) {
+	norm := abr.NormaliseName(name)
+	if norm == "" {
+		return nil, nil
+	}
+
+	rows, err := idx.pool.Query(ctx, `
+		select e.abn, e.status, coalesce(e.entity_type_code, ''), coalesce(e.asic_number, ''),
+		       coalesce(e.state, ''), n.name, n.name_type, similarity(n.name_norm, $1)
+		from abn_bulk_names n
+		join abn_bulk_entities e on e.abn = n.abn
+		where n.name_norm % $1
+		order by similarity(n.name_norm, $1) desc
+		limit $2
+	`, norm, searchLimit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []abr.Result
+	for rows.Next() {
+		var abn, status, entityType, asic, state, legalName, nameType string
+		var sim float64
+		if err := rows.Scan(&abn, &status, &entityType, &asic, &state, &legalName, &nameType, &sim); err != nil {
+			return nil, err
+		}
+		acn, _ := abr.ParseACN(asic)
+		results = append(results, abr.Result{
+			ABN:        abr.ABN(abn),
+			ACN:        acn,
+			State:      state,
+			LegalName:  legalName,
+			Score:      fmt.Sprintf("%.0f", sim*100),
+			Status:     statusName(status),
+			NameType:   nameType,
+			EntityType: entityType,
+		})
+	}
+	return results, rows.Err()
+}
+
+// SearchByABN returns the stored record for abn.
+func (idx *Index) SearchByABN(ctx context.Context, abn abr.ABN) (*abr.ABNDetails, error) {
+	var (
+		status, entityTypeCode, entityType, asic string
+		gstStatus, state, postcode, legalName    string
+		statusFrom, gstFrom, recordLastUpdated   *time.Time
+	)
+	err := idx.pool.QueryRow(ctx, `
+		select status, status_from, coalesce(entity_type_code, ''), coalesce(entity_type, ''),
+		       coalesce(asic_number, ''), coalesce(gst_status, ''), gst_from,
+		       coalesce(state, ''), coalesce(postcode, ''), coalesce(legal_name, ''), record_last_updated
+		from abn_bulk_entities
+		where abn = $1
+	`, abn.String()).Scan(&status, &statusFrom, &entityTypeCode, &entityType, &asic, &gstStatus, &gstFrom,
+		&state, &postcode, &legalName, &recordLastUpdated)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, abr.ErrABNNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	details := &abr.ABNDetails{
+		ABN:            abn,
+		Status:         statusName(status),
+		StatusHistory:  []abr.StatusPeriod{{Status: statusName(status), Period: abr.Period{From: derefDate(statusFrom)}}},
+		EntityTypeCode: entityTypeCode,
+		EntityType:     entityType,
+		ASICNumber:     asic,
+		LegalName:      legalName,
+		State:          state,
+		Postcode:       postcode,
+		LastUpdated:    derefDate(recordLastUpdated),
+	}
+	switch gstStatus {
+	case "ACT":
+		details.GST = []abr.Period{{From: derefDate(gstFrom)}}
+	case "CAN":
+		details.GST = []abr.Period{{To: derefDate(gstFrom)}}
+	}
+
+	rows, err := idx.pool.Query(ctx, `
+		select name_type, name from abn_bulk_names where abn = $1
+	`, abn.String())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var nameType, name string
+		if err := rows.Scan(&nameType, &name); err != nil {
+			return nil, err
+		}
+		np := abr.NamePeriod{Name: name}
+		switch nameType {
+		case "MN", "LGL":
+			details.LegalNames = append(details.LegalNames, np)
+		case "BN":
+			details.BusinessNames = append(details.BusinessNames, np)
+		default:
+			details.TradingNames = append(details.TradingNames, np)
+		}
+	}
+	return details, rows.Err()
+}
+
+// statusName maps the extract's status codes to the names the ABR web
+// service uses.
+func statusName(code string) string {
+	switch code {
+	case "ACT":
+		return "Active"
+	case "CAN":
+		return "Cancelled"
+	}
+	return code
+}
+
+func nullIfEmpty(s string) any {
+	if strings.TrimSpace(s) == "" {
+		return nil
+	}
+	return s
+}
+
+func nullDate(t time.Time) any {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
+
+func derefDate(t *time.Time) time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return *t
+}
@@ -0,0 +1,188 @@
+package bulk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"merchantcache/abn/abr"
+)
+
+// testIndex builds an empty index in a throwaway schema of the database
+// named by ABR_INDEX_TEST_DATABASE_URL, and skips the test when it is not
+// set. The database needs the pg_trgm extension available.
+func testIndex(t *testing.T) *Index {
+	t.Helper()
+	url := os.Getenv("ABR_INDEX_TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("set ABR_INDEX_TEST_DATABASE_URL to run the index tests against Postgres")
+	}
+	ctx := context.Background()
+
+	admin, err := pgx.Connect(ctx, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := fmt.Sprintf("abn_bulk_test_%d", time.Now().UnixNano())
+	if _, err := admin.Exec(ctx, "create extension if not exists pg_trgm"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := admin.Exec(ctx, "create schema "+schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		admin.Exec(context.Background(), "drop schema "+schema+" cascade")
+		admin.Close(context.Background())
+	})
+
+	cfg, err := pgxpool.ParseConfig(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ConnConfig.RuntimeParams["search_path"] = schema + ", public"
+	pool, err := pgxpool.NewWithConfig(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(pool.Close)
+
+	idx := NewIndex(pool)
+	if err := idx.EnsureSchema(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return idx
+}
+
+// extractDir copies the test extract into a fresh directory.
+func extractDir(t *testing.T) string {
+	t.Helper()
+	raw, err := os.ReadFile("testdata/extract.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "20230501_Public01.xml"), raw, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestIndexIngest(t *testing.T) {
+	idx := testIndex(t)
+	ctx := context.Background()
+	dir := extractDir(t)
+
+	stats, err := idx.Ingest(ctx, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats != (Stats{Files: 1, Records: 3, Updated: 3}) {
+		t.Errorf("first ingest = %+v", stats)
+	}
+
+	// An unchanged file is skipped
+	stats, err = idx.Ingest(ctx, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats != (Stats{SkippedFiles: 1}) {
+		t.Errorf("second ingest = %+v", stats)
+	}
+
+	// A weekly update only rewrites records that are newer than the index
+	update := `<Transfer>
+  <ABR recordLastUpdatedDate="20240101">
+    <ABN status="ACT" ABNStatusFromDate="19991101">88000014675</ABN>
+    <EntityType><EntityTypeInd>PUB</EntityTypeInd><EntityTypeText>Australian Public Company</EntityTypeText></EntityType>
+    <MainEntity>
+      <NonIndividualName type="MN"><NonIndividualNameText>WOOLWORTHS GROUP LIMITED</NonIndividualNameText></NonIndividualName>
+      <BusinessAddress><AddressDetails><State>VIC</State><Postcode>3000</Postcode></AddressDetails></BusinessAddress>
+    </MainEntity>
+    <ASICNumber>000014675</ASICNumber>
+    <GST status="ACT" GSTStatusFromDate="20000701" />
+  </ABR>
+  <ABR recordLastUpdatedDate="20100101">
+    <ABN status="ACT" ABNStatusFromDate="20100101">33051775556</ABN>
+    <MainEntity>
+      <NonIndividualName type="MN"><NonIndividualNameText>STALE NAME PTY LTD</NonIndividualNameText></NonIndividualName>
+    </MainEntity>
+  </ABR>
+</Transfer>`
+	if err := os.WriteFile(filepath.Join(dir, "20240101_Public02.xml"), []byte(update), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	stats, err = idx.Ingest(ctx, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats != (Stats{Files: 1, SkippedFiles: 1, Records: 2, Updated: 1}) {
+		t.Errorf("update ingest = %+v", stats)
+	}
+
+	d, err := idx.SearchByABN(ctx, "88000014675")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.State != "VIC" || d.Postcode != "3000" || !d.Active() || !d.GSTRegistered() ||
+		d.LegalName != "WOOLWORTHS GROUP LIMITED" || d.ASICNumber != "000014675" {
+		t.Errorf("updated record = %+v", d)
+	}
+	// The update replaced the names too
+	if len(d.TradingNames) != 0 || len(d.BusinessNames) != 0 {
+		t.Errorf("names not replaced: trading %v, business %v", d.TradingNames, d.BusinessNames)
+	}
+
+	d, err = idx.SearchByABN(ctx, "33051775556")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.LegalName != "OLD SHOPS PTY LTD" || d.Active() {
+		t.Errorf("older update overwrote the record: %+v", d)
+	}
+}
+
+func TestIndexSearch(t *testing.T) {
+	idx := testIndex(t)
+	ctx := context.Background()
+	if _, err := idx.Ingest(ctx, extractDir(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := idx.SearchByName(ctx, "Woolworths")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) == 0 || results[0].ABN != "88000014675" || results[0].Status != "Active" || results[0].EntityType != "PUB" {
+		t.Fatalf("SearchByName(Woolworths) = %+v", results)
+	}
+
+	d, err := idx.SearchByABN(ctx, "51824753556")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.LegalName != "JANE MARY CITIZEN" || d.State != "VIC" || d.GSTRegistered() {
+		t.Errorf("individual = %+v", d)
+	}
+
+	if _, err := idx.SearchByABN(ctx, "53004085616"); !errors.Is(err, abr.ErrABNNotFound) {
+		t.Errorf("unknown ABN gave %v, want ErrABNNotFound", err)
+	}
+
+	// An index-only client answers without a GUID or network
+	client := abr.NewClient("", "", 5, abr.WithIndex(idx))
+	abn, _, state, legal, _, err := client.Lookup(ctx, "Woolworths Group")
+	if err != nil || abn != "88000014675" || state != "NSW" || legal == "" {
+		t.Errorf("offline Lookup = %q %q %q, %v", abn, state, legal, err)
+	}
+	details, err := client.SearchByABN(ctx, "33051775556")
+	if err != nil || details.Status != "Cancelled" {
+		t.Errorf("offline SearchByABN = %+v, %v", details, err)
+	}
+}
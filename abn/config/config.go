@@ -8,34 +8,58 @@ import (
 type Config struct {
 	ABRGuid              string
 	ABREndpoint          string
+	ABRMatchThreshold    float64
+	ABRIndexDatabaseURL  string
+	ABRBulkDir           string
+	DatabaseURL          string
 	Timeout              int
 	GoogleAPIKey         string
 	GoogleSearchEngineID string
 	GoogleClientID       string
 	GoogleClientSecret   string
 	GoogleRedirectURI    string
+	Workers              int
+	ABRRatePerSecond     float64
+	GoogleRatePerSecond  float64
 	OutputFile           string
 	EnableVerification   bool
 	SupabaseURL          string
 	SupabaseKey          string
 	SupabaseTable        string
+	SupabaseOnConflict   string
+	SupabaseBatchSize    int
+	SupabaseMaxRetries   int
+	SupabaseProvenance   bool
+	SupabaseAddressParts bool
 }
 
 func LoadFromEnv() Config {
 	return Config{
 		ABRGuid:              os.Getenv("ABR_GUID"),
 		ABREndpoint:          os.Getenv("ABR_ENDPOINT"),
+		ABRMatchThreshold:    parseFloatOrDefault(os.Getenv("ABR_MATCH_THRESHOLD"), 50),
+		ABRIndexDatabaseURL:  os.Getenv("ABR_INDEX_DATABASE_URL"),
+		ABRBulkDir:           os.Getenv("ABR_BULK_DIR"),
+		DatabaseURL:          os.Getenv("DATABASE_URL"),
 		Timeout:              parseIntOrDefault(os.Getenv("TIMEOUT"), 5),
 		GoogleAPIKey:         os.Getenv("GOOGLE_API_KEY"),
 		GoogleSearchEngineID: os.Getenv("GOOGLE_SEARCH_ENGINE_ID"),
 		GoogleClientID:       os.Getenv("GOOGLE_CLIENT_ID"),
 		GoogleClientSecret:   os.Getenv("GOOGLE_CLIENT_SECRET"),
 		GoogleRedirectURI:    getOrDefault(os.Getenv("GOOGLE_REDIRECT_URI"), "http://localhost:8080/callback"),
+		Workers:              parseIntOrDefault(os.Getenv("WORKERS"), 4),
+		ABRRatePerSecond:     parseFloatOrDefault(os.Getenv("ABR_RATE_PER_SECOND"), 2),
+		GoogleRatePerSecond:  parseFloatOrDefault(os.Getenv("GOOGLE_RATE_PER_SECOND"), 1),
 		OutputFile:           getOrDefault(os.Getenv("OUTPUT_FILE"), "enriched_merchants_demo.csv"),
 		EnableVerification:   os.Getenv("ENABLE_VERIFICATION") != "false",
 		SupabaseURL:          os.Getenv("SUPABASE_URL"),
 		SupabaseKey:          os.Getenv("SUPABASE_KEY"),
 		SupabaseTable:        getOrDefault(os.Getenv("SUPABASE_TABLE"), "merchant_results"),
+		SupabaseOnConflict:   getOrDefault(os.Getenv("SUPABASE_ON_CONFLICT"), "merchant_name"),
+		SupabaseBatchSize:    parseIntOrDefault(os.Getenv("SUPABASE_BATCH_SIZE"), 500),
+		SupabaseMaxRetries:   parseIntOrDefault(os.Getenv("SUPABASE_MAX_RETRIES"), 3),
+		SupabaseProvenance:   os.Getenv("SUPABASE_PROVENANCE") == "true",
+		SupabaseAddressParts: os.Getenv("SUPABASE_ADDRESS_PARTS") == "true",
 	}
 }
 
@@ -43,6 +67,12 @@ func (c Config) SupabaseEnabled() bool {
 	return c.SupabaseURL != "" && c.SupabaseKey != "" && c.SupabaseTable != ""
 }
 
+// ABRIndexEnabled reports whether ABR lookups should be answered from the
+// local bulk extract index.
+func (c Config) ABRIndexEnabled() bool {
+	return c.ABRIndexDatabaseURL != ""
+}
+
 func (c Config) GetMerchants() []string {
 	return []string{
 		"Afterpay",
@@ -91,6 +121,13 @@ func parseIntOrDefault(s string, defaultVal int) int {
 	return defaultVal
 }
 
+func parseFloatOrDefault(s string, defaultVal float64) float64 {
+	if val, err := strconv.ParseFloat(s, 64); err == nil {
+		return val
+	}
+	return defaultVal
+}
+
 func getOrDefault(s string, defaultVal string) string {
 	if s != "" {
 		return s
@@ -0,0 +1,143 @@
+package data
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Journal is an append-only NDJSON checkpoint of finished merchants. Each
+// result is written and synced as soon as it completes, so a run that dies
+// part way through can be resumed without repeating lookups. Merchants
+// whose lookups failed are never written, so a resumed run retries them
+// rather than treating them as not found.
+type Journal struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+// JournalPath returns the checkpoint path kept next to outputFile, e.g.
+// "enriched.csv" -> "enriched.journal.ndjson".
+func JournalPath(outputFile string) string {
+	base := strings.TrimSuffix(outputFile, filepath.Ext(outputFile))
+	return base + ".journal.ndjson"
+}
+
+// OpenJournal opens the journal at path. With resume set the existing
+// entries are returned and new entries are appended after them; otherwise
+// the journal is started afresh. A half-written final line left by a crash
+// is discarded.
+func OpenJournal(path string, resume bool) (*Journal, []Result, error) {
+	var rows []Result
+	if resume {
+		var (
+			valid int64
+			err   error
+		)
+		rows, valid, err = readJournal(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, nil, err
+		}
+		if err == nil {
+			if err := os.Truncate(path, valid); err != nil {
+				return nil, nil, fmt.Errorf("truncate journal: %w", err)
+			}
+		}
+	}
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if !resume {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(path, flags, 0o644)
+	if err != nil {
+		return nil, nil, fmt.Errorf("open journal: %w", err)
+	}
+	return &Journal{path: path, file: f}, rows, nil
+}
+
+// Path returns the journal's file path.
+func (j *Journal) Path() string {
+	return j.path
+}
+
+// Append writes r as one line and syncs it to disk.
+func (j *Journal) Append(r Result) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("marshal journal entry: %w", err)
+	}
+	line = append(line, '\n')
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, err := j.file.Write(line); err != nil {
+		return fmt.Errorf("write journal: %w", err)
+	}
+	return j.file.Sync()
+}
+
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.file.Close()
+}
+
+// ReadJournal returns every complete entry in the journal at path. When a
+// merchant appears more than once the latest entry wins, keeping the
+// position of the first.
+func ReadJournal(path string) ([]Result, error) {
+	rows, _, err := readJournal(path)
+	return rows, err
+}
+
+// readJournal also returns the byte offset just past the last complete line.
+func readJournal(path string) ([]Result, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	var (
+		rows  []Result
+		index = map[string]int{}
+		valid int64
+		lineN int
+	)
+	br := bufio.NewReader(f)
+	for {
+		line, err := br.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			// A final line without a newline was cut off mid-write
+			break
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("read journal: %w", err)
+		}
+		lineN++
+
+		if trimmed := bytes.TrimSpace(line); len(trimmed) > 0 {
+			var r Result
+			if err := json.Unmarshal(trimmed, &r); err != nil {
+				return nil, 0, fmt.Errorf("journal line %d: %w", lineN, err)
+			}
+			if i, ok := index[r.MerchantName]; ok {
+				rows[i] = r
+			} else {
+				index[r.MerchantName] = len(rows)
+				rows = append(rows, r)
+			}
+		}
+		valid += int64(len(line))
+	}
+	return rows, valid, nil
+}
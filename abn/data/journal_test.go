@@ -0,0 +1,82 @@
+package data
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestJournalPath(t *testing.T) {
+	if got := JournalPath("out/enriched.csv"); got != "out/enriched.journal.ndjson" {
+		t.Errorf("JournalPath = %q", got)
+	}
+}
+
+func TestJournalResume(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "enriched.journal.ndjson")
+
+	j, rows, err := OpenJournal(path, false)
+	if err != nil || len(rows) != 0 {
+		t.Fatalf("fresh journal = %v, %v", rows, err)
+	}
+	p := NewProcessor("", SupabaseConfig{})
+	p.UseJournal(j)
+	p.AddResult(Result{MerchantName: "Woolworths", ABN: "88000014675", LegalName: "WOOLWORTHS GROUP LIMITED"})
+	p.AddResult(Result{MerchantName: "Nobody", LegalName: "Nobody"})
+	p.AddResult(Result{MerchantName: "Bad Checksum", ABN: "51824753557"})
+	if err := j.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a crash part way through writing the next entry
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"merchant_name": "Co`)
+	f.Close()
+
+	j, rows, err = OpenJournal(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 || rows[0].ABN != "88000014675" || !rows[1].ABN.IsZero() {
+		t.Fatalf("resumed rows = %+v", rows)
+	}
+	if !rows[2].ABN.IsZero() {
+		t.Errorf("invalid ABN %q was journaled", rows[2].ABN)
+	}
+
+	// A retried merchant replaces its earlier entry in place
+	p = NewProcessor("", SupabaseConfig{})
+	p.Restore(rows)
+	p.UseJournal(j)
+	if done := p.Done(); !done["Nobody"] || done["Coles"] {
+		t.Errorf("done = %v", done)
+	}
+	p.AddResult(Result{MerchantName: "Nobody", ABN: "51824753556", LegalName: "NOBODY"})
+	p.AddResult(Result{MerchantName: "Coles", LegalName: "Coles"})
+	j.Close()
+
+	rows, err = ReadJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, r := range rows {
+		names = append(names, r.MerchantName)
+	}
+	if len(rows) != 4 || rows[1].ABN != "51824753556" || rows[3].MerchantName != "Coles" {
+		t.Errorf("journal after retry = %v: %+v", names, rows)
+	}
+
+	// Without resume the journal starts again
+	j, rows, err = OpenJournal(path, false)
+	if err != nil || len(rows) != 0 {
+		t.Fatalf("restarted journal = %v, %v", rows, err)
+	}
+	j.Close()
+	if rows, err := ReadJournal(path); err != nil || len(rows) != 0 {
+		t.Errorf("restarted journal still has %d rows, %v", len(rows), err)
+	}
+}
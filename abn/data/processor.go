@@ -4,39 +4,69 @@ import (
 	"bytes"
 	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
+
+	"merchantcache/abn/abr"
+	"merchantcache/provenance"
+	"merchantcache/ratelimit"
 )
 
 type Result struct {
 	MerchantName    string  `json:"merchant_name"`
-	ABN             string  `json:"abn"`
-	ACN             string  `json:"acn"`
+	ABN             abr.ABN `json:"abn"`
+	ACN             abr.ACN `json:"acn"`
 	State           string  `json:"state"`
 	LegalName       string  `json:"legal_name"`
 	Score           string  `json:"score"`
 	Verified        bool    `json:"verified"`
 	Confidence      float64 `json:"confidence"`
 	Address         string  `json:"head_office_address"`
-	GoogleABN       string  `json:"google_abn"`
+	AddressUnit     string  `json:"head_office_unit"`
+	StreetNumber    string  `json:"head_office_street_number"`
+	StreetName      string  `json:"head_office_street_name"`
+	StreetType      string  `json:"head_office_street_type"`
+	Suburb          string  `json:"head_office_suburb"`
+	AddressState    string  `json:"head_office_state"`
+	Postcode        string  `json:"head_office_postcode"`
+	AddressScore    float64 `json:"head_office_confidence"`
+	GoogleABN       abr.ABN `json:"google_abn"`
 	GoogleLegalName string  `json:"google_legal_name"`
+
+	// Provenance says where each field came from and how far to trust it
+	Provenance []provenance.Record `json:"provenance,omitempty"`
 }
 
+// Processor collects results and writes them out. It is safe for
+// concurrent use.
 type Processor struct {
+	mu         sync.Mutex
 	outputFile string
 	rows       []Result
 	supabase   SupabaseConfig
+	journal    *Journal
 }
 
 type SupabaseConfig struct {
-	URL   string
-	Key   string
-	Table string
+	URL        string
+	Key        string
+	Table      string
+	OnConflict string // column rows are upserted on, merchant_name by default
+	BatchSize  int
+	MaxRetries int
+	Provenance bool // send the provenance jsonb column; the table must have one
+
+	// AddressParts sends the structured head_office_* columns next to
+	// head_office_address; the table must have them
+	AddressParts bool
 }
 
 func (p SupabaseConfig) Enabled() bool {
@@ -51,10 +81,63 @@ func NewProcessor(outputFile string, supabase SupabaseConfig) *Processor {
 	}
 }
 
+// UseJournal checkpoints every result passed to AddResult to j.
+func (p *Processor) UseJournal(j *Journal) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.journal = j
+}
+
+// Restore loads results finished by an earlier run, as returned by
+// OpenJournal, without writing them to the journal again.
+func (p *Processor) Restore(rows []Result) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rows = append(p.rows, rows...)
+}
+
+// Done returns the names of the merchants already recorded.
+func (p *Processor) Done() map[string]bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	done := make(map[string]bool, len(p.rows))
+	for _, r := range p.rows {
+		done[r.MerchantName] = true
+	}
+	return done
+}
+
+// AddResult records a processed merchant. Identifiers that fail their
+// checksum are dropped so they never reach the CSV or Supabase. With a
+// journal in use the result is checkpointed before AddResult returns.
 func (p *Processor) AddResult(r Result) {
+	if !r.ABN.IsZero() && !r.ABN.Valid() {
+		r.ABN = ""
+	}
+	if !r.ACN.IsZero() && !r.ACN.Valid() {
+		r.ACN = ""
+	}
+	if !r.GoogleABN.IsZero() && !r.GoogleABN.Valid() {
+		r.GoogleABN = ""
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.journal != nil {
+		if err := p.journal.Append(r); err != nil {
+			fmt.Printf("✗ Checkpoint failed for %s: %v\n", r.MerchantName, err)
+		}
+	}
 	p.rows = append(p.rows, r)
 }
 
+// Rows returns a copy of the results recorded so far.
+func (p *Processor) Rows() []Result {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]Result(nil), p.rows...)
+}
+
 func (p *Processor) SaveToFile() (string, error) {
 	outPath := filepath.Join(".", p.outputFile)
 
@@ -78,25 +161,43 @@ func (p *Processor) SaveToFile() (string, error) {
 		"verified",
 		"confidence",
 		"head_office_address",
+		"head_office_unit",
+		"head_office_street_number",
+		"head_office_street_name",
+		"head_office_street_type",
+		"head_office_suburb",
+		"head_office_state",
+		"head_office_postcode",
+		"head_office_confidence",
 		"google_abn",
 		"google_legal_name",
+		"provenance",
 	}
 	writer.Write(header)
 
 	// Write data
-	for _, r := range p.rows {
+	for _, r := range p.Rows() {
 		row := []string{
 			r.MerchantName,
-			r.ABN,
-			r.ACN,
+			r.ABN.String(),
+			r.ACN.String(),
 			r.State,
 			r.LegalName,
 			r.Score,
 			boolToYesNo(r.Verified),
 			fmt.Sprintf("%.2f", r.Confidence),
 			r.Address,
-			r.GoogleABN,
+			r.AddressUnit,
+			r.StreetNumber,
+			r.StreetName,
+			r.StreetType,
+			r.Suburb,
+			r.AddressState,
+			r.Postcode,
+			fmt.Sprintf("%.2f", r.AddressScore),
+			r.GoogleABN.String(),
 			r.GoogleLegalName,
+			provenanceJSON(r.Provenance),
 		}
 		writer.Write(row)
 	}
@@ -104,14 +205,27 @@ func (p *Processor) SaveToFile() (string, error) {
 	return outPath, nil
 }
 
+// provenanceJSON flattens a result's provenance into one CSV cell.
+func provenanceJSON(records []provenance.Record) string {
+	if len(records) == 0 {
+		return ""
+	}
+	raw, err := json.Marshal(records)
+	if err != nil {
+		return ""
+	}
+	return string(raw)
+}
+
 func (p *Processor) PrintSummary() {
-	total := len(p.rows)
+	rows := p.Rows()
+	total := len(rows)
 	found := 0
 	verified := 0
 	withAddress := 0
 
-	for _, r := range p.rows {
-		if r.ABN != "" {
+	for _, r := range rows {
+		if !r.ABN.IsZero() {
 			found++
 		}
 		if r.Verified {
@@ -146,16 +260,16 @@ func (p *Processor) PrintSummary() {
 	// Print detailed results table
 	fmt.Println("DETAILED RESULTS:")
 	fmt.Println("============================================================")
-	fmt.Printf("%-4s | %-20s | %-12s | %-10s | %-25s | %-50s\n",
+	fmt.Printf("%-4s | %-20s | %-14s | %-11s | %-25s | %-50s\n",
 		"No.", "Merchant", "ABN", "ACN", "Legal Name", "Head Office Address")
 	fmt.Println(strings.Repeat("-", 150))
 
-	for idx, r := range p.rows {
-		fmt.Printf("%-4d | %-20s | %-12s | %-10s | %-25s | %-50s\n",
+	for idx, r := range rows {
+		fmt.Printf("%-4d | %-20s | %-14s | %-11s | %-25s | %-50s\n",
 			idx+1,
 			truncate(r.MerchantName, 20),
-			r.ABN,
-			r.ACN,
+			r.ABN.Format(),
+			r.ACN.Format(),
 			truncate(r.LegalName, 25),
 			truncate(r.Address, 50))
 	}
@@ -176,48 +290,221 @@ func truncate(s string, maxLen int) string {
 	return s[:maxLen-3] + "..."
 }
 
-// SyncSupabase sends all processed rows to Supabase via REST if configured.
+// SyncSupabase upserts all processed rows to Supabase via REST if
+// configured. Rows are sent in batches keyed on the conflict column, so
+// reruns update existing rows instead of duplicating them. Transient
+// failures are retried with backoff; batches that still fail are reported
+// and the rest are sent anyway.
 func (p *Processor) SyncSupabase() error {
 	if !p.supabase.Enabled() {
 		fmt.Println("Supabase sync skipped: config not provided")
 		return nil
 	}
 
-	if len(p.rows) == 0 {
+	rows, skipped := dedupeByConflictKey(p.Rows(), p.supabase.conflictColumn())
+	if skipped > 0 {
+		fmt.Printf("Supabase sync: skipping %d rows with no %s\n", skipped, p.supabase.conflictColumn())
+	}
+	if len(rows) == 0 {
 		fmt.Println("Supabase sync skipped: no rows to send")
 		return nil
 	}
 
-	payload, err := json.Marshal(p.rows)
+	batchSize := p.supabase.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultSupabaseBatchSize
+	}
+	batches := (len(rows) + batchSize - 1) / batchSize
+
+	client := &http.Client{Timeout: 15 * time.Second}
+
+	var errs []error
+	sent := 0
+	for b := 0; b < batches; b++ {
+		start := b * batchSize
+		end := start + batchSize
+		if end > len(rows) {
+			end = len(rows)
+		}
+
+		if err := p.upsertBatch(client, rows[start:end]); err != nil {
+			fmt.Printf("✗ Supabase batch %d/%d (rows %d-%d) failed: %v\n", b+1, batches, start+1, end, err)
+			errs = append(errs, fmt.Errorf("batch %d: %w", b+1, err))
+			continue
+		}
+		sent += end - start
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%d of %d supabase batches failed: %w", len(errs), batches, errors.Join(errs...))
+	}
+	fmt.Printf("✓ Supabase sync complete (%d rows in %d batches)\n", sent, batches)
+	return nil
+}
+
+const (
+	defaultSupabaseBatchSize  = 500
+	defaultSupabaseOnConflict = "merchant_name"
+)
+
+// supabaseBackoff spaces out retries of a failed batch.
+var supabaseBackoff = ratelimit.Backoff{Base: 500 * time.Millisecond, Max: 30 * time.Second}
+
+func (p SupabaseConfig) conflictColumn() string {
+	if p.OnConflict == "" {
+		return defaultSupabaseOnConflict
+	}
+	return p.OnConflict
+}
+
+// upsertBatch posts one batch, retrying 429 and 5xx responses and network
+// errors up to MaxRetries times.
+func (p *Processor) upsertBatch(client *http.Client, rows []Result) error {
+	payload, err := p.supabasePayload(rows)
 	if err != nil {
 		return fmt.Errorf("marshal supabase payload: %w", err)
 	}
 
-	endpoint := fmt.Sprintf("%s/rest/v1/%s", strings.TrimSuffix(p.supabase.URL, "/"), p.supabase.Table)
+	params := url.Values{}
+	params.Set("on_conflict", p.supabase.conflictColumn())
+	endpoint := fmt.Sprintf("%s/rest/v1/%s?%s", strings.TrimSuffix(p.supabase.URL, "/"), p.supabase.Table, params.Encode())
+
+	for attempt := 0; ; attempt++ {
+		retryAfter, err := p.postBatch(client, endpoint, payload)
+		if err == nil {
+			return nil
+		}
+
+		var perm *permanentError
+		if errors.As(err, &perm) || attempt >= p.supabase.MaxRetries {
+			return err
+		}
+
+		wait := supabaseBackoff.Delay(attempt)
+		if retryAfter > 0 {
+			wait = retryAfter
+		}
+		fmt.Printf("  ↻ Supabase retry %d/%d in %s: %v\n", attempt+1, p.supabase.MaxRetries, wait, err)
+		time.Sleep(wait)
+	}
+}
+
+// addressPartColumns are the structured head office columns, only sent with
+// SupabaseConfig.AddressParts.
+var addressPartColumns = []string{
+	"head_office_unit",
+	"head_office_street_number",
+	"head_office_street_name",
+	"head_office_street_type",
+	"head_office_suburb",
+	"head_office_state",
+	"head_office_postcode",
+	"head_office_confidence",
+}
+
+// supabasePayload encodes rows with only the columns the table is
+// configured to have.
+func (p *Processor) supabasePayload(rows []Result) ([]byte, error) {
+	out := make([]map[string]json.RawMessage, len(rows))
+	for i, r := range rows {
+		if !p.supabase.Provenance {
+			r.Provenance = nil
+		}
+		raw, err := json.Marshal(r)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(raw, &out[i]); err != nil {
+			return nil, err
+		}
+		if !p.supabase.AddressParts {
+			for _, col := range addressPartColumns {
+				delete(out[i], col)
+			}
+		}
+	}
+	return json.Marshal(out)
+}
 
+// permanentError is a response that retrying will not fix.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+func (p *Processor) postBatch(client *http.Client, endpoint string, payload []byte) (time.Duration, error) {
 	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(payload))
 	if err != nil {
-		return fmt.Errorf("build supabase request: %w", err)
+		return 0, &permanentError{fmt.Errorf("build supabase request: %w", err)}
 	}
 
 	req.Header.Set("apikey", p.supabase.Key)
 	req.Header.Set("Authorization", "Bearer "+p.supabase.Key)
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Prefer", "return=representation")
-
-	client := &http.Client{Timeout: 15 * time.Second}
+	req.Header.Set("Prefer", "resolution=merge-duplicates,return=minimal")
 
 	resp, err := client.Do(req)
 	if err != nil {
-		return fmt.Errorf("supabase request failed: %w", err)
+		return 0, fmt.Errorf("supabase request failed: %w", err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode >= 300 {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("supabase returned %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	if resp.StatusCode < 300 {
+		return 0, nil
 	}
 
-	fmt.Printf("✓ Supabase sync complete (%d rows)\n", len(p.rows))
-	return nil
+	body, _ := io.ReadAll(resp.Body)
+	err = fmt.Errorf("supabase returned %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		return supabaseBackoff.RetryAfter(resp.Header.Get("Retry-After")), err
+	}
+	return 0, &permanentError{err}
+}
+
+// dedupeByConflictKey keeps the last row for each value of column, since
+// PostgREST rejects a batch that upserts the same key twice. Rows with an
+// empty key, such as merchants with no ABN when upserting on abn, cannot be
+// upserted and are dropped; skipped counts them.
+func dedupeByConflictKey(rows []Result, column string) (out []Result, skipped int) {
+	index := map[string]int{}
+	out = make([]Result, 0, len(rows))
+	for _, r := range rows {
+		key := conflictKey(r, column)
+		if key == "" {
+			skipped++
+			continue
+		}
+		if i, ok := index[key]; ok {
+			out[i] = r
+			continue
+		}
+		index[key] = len(out)
+		out = append(out, r)
+	}
+	return out, skipped
+}
+
+// conflictKey returns the value of the JSON field named column.
+func conflictKey(r Result, column string) string {
+	switch column {
+	case "merchant_name":
+		return r.MerchantName
+	case "abn":
+		return r.ABN.String()
+	}
+
+	raw, err := json.Marshal(r)
+	if err != nil {
+		return ""
+	}
+	var fields map[string]any
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return ""
+	}
+	if v, ok := fields[column]; ok && v != nil {
+		return fmt.Sprint(v)
+	}
+	return ""
 }
@@ -0,0 +1,195 @@
+package data
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"merchantcache/provenance"
+	"merchantcache/ratelimit"
+)
+
+// stubPostgREST records upsert requests and answers each with the next
+// status in statuses, then 201 once they run out.
+type stubPostgREST struct {
+	t        *testing.T
+	mu       sync.Mutex
+	statuses []int
+	batches  [][]map[string]any
+	queries  []string
+}
+
+func (s *stubPostgREST) serve() *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if r.Method != http.MethodPost || r.URL.Path != "/rest/v1/merchants" {
+			s.t.Errorf("request %s %s", r.Method, r.URL.Path)
+		}
+		if r.Header.Get("apikey") != "secret" || r.Header.Get("Authorization") != "Bearer secret" ||
+			!strings.Contains(r.Header.Get("Prefer"), "resolution=merge-duplicates") {
+			s.t.Errorf("headers = %v", r.Header)
+		}
+		s.queries = append(s.queries, r.URL.RawQuery)
+
+		if len(s.statuses) > 0 {
+			status := s.statuses[0]
+			s.statuses = s.statuses[1:]
+			if status == http.StatusTooManyRequests {
+				w.Header().Set("Retry-After", "0")
+			}
+			if status >= 300 {
+				http.Error(w, `{"message": "try again"}`, status)
+				return
+			}
+		}
+
+		var batch []map[string]any
+		body, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &batch); err != nil {
+			s.t.Errorf("body %s: %v", body, err)
+		}
+		s.batches = append(s.batches, batch)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	s.t.Cleanup(srv.Close)
+	return srv
+}
+
+func fastBackoff(t *testing.T) {
+	saved := supabaseBackoff
+	supabaseBackoff = ratelimit.Backoff{Base: time.Millisecond, Max: time.Millisecond}
+	t.Cleanup(func() { supabaseBackoff = saved })
+}
+
+func testProcessor(url string, cfg SupabaseConfig, rows ...Result) *Processor {
+	cfg.URL, cfg.Key, cfg.Table = url, "secret", "merchants"
+	p := NewProcessor("", cfg)
+	p.Restore(rows)
+	return p
+}
+
+func TestSyncSupabaseBatches(t *testing.T) {
+	stub := &stubPostgREST{t: t}
+	srv := stub.serve()
+	p := testProcessor(srv.URL, SupabaseConfig{BatchSize: 2},
+		Result{MerchantName: "Woolworths", LegalName: "WOOLWORTHS LIMITED"},
+		Result{MerchantName: "Coles"},
+		Result{MerchantName: "Aldi"},
+		Result{MerchantName: "Woolworths", LegalName: "WOOLWORTHS GROUP LIMITED",
+			Provenance: []provenance.Record{{Field: provenance.LegalName, Value: "WOOLWORTHS GROUP LIMITED"}}},
+		Result{MerchantName: "Kmart"},
+		Result{MerchantName: "Big W"},
+	)
+
+	if err := p.SyncSupabase(); err != nil {
+		t.Fatal(err)
+	}
+	// Six rows with one duplicate upsert as five, two to a batch
+	if len(stub.batches) != 3 || len(stub.batches[0]) != 2 || len(stub.batches[2]) != 1 {
+		t.Fatalf("batches = %v", stub.batches)
+	}
+	for _, q := range stub.queries {
+		if q != "on_conflict=merchant_name" {
+			t.Errorf("query = %q", q)
+		}
+	}
+	woolies := stub.batches[0][0]
+	if woolies["merchant_name"] != "Woolworths" || woolies["legal_name"] != "WOOLWORTHS GROUP LIMITED" {
+		t.Errorf("duplicate kept %v, want the latest", woolies)
+	}
+	if _, ok := woolies["provenance"]; ok {
+		t.Error("provenance sent without SupabaseConfig.Provenance")
+	}
+}
+
+func TestSyncSupabaseAddressParts(t *testing.T) {
+	row := Result{MerchantName: "Woolworths", Address: "1 Woolworths Way, Bella Vista NSW 2153", Suburb: "Bella Vista", Postcode: "2153"}
+	for _, parts := range []bool{false, true} {
+		stub := &stubPostgREST{t: t}
+		srv := stub.serve()
+		p := testProcessor(srv.URL, SupabaseConfig{AddressParts: parts}, row)
+		if err := p.SyncSupabase(); err != nil {
+			t.Fatal(err)
+		}
+		sent := stub.batches[0][0]
+		if sent["head_office_address"] != row.Address {
+			t.Errorf("AddressParts=%v sent %v without head_office_address", parts, sent)
+		}
+		// A table that predates the columns would reject the whole batch
+		if _, ok := sent["head_office_suburb"]; ok != parts {
+			t.Errorf("AddressParts=%v sent %v", parts, sent)
+		}
+	}
+}
+
+func TestSyncSupabaseOnConflictABN(t *testing.T) {
+	stub := &stubPostgREST{t: t}
+	srv := stub.serve()
+	p := testProcessor(srv.URL, SupabaseConfig{OnConflict: "abn"},
+		Result{MerchantName: "Woolworths", ABN: "88000014675"},
+		Result{MerchantName: "Woolworths Metro", ABN: "88000014675"},
+		Result{MerchantName: "Nobody"},
+		Result{MerchantName: "Jane Citizen", ABN: "51824753556"},
+	)
+
+	if err := p.SyncSupabase(); err != nil {
+		t.Fatal(err)
+	}
+	if len(stub.batches) != 1 || stub.queries[0] != "on_conflict=abn" {
+		t.Fatalf("sent %v with %q", stub.batches, stub.queries)
+	}
+	var names []string
+	for _, row := range stub.batches[0] {
+		names = append(names, row["merchant_name"].(string))
+	}
+	if strings.Join(names, ",") != "Woolworths Metro,Jane Citizen" {
+		t.Errorf("upserted %v; rows without an ABN must be skipped", names)
+	}
+
+	// Nothing to send at all is not an error
+	p = testProcessor(srv.URL, SupabaseConfig{OnConflict: "abn"}, Result{MerchantName: "Nobody"})
+	if err := p.SyncSupabase(); err != nil || len(stub.batches) != 1 {
+		t.Errorf("sync of keyless rows = %v after %d batches", err, len(stub.batches))
+	}
+}
+
+func TestSyncSupabaseRetries(t *testing.T) {
+	fastBackoff(t)
+	rows := []Result{{MerchantName: "Woolworths"}, {MerchantName: "Coles"}}
+
+	tests := []struct {
+		name       string
+		statuses   []int
+		maxRetries int
+		batchSize  int
+		wantErr    bool
+		posts      int
+		sent       int
+	}{
+		{name: "429 then 503 then ok", statuses: []int{429, 503}, maxRetries: 2, posts: 3, sent: 1},
+		{name: "retries exhausted", statuses: []int{502, 502}, maxRetries: 1, wantErr: true, posts: 2},
+		{name: "bad request is not retried", statuses: []int{400}, maxRetries: 3, wantErr: true, posts: 1},
+		{name: "one batch fails, the next is sent", statuses: []int{400}, maxRetries: 3, batchSize: 1, wantErr: true, posts: 2, sent: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := &stubPostgREST{t: t, statuses: tt.statuses}
+			srv := stub.serve()
+			p := testProcessor(srv.URL, SupabaseConfig{MaxRetries: tt.maxRetries, BatchSize: tt.batchSize}, rows...)
+
+			err := p.SyncSupabase()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if len(stub.queries) != tt.posts || len(stub.batches) != tt.sent {
+				t.Errorf("%d posts, %d accepted; want %d, %d", len(stub.queries), len(stub.batches), tt.posts, tt.sent)
+			}
+		})
+	}
+}
@@ -0,0 +1,307 @@
+// Package merchants loads the list of merchants to enrich from files, stdin
+// or the raw_transactions table.
+package merchants
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"merchantcache/abn/abr"
+)
+
+// DefaultQuery selects every transaction description seeded by brandfetch.
+const DefaultQuery = `select description from raw_transactions order by created_at`
+
+// Format is an input file format.
+type Format string
+
+const (
+	FormatText Format = "txt"
+	FormatCSV  Format = "csv"
+	FormatJSON Format = "json"
+)
+
+// Merchant is a merchant name plus optional hints that narrow the lookups.
+type Merchant struct {
+	Name    string  `json:"name"`
+	ABN     abr.ABN `json:"abn,omitempty"`
+	State   string  `json:"state,omitempty"`
+	Website string  `json:"website,omitempty"`
+}
+
+// FromNames wraps plain names, such as config.GetMerchants, without hints.
+func FromNames(names []string) []Merchant {
+	out := make([]Merchant, 0, len(names))
+	for _, n := range names {
+		out = append(out, Merchant{Name: n})
+	}
+	return Dedupe(out)
+}
+
+// Load reads merchants from path, or from stdin when path is "-". An empty
+// format is inferred from the file extension, falling back to one name per
+// line.
+func Load(path string, format Format) ([]Merchant, error) {
+	if format == "" {
+		format = formatFromExt(path)
+	}
+
+	if path == "-" {
+		return Read(os.Stdin, format)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open merchants file: %w", err)
+	}
+	defer f.Close()
+
+	return Read(f, format)
+}
+
+// Read parses merchants from r in the given format and removes duplicates.
+func Read(r io.Reader, format Format) ([]Merchant, error) {
+	var (
+		out []Merchant
+		err error
+	)
+	switch format {
+	case FormatCSV:
+		out, err = readCSV(r)
+	case FormatJSON:
+		out, err = readJSON(r)
+	case FormatText, "":
+		out, err = readText(r)
+	default:
+		return nil, fmt.Errorf("unknown merchants format %q", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return Dedupe(out), nil
+}
+
+// LoadFromDB runs query, which must return the merchant name as its first
+// column and may return ABN, state and website hints as further columns.
+func LoadFromDB(ctx context.Context, pool *pgxpool.Pool, query string) ([]Merchant, error) {
+	if query == "" {
+		query = DefaultQuery
+	}
+
+	rows, err := pool.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []Merchant
+	line := 0
+	for rows.Next() {
+		line++
+		values, err := rows.Values()
+		if err != nil {
+			return nil, err
+		}
+		fields := make([]string, len(values))
+		for i, v := range values {
+			if v != nil {
+				fields[i] = fmt.Sprint(v)
+			}
+		}
+		m, err := fromFields(fields, line)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return Dedupe(out), nil
+}
+
+// Dedupe trims names, drops empty ones and keeps the first occurrence of
+// each name, matching how brandfetch loads transactions.txt.
+func Dedupe(in []Merchant) []Merchant {
+	out := make([]Merchant, 0, len(in))
+	seen := make(map[string]struct{})
+	for _, m := range in {
+		m.Name = strings.TrimSpace(m.Name)
+		if m.Name == "" {
+			continue
+		}
+		if _, ok := seen[m.Name]; ok {
+			continue
+		}
+		seen[m.Name] = struct{}{}
+		out = append(out, m)
+	}
+	return out
+}
+
+func formatFromExt(path string) Format {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		return FormatCSV
+	case ".json":
+		return FormatJSON
+	}
+	return FormatText
+}
+
+func readText(r io.Reader) ([]Merchant, error) {
+	var out []Merchant
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		out = append(out, Merchant{Name: sc.Text()})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("scan merchants: %w", err)
+	}
+	return out, nil
+}
+
+// readCSV accepts a header naming the columns (name or merchant, abn, state,
+// website) in any order. Without a recognisable header the columns are
+// taken as name, abn, state, website.
+func readCSV(r io.Reader) ([]Merchant, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	records, err := cr.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("read merchants csv: %w", err)
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	columns := []string{"name", "abn", "state", "website"}
+	start := 0
+	if header, ok := csvHeader(records[0]); ok {
+		columns = header
+		start = 1
+	}
+
+	var out []Merchant
+	for i, rec := range records[start:] {
+		fields := make([]string, 4)
+		for col, value := range rec {
+			if col >= len(columns) {
+				break
+			}
+			switch columns[col] {
+			case "name":
+				fields[0] = value
+			case "abn":
+				fields[1] = value
+			case "state":
+				fields[2] = value
+			case "website":
+				fields[3] = value
+			}
+		}
+		m, err := fromFields(fields, start+i+1)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, m)
+	}
+	return out, nil
+}
+
+func csvHeader(rec []string) ([]string, bool) {
+	aliases := map[string]string{
+		"name":          "name",
+		"merchant":      "name",
+		"merchant_name": "name",
+		"description":   "name",
+		"abn":           "abn",
+		"state":         "state",
+		"website":       "website",
+		"website_url":   "website",
+		"domain":        "website",
+	}
+
+	columns := make([]string, len(rec))
+	hasName := false
+	for i, h := range rec {
+		columns[i] = aliases[strings.ToLower(strings.TrimSpace(h))]
+		if columns[i] == "name" {
+			hasName = true
+		}
+	}
+	return columns, hasName
+}
+
+// readJSON accepts either an array of names or an array of Merchant objects.
+func readJSON(r io.Reader) ([]Merchant, error) {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	if err := json.Unmarshal(body, &names); err == nil {
+		return FromNames(names), nil
+	}
+
+	var raw []struct {
+		Name    string `json:"name"`
+		ABN     string `json:"abn"`
+		State   string `json:"state"`
+		Website string `json:"website"`
+	}
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return nil, fmt.Errorf("decode merchants json: %w", err)
+	}
+
+	out := make([]Merchant, 0, len(raw))
+	for i, m := range raw {
+		merchant, err := fromFields([]string{m.Name, m.ABN, m.State, m.Website}, i+1)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, merchant)
+	}
+	return out, nil
+}
+
+// fromFields builds a Merchant from name, abn, state and website values.
+// Missing trailing fields are allowed; a malformed ABN hint is an error so
+// bad input is caught before any lookups run.
+func fromFields(fields []string, line int) (Merchant, error) {
+	get := func(i int) string {
+		if i < len(fields) {
+			return strings.TrimSpace(fields[i])
+		}
+		return ""
+	}
+
+	m := Merchant{
+		Name:    get(0),
+		State:   strings.ToUpper(get(2)),
+		Website: get(3),
+	}
+	if raw := get(1); raw != "" {
+		abn, err := abr.ParseABN(raw)
+		if err != nil {
+			return Merchant{}, fmt.Errorf("merchant %d (%s): %w", line, m.Name, err)
+		}
+		m.ABN = abn
+	}
+	if m.Name == "" && (m.ABN != "" || m.Website != "") {
+		return Merchant{}, fmt.Errorf("merchant %d: hints given without a name", line)
+	}
+	return m, nil
+}
@@ -0,0 +1,121 @@
+package merchants
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRead(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  Format
+		input   string
+		want    []Merchant
+		wantErr string
+	}{
+		{
+			name:   "text",
+			format: FormatText,
+			input:  "Woolworths\n  Coles  \n\nWoolworths\nKmart\n",
+			want:   []Merchant{{Name: "Woolworths"}, {Name: "Coles"}, {Name: "Kmart"}},
+		},
+		{
+			name:   "csv with header",
+			format: FormatCSV,
+			input:  "website,Merchant,state,abn\nwoolworths.com.au,Woolworths,nsw,88 000 014 675\nbigw.com.au,Big W,,\n",
+			want: []Merchant{
+				{Name: "Woolworths", ABN: "88000014675", State: "NSW", Website: "woolworths.com.au"},
+				{Name: "Big W", Website: "bigw.com.au"},
+			},
+		},
+		{
+			name:   "csv without header",
+			format: FormatCSV,
+			input:  "Woolworths,88000014675,NSW\nColes\nWoolworths,,VIC\n",
+			want:   []Merchant{{Name: "Woolworths", ABN: "88000014675", State: "NSW"}, {Name: "Coles"}},
+		},
+		{
+			name:    "csv with a bad abn",
+			format:  FormatCSV,
+			input:   "name,abn\nWoolworths,88000014676\n",
+			wantErr: "merchant 2 (Woolworths)",
+		},
+		{
+			name:    "csv hints without a name",
+			format:  FormatCSV,
+			input:   ",88000014675\n",
+			wantErr: "hints given without a name",
+		},
+		{
+			name:   "json names",
+			format: FormatJSON,
+			input:  `["Woolworths", " ", "Coles", "Woolworths"]`,
+			want:   []Merchant{{Name: "Woolworths"}, {Name: "Coles"}},
+		},
+		{
+			name:   "json objects",
+			format: FormatJSON,
+			input:  `[{"name": "Woolworths", "abn": "88000014675", "state": "nsw", "website": "woolworths.com.au"}, {"name": "Coles"}]`,
+			want: []Merchant{
+				{Name: "Woolworths", ABN: "88000014675", State: "NSW", Website: "woolworths.com.au"},
+				{Name: "Coles"},
+			},
+		},
+		{
+			name:    "json that is neither",
+			format:  FormatJSON,
+			input:   `{"name": "Woolworths"}`,
+			wantErr: "decode merchants json",
+		},
+		{
+			name:    "unknown format",
+			format:  "xml",
+			wantErr: `unknown merchants format "xml"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Read(strings.NewReader(tt.input), tt.format)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("err = %v, want one mentioning %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got  %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadInfersFormat(t *testing.T) {
+	dir := t.TempDir()
+	for name, body := range map[string]string{
+		"merchants.csv":  "name,state\nColes,vic\n",
+		"merchants.json": `[{"name": "Coles", "state": "vic"}]`,
+		"merchants.txt":  "Coles\n",
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := Load(path, "")
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		want := Merchant{Name: "Coles"}
+		if name != "merchants.txt" {
+			want.State = "VIC"
+		}
+		if len(got) != 1 || got[0] != want {
+			t.Errorf("%s loaded %+v", name, got)
+		}
+	}
+}
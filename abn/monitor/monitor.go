@@ -0,0 +1,113 @@
+// Package monitor watches stored ABNs for changes on the ABR: status
+// changes such as cancellation, legal name changes, GST registration and
+// moves between states. Each change becomes an Event, which a Notifier
+// sends on.
+package monitor
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"merchantcache/abn/abr"
+)
+
+// StatusNotFound is the status recorded for an ABN the ABR no longer has.
+const StatusNotFound = "Not found"
+
+// Kind is what changed about an ABN.
+type Kind string
+
+const (
+	StatusChanged   Kind = "status_changed"
+	NameChanged     Kind = "name_changed"
+	GSTDeregistered Kind = "gst_deregistered"
+	GSTRegistered   Kind = "gst_registered"
+	StateChanged    Kind = "state_changed"
+)
+
+// Snapshot is what the monitor remembers about an ABN between checks.
+type Snapshot struct {
+	ABN           abr.ABN   `json:"abn"`
+	Status        string    `json:"status"`
+	LegalName     string    `json:"legal_name"`
+	GSTRegistered bool      `json:"gst_registered"`
+	State         string    `json:"state"`
+	Postcode      string    `json:"postcode"`
+	CheckedAt     time.Time `json:"checked_at"`
+}
+
+// SnapshotOf takes the monitored fields from an ABR record.
+func SnapshotOf(d abr.ABNDetails, checkedAt time.Time) Snapshot {
+	return Snapshot{
+		ABN:           d.ABN,
+		Status:        d.Status,
+		LegalName:     d.LegalName,
+		GSTRegistered: d.GSTRegistered(),
+		State:         d.State,
+		Postcode:      d.Postcode,
+		CheckedAt:     checkedAt,
+	}
+}
+
+// NotFound is the snapshot of an ABN the ABR no longer knows. Everything
+// but the status is carried over from prev, so only the status changes.
+func NotFound(prev Snapshot, checkedAt time.Time) Snapshot {
+	s := prev
+	s.Status = StatusNotFound
+	s.CheckedAt = checkedAt
+	return s
+}
+
+// Event is one change to an ABN. Merchants lists the brands stored
+// against it, for whoever is notified.
+type Event struct {
+	ABN        abr.ABN   `json:"abn"`
+	Kind       Kind      `json:"kind"`
+	Old        string    `json:"old"`
+	New        string    `json:"new"`
+	Merchants  []string  `json:"merchants,omitempty"`
+	DetectedAt time.Time `json:"detected_at"`
+}
+
+func (e Event) String() string {
+	s := fmt.Sprintf("%s %s: %q -> %q", e.ABN.Format(), e.Kind, e.Old, e.New)
+	if len(e.Merchants) > 0 {
+		s += " (" + strings.Join(e.Merchants, ", ") + ")"
+	}
+	return s
+}
+
+// Compare lists what changed between two checks of the same ABN. Fields
+// that came back empty are not reported as changes, since the ABR leaves
+// them out as often as it clears them.
+func Compare(prev, cur Snapshot) []Event {
+	var out []Event
+	add := func(kind Kind, old, new string) {
+		out = append(out, Event{ABN: cur.ABN, Kind: kind, Old: old, New: new, DetectedAt: cur.CheckedAt})
+	}
+
+	if cur.Status != "" && !strings.EqualFold(prev.Status, cur.Status) {
+		add(StatusChanged, prev.Status, cur.Status)
+	}
+	if cur.Status == StatusNotFound {
+		return out
+	}
+	if cur.LegalName != "" && abr.NormaliseName(prev.LegalName) != abr.NormaliseName(cur.LegalName) {
+		add(NameChanged, prev.LegalName, cur.LegalName)
+	}
+	switch {
+	case prev.GSTRegistered && !cur.GSTRegistered:
+		add(GSTDeregistered, "registered", "not registered")
+	case !prev.GSTRegistered && cur.GSTRegistered:
+		add(GSTRegistered, "not registered", "registered")
+	}
+	if cur.State != "" && !strings.EqualFold(prev.State, cur.State) {
+		add(StateChanged, location(prev), location(cur))
+	}
+	return out
+}
+
+func location(s Snapshot) string {
+	return strings.TrimSpace(s.State + " " + s.Postcode)
+}
@@ -0,0 +1,116 @@
+package monitor
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"merchantcache/abn/abr"
+)
+
+func TestCompare(t *testing.T) {
+	checked := time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC)
+	prev := Snapshot{
+		ABN:           "88000014675",
+		Status:        "Active",
+		LegalName:     "WOOLWORTHS GROUP LIMITED",
+		GSTRegistered: true,
+		State:         "NSW",
+		Postcode:      "2153",
+	}
+	with := func(change func(*Snapshot)) Snapshot {
+		s := prev
+		s.CheckedAt = checked
+		change(&s)
+		return s
+	}
+	event := func(kind Kind, old, new string) Event {
+		return Event{ABN: prev.ABN, Kind: kind, Old: old, New: new, DetectedAt: checked}
+	}
+
+	tests := []struct {
+		name string
+		cur  Snapshot
+		want []Event
+	}{
+		{name: "no change", cur: with(func(s *Snapshot) {})},
+		{
+			name: "status",
+			cur:  with(func(s *Snapshot) { s.Status = "Cancelled" }),
+			want: []Event{event(StatusChanged, "Active", "Cancelled")},
+		},
+		{name: "status case only", cur: with(func(s *Snapshot) { s.Status = "ACTIVE" })},
+		{
+			name: "legal name",
+			cur:  with(func(s *Snapshot) { s.LegalName = "WOOLWORTHS LIMITED" }),
+			want: []Event{event(NameChanged, "WOOLWORTHS GROUP LIMITED", "WOOLWORTHS LIMITED")},
+		},
+		{name: "name case and punctuation only", cur: with(func(s *Snapshot) { s.LegalName = "Woolworths Group Limited." })},
+		{
+			name: "state",
+			cur:  with(func(s *Snapshot) { s.State, s.Postcode = "VIC", "3000" }),
+			want: []Event{event(StateChanged, "NSW 2153", "VIC 3000")},
+		},
+		{name: "postcode within the state", cur: with(func(s *Snapshot) { s.Postcode = "2000" })},
+		{
+			name: "gst",
+			cur:  with(func(s *Snapshot) { s.GSTRegistered = false }),
+			want: []Event{event(GSTDeregistered, "registered", "not registered")},
+		},
+		{
+			name: "fields left out are not changes",
+			cur:  with(func(s *Snapshot) { s.Status, s.LegalName, s.State, s.Postcode = "", "", "", "" }),
+		},
+		{
+			name: "several at once",
+			cur:  with(func(s *Snapshot) { s.Status, s.LegalName = "Cancelled", "WOOLWORTHS LIMITED" }),
+			want: []Event{
+				event(StatusChanged, "Active", "Cancelled"),
+				event(NameChanged, "WOOLWORTHS GROUP LIMITED", "WOOLWORTHS LIMITED"),
+			},
+		},
+		{
+			name: "not found reports only the status",
+			cur:  NotFound(prev, checked),
+			want: []Event{event(StatusChanged, "Active", StatusNotFound)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Compare(prev, tt.cur); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Compare = %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSnapshotOf(t *testing.T) {
+	checked := time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC)
+	d := abr.ABNDetails{
+		ABN:       "88000014675",
+		Status:    "Active",
+		LegalName: "WOOLWORTHS GROUP LIMITED",
+		GST:       []abr.Period{{From: time.Date(2000, 7, 1, 0, 0, 0, 0, time.UTC)}},
+		State:     "NSW",
+		Postcode:  "2153",
+	}
+	want := Snapshot{
+		ABN:           "88000014675",
+		Status:        "Active",
+		LegalName:     "WOOLWORTHS GROUP LIMITED",
+		GSTRegistered: true,
+		State:         "NSW",
+		Postcode:      "2153",
+		CheckedAt:     checked,
+	}
+	if got := SnapshotOf(d, checked); got != want {
+		t.Errorf("SnapshotOf = %+v\nwant %+v", got, want)
+	}
+}
+
+func TestEventString(t *testing.T) {
+	e := Event{ABN: "88000014675", Kind: StatusChanged, Old: "Active", New: "Cancelled", Merchants: []string{"Big W", "Woolworths"}}
+	if got, want := e.String(), `88 000 014 675 status_changed: "Active" -> "Cancelled" (Big W, Woolworths)`; got != want {
+		t.Errorf("String = %s, want %s", got, want)
+	}
+}
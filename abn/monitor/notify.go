@@ -0,0 +1,115 @@
+package monitor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Notifier sends change events on. Notify gets every event from one
+// check run; an error means none of them should be treated as delivered.
+type Notifier interface {
+	Notify(ctx context.Context, events []Event) error
+}
+
+// LogNotifier writes each event to a logger.
+type LogNotifier struct {
+	Logger *log.Logger
+}
+
+// NewLogNotifier logs to l, or the standard logger when l is nil.
+func NewLogNotifier(l *log.Logger) *LogNotifier {
+	if l == nil {
+		l = log.Default()
+	}
+	return &LogNotifier{Logger: l}
+}
+
+func (n *LogNotifier) Notify(_ context.Context, events []Event) error {
+	for _, e := range events {
+		n.Logger.Printf("abn change: %s", e)
+	}
+	return nil
+}
+
+// WebhookNotifier POSTs {"events": [...]} as JSON to URL. Any response
+// other than 2xx is an error.
+type WebhookNotifier struct {
+	URL    string
+	Client *http.Client
+}
+
+// NewWebhookNotifier posts to url with a 10 second timeout.
+func NewWebhookNotifier(url string) *WebhookNotifier {
+	return &WebhookNotifier{URL: url, Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (n *WebhookNotifier) Notify(ctx context.Context, events []Event) error {
+	body, err := json.Marshal(map[string]any{"events": events})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("webhook: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook: %s", resp.Status)
+	}
+	return nil
+}
+
+// PGNotifier sends each event as a JSON payload on a Postgres NOTIFY
+// channel, for listeners such as other services sharing the database.
+type PGNotifier struct {
+	Pool    *pgxpool.Pool
+	Channel string
+}
+
+// NewPGNotifier notifies on channel through pool.
+func NewPGNotifier(pool *pgxpool.Pool, channel string) *PGNotifier {
+	return &PGNotifier{Pool: pool, Channel: channel}
+}
+
+func (n *PGNotifier) Notify(ctx context.Context, events []Event) error {
+	for _, e := range events {
+		payload, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if _, err := n.Pool.Exec(ctx, `select pg_notify($1, $2)`, n.Channel, string(payload)); err != nil {
+			return fmt.Errorf("notify %s: %w", n.Channel, err)
+		}
+	}
+	return nil
+}
+
+// Multi sends events to every notifier in turn, even when one fails, and
+// returns their errors joined.
+type Multi []Notifier
+
+func (m Multi) Notify(ctx context.Context, events []Event) error {
+	var errs []error
+	for _, n := range m {
+		if err := n.Notify(ctx, events); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,246 @@
+// Package pipeline runs the ABN and head office lookups for many merchants
+// concurrently.
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"merchantcache/abn/abr"
+	"merchantcache/abn/data"
+	"merchantcache/abn/merchants"
+	"merchantcache/google"
+	"merchantcache/provenance"
+	"merchantcache/provider"
+)
+
+// Runner looks up merchants with a fixed number of workers: the entity
+// chain finds each merchant's legal entity and the address chain its head
+// office. Rate limits are applied by the HTTP clients the providers were
+// built with. With an empty address chain head office addresses are
+// skipped.
+type Runner struct {
+	entity  provider.Chain
+	address provider.Chain
+	workers int
+}
+
+func NewRunner(entity, address provider.Chain, workers int) *Runner {
+	if workers < 1 {
+		workers = 1
+	}
+	return &Runner{
+		entity:  entity,
+		address: address,
+		workers: workers,
+	}
+}
+
+// Failure is a merchant whose lookup could not finish, such as when ABR
+// was unavailable, as opposed to one that was looked up and not found.
+type Failure struct {
+	Merchant merchants.Merchant
+	Err      error
+}
+
+// RunError is returned by Run when some lookups failed. Those merchants
+// were not emitted, so a later run can retry them.
+type RunError struct {
+	Failures []Failure
+}
+
+func (e *RunError) Error() string {
+	names := make([]string, 0, len(e.Failures))
+	for _, f := range e.Failures {
+		names = append(names, f.Merchant.Name)
+	}
+	return fmt.Sprintf("%d lookups failed (%s): %v", len(e.Failures), strings.Join(names, ", "), e.Failures[0].Err)
+}
+
+func (e *RunError) Unwrap() []error {
+	errs := make([]error, len(e.Failures))
+	for i, f := range e.Failures {
+		errs[i] = f.Err
+	}
+	return errs
+}
+
+// Run processes list and calls emit for each finished result in input
+// order. emit is never called concurrently. A merchant whose lookup fails
+// is left out and reported in a *RunError once the rest are done. When ctx
+// is cancelled no new merchants are started, in-flight lookups are
+// abandoned, and every result that did finish is still emitted before Run
+// returns ctx's error.
+func (r *Runner) Run(ctx context.Context, list []merchants.Merchant, emit func(data.Result)) error {
+	jobs := make(chan int)
+	type done struct {
+		idx    int
+		result data.Result
+		err    error
+	}
+	finished := make(chan done)
+
+	var wg sync.WaitGroup
+	for w := 0; w < r.workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range jobs {
+				result, err := r.process(ctx, list[idx])
+				if ctx.Err() != nil {
+					// Lookups cut short by cancellation are dropped
+					continue
+				}
+				finished <- done{idx: idx, result: result, err: err}
+			}
+		}()
+	}
+
+	go func() {
+		defer close(jobs)
+		for idx := range list {
+			select {
+			case jobs <- idx:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+
+	// Buffer out-of-order results until everything before them is emitted;
+	// a failed merchant settles its slot without a result
+	results := make([]*data.Result, len(list))
+	settled := make([]bool, len(list))
+	var failures []Failure
+	next := 0
+	completed := 0
+	for d := range finished {
+		completed++
+		settled[d.idx] = true
+		if d.err != nil {
+			failures = append(failures, Failure{Merchant: list[d.idx], Err: d.err})
+			fmt.Printf("[%*d/%d] %s: ✗ lookup failed: %v\n", len(fmt.Sprint(len(list))), completed, len(list), list[d.idx].Name, d.err)
+		} else {
+			res := d.result
+			results[d.idx] = &res
+			fmt.Printf("[%*d/%d] %s\n", len(fmt.Sprint(len(list))), completed, len(list), describe(res))
+		}
+
+		for next < len(results) && settled[next] {
+			if results[next] != nil {
+				emit(*results[next])
+			}
+			next++
+		}
+	}
+
+	// After a cancellation flush whatever finished past the first gap
+	for ; next < len(results); next++ {
+		if results[next] != nil {
+			emit(*results[next])
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if len(failures) > 0 {
+		return &RunError{Failures: failures}
+	}
+	return nil
+}
+
+// process looks up one merchant. It returns an error when ctx was cancelled
+// part way through or a chain could not answer; a merchant no entity
+// provider knows is a result with no ABN.
+func (r *Runner) process(ctx context.Context, m merchants.Merchant) (data.Result, error) {
+	q := provider.Query{
+		Names:   []string{m.Name},
+		Brand:   m.Name,
+		Website: m.Website,
+		State:   m.State,
+		ABN:     m.ABN.String(),
+	}
+	entity, found, err := r.entity.Best(ctx, q)
+	if err != nil {
+		return data.Result{}, err
+	}
+	if err := ctx.Err(); err != nil {
+		return data.Result{}, err
+	}
+	abn, _ := abr.ParseABN(entity.Value(provenance.ABN))
+	if !found || abn.IsZero() {
+		return data.Result{
+			MerchantName: m.Name,
+			LegalName:    m.Name,
+		}, nil
+	}
+
+	// The ABR's payload carries the fields that have no provenance record
+	var payload entityPayload
+	json.Unmarshal(entity.Raw, &payload)
+	acn, _ := abr.ParseACN(entity.Value(provenance.ACN))
+	res := data.Result{
+		MerchantName: m.Name,
+		ABN:          abn,
+		ACN:          acn,
+		State:        payload.State,
+		LegalName:    entity.Value(provenance.LegalName),
+		Score:        payload.Score,
+		Verified:     true,
+		Confidence:   entity.Confidence,
+		Provenance:   entity.Records,
+	}
+
+	if !r.address.Empty() {
+		q.LegalName = res.LegalName
+		head, ok, err := r.address.Best(ctx, q)
+		// A failed search is retried on a later run; no address is an answer
+		if err != nil {
+			return data.Result{}, err
+		}
+		if ok {
+			var address google.Address
+			json.Unmarshal(head.Raw, &address)
+			res.Address = head.Value(provenance.HeadOffice)
+			res.AddressUnit = address.Unit
+			res.StreetNumber = address.StreetNumber
+			res.StreetName = address.StreetName
+			res.StreetType = address.StreetType
+			res.Suburb = address.Suburb
+			res.AddressState = address.State
+			res.Postcode = address.Postcode
+			res.AddressScore = head.Confidence
+			res.Provenance = append(append([]provenance.Record(nil), res.Provenance...), head.Records...)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return data.Result{}, err
+	}
+	return res, nil
+}
+
+// Lookup runs the ABN and head office lookups for a single merchant, for
+// callers that schedule their own work. Like Run, it returns an error when
+// ctx was cancelled or a lookup could not answer, but not for a miss.
+func (r *Runner) Lookup(ctx context.Context, m merchants.Merchant) (data.Result, error) {
+	return r.process(ctx, m)
+}
+
+func describe(r data.Result) string {
+	if r.ABN.IsZero() {
+		return fmt.Sprintf("%s: ✗ ABN not found", r.MerchantName)
+	}
+	if r.Address == "" {
+		return fmt.Sprintf("%s: ✓ ABN %s (%s), ✗ no address", r.MerchantName, r.ABN.Format(), r.LegalName)
+	}
+	return fmt.Sprintf("%s: ✓ ABN %s (%s), ✓ %s", r.MerchantName, r.ABN.Format(), r.LegalName, r.Address)
+}
@@ -0,0 +1,170 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"merchantcache/abn/abr"
+	"merchantcache/abn/data"
+	"merchantcache/abn/merchants"
+	"merchantcache/google"
+	"merchantcache/provenance"
+	"merchantcache/provider"
+)
+
+const woolworthsSearch = `<ABRPayloadSearchResults><response><searchResultsList>
+<searchResultsRecord>
+  <ABN><identifierValue>88000014675</identifierValue><identifierStatus>Active</identifierStatus></ABN>
+  <mainName><organisationName>WOOLWORTHS GROUP LIMITED</organisationName><score>100</score></mainName>
+  <mainBusinessPhysicalAddress><stateCode>NSW</stateCode><postcode>2153</postcode></mainBusinessPhysicalAddress>
+</searchResultsRecord>
+</searchResultsList></response></ABRPayloadSearchResults>`
+
+const noRecords = `<ABRPayloadSearchResults><response><exception>
+<exceptionDescription>No records found</exceptionDescription>
+<exceptionCode>WEBSERVICES</exceptionCode>
+</exception></response></ABRPayloadSearchResults>`
+
+// stubABR answers name searches by merchant name: Woolworths is found,
+// "Outage" gets a 503 and anything else has no records.
+func stubABR(t *testing.T) *abr.Client {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("name") {
+		case "Woolworths":
+			io.WriteString(w, woolworthsSearch)
+		case "Outage":
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		default:
+			io.WriteString(w, noRecords)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return abr.NewClient("guid", srv.URL+"/ABRSearchByName", 5)
+}
+
+// testRunner routes the pipeline through the registry, as abngooglemain
+// does, with Google only when g is set.
+func testRunner(t *testing.T, a *abr.Client, g *google.Client, workers int) *Runner {
+	t.Helper()
+	reg := provider.NewRegistry()
+	Register(reg, a, g)
+	cfg := DefaultConfig(g != nil)
+	entity, err := reg.Chain(cfg, ChainEntity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	address, err := reg.Chain(cfg, ChainAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewRunner(entity, address, workers)
+}
+
+func TestRun(t *testing.T) {
+	list := merchants.FromNames([]string{"Woolworths", "Outage", "Nobody Pty Ltd"})
+
+	var emitted []data.Result
+	err := testRunner(t, stubABR(t), nil, 2).Run(context.Background(), list, func(r data.Result) {
+		emitted = append(emitted, r)
+	})
+
+	// The outage is reported, not emitted as a miss
+	var runErr *RunError
+	if !errors.As(err, &runErr) || len(runErr.Failures) != 1 || runErr.Failures[0].Merchant.Name != "Outage" {
+		t.Fatalf("Run = %v, want a RunError for Outage", err)
+	}
+	if len(emitted) != 2 {
+		t.Fatalf("emitted %d results, want 2: %+v", len(emitted), emitted)
+	}
+	if r := emitted[0]; r.MerchantName != "Woolworths" || r.ABN != "88000014675" || r.LegalName != "WOOLWORTHS GROUP LIMITED" || !r.Verified {
+		t.Errorf("found = %+v", r)
+	}
+	if r := emitted[1]; r.MerchantName != "Nobody Pty Ltd" || !r.ABN.IsZero() {
+		t.Errorf("miss = %+v", r)
+	}
+
+	if err := testRunner(t, stubABR(t), nil, 1).Run(context.Background(), list[:1], func(data.Result) {}); err != nil {
+		t.Errorf("Run with no failures = %v", err)
+	}
+}
+
+func TestLookupKnownABN(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("searchString") {
+		case "53004085616":
+			io.WriteString(w, `<ABRPayloadSearchResults><response><exception>
+<exceptionDescription>Search text is not a valid ABN or ACN</exceptionDescription>
+<exceptionCode>WEBSERVICES</exceptionCode>
+</exception></response></ABRPayloadSearchResults>`)
+		default:
+			http.Error(w, "unavailable", http.StatusBadGateway)
+		}
+	}))
+	defer srv.Close()
+	r := testRunner(t, abr.NewClient("guid", srv.URL+"/ABRSearchByName", 5), nil, 1)
+
+	res, err := r.Lookup(context.Background(), merchants.Merchant{Name: "Old Shop", ABN: "53004085616"})
+	if err != nil || !res.ABN.IsZero() || res.MerchantName != "Old Shop" {
+		t.Errorf("unknown ABN = %+v, %v; want a miss", res, err)
+	}
+	if _, err := r.Lookup(context.Background(), merchants.Merchant{Name: "Woolworths", ABN: "88000014675"}); err == nil {
+		t.Error("a 502 from ABR was reported as a miss")
+	}
+}
+
+func TestRunAddressSearchFailure(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error": {"code": 429}}`, http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+	g, err := google.NewClient("key", "cx", "", "", 5, google.WithBaseURL(srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A rate-limited address search must not be journaled as "no address"
+	var emitted []data.Result
+	err = testRunner(t, stubABR(t), g, 1).Run(context.Background(), merchants.FromNames([]string{"Woolworths"}), func(r data.Result) {
+		emitted = append(emitted, r)
+	})
+	var runErr *RunError
+	if !errors.As(err, &runErr) || len(emitted) != 0 {
+		t.Errorf("Run = %v with %d results, want a RunError and none", err, len(emitted))
+	}
+}
+
+func TestRunWithAddress(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Query().Get("q"), "WOOLWORTHS GROUP LIMITED head office") {
+			io.WriteString(w, `{"items": [{"snippet": "Head office: 1 Woolworths Way, Bella Vista NSW 2153."}]}`)
+			return
+		}
+		io.WriteString(w, `{}`)
+	}))
+	defer srv.Close()
+	g, err := google.NewClient("key", "cx", "", "", 5, google.WithBaseURL(srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := testRunner(t, stubABR(t), g, 1).Lookup(context.Background(), merchants.Merchant{Name: "Woolworths"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Address != "1 Woolworths Way, Bella Vista NSW 2153" || res.Postcode != "2153" || res.State != "NSW" {
+		t.Errorf("result = %+v", res)
+	}
+	sources := map[provenance.Field]provenance.Source{}
+	for _, r := range res.Provenance {
+		sources[r.Field] = r.Source
+	}
+	if sources[provenance.ABN] != provenance.SourceABR || sources[provenance.HeadOffice] != provenance.SourceGoogle {
+		t.Errorf("provenance sources = %v", sources)
+	}
+}
@@ -0,0 +1,229 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"merchantcache/abn/abr"
+	"merchantcache/google"
+	"merchantcache/provenance"
+	"merchantcache/provider"
+)
+
+// The provider types the pipeline registers, and the chains it asks: the
+// entity chain finds a merchant's legal entity, the address chain that
+// entity's head office.
+const (
+	ProviderABR    = "abr"
+	ProviderGoogle = "google"
+
+	ChainEntity  = "entity"
+	ChainAddress = "address"
+)
+
+// Register adds the abr and google provider types to reg, built on the
+// given clients. A nil client leaves its type out.
+func Register(reg *provider.Registry, abrClient *abr.Client, googleClient *google.Client) {
+	if abrClient != nil {
+		reg.Register(ProviderABR, func(name string, _ provider.Settings) (provider.Provider, error) {
+			return NewABRProvider(name, abrClient), nil
+		})
+	}
+	if googleClient != nil {
+		reg.Register(ProviderGoogle, func(name string, _ provider.Settings) (provider.Provider, error) {
+			return NewGoogleProvider(name, googleClient), nil
+		})
+	}
+}
+
+// DefaultConfig asks the ABR for the entity and, when head is set, Google
+// for the head office.
+func DefaultConfig(head bool) provider.Config {
+	cfg := provider.Config{Chains: map[string]provider.ChainConfig{
+		ChainEntity: {Providers: []string{ProviderABR}},
+	}}
+	if head {
+		cfg.Chains[ChainAddress] = provider.ChainConfig{Providers: []string{ProviderGoogle}}
+	}
+	return cfg
+}
+
+// ABRProvider finds the legal entity behind a merchant. A known ABN is
+// looked up directly; otherwise the best name match is used, with the
+// website and state hints feeding the ranking.
+type ABRProvider struct {
+	name   string
+	client *abr.Client
+}
+
+func NewABRProvider(name string, client *abr.Client) *ABRProvider {
+	return &ABRProvider{name: name, client: client}
+}
+
+func (p *ABRProvider) Name() string { return p.name }
+
+// entityPayload is an ABR candidate's Raw: the entity as matched, with the
+// evidence for choosing it.
+type entityPayload struct {
+	ABN        abr.ABN        `json:"abn"`
+	ACN        abr.ACN        `json:"acn,omitempty"`
+	LegalName  string         `json:"legal_name"`
+	State      string         `json:"state,omitempty"`
+	Score      string         `json:"score,omitempty"`
+	Status     string         `json:"status,omitempty"`
+	EntityType string         `json:"entity_type,omitempty"`
+	Evidence   map[string]any `json:"evidence,omitempty"`
+}
+
+func (p *ABRProvider) Lookup(ctx context.Context, q provider.Query) ([]provider.Candidate, error) {
+	abn, _ := abr.ParseABN(q.ABN)
+	e, found, err := lookupEntity(ctx, p.client, q.Brand, abn, abr.Hints{Domain: q.Website, State: q.State})
+	if err != nil || !found {
+		return nil, err
+	}
+	raw, err := json.Marshal(entityPayload{
+		ABN:        e.ABN,
+		ACN:        e.ACN,
+		LegalName:  e.LegalName,
+		State:      e.State,
+		Score:      e.Score,
+		Status:     e.Status,
+		EntityType: e.EntityType,
+		Evidence:   e.Evidence,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return []provider.Candidate{{
+		Provider:   p.name,
+		ID:         e.ABN.String(),
+		Confidence: e.Confidence,
+		Records:    e.provenance(),
+		Raw:        raw,
+	}}, nil
+}
+
+// GoogleProvider finds an entity's head office address: first on the
+// merchant's own website, then by searching for the brand and legal name.
+type GoogleProvider struct {
+	name   string
+	client *google.Client
+}
+
+func NewGoogleProvider(name string, client *google.Client) *GoogleProvider {
+	return &GoogleProvider{name: name, client: client}
+}
+
+func (p *GoogleProvider) Name() string { return p.name }
+
+// Lookup returns the address as a google.Address in the candidate's Raw.
+// Finding no address is a miss; a failed search is an error.
+func (p *GoogleProvider) Lookup(ctx context.Context, q provider.Query) ([]provider.Candidate, error) {
+	address, err := p.client.SearchSiteAddress(ctx, q.Website)
+	evidence := map[string]any{"method": "site_search", "website": q.Website}
+	if err != nil {
+		address, err = p.client.SearchHeadOfficeAddress(ctx, q.Brand, q.LegalName)
+		evidence = map[string]any{"method": "head_office_search", "merchant_name": q.Brand, "legal_name": q.LegalName}
+	}
+	if errors.Is(err, google.ErrNoAddress) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("head office search %q: %w", q.Brand, err)
+	}
+	raw, err := json.Marshal(address)
+	if err != nil {
+		return nil, err
+	}
+	return []provider.Candidate{{
+		Provider:   p.name,
+		Confidence: address.Confidence,
+		Records:    []provenance.Record{provenance.New(provenance.HeadOffice, address.String(), provenance.SourceGoogle, address.Confidence, evidence)},
+		Raw:        raw,
+	}}, nil
+}
+
+// entityMatch is the ABR entity chosen for a merchant, the confidence, 0 to
+// 100, that it is the right one, and the evidence for choosing it.
+type entityMatch struct {
+	abr.Result
+	Confidence float64
+	Evidence   map[string]any
+}
+
+// lookupEntity resolves a merchant's ABR entity. An ABN that ABR (or an
+// index-only client's index) does not know, or a name with no accepted
+// match, is a miss rather than an error.
+func lookupEntity(ctx context.Context, client *abr.Client, name string, abn abr.ABN, hints abr.Hints) (entityMatch, bool, error) {
+	if !abn.IsZero() {
+		details, err := client.SearchByABN(ctx, abn)
+		if errors.Is(err, abr.ErrABNNotFound) || errors.Is(err, abr.ErrNotInIndex) {
+			return entityMatch{}, false, nil
+		}
+		if err != nil {
+			return entityMatch{}, false, fmt.Errorf("abr lookup %s: %w", abn, err)
+		}
+		acn, _ := abr.ParseACN(details.ASICNumber)
+		return entityMatch{
+			Result: abr.Result{
+				ABN:        details.ABN,
+				ACN:        acn,
+				State:      details.State,
+				LegalName:  details.LegalName,
+				Score:      "100",
+				Status:     details.Status,
+				EntityType: details.EntityTypeCode,
+			},
+			Confidence: 100,
+			Evidence: map[string]any{
+				"method": "abn_lookup",
+				"status": details.Status,
+			},
+		}, true, nil
+	}
+
+	candidates, err := client.MatchWithHints(ctx, name, hints)
+	if err != nil {
+		return entityMatch{}, false, fmt.Errorf("abr search %q: %w", name, err)
+	}
+	if len(candidates) == 0 || !candidates[0].Accepted {
+		return entityMatch{}, false, nil
+	}
+	best := candidates[0]
+	return entityMatch{
+		Result:     best.Result,
+		Confidence: min(best.Score, 100),
+		Evidence: map[string]any{
+			"method":       "name_match",
+			"query":        name,
+			"matched_name": best.Result.LegalName,
+			"name_type":    best.Result.NameType,
+			"abr_score":    best.Result.Score,
+			"status":       best.Result.Status,
+			"match_score":  best.Score,
+			"features":     best.Features,
+		},
+	}, true, nil
+}
+
+// provenance describes where each field of the entity came from. An ACN
+// embedded in the ABN is confirmed by both checksums; otherwise it is only
+// as good as the ASIC number on the record.
+func (e entityMatch) provenance() []provenance.Record {
+	records := []provenance.Record{
+		provenance.New(provenance.LegalName, e.LegalName, provenance.SourceABR, e.Confidence, e.Evidence),
+		provenance.New(provenance.ABN, e.ABN.String(), provenance.SourceABR, e.Confidence, e.Evidence),
+	}
+	if !e.ACN.IsZero() {
+		embedded, ok := e.ABN.EmbeddedACN()
+		confidence := e.Confidence * 0.9
+		if ok && embedded == e.ACN {
+			confidence = e.Confidence
+		}
+		records = append(records, provenance.New(provenance.ACN, e.ACN.String(), provenance.SourceABR, confidence,
+			map[string]any{"abn": e.ABN.String(), "embedded_in_abn": ok && embedded == e.ACN}))
+	}
+	return records
+}
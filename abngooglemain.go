@@ -1,23 +1,64 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
-	"merchantcache/internal/abn/abr"
-	"merchantcache/internal/abn/config"
-	"merchantcache/internal/abn/data"
-	"merchantcache/internal/google"
-
+	"merchantcache/abn/abr"
+	"merchantcache/abn/bulk"
+	"merchantcache/abn/config"
+	"merchantcache/abn/data"
+	"merchantcache/abn/merchants"
+	"merchantcache/abn/pipeline"
+	"merchantcache/cassette"
+	"merchantcache/google"
+	"merchantcache/provider"
+	"merchantcache/ratelimit"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/joho/godotenv"
 )
 
 func main() {
+	input := flag.String("input", "", "merchants file (csv, txt or json), or - for stdin")
+	format := flag.String("format", "", "input format: csv, txt or json (default: from file extension)")
+	fromDB := flag.Bool("db", false, "load merchants from raw_transactions in DATABASE_URL")
+	dbQuery := flag.String("db-query", merchants.DefaultQuery, "query used with -db; columns are name, abn, state, website")
+	resume := flag.Bool("resume", false, "skip merchants already in the checkpoint journal from an earlier run")
+	flag.Parse()
+
 	// Load environment variables from .env
 	_ = godotenv.Load()
 
 	// Load configuration from environment
 	cfg := config.LoadFromEnv()
 
+	// Stop dispatching on Ctrl-C; finished results are still saved
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Each provider gets its own rate limit over one shared connection pool,
+	// and the timeout starts once a request is through the limiter;
+	// CASSETTE_MODE=record or replay saves its responses or serves them offline
+	timeout := time.Duration(cfg.Timeout) * time.Second
+	googleTransport, err := cassette.FromEnv(ratelimit.NewTransport(http.DefaultTransport, ratelimit.New(cfg.GoogleRatePerSecond, 1)).WithTimeout(timeout))
+	if err != nil {
+		log.Fatalf("Invalid cassette settings: %v", err)
+	}
+	abrTransport, err := cassette.FromEnv(ratelimit.NewTransport(http.DefaultTransport, ratelimit.New(cfg.ABRRatePerSecond, 1)).WithTimeout(timeout))
+	if err != nil {
+		log.Fatalf("Invalid cassette settings: %v", err)
+	}
+	googleHTTP := &http.Client{Transport: googleTransport}
+	abrHTTP := &http.Client{Transport: abrTransport}
+
 	// Initialize Google Search client for address lookup
 	googleClient, err := google.NewClient(
 		cfg.GoogleAPIKey,
@@ -25,6 +66,7 @@ func main() {
 		cfg.GoogleClientID,
 		cfg.GoogleClientSecret,
 		cfg.Timeout,
+		google.WithHTTPClient(googleHTTP),
 	)
 	if err != nil {
 		log.Fatalf("Failed to initialize Google Custom Search API: %v", err)
@@ -32,71 +74,104 @@ func main() {
 	fmt.Println("✓ Google Custom Search API initialized")
 
 	// Initialize ABR client
-	abrClient := abr.NewClient(cfg.ABRGuid, cfg.ABREndpoint, cfg.Timeout)
-	fmt.Println("✓ ABN Registry (ABR) client initialized")
+	matchCfg := abr.DefaultMatchConfig()
+	matchCfg.Threshold = cfg.ABRMatchThreshold
+	abrOpts := []abr.Option{abr.WithMatchConfig(matchCfg), abr.WithHTTPClient(abrHTTP)}
 
-	// Initialize data processor
-	processor := data.NewProcessor(cfg.OutputFile, data.SupabaseConfig{
-		URL:   cfg.SupabaseURL,
-		Key:   cfg.SupabaseKey,
-		Table: cfg.SupabaseTable,
-	})
-
-	// Process each merchant
-	merchants := cfg.GetMerchants()
-	fmt.Printf("Processing %d merchants - ABN lookup + Head Office address search...\n\n", len(merchants))
-
-	for i, merchant := range merchants {
-		fmt.Printf("[%2d/%d] %s\n", i+1, len(merchants), merchant)
-
-		// Lookup ABN using merchant name
-		fmt.Printf("    [ABN Lookup] Using merchant name: %s\n", merchant)
+	// Answer ABR lookups from the local bulk extract index when configured
+	if cfg.ABRIndexEnabled() {
+		pool, err := pgxpool.New(ctx, cfg.ABRIndexDatabaseURL)
+		if err != nil {
+			log.Fatalf("Failed to connect to ABR index: %v", err)
+		}
+		defer pool.Close()
+		abrOpts = append(abrOpts, abr.WithIndex(bulk.NewIndex(pool)))
+		fmt.Println("✓ ABN bulk extract index connected")
+	}
 
-		abn, acn, abnState, abnLegalName, score := abrClient.Lookup(merchant)
+	abrClient := abr.NewClient(cfg.ABRGuid, cfg.ABREndpoint, cfg.Timeout, abrOpts...)
+	fmt.Println("✓ ABN Registry (ABR) client initialized")
 
-		if abn == "" {
-			fmt.Printf("      ✗ ABN not found\n")
-			processor.AddResult(data.Result{
-				MerchantName: merchant,
-				LegalName:    merchant,
-			})
-			fmt.Println()
-			continue
+	// Load merchants from the chosen source, falling back to the demo list
+	var list []merchants.Merchant
+	switch {
+	case *input != "":
+		list, err = merchants.Load(*input, merchants.Format(*format))
+	case *fromDB:
+		if cfg.DatabaseURL == "" {
+			log.Fatal("DATABASE_URL is required with -db")
 		}
-
-		fmt.Printf("      ✓ ABN Found: %s\n", abn)
-		if acn != "" {
-			fmt.Printf("      ✓ ACN Found: %s\n", acn)
+		pool, perr := pgxpool.New(ctx, cfg.DatabaseURL)
+		if perr != nil {
+			log.Fatalf("Failed to connect to database: %v", perr)
 		}
-		fmt.Printf("      Legal Name: %s\n", abnLegalName)
-		fmt.Printf("      State: %s\n", abnState)
+		defer pool.Close()
+		list, err = merchants.LoadFromDB(ctx, pool, *dbQuery)
+	default:
+		list = merchants.FromNames(cfg.GetMerchants())
+	}
+	if err != nil {
+		log.Fatalf("Failed to load merchants: %v", err)
+	}
 
-		// Search for head office address using Google Custom Search
-		fmt.Printf("    [Address Lookup] Searching for head office address...\n")
-		address, err := googleClient.SearchHeadOfficeAddress(merchant, abnLegalName)
-		if err != nil {
-			fmt.Printf("      ✗ Address lookup failed: %v\n", err)
-		} else if address != "" {
-			fmt.Printf("      ✓ Address Found: %s\n", address)
-		} else {
-			fmt.Printf("      ✗ No address found\n")
+	// Initialize data processor, checkpointing each result as it finishes
+	supabaseCfg := data.SupabaseConfig{
+		URL:          cfg.SupabaseURL,
+		Key:          cfg.SupabaseKey,
+		Table:        cfg.SupabaseTable,
+		OnConflict:   cfg.SupabaseOnConflict,
+		BatchSize:    cfg.SupabaseBatchSize,
+		MaxRetries:   cfg.SupabaseMaxRetries,
+		Provenance:   cfg.SupabaseProvenance,
+		AddressParts: cfg.SupabaseAddressParts,
+	}
+	processor := data.NewProcessor(cfg.OutputFile, supabaseCfg)
+
+	journalPath := data.JournalPath(cfg.OutputFile)
+	journal, finished, err := data.OpenJournal(journalPath, *resume)
+	if err != nil {
+		log.Fatalf("Failed to open checkpoint journal: %v", err)
+	}
+	processor.Restore(finished)
+	processor.UseJournal(journal)
+
+	if *resume {
+		done := processor.Done()
+		pending := list[:0]
+		for _, m := range list {
+			if !done[m.Name] {
+				pending = append(pending, m)
+			}
 		}
+		fmt.Printf("✓ Resuming from %s: %d merchants already done, %d to go\n", journalPath, len(list)-len(pending), len(pending))
+		list = pending
+	}
 
-		// Add result
-		processor.AddResult(data.Result{
-			MerchantName: merchant,
-			ABN:          abn,
-			ACN:          acn,
-			State:        abnState,
-			LegalName:    abnLegalName,
-			Score:        score,
-			Address:      address,
-			Verified:     true,
-			Confidence:   100.0,
-		})
+	// Process each merchant
+	fmt.Printf("Processing %d merchants with %d workers - ABN lookup + Head Office address search...\n\n", len(list), cfg.Workers)
 
-		fmt.Println()
+	runner, err := newRunner(abrClient, googleClient, cfg.Workers)
+	if err != nil {
+		log.Fatalf("Failed to build providers: %v", err)
+	}
+	var runErr *pipeline.RunError
+	if err := runner.Run(ctx, list, processor.AddResult); errors.As(err, &runErr) {
+		fmt.Printf("\n✗ %d lookups failed and were not saved; run again with -resume to retry them\n", len(runErr.Failures))
+	} else if err != nil {
+		fmt.Printf("\n✗ Run interrupted (%v); saving %d finished merchants\n", err, len(processor.Rows()))
 	}
+	fmt.Println()
+
+	// Rebuild the results from the journal so the CSV covers every run
+	if err := journal.Close(); err != nil {
+		log.Printf("Failed to close checkpoint journal: %v", err)
+	}
+	rows, err := data.ReadJournal(journalPath)
+	if err != nil {
+		log.Fatalf("Failed to read checkpoint journal: %v", err)
+	}
+	processor = data.NewProcessor(cfg.OutputFile, supabaseCfg)
+	processor.Restore(rows)
 
 	// Save results
 	outputPath, err := processor.SaveToFile()
@@ -114,3 +189,29 @@ func main() {
 	// Print summary
 	processor.PrintSummary()
 }
+
+// newRunner routes the lookups through the provider registry: the entity
+// chain defaults to the ABR and the address chain to Google, and the
+// providers file named by PROVIDERS_FILE can reorder them or add others,
+// such as a csv of known merchants.
+func newRunner(abrClient *abr.Client, googleClient *google.Client, workers int) (*pipeline.Runner, error) {
+	reg := provider.NewRegistry()
+	pipeline.Register(reg, abrClient, googleClient)
+
+	pcfg := pipeline.DefaultConfig(true)
+	if path := os.Getenv("PROVIDERS_FILE"); path != "" {
+		var err error
+		if pcfg, err = provider.LoadConfig(path, pcfg); err != nil {
+			return nil, err
+		}
+	}
+	entity, err := reg.Chain(pcfg, pipeline.ChainEntity)
+	if err != nil {
+		return nil, err
+	}
+	address, err := reg.Chain(pcfg, pipeline.ChainAddress)
+	if err != nil {
+		return nil, err
+	}
+	return pipeline.NewRunner(entity, address, workers), nil
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"merchantcache/abn/abr"
+	"merchantcache/abn/config"
+	"merchantcache/abn/monitor"
+	"merchantcache/ratelimit"
+)
+
+// maxNotifyBatch caps how many pending events go to the notifier at once.
+const maxNotifyBatch = 500
+
+// watchedABN is a stored ABN due for a check, with what the last check saw.
+// Known is false for ABNs never checked, whose first check only records a
+// baseline.
+type watchedABN struct {
+	Last  monitor.Snapshot
+	Known bool
+}
+
+// fetchDueABNs returns up to limit of the ABNs served for merchants that
+// were never checked or were last checked more than maxAge ago, those
+// never checked first.
+func fetchDueABNs(ctx context.Context, pool *pgxpool.Pool, maxAge time.Duration, limit int) ([]watchedABN, error) {
+	rows, err := pool.Query(ctx, `
+		with stored as (
+			select distinct coalesce(g.abn, e.abn_head_office) as abn
+			from enriched_merchants e
+			left join golden_merchants g on g.transaction_cache = e.transaction_cache
+			where coalesce(g.abn, e.abn_head_office) is not null
+		)
+		select s.abn, coalesce(a.status, ''), coalesce(a.legal_name, ''), coalesce(a.gst_registered, false),
+		       coalesce(a.state, ''), coalesce(a.postcode, ''), a.checked_at
+		from stored s
+		left join abn_status a on a.abn = s.abn
+		where a.checked_at is null
+		   or a.checked_at < now() - make_interval(secs => $1)
+		order by a.checked_at nulls first
+		limit $2
+	`, maxAge.Seconds(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []watchedABN
+	for rows.Next() {
+		var (
+			w         watchedABN
+			checkedAt *time.Time
+		)
+		err := rows.Scan(&w.Last.ABN, &w.Last.Status, &w.Last.LegalName, &w.Last.GSTRegistered,
+			&w.Last.State, &w.Last.Postcode, &checkedAt)
+		if err != nil {
+			return nil, err
+		}
+		if checkedAt != nil {
+			w.Known = true
+			w.Last.CheckedAt = *checkedAt
+		}
+		out = append(out, w)
+	}
+	return out, rows.Err()
+}
+
+// merchantsForABN lists the brands currently served with an ABN.
+func merchantsForABN(ctx context.Context, pool *pgxpool.Pool, abn abr.ABN) ([]string, error) {
+	rows, err := pool.Query(ctx, `
+		select distinct coalesce(g.brand_name, e.brand_name)
+		from enriched_merchants e
+		left join golden_merchants g on g.transaction_cache = e.transaction_cache
+		where coalesce(g.abn, e.abn_head_office) = $1
+		  and coalesce(g.brand_name, e.brand_name) is not null
+		order by 1
+	`, abn.String())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		out = append(out, name)
+	}
+	return out, rows.Err()
+}
+
+// saveABNCheck stores a check's snapshot and the events it produced
+// together, so an event is never lost or recorded twice.
+func saveABNCheck(ctx context.Context, pool *pgxpool.Pool, s monitor.Snapshot, events []monitor.Event) error {
+	return pgx.BeginFunc(ctx, pool, func(tx pgx.Tx) error {
+		for _, e := range events {
+			merchants := e.Merchants
+			if merchants == nil {
+				merchants = []string{}
+			}
+			_, err := tx.Exec(ctx, `
+				insert into abn_events (abn, kind, old_value, new_value, merchants, detected_at)
+				values ($1, $2, $3, $4, $5, $6)
+			`, e.ABN.String(), string(e.Kind), nullIfEmpty(e.Old), nullIfEmpty(e.New), merchants, e.DetectedAt)
+			if err != nil {
+				return err
+			}
+		}
+		_, err := tx.Exec(ctx, `
+			insert into abn_status (abn, status, legal_name, gst_registered, state, postcode, checked_at)
+			values ($1, $2, $3, $4, $5, $6, $7)
+			on conflict (abn) do update set
+				status = excluded.status,
+				legal_name = excluded.legal_name,
+				gst_registered = excluded.gst_registered,
+				state = excluded.state,
+				postcode = excluded.postcode,
+				checked_at = excluded.checked_at
+		`, s.ABN.String(), nullIfEmpty(s.Status), nullIfEmpty(s.LegalName), s.GSTRegistered,
+			nullIfEmpty(s.State), nullIfEmpty(s.Postcode), s.CheckedAt)
+		return err
+	})
+}
+
+// deliverABNEvents hands events no notifier has taken yet to n, oldest
+// first, and marks them notified once n accepts them.
+func deliverABNEvents(ctx context.Context, pool *pgxpool.Pool, n monitor.Notifier) (int, error) {
+	delivered := 0
+	for {
+		rows, err := pool.Query(ctx, `
+			select id, abn, kind, coalesce(old_value, ''), coalesce(new_value, ''), merchants, detected_at
+			from abn_events
+			where notified_at is null
+			order by id
+			limit $1
+		`, maxNotifyBatch)
+		if err != nil {
+			return delivered, err
+		}
+		var (
+			ids    []int64
+			events []monitor.Event
+		)
+		for rows.Next() {
+			var (
+				id   int64
+				e    monitor.Event
+				kind string
+			)
+			if err := rows.Scan(&id, &e.ABN, &kind, &e.Old, &e.New, &e.Merchants, &e.DetectedAt); err != nil {
+				rows.Close()
+				return delivered, err
+			}
+			e.Kind = monitor.Kind(kind)
+			ids = append(ids, id)
+			events = append(events, e)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return delivered, err
+		}
+		if len(events) == 0 {
+			return delivered, nil
+		}
+
+		if err := n.Notify(ctx, events); err != nil {
+			return delivered, fmt.Errorf("notify: %w", err)
+		}
+		if _, err := pool.Exec(ctx, `update abn_events set notified_at = now() where id = any($1::bigint[])`, ids); err != nil {
+			return delivered, err
+		}
+		delivered += len(events)
+		if len(events) < maxNotifyBatch {
+			return delivered, nil
+		}
+	}
+}
+
+// abnNotifier builds the notifiers named in spec, a comma separated list
+// of log, webhook and pg. The webhook posts to ABN_MONITOR_WEBHOOK_URL and
+// pg notifies on ABN_MONITOR_CHANNEL (abn_changes by default).
+func abnNotifier(pool *pgxpool.Pool, spec string) (monitor.Notifier, error) {
+	var out monitor.Multi
+	for _, name := range strings.Split(spec, ",") {
+		switch strings.TrimSpace(name) {
+		case "":
+		case "log":
+			out = append(out, monitor.NewLogNotifier(nil))
+		case "webhook":
+			url := getenvDefault("ABN_MONITOR_WEBHOOK_URL", "")
+			if url == "" {
+				return nil, errors.New("ABN_MONITOR_WEBHOOK_URL is required for the webhook notifier")
+			}
+			out = append(out, monitor.NewWebhookNotifier(url))
+		case "pg":
+			out = append(out, monitor.NewPGNotifier(pool, getenvDefault("ABN_MONITOR_CHANNEL", "abn_changes")))
+		default:
+			return nil, fmt.Errorf("unknown notifier %q, want log, webhook or pg", name)
+		}
+	}
+	if len(out) == 0 {
+		return nil, errors.New("no notifiers configured")
+	}
+	return out, nil
+}
+
+// abnMonitorStats counts how one pass went.
+type abnMonitorStats struct {
+	Checked   int
+	Baselined int
+	Events    int
+	Failed    int
+	Delivered int
+	APICalls  int
+}
+
+// monitorABNsOnce checks every due ABN within budget ABR calls, records
+// what changed and delivers pending events.
+func monitorABNsOnce(ctx context.Context, pool *pgxpool.Pool, client *abr.Client, b *ratelimit.Budget, n monitor.Notifier, maxAge time.Duration, workers int) (abnMonitorStats, error) {
+	limit := b.Limit()
+	if limit <= 0 {
+		limit = 1000
+	}
+	due, err := fetchDueABNs(ctx, pool, maxAge, limit)
+	if err != nil {
+		return abnMonitorStats{}, fmt.Errorf("find due ABNs: %w", err)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	var (
+		mu       sync.Mutex
+		stats    abnMonitorStats
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	jobs := make(chan watchedABN)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				events, err := checkABN(ctx, pool, client, job)
+
+				mu.Lock()
+				switch {
+				case err == nil:
+					stats.Checked++
+					stats.Events += len(events)
+					if !job.Known {
+						stats.Baselined++
+					}
+					for _, e := range events {
+						fmt.Printf("• %s\n", e)
+					}
+				case errors.Is(err, ratelimit.ErrBudgetSpent), ctx.Err() != nil:
+				case errors.Is(err, errABNLookup):
+					stats.Failed++
+					fmt.Printf("%s: check failed, will retry next run (%v)\n", job.Last.ABN.Format(), err)
+				default:
+					if firstErr == nil {
+						firstErr = err
+						cancel()
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+dispatch:
+	for _, job := range due {
+		if b.Spent() {
+			break
+		}
+		select {
+		case jobs <- job:
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	stats.APICalls = b.Used()
+	if firstErr != nil {
+		return stats, firstErr
+	}
+
+	stats.Delivered, err = deliverABNEvents(ctx, pool, n)
+	return stats, err
+}
+
+// errABNLookup marks a failed ABR call, which is retried on the next run
+// rather than stopping the pass.
+var errABNLookup = errors.New("abr lookup")
+
+// checkABN looks an ABN up again and saves what changed since the last
+// check. The first check of an ABN only records a baseline.
+func checkABN(ctx context.Context, pool *pgxpool.Pool, client *abr.Client, job watchedABN) ([]monitor.Event, error) {
+	now := time.Now().UTC()
+	var cur monitor.Snapshot
+	details, err := client.SearchByABN(ctx, job.Last.ABN)
+	switch {
+	case err == nil:
+		cur = monitor.SnapshotOf(*details, now)
+		// The record may list the ABN in another form; keep the stored one
+		cur.ABN = job.Last.ABN
+	case errors.Is(err, abr.ErrABNNotFound):
+		// Only the ABR itself saying so; a bad GUID or an ABN missing from
+		// the bulk extract is a failed check
+		cur = monitor.NotFound(job.Last, now)
+	case errors.Is(err, ratelimit.ErrBudgetSpent), ctx.Err() != nil:
+		return nil, err
+	default:
+		return nil, fmt.Errorf("%w: %v", errABNLookup, err)
+	}
+
+	var events []monitor.Event
+	if job.Known {
+		events = monitor.Compare(job.Last, cur)
+	}
+	if len(events) > 0 {
+		merchants, err := merchantsForABN(ctx, pool, cur.ABN)
+		if err != nil {
+			return nil, err
+		}
+		for i := range events {
+			events[i].Merchants = merchants
+		}
+	}
+	if err := saveABNCheck(ctx, pool, cur, events); err != nil {
+		return nil, fmt.Errorf("save check for %s: %w", cur.ABN, err)
+	}
+	return events, nil
+}
+
+// runABNMonitor handles `brandfetch abn-monitor [-budget n] [-every d]
+// [-max-age d] [-notify log,webhook,pg]`. Without -every it makes one
+// pass; with it, it keeps checking on that interval until stopped.
+func runABNMonitor(ctx context.Context, pool *pgxpool.Pool, args []string) error {
+	fs := flag.NewFlagSet("abn-monitor", flag.ContinueOnError)
+	every := fs.Duration("every", 0, "keep running, checking on this interval")
+	budget := fs.Int("budget", getenvInt("ABN_MONITOR_BUDGET", 500), "most ABR calls per pass; 0 for no limit")
+	maxAge := fs.Duration("max-age", getenvDuration("ABN_MONITOR_MAX_AGE", 7*24*time.Hour), "re-check ABNs last checked longer ago than this")
+	notify := fs.String("notify", getenvDefault("ABN_MONITOR_NOTIFY", "log"), "notifiers: log, webhook, pg")
+	workers := fs.Int("workers", getenvInt("ABN_MONITOR_WORKERS", 2), "concurrent ABR lookups")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	n, err := abnNotifier(pool, *notify)
+	if err != nil {
+		return err
+	}
+	abrCfg := config.LoadFromEnv()
+	if abrCfg.ABRGuid == "" && !abrCfg.ABRIndexEnabled() {
+		return errors.New("ABR_GUID or ABR_INDEX_DATABASE_URL is required")
+	}
+
+	pass := func() error {
+		b := ratelimit.NewBudget(*budget)
+		client, closeClient, err := newABRClient(ctx, abrCfg, func(base http.RoundTripper, _ string) http.RoundTripper {
+			return ratelimit.NewBudgetTransport(base, b)
+		})
+		if err != nil {
+			return err
+		}
+		defer closeClient()
+
+		stats, err := monitorABNsOnce(ctx, pool, client, b, n, *maxAge, *workers)
+		fmt.Printf("ABN monitor: %d checked (%d new), %d changes, %d failed, %d notified; %d API calls",
+			stats.Checked, stats.Baselined, stats.Events, stats.Failed, stats.Delivered, stats.APICalls)
+		if *budget > 0 {
+			fmt.Printf(" of %d", *budget)
+		}
+		fmt.Println()
+		return err
+	}
+
+	if *every <= 0 {
+		return pass()
+	}
+
+	ticker := time.NewTicker(*every)
+	defer ticker.Stop()
+	for {
+		if err := pass(); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			fmt.Printf("ABN monitor pass failed: %v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
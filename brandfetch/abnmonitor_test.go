@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"merchantcache/abn/abr"
+	"merchantcache/abn/monitor"
+)
+
+// stubABR answers SearchByABN with whatever record it was last given.
+type stubABR struct {
+	mu   sync.Mutex
+	body string
+}
+
+func (s *stubABR) set(status, name, state, postcode string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.body = fmt.Sprintf(`<ABRPayloadSearchResults><response><businessEntity202001>
+<ABN><identifierValue>88000014675</identifierValue><isCurrentIndicator>Y</isCurrentIndicator></ABN>
+<entityStatus><entityStatusCode>%s</entityStatusCode><effectiveFrom>1999-11-01</effectiveFrom><effectiveTo>0001-01-01</effectiveTo></entityStatus>
+<mainName><organisationName>%s</organisationName><effectiveFrom>2017-12-12</effectiveFrom></mainName>
+<mainBusinessPhysicalAddress><stateCode>%s</stateCode><postcode>%s</postcode><effectiveFrom>2017-12-12</effectiveFrom><effectiveTo>0001-01-01</effectiveTo></mainBusinessPhysicalAddress>
+</businessEntity202001></response></ABRPayloadSearchResults>`, status, name, state, postcode)
+}
+
+func (s *stubABR) notFound() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.body = `<ABRPayloadSearchResults><response><exception><exceptionDescription>No records found</exceptionDescription>` +
+		`<exceptionCode>WEBSERVICES</exceptionCode></exception></response></ABRPayloadSearchResults>`
+}
+
+func (s *stubABR) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	io.WriteString(w, s.body)
+}
+
+func TestCheckABN(t *testing.T) {
+	pool := testPool(t)
+	ctx := context.Background()
+
+	for _, row := range []EnrichedRow{
+		{TransactionCache: "WOOLWORTHS 1234", BrandName: "Woolworths", ABN: "88000014675", FullResponse: []byte(`null`)},
+		{TransactionCache: "BIG W 0042", BrandName: "Big W", ABN: "88000014675", FullResponse: []byte(`null`)},
+	} {
+		if err := upsertEnriched(ctx, pool, row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stub := &stubABR{}
+	srv := httptest.NewServer(stub)
+	defer srv.Close()
+	client := abr.NewClient("guid", srv.URL+"/ABRSearchByName", 5)
+
+	// check runs the next check, treating the ABN as due however recently
+	// it was last checked
+	check := func() []monitor.Event {
+		t.Helper()
+		due, err := fetchDueABNs(ctx, pool, -time.Hour, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(due) != 1 {
+			t.Fatalf("due = %+v, want the one ABN", due)
+		}
+		events, err := checkABN(ctx, pool, client, due[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return events
+	}
+	kinds := func(events []monitor.Event) []monitor.Kind {
+		var out []monitor.Kind
+		for _, e := range events {
+			out = append(out, e.Kind)
+		}
+		return out
+	}
+
+	stub.set("Active", "WOOLWORTHS GROUP LIMITED", "NSW", "2153")
+	if events := check(); len(events) != 0 {
+		t.Errorf("first check found %v, want only a baseline", kinds(events))
+	}
+	if events := check(); len(events) != 0 {
+		t.Errorf("unchanged record found %v", kinds(events))
+	}
+
+	stub.set("Active", "WOOLWORTHS LIMITED", "VIC", "3000")
+	events := check()
+	if got := kinds(events); fmt.Sprint(got) != "[name_changed state_changed]" {
+		t.Fatalf("events = %v, want a name and a state change", got)
+	}
+	if got := fmt.Sprint(events[0].Merchants); got != "[Big W Woolworths]" {
+		t.Errorf("merchants = %s", got)
+	}
+
+	stub.set("Cancelled", "WOOLWORTHS LIMITED", "VIC", "3000")
+	if got := kinds(check()); fmt.Sprint(got) != "[status_changed]" {
+		t.Errorf("events = %v, want a status change", got)
+	}
+
+	stub.notFound()
+	events = check()
+	if len(events) != 1 || events[0].Kind != monitor.StatusChanged || events[0].New != monitor.StatusNotFound {
+		t.Errorf("events = %+v, want the status to become not found", events)
+	}
+
+	var stored int
+	if err := pool.QueryRow(ctx, `select count(*) from abn_events`).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored != 4 {
+		t.Errorf("%d events stored, want 4", stored)
+	}
+}
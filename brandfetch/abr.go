@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"merchantcache/abn/abr"
+	"merchantcache/abn/bulk"
+	"merchantcache/abn/config"
+	"merchantcache/google"
+	"merchantcache/merge"
+	"merchantcache/provenance"
+	"merchantcache/provider"
+	"merchantcache/ratelimit"
+)
+
+// abrFields is what the entity and address chains found for one brand:
+// legal_name, abn_head_office, acn_head_office and head_office_address.
+// Confidences are 0 to 100 and only meaningful when the matching field is
+// set; Provenance holds the evidence behind them.
+type abrFields struct {
+	LegalName            string
+	LegalNameConfidence  float64
+	ABN                  abr.ABN
+	ABNConfidence        float64
+	ACN                  abr.ACN
+	ACNConfidence        float64
+	HeadOffice           string
+	HeadOfficeConfidence float64
+	Provenance           []provenance.Record
+}
+
+// abrJob is an already enriched row waiting for the entity lookups.
+type abrJob struct {
+	TransactionCache string
+	BrandName        string
+	Website          string
+	State            string
+}
+
+// newGoogleClient builds the rate-limited Google Custom Search client from
+// the abngooglemain environment (GOOGLE_API_KEY, ...), wrapped by wrap.
+func newGoogleClient(cfg config.Config, wrap transportWrapper) (*google.Client, error) {
+	googleHTTP := &http.Client{
+		Transport: wrap(ratelimit.NewTransport(http.DefaultTransport, ratelimit.New(cfg.GoogleRatePerSecond, 1)).WithTimeout(time.Duration(cfg.Timeout)*time.Second), providerGoogle),
+	}
+	return google.NewClient(
+		cfg.GoogleAPIKey,
+		cfg.GoogleSearchEngineID,
+		cfg.GoogleClientID,
+		cfg.GoogleClientSecret,
+		cfg.Timeout,
+		google.WithHTTPClient(googleHTTP),
+	)
+}
+
+// newABRClient builds the rate-limited ABR client, answering from the bulk
+// index when ABR_INDEX_DATABASE_URL is set. The returned func closes the
+// index connection.
+func newABRClient(ctx context.Context, cfg config.Config, wrap transportWrapper) (*abr.Client, func(), error) {
+	abrHTTP := &http.Client{
+		Transport: wrap(ratelimit.NewTransport(http.DefaultTransport, ratelimit.New(cfg.ABRRatePerSecond, 1)).WithTimeout(time.Duration(cfg.Timeout)*time.Second), providerABR),
+	}
+
+	matchCfg := abr.DefaultMatchConfig()
+	matchCfg.Threshold = cfg.ABRMatchThreshold
+	abrOpts := []abr.Option{abr.WithMatchConfig(matchCfg), abr.WithHTTPClient(abrHTTP)}
+
+	cleanup := func() {}
+	if cfg.ABRIndexEnabled() {
+		indexPool, err := pgxpool.New(ctx, cfg.ABRIndexDatabaseURL)
+		if err != nil {
+			return nil, cleanup, fmt.Errorf("connect abr index: %w", err)
+		}
+		cleanup = indexPool.Close
+		abrOpts = append(abrOpts, abr.WithIndex(bulk.NewIndex(indexPool)))
+	}
+	return abr.NewClient(cfg.ABRGuid, cfg.ABREndpoint, cfg.Timeout, abrOpts...), cleanup, nil
+}
+
+// lookupEntity asks the entity chain about a brand and, once it has an
+// entity, the address chain for its head office. The brand's domain and
+// the descriptor's state feed the ABR ranking. It fails when ctx is
+// cancelled or a chain could not answer; a miss is empty fields.
+func lookupEntity(ctx context.Context, ps *providerSet, q provider.Query) (abrFields, error) {
+	if q.Brand == "" && q.ABN == "" {
+		return abrFields{}, nil
+	}
+	q.Website = domainOf(q.Website)
+	q.State = strings.ToUpper(q.State)
+	entity, ok, err := ps.entity.Best(ctx, q)
+	if err != nil || !ok {
+		return abrFields{}, err
+	}
+	f := entityFields(entity)
+	if f.ABN.IsZero() || ps.address.Empty() {
+		return f, nil
+	}
+
+	q.LegalName = f.LegalName
+	head, ok, err := ps.address.Best(ctx, q)
+	if err != nil {
+		return abrFields{}, err
+	}
+	if ok {
+		f.HeadOffice = head.Value(provenance.HeadOffice)
+		f.HeadOfficeConfidence = confidenceOf(head.Records, provenance.HeadOffice)
+		f.Provenance = append(f.Provenance, head.Records...)
+	}
+	return f, nil
+}
+
+func confidenceOf(records []provenance.Record, field provenance.Field) float64 {
+	r, _ := provenance.Find(records, field)
+	return r.Confidence
+}
+
+// backfillStats counts how each backlog row ended. Failed rows hit an ABR
+// or Google error and stay in the backlog for the next run.
+type backfillStats struct {
+	Found  int
+	Missed int
+	Failed int
+}
+
+// backfillABR runs the entity lookups over matched rows that have not had
+// them yet, such as rows enriched before they existed or whose lookup
+// failed last time, and re-merges their golden records. A database error
+// stops the run; lookup errors only affect the row they happened on.
+func backfillABR(ctx context.Context, pool *pgxpool.Pool, ps *providerSet, rules merge.Rules, workers int) (backfillStats, error) {
+	jobs, err := fetchABRBacklog(ctx, pool)
+	if err != nil {
+		return backfillStats{}, err
+	}
+	fmt.Printf("ABR backfill: %d rows\n", len(jobs))
+
+	if workers < 1 {
+		workers = 1
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mu       sync.Mutex
+		stats    backfillStats
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	ch := make(chan abrJob)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range ch {
+				f, err := lookupEntity(ctx, ps, provider.Query{
+					Names:   []string{j.BrandName},
+					Brand:   j.BrandName,
+					Website: j.Website,
+					State:   j.State,
+				})
+				if err != nil {
+					if ctx.Err() != nil {
+						return
+					}
+					fmt.Printf("%s: abr lookup error: %v\n", j.TransactionCache, err)
+					mu.Lock()
+					stats.Failed++
+					mu.Unlock()
+					continue
+				}
+				err = pgx.BeginFunc(ctx, pool, func(tx pgx.Tx) error {
+					if err := saveABRFields(ctx, tx, j.TransactionCache, f); err != nil {
+						return err
+					}
+					_, err := mergeGolden(ctx, tx, rules, j.TransactionCache)
+					return err
+				})
+
+				mu.Lock()
+				switch {
+				case err != nil:
+					if firstErr == nil {
+						firstErr = err
+						cancel()
+					}
+				case f.ABN.IsZero():
+					stats.Missed++
+				default:
+					stats.Found++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+dispatch:
+	for _, j := range jobs {
+		select {
+		case ch <- j:
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(ch)
+	wg.Wait()
+
+	if firstErr == nil {
+		firstErr = ctx.Err()
+	}
+	return stats, firstErr
+}
@@ -9,6 +9,8 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+
+	"merchantcache/provenance"
 )
 
 type SearchHit struct {
@@ -29,7 +31,16 @@ type BrandProfile struct {
 }
 
 type Company struct {
-	Location Location `json:"location"`
+	Location   Location   `json:"location"`
+	Industries []Industry `json:"industries"`
+}
+
+// Industry is one of Brandfetch's industry classifications for a brand,
+// with Score from 0 to 1.
+type Industry struct {
+	Name  string  `json:"name"`
+	Slug  string  `json:"slug"`
+	Score float64 `json:"score"`
 }
 
 type Location struct {
@@ -47,15 +58,13 @@ type choiceProfile struct {
 
 func searchBrand(ctx context.Context, client *http.Client, name string, cfg Config) (*SearchHit, error) {
 	url := fmt.Sprintf("https://api.brandfetch.io/v2/search/%s?c=%s", urlEncode(name), cfg.BrandfetchClientID)
-	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
-	resp, err := client.Do(req)
+	resp, err := getWithRetry(ctx, client, "search", cfg.MaxRetries, func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	})
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("search status %d", resp.StatusCode)
-	}
 	var hits []SearchHit
 	if err := json.NewDecoder(resp.Body).Decode(&hits); err != nil {
 		return nil, err
@@ -68,16 +77,18 @@ func fetchBrandProfile(ctx context.Context, client *http.Client, domain string,
 		return nil, nil
 	}
 	url := fmt.Sprintf("https://api.brandfetch.io/v2/brands/%s", urlEncode(domain))
-	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
-	req.Header.Set("Authorization", "Bearer "+cfg.BrandfetchAPIKey)
-	resp, err := client.Do(req)
+	resp, err := getWithRetry(ctx, client, "brand api", cfg.MaxRetries, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+cfg.BrandfetchAPIKey)
+		return req, nil
+	})
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("brand api status %d", resp.StatusCode)
-	}
 	var prof BrandProfile
 	body, err := ioReadAll(resp.Body)
 	if err != nil {
@@ -124,6 +135,36 @@ func pickProfile(profile *BrandProfile, hit *SearchHit) choiceProfile {
 	return choiceProfile{}
 }
 
+// brandProvenance describes the fields taken from Brandfetch. Brand name,
+// website and logo share the brand's quality score; the category uses the
+// best scoring industry on the profile.
+func brandProvenance(choice choiceProfile, profile *BrandProfile, desc, clientID string) []provenance.Record {
+	confidence := choice.QualityScore * 100
+	evidence := map[string]any{
+		"descriptor":    desc,
+		"brandfetch_id": choice.ID,
+		"domain":        choice.Domain,
+		"quality_score": choice.QualityScore,
+	}
+	records := []provenance.Record{
+		provenance.New(provenance.BrandName, choice.Name, provenance.SourceBrandfetch, confidence, evidence),
+		provenance.New(provenance.Website, domainToURL(choice.Domain), provenance.SourceBrandfetch, confidence, evidence),
+		provenance.New(provenance.Logo, logoURL(choice.Domain, clientID), provenance.SourceBrandfetch, confidence, evidence),
+	}
+
+	if profile != nil && len(profile.Company.Industries) > 0 {
+		best := profile.Company.Industries[0]
+		for _, ind := range profile.Company.Industries[1:] {
+			if ind.Score > best.Score {
+				best = ind
+			}
+		}
+		records = append(records, provenance.New(provenance.Category, best.Name, provenance.SourceBrandfetch, best.Score*100,
+			map[string]any{"brandfetch_id": choice.ID, "slug": best.Slug, "score": best.Score}))
+	}
+	return records
+}
+
 func rawJSON(profile *BrandProfile, hit *SearchHit) json.RawMessage {
 	if profile != nil && profile.Raw != nil {
 		return profile.Raw
@@ -145,6 +186,12 @@ func domainToURL(domain string) string {
 	return "https://" + domain
 }
 
+// domainOf strips the scheme and trailing slash from a website URL.
+func domainOf(website string) string {
+	d := strings.TrimPrefix(strings.TrimPrefix(strings.TrimSpace(website), "https://"), "http://")
+	return strings.TrimSuffix(d, "/")
+}
+
 func logoURL(domain, clientID string) string {
 	if domain == "" {
 		return ""
@@ -3,6 +3,10 @@ package main
 import (
 	"errors"
 	"os"
+	"strconv"
+	"time"
+
+	"merchantcache/merge"
 )
 
 type Config struct {
@@ -11,16 +15,18 @@ type Config struct {
 	BrandfetchClientID   string
 	TransactionsFilePath string
 	CountryTLDPreference string
+	Workers              int
+	RatePerSecond        float64
+	MaxRetries           int
+	Timeout              time.Duration
+	LeaseDuration        time.Duration
+	MaxAttempts          int
+	MergeRules           merge.Rules
+	ReviewThreshold      float64
 }
 
 func loadConfig() (Config, error) {
-	cfg := Config{
-		DatabaseURL:          os.Getenv("DATABASE_URL"),
-		BrandfetchAPIKey:     os.Getenv("BRANDFETCH_API_KEY"),
-		BrandfetchClientID:   os.Getenv("BRANDFETCH_CLIENT_ID"),
-		TransactionsFilePath: getenvDefault("TRANSACTIONS_FILE", "transactions.txt"),
-		CountryTLDPreference: getenvDefault("COUNTRY_TLD_PREFERENCE", ".au"),
-	}
+	cfg := configFromEnv()
 	if cfg.DatabaseURL == "" {
 		return cfg, errors.New("DATABASE_URL is required")
 	}
@@ -30,12 +36,57 @@ func loadConfig() (Config, error) {
 	if cfg.BrandfetchClientID == "" {
 		return cfg, errors.New("BRANDFETCH_CLIENT_ID is required")
 	}
+	rules, err := loadMergeRules()
+	if err != nil {
+		return cfg, err
+	}
+	cfg.MergeRules = rules
 	return cfg, nil
 }
 
+// configFromEnv reads the environment without checking that anything
+// required is set.
+func configFromEnv() Config {
+	return Config{
+		DatabaseURL:          os.Getenv("DATABASE_URL"),
+		BrandfetchAPIKey:     os.Getenv("BRANDFETCH_API_KEY"),
+		BrandfetchClientID:   os.Getenv("BRANDFETCH_CLIENT_ID"),
+		TransactionsFilePath: getenvDefault("TRANSACTIONS_FILE", "transactions.txt"),
+		CountryTLDPreference: getenvDefault("COUNTRY_TLD_PREFERENCE", ".au"),
+		Workers:              getenvInt("BRANDFETCH_WORKERS", 4),
+		RatePerSecond:        getenvFloat("BRANDFETCH_RATE_PER_SECOND", 2),
+		MaxRetries:           getenvInt("BRANDFETCH_MAX_RETRIES", 4),
+		Timeout:              time.Duration(getenvInt("BRANDFETCH_TIMEOUT", 12)) * time.Second,
+		LeaseDuration:        time.Duration(getenvInt("QUEUE_LEASE_SECONDS", 300)) * time.Second,
+		MaxAttempts:          getenvInt("QUEUE_MAX_ATTEMPTS", 5),
+		ReviewThreshold:      getenvFloat("REVIEW_CONFIDENCE_THRESHOLD", 60),
+	}
+}
+
 func getenvDefault(key, def string) string {
 	if v := os.Getenv(key); v != "" {
 		return v
 	}
 	return def
 }
+
+func getenvInt(key string, def int) int {
+	if v, err := strconv.Atoi(os.Getenv(key)); err == nil {
+		return v
+	}
+	return def
+}
+
+func getenvFloat(key string, def float64) float64 {
+	if v, err := strconv.ParseFloat(os.Getenv(key), 64); err == nil {
+		return v
+	}
+	return def
+}
+
+func getenvDuration(key string, def time.Duration) time.Duration {
+	if v, err := time.ParseDuration(os.Getenv(key)); err == nil {
+		return v
+	}
+	return def
+}
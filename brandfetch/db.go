@@ -2,14 +2,29 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"strings"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
+
+	"merchantcache/abn/abr"
+	"merchantcache/descriptor"
+	"merchantcache/provenance"
 )
 
 type RawTransaction struct {
-	ID          string
-	Description string
+	ID            string
+	Description   string
+	LocationState string
+	Attempts      int
+}
+
+// dbtx is what the row helpers need from the database. *pgxpool.Pool and
+// pgx.Tx both satisfy it, so writeRow can run them in one transaction.
+type dbtx interface {
+	provenance.DB
+	Begin(ctx context.Context) (pgx.Tx, error)
 }
 
 type EnrichedRow struct {
@@ -19,16 +34,41 @@ type EnrichedRow struct {
 	Logo             string
 	ConfidenceScore  float64
 	BrandfetchID     string
+	ABN              abr.ABN
+	ACN              abr.ACN
 	FullResponse     []byte
 }
 
+// connectDB opens a pool using the simple protocol, which Supabase's
+// connection pooler requires.
+func connectDB(ctx context.Context, dbURL string) (*pgxpool.Pool, error) {
+	pgxCfg, err := pgxpool.ParseConfig(dbURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse db config: %w", err)
+	}
+	pgxCfg.ConnConfig.DefaultQueryExecMode = pgx.QueryExecModeSimpleProtocol
+	pool, err := pgxpool.NewWithConfig(ctx, pgxCfg)
+	if err != nil {
+		return nil, fmt.Errorf("connect db: %w", err)
+	}
+	return pool, nil
+}
+
+// seedRawTransactions stores each raw description with its normalised
+// merchant key and location hints. Existing rows keep their queue state
+// but pick up the key from the current rule set.
 func seedRawTransactions(ctx context.Context, pool *pgxpool.Pool, lines []string) error {
 	for _, line := range lines {
+		d := descriptor.Normalise(line)
 		_, err := pool.Exec(ctx, `
-			insert into raw_transactions (description)
-			values ($1)
-			on conflict (description) do nothing
-		`, line)
+			insert into raw_transactions (description, merchant_key, location_city, location_state, location_country)
+			values ($1, $2, $3, $4, $5)
+			on conflict (description) do update set
+				merchant_key = excluded.merchant_key,
+				location_city = excluded.location_city,
+				location_state = excluded.location_state,
+				location_country = excluded.location_country
+		`, line, nullIfEmpty(d.Key), nullIfEmpty(d.City), nullIfEmpty(d.State), nullIfEmpty(d.Country))
 		if err != nil {
 			return err
 		}
@@ -36,31 +76,8 @@ func seedRawTransactions(ctx context.Context, pool *pgxpool.Pool, lines []string
 	return nil
 }
 
-func fetchPending(ctx context.Context, pool *pgxpool.Pool, lines []string) ([]RawTransaction, error) {
-	rows, err := pool.Query(ctx, `
-		select id, description
-		from raw_transactions
-		where processed = false
-		  and description = any($1)
-	`, lines)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var out []RawTransaction
-	for rows.Next() {
-		var r RawTransaction
-		if err := rows.Scan(&r.ID, &r.Description); err != nil {
-			return nil, err
-		}
-		out = append(out, r)
-	}
-	return out, rows.Err()
-}
-
-func upsertEnriched(ctx context.Context, pool *pgxpool.Pool, r EnrichedRow) error {
-	_, err := pool.Exec(ctx, `
+func upsertEnriched(ctx context.Context, db dbtx, r EnrichedRow) error {
+	_, err := db.Exec(ctx, `
 		insert into enriched_merchants (
 			transaction_cache,
 			brand_name,
@@ -68,32 +85,100 @@ func upsertEnriched(ctx context.Context, pool *pgxpool.Pool, r EnrichedRow) erro
 			logo,
 			confidence_score,
 			brandfetch_id,
+			abn_head_office,
+			acn_head_office,
 			full_response
 		)
-		values ($1, $2, $3, $4, $5, $6, $7)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9)
 		on conflict (transaction_cache) do update set
 			brand_name = excluded.brand_name,
 			website_url = excluded.website_url,
 			logo = excluded.logo,
 			confidence_score = excluded.confidence_score,
 			brandfetch_id = excluded.brandfetch_id,
+			abn_head_office = coalesce(excluded.abn_head_office, enriched_merchants.abn_head_office),
+			acn_head_office = coalesce(excluded.acn_head_office, enriched_merchants.acn_head_office),
 			full_response = excluded.full_response
-	`, r.TransactionCache, nullIfEmpty(r.BrandName), nullIfEmpty(r.WebsiteURL), nullIfEmpty(r.Logo), r.ConfidenceScore, nullIfEmpty(r.BrandfetchID), r.FullResponse)
+	`, r.TransactionCache, nullIfEmpty(r.BrandName), nullIfEmpty(r.WebsiteURL), nullIfEmpty(r.Logo), r.ConfidenceScore, nullIfEmpty(r.BrandfetchID), nullIfInvalidABN(r.ABN), nullIfInvalidACN(r.ACN), r.FullResponse)
 	return err
 }
 
-func cleanupNulls(ctx context.Context, pool *pgxpool.Pool) error {
-	_, err := pool.Exec(ctx, `
-		delete from enriched_merchants
-		where brand_name is null
-		   or website_url is null
-	`)
+// updateABRFields writes the entity lookups' findings for one row and
+// marks it checked, so only call it once a lookup has completed. Fields
+// the lookups could not find keep whatever the row already had.
+func updateABRFields(ctx context.Context, db dbtx, transactionCache string, f abrFields) error {
+	_, err := db.Exec(ctx, `
+		update enriched_merchants set
+			legal_name = coalesce($2, legal_name),
+			legal_name_confidence = case when $2::text is null then legal_name_confidence else $3 end,
+			abn_head_office = coalesce($4, abn_head_office),
+			abn_confidence = case when $4::text is null then abn_confidence else $5 end,
+			acn_head_office = coalesce($6, acn_head_office),
+			acn_confidence = case when $6::text is null then acn_confidence else $7 end,
+			head_office_address = coalesce($8, head_office_address),
+			head_office_confidence = case when $8::text is null then head_office_confidence else $9 end,
+			abr_checked_at = now()
+		where transaction_cache = $1
+	`, transactionCache,
+		nullIfEmpty(f.LegalName), f.LegalNameConfidence,
+		nullIfInvalidABN(f.ABN), f.ABNConfidence,
+		nullIfInvalidACN(f.ACN), f.ACNConfidence,
+		nullIfEmpty(f.HeadOffice), f.HeadOfficeConfidence)
 	return err
 }
 
+// saveABRFields writes the entity lookups' findings and their provenance.
+func saveABRFields(ctx context.Context, db dbtx, transactionCache string, f abrFields) error {
+	if err := updateABRFields(ctx, db, transactionCache, f); err != nil {
+		return err
+	}
+	return provenance.Save(ctx, db, transactionCache, f.Provenance)
+}
+
+// fetchABRBacklog returns matched rows the entity lookups have not seen yet.
+func fetchABRBacklog(ctx context.Context, pool *pgxpool.Pool) ([]abrJob, error) {
+	rows, err := pool.Query(ctx, `
+		select e.transaction_cache, e.brand_name, coalesce(e.website_url, ''), coalesce(r.location_state, '')
+		from enriched_merchants e
+		left join raw_transactions r on r.description = e.transaction_cache
+		where e.brand_name is not null
+		  and e.abr_checked_at is null
+		order by e.created_at
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []abrJob
+	for rows.Next() {
+		var j abrJob
+		if err := rows.Scan(&j.TransactionCache, &j.BrandName, &j.Website, &j.State); err != nil {
+			return nil, err
+		}
+		out = append(out, j)
+	}
+	return out, rows.Err()
+}
+
 func nullIfEmpty(s string) any {
 	if strings.TrimSpace(s) == "" {
 		return nil
 	}
 	return s
 }
+
+// nullIfInvalidABN keeps identifiers that fail their checksum out of the table.
+func nullIfInvalidABN(a abr.ABN) any {
+	if !a.Valid() {
+		return nil
+	}
+	return a.String()
+}
+
+func nullIfInvalidACN(a abr.ACN) any {
+	if !a.Valid() {
+		return nil
+	}
+	return a.String()
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+
+	"merchantcache/provenance"
+)
+
+func TestUpsertEnrichedKeepsABN(t *testing.T) {
+	pool := testPool(t)
+	ctx := context.Background()
+
+	row := EnrichedRow{TransactionCache: "WOOLWORTHS 1234", BrandName: "Woolworths", ABN: "88000014675", ACN: "000014675", FullResponse: []byte(`null`)}
+	if err := upsertEnriched(ctx, pool, row); err != nil {
+		t.Fatal(err)
+	}
+	// A later lookup that found no ABN leaves the earlier one in place
+	row.ABN, row.ACN = "", ""
+	if err := upsertEnriched(ctx, pool, row); err != nil {
+		t.Fatal(err)
+	}
+	var abn, acn string
+	if err := pool.QueryRow(ctx, `select abn_head_office, acn_head_office from enriched_merchants`).Scan(&abn, &acn); err != nil {
+		t.Fatal(err)
+	}
+	if abn != "88000014675" || acn != "000014675" {
+		t.Errorf("abn, acn = %q, %q", abn, acn)
+	}
+}
+
+func TestABRBacklog(t *testing.T) {
+	pool := testPool(t)
+	ctx := context.Background()
+
+	for _, row := range []EnrichedRow{
+		{TransactionCache: "WOOLWORTHS 1234", BrandName: "Woolworths", FullResponse: []byte(`null`)},
+		{TransactionCache: "COLES 55", BrandName: "Coles", FullResponse: []byte(`null`)},
+		{TransactionCache: "EFTPOS 99", FullResponse: []byte(`null`)},
+	} {
+		if err := upsertEnriched(ctx, pool, row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	backlog := func() []string {
+		t.Helper()
+		jobs, err := fetchABRBacklog(ctx, pool)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out []string
+		for _, j := range jobs {
+			out = append(out, j.TransactionCache)
+		}
+		return out
+	}
+	if got := backlog(); len(got) != 2 {
+		t.Fatalf("backlog = %v, want the two matched rows", got)
+	}
+
+	// A completed lookup takes the row out of the backlog, even a miss;
+	// the row whose lookup failed was never written and stays
+	if err := updateABRFields(ctx, pool, "WOOLWORTHS 1234", abrFields{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := backlog(); len(got) != 1 || got[0] != "COLES 55" {
+		t.Errorf("backlog = %v, want [COLES 55]", got)
+	}
+}
+
+func TestSaveProvenanceDropsOmittedFields(t *testing.T) {
+	pool := testPool(t)
+	ctx := context.Background()
+	const desc = "WOOLWORTHS 1234"
+
+	save := func(records ...provenance.Record) {
+		t.Helper()
+		if err := provenance.Save(ctx, pool, desc, records); err != nil {
+			t.Fatal(err)
+		}
+	}
+	save(
+		provenance.New(provenance.BrandName, "Woolworths", provenance.SourceBrandfetch, 90, nil),
+		provenance.New(provenance.Logo, "https://cdn.example/w.png", provenance.SourceBrandfetch, 90, nil),
+		provenance.New(provenance.ABN, "88000014675", provenance.SourceABR, 95, nil),
+	)
+	// Brandfetch no longer has a logo; the ABR's record is not its to drop
+	save(provenance.New(provenance.BrandName, "Woolworths", provenance.SourceBrandfetch, 92, nil))
+
+	records, err := provenance.Load(ctx, pool, desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, r := range records {
+		got = append(got, string(r.Source)+"/"+string(r.Field))
+	}
+	sort.Strings(got)
+	if strings.Join(got, ",") != "abr/abn,brandfetch/brand_name" {
+		t.Errorf("stored %v", got)
+	}
+}
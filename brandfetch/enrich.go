@@ -3,76 +3,271 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"sync"
 	"time"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
+
+	"merchantcache/descriptor"
+	"merchantcache/provenance"
+	"merchantcache/provider"
+	"merchantcache/ratelimit"
 )
 
-func enrich(ctx context.Context, pool *pgxpool.Pool, rows []RawTransaction, cfg Config) (int, int, error) {
-	client := &http.Client{Timeout: 12 * time.Second}
-	matches, misses := 0, 0
+// enrichStats counts how each claimed row ended. Retried rows hit a
+// transient Brandfetch failure and went back to the queue; Failed rows used
+// their last attempt and were dead-lettered.
+type enrichStats struct {
+	Matches int
+	Misses  int
+	Retried int
+	Failed  int
+}
 
-	for _, tx := range rows {
-		desc := tx.Description
-		fmt.Printf("Processing: %s\n", desc)
+// enrich drains the queue with cfg.Workers workers sharing one set of
+// providers, stopping once nothing is due. Matched brands also go through
+// the entity chain when it has providers. A database error stops the run;
+// provider errors only affect the row they happened on.
+func enrich(ctx context.Context, pool *pgxpool.Pool, q *queue, ps *providerSet, cfg Config) (enrichStats, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-		searchHit, err := searchBrand(ctx, client, desc, cfg)
-		if err != nil {
-			fmt.Printf("  search error: %v\n", err)
-		}
+	workers := cfg.Workers
+	if workers < 1 {
+		workers = 1
+	}
 
-		var domain string
-		if searchHit != nil {
-			domain = searchHit.Domain
+	var (
+		mu       sync.Mutex
+		stats    enrichStats
+		firstErr error
+	)
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if firstErr == nil {
+			firstErr = err
+			cancel()
 		}
+	}
+	count := func(field *int) {
+		mu.Lock()
+		defer mu.Unlock()
+		*field++
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				tx, ok, err := q.claim(ctx)
+				if err != nil {
+					if ctx.Err() == nil {
+						fail(fmt.Errorf("claim: %w", err))
+					}
+					return
+				}
+				if !ok {
+					return
+				}
 
-		var profile *BrandProfile
-		if domain != "" {
-			p, err := fetchBrandProfile(ctx, client, domain, cfg)
-			if err != nil {
-				fmt.Printf("  profile error: %v\n", err)
+				stop := q.keepLease(ctx, tx)
+				matched, err := enrichOne(ctx, pool, ps, tx, cfg)
+				stop()
+				switch {
+				case err == nil:
+					if err := q.complete(ctx, tx); errors.Is(err, errLeaseLost) {
+						fmt.Printf("%s: %v before it finished\n", tx.Description, err)
+						continue
+					} else if err != nil {
+						fail(fmt.Errorf("complete %s: %w", tx.Description, err))
+						return
+					}
+					if matched {
+						count(&stats.Matches)
+					} else {
+						count(&stats.Misses)
+					}
+				case ctx.Err() != nil:
+					// Stopped mid-row; hand it back without spending an attempt
+					releaseCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+					if err := q.release(releaseCtx, tx); err != nil {
+						fmt.Printf("%s: release failed: %v\n", tx.Description, err)
+					}
+					cancel()
+					return
+				case isTransient(err):
+					dead, qerr := q.retry(ctx, tx, err)
+					if errors.Is(qerr, errLeaseLost) {
+						fmt.Printf("%s: %v before it failed (%v)\n", tx.Description, qerr, err)
+						continue
+					}
+					if qerr != nil {
+						fail(fmt.Errorf("retry %s: %w", tx.Description, qerr))
+						return
+					}
+					if dead {
+						fmt.Printf("%s: dead-lettered after %d attempts (%v)\n", tx.Description, tx.Attempts, err)
+						count(&stats.Failed)
+					} else {
+						fmt.Printf("%s: attempt %d failed, retrying later (%v)\n", tx.Description, tx.Attempts, err)
+						count(&stats.Retried)
+					}
+				default:
+					fail(err)
+					return
+				}
 			}
-			profile = p
-		}
+		}()
+	}
+	wg.Wait()
+
+	return stats, firstErr
+}
 
-		if searchHit != nil || profile != nil {
-			choice := pickProfile(profile, searchHit)
-			domain = choice.Domain
-			fullResp := rawJSON(profile, searchHit)
+// enrichOne looks up a single claimed row and writes the result, reporting
+// whether a brand provider matched it. Transient provider failures are
+// returned as a transientError so the row can be retried; any other error
+// is from the database.
+func enrichOne(ctx context.Context, pool *pgxpool.Pool, ps *providerSet, tx RawTransaction, cfg Config) (bool, error) {
+	r, err := resolveRow(ctx, ps, tx)
+	if err != nil {
+		return false, err
+	}
+	queued, err := writeRow(ctx, pool, r, cfg)
+	if err != nil {
+		return r.Matched, err
+	}
 
-			if err := upsertEnriched(ctx, pool, EnrichedRow{
-				TransactionCache: desc,
-				BrandName:        choice.Name,
-				WebsiteURL:       domainToURL(domain),
-				Logo:             logoURL(domain, cfg.BrandfetchClientID),
-				ConfidenceScore:  choice.QualityScore,
-				BrandfetchID:     choice.ID,
-				FullResponse:     fullResp,
-			}); err != nil {
-				return matches, misses, err
-			}
-			matches++
-		} else {
-			if err := upsertEnriched(ctx, pool, EnrichedRow{
+	if !r.Matched {
+		fmt.Printf("%s: no match\n", tx.Description)
+		return false, nil
+	}
+	fmt.Printf("%s -> %s (%s)\n", tx.Description, r.Row.BrandName, r.Domain)
+	if r.ABR != nil && !r.ABR.ABN.IsZero() {
+		fmt.Printf("  ABN %s (%s, %.0f%%)\n", r.ABR.ABN.Format(), r.ABR.LegalName, r.ABR.ABNConfidence)
+	}
+	if queued {
+		fmt.Println("  queued for review (low confidence)")
+	}
+	return true, nil
+}
+
+// rowResult is everything looked up for one descriptor, before any of it
+// is written.
+type rowResult struct {
+	Row        EnrichedRow
+	Domain     string
+	Matched    bool
+	Provenance []provenance.Record
+	ABR        *abrFields // nil when the entity chain is empty, no brand matched or the lookup failed
+}
+
+// resolveRow asks the brand chain about the descriptor, and the entity
+// chain about the brand it found, without touching the database.
+func resolveRow(ctx context.Context, ps *providerSet, tx RawTransaction) (rowResult, error) {
+	desc := tx.Description
+	d := descriptor.Normalise(desc)
+	q := provider.Query{Descriptor: desc, Names: d.Parts, State: tx.LocationState}
+
+	brand, ok, err := ps.brand.Best(ctx, q)
+	if err != nil {
+		if abortRow(ctx, err) {
+			return rowResult{}, err
+		}
+		fmt.Printf("%s: lookup error: %v\n", desc, err)
+	}
+	var r rowResult
+	if ok {
+		r = brandRow(desc, brand)
+	}
+	if !r.Matched {
+		return rowResult{
+			Row: EnrichedRow{
 				TransactionCache: desc,
 				ConfidenceScore:  0,
 				FullResponse:     json.RawMessage(`null`),
-			}); err != nil {
-				return matches, misses, err
+			},
+		}, nil
+	}
+
+	if !ps.entity.Empty() {
+		q.Brand = r.Row.BrandName
+		q.Website = r.Row.WebsiteURL
+		q.ABN = brand.Value(provenance.ABN)
+		f, err := lookupEntity(ctx, ps, q)
+		if err != nil {
+			if abortRow(ctx, err) {
+				return rowResult{}, err
 			}
-			misses++
+			// Left unchecked so abr-backfill tries the row again
+			fmt.Printf("%s: entity lookup error: %v\n", desc, err)
+			return r, nil
 		}
+		r.ABR = &f
+	}
+	return r, nil
+}
 
-		if _, err := pool.Exec(ctx, `
-			update raw_transactions
-			set processed = true
-			where id = $1
-		`, tx.ID); err != nil {
-			return matches, misses, err
+// writeRow stores a resolved row: the enriched columns, provenance and ABR
+// fields, then settles overrides, the golden record and the review queue.
+// It all happens in one transaction, so a failure part way leaves the row
+// as it was.
+func writeRow(ctx context.Context, pool *pgxpool.Pool, r rowResult, cfg Config) (queued bool, err error) {
+	desc := r.Row.TransactionCache
+	err = pgx.BeginFunc(ctx, pool, func(tx pgx.Tx) error {
+		if err := upsertEnriched(ctx, tx, r.Row); err != nil {
+			return err
+		}
+		if err := provenance.Save(ctx, tx, desc, r.Provenance); err != nil {
+			return err
 		}
+		if r.ABR != nil {
+			if err := saveABRFields(ctx, tx, desc, *r.ABR); err != nil {
+				return err
+			}
+		}
+		queued, err = settleRow(ctx, tx, cfg, desc)
+		return err
+	})
+	return queued, err
+}
+
+// abortRow reports whether a lookup error should stop work on the row
+// rather than count as a miss.
+func abortRow(ctx context.Context, err error) bool {
+	return ctx.Err() != nil || isTransient(err) || errors.Is(err, ratelimit.ErrBudgetSpent)
+}
+
+// searchDescriptor searches Brandfetch for each merchant a descriptor names,
+// in order, and returns the first hit. The raw text is only searched when
+// normalising left nothing behind. A transient error is only returned when
+// no part produced a hit.
+func searchDescriptor(ctx context.Context, client *http.Client, d descriptor.Descriptor, cfg Config) (*SearchHit, error) {
+	queries := d.Parts
+	if len(queries) == 0 {
+		queries = []string{d.Raw}
 	}
 
-	return matches, misses, nil
+	var lastErr error
+	for _, q := range queries {
+		hit, err := searchBrand(ctx, client, q, cfg)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			lastErr = err
+			continue
+		}
+		if hit != nil {
+			return hit, nil
+		}
+	}
+	return nil, lastErr
 }
@@ -1,10 +1,11 @@
-module merchantcache
+module merchantcache/brandfetch
 
 go 1.22
 
 require (
 	github.com/jackc/pgx/v5 v5.5.4
 	github.com/joho/godotenv v1.5.1
+	merchantcache v0.0.0
 )
 
 require (
@@ -15,3 +16,6 @@ require (
 	golang.org/x/sync v0.1.0 // indirect
 	golang.org/x/text v0.14.0 // indirect
 )
+
+// The ABN and Google packages live in the parent module.
+replace merchantcache => ../
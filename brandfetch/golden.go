@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"merchantcache/merge"
+	"merchantcache/provenance"
+)
+
+// loadMergeRules reads the survivorship rules from MERGE_RULES_FILE, or
+// returns the defaults when it is not set.
+func loadMergeRules() (merge.Rules, error) {
+	path := os.Getenv("MERGE_RULES_FILE")
+	if path == "" {
+		return merge.DefaultRules(), nil
+	}
+	return merge.LoadRules(path)
+}
+
+// settleRow runs once enrichment has written a row: manual overrides are
+// put back over the automated values, the golden record is rebuilt, and
+// the row is queued for review if it still needs a person.
+func settleRow(ctx context.Context, db dbtx, cfg Config, transactionCache string) (queued bool, err error) {
+	overrides, err := loadOverrides(ctx, db, transactionCache)
+	if err != nil {
+		return false, err
+	}
+	if err := applyOverrides(ctx, db, transactionCache, overrides); err != nil {
+		return false, err
+	}
+	g, err := mergeWith(ctx, db, cfg.MergeRules, transactionCache, overrides)
+	if err != nil {
+		return false, err
+	}
+	return triage(ctx, db, g, cfg.ReviewThreshold)
+}
+
+// mergeGolden rebuilds the golden record for one row from every provider's
+// stored values and its manual overrides.
+func mergeGolden(ctx context.Context, db dbtx, rules merge.Rules, transactionCache string) (merge.Golden, error) {
+	overrides, err := loadOverrides(ctx, db, transactionCache)
+	if err != nil {
+		return merge.Golden{}, err
+	}
+	return mergeWith(ctx, db, rules, transactionCache, overrides)
+}
+
+// mergeWith saves the merged golden record and, when the merchant now
+// reads differently, a new merchant_history version.
+func mergeWith(ctx context.Context, db dbtx, rules merge.Rules, transactionCache string, overrides []provenance.Record) (merge.Golden, error) {
+	records, err := provenance.Load(ctx, db, transactionCache)
+	if err != nil {
+		return merge.Golden{}, err
+	}
+	g := rules.Merge(transactionCache, append(records, overrides...))
+	if err := saveGolden(ctx, db, g); err != nil {
+		return merge.Golden{}, fmt.Errorf("save golden record for %s: %w", transactionCache, err)
+	}
+	if err := recordHistory(ctx, db, transactionCache); err != nil {
+		return merge.Golden{}, err
+	}
+	return g, nil
+}
+
+func saveGolden(ctx context.Context, db dbtx, g merge.Golden) error {
+	fields, err := json.Marshal(g.Fields)
+	if err != nil {
+		return err
+	}
+	losers, err := json.Marshal(g.Losers)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(ctx, `
+		insert into golden_merchants (
+			transaction_cache,
+			brand_name,
+			legal_name,
+			abn,
+			acn,
+			head_office_address,
+			logo,
+			website_url,
+			category,
+			fields,
+			losers,
+			merged_at
+		)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10::jsonb, $11::jsonb, now())
+		on conflict (transaction_cache) do update set
+			brand_name = excluded.brand_name,
+			legal_name = excluded.legal_name,
+			abn = excluded.abn,
+			acn = excluded.acn,
+			head_office_address = excluded.head_office_address,
+			logo = excluded.logo,
+			website_url = excluded.website_url,
+			category = excluded.category,
+			fields = excluded.fields,
+			losers = excluded.losers,
+			merged_at = excluded.merged_at
+	`, g.Key,
+		nullIfEmpty(g.Value(provenance.BrandName)),
+		nullIfEmpty(g.Value(provenance.LegalName)),
+		nullIfEmpty(g.Value(provenance.ABN)),
+		nullIfEmpty(g.Value(provenance.ACN)),
+		nullIfEmpty(g.Value(provenance.HeadOffice)),
+		nullIfEmpty(g.Value(provenance.Logo)),
+		nullIfEmpty(g.Value(provenance.Website)),
+		nullIfEmpty(g.Value(provenance.Category)),
+		string(fields), string(losers))
+	return err
+}
+
+// runMerge handles `brandfetch merge`, rebuilding every golden record, for
+// example after the survivorship rules change.
+func runMerge(ctx context.Context, pool *pgxpool.Pool) error {
+	rules, err := loadMergeRules()
+	if err != nil {
+		return err
+	}
+
+	rows, err := pool.Query(ctx, `
+		select transaction_cache from field_provenance
+		union
+		select transaction_cache from manual_overrides
+		order by 1
+	`)
+	if err != nil {
+		return err
+	}
+	var keys []string
+	for rows.Next() {
+		var k string
+		if err := rows.Scan(&k); err != nil {
+			rows.Close()
+			return err
+		}
+		keys = append(keys, k)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	withLosers := 0
+	for _, k := range keys {
+		g, err := mergeGolden(ctx, pool, rules, k)
+		if err != nil {
+			return err
+		}
+		if len(g.Losers) > 0 {
+			withLosers++
+		}
+	}
+	fmt.Printf("Merged %d golden records (%d kept losing candidates)\n", len(keys), withLosers)
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"merchantcache/merge"
+	"merchantcache/provenance"
+)
+
+func TestLoadMergeRules(t *testing.T) {
+	t.Setenv("MERGE_RULES_FILE", "")
+	rules, err := loadMergeRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rules.Rule(provenance.BrandName); got.Strategy != merge.Priority || got.Priority[0] != provenance.SourceBrandfetch {
+		t.Errorf("brand rule without a file = %+v, want the default", got)
+	}
+
+	path := filepath.Join(t.TempDir(), "rules.json")
+	if err := os.WriteFile(path, []byte(`{"fields": {"brand_name": {"strategy": "most_recent"}}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("MERGE_RULES_FILE", path)
+	rules, err = loadMergeRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rules.Rule(provenance.BrandName).Strategy; got != merge.MostRecent {
+		t.Errorf("brand strategy = %q, want it read from MERGE_RULES_FILE", got)
+	}
+
+	t.Setenv("MERGE_RULES_FILE", filepath.Join(t.TempDir(), "missing.json"))
+	if _, err := loadMergeRules(); err == nil {
+		t.Error("loaded rules from a missing file")
+	}
+}
+
+func TestMergeGolden(t *testing.T) {
+	pool := testPool(t)
+	ctx := context.Background()
+	const desc = "COLES 0455 SYDNEY"
+
+	if err := upsertEnriched(ctx, pool, EnrichedRow{TransactionCache: desc, BrandName: "Coles", FullResponse: []byte(`null`)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := provenance.Save(ctx, pool, desc, []provenance.Record{
+		provenance.New(provenance.BrandName, "Coles", provenance.SourceBrandfetch, 70, nil),
+		provenance.New(provenance.BrandName, "Coles Supermarkets", provenance.SourceGoogle, 90, nil),
+		provenance.New(provenance.Website, "https://coles.com.au", provenance.SourceBrandfetch, 70, nil),
+		provenance.New(provenance.LegalName, "COLES SUPERMARKETS AUSTRALIA PTY LTD", provenance.SourceABR, 99, nil),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// Blanked by hand, which beats the Brandfetch website
+	if _, err := pool.Exec(ctx, `insert into manual_overrides (transaction_cache, field, value) values ($1, 'website_url', '')`, desc); err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := mergeGolden(ctx, pool, merge.DefaultRules(), desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(g.Losers[provenance.BrandName]); n != 1 {
+		t.Errorf("%d brand losers, want the google candidate", n)
+	}
+
+	var brand, legal string
+	var website *string
+	err = pool.QueryRow(ctx, `select brand_name, legal_name, website_url from golden_merchants where transaction_cache = $1`, desc).
+		Scan(&brand, &legal, &website)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if brand != "Coles" || legal != "COLES SUPERMARKETS AUSTRALIA PTY LTD" || website != nil {
+		t.Errorf("golden = %q, %q, %v", brand, legal, website)
+	}
+
+	// Merging again with nothing new keeps a single history version
+	if _, err := mergeGolden(ctx, pool, merge.DefaultRules(), desc); err != nil {
+		t.Fatal(err)
+	}
+	var versions int
+	if err := pool.QueryRow(ctx, `select count(*) from merchant_history where transaction_cache = $1`, desc).Scan(&versions); err != nil {
+		t.Fatal(err)
+	}
+	if versions != 1 {
+		t.Errorf("%d history versions, want 1", versions)
+	}
+}
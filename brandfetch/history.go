@@ -0,0 +1,398 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"merchantcache/descriptor"
+	"merchantcache/provenance"
+)
+
+// merchantVersion is one row of merchant_history: a merchant as it was
+// served from ValidFrom until ValidTo, or until now when ValidTo is nil.
+type merchantVersion struct {
+	Version int `json:"version"`
+	merchantView
+	ConfidenceScore float64         `json:"confidence_score,omitempty"`
+	BrandfetchID    string          `json:"brandfetch_id,omitempty"`
+	Provenance      json.RawMessage `json:"provenance,omitempty"`
+	ValidFrom       time.Time       `json:"valid_from"`
+	ValidTo         *time.Time      `json:"valid_to,omitempty"`
+}
+
+// servedColumns selects what lookups serve for row $1, named as the
+// merchant_history columns. Golden values win over the raw columns.
+const servedColumns = `
+	select
+		e.transaction_cache,
+		coalesce(g.brand_name, e.brand_name) as brand_name,
+		coalesce(g.legal_name, e.legal_name) as legal_name,
+		coalesce(g.abn, e.abn_head_office) as abn,
+		coalesce(g.acn, e.acn_head_office) as acn,
+		coalesce(g.head_office_address, e.head_office_address) as head_office_address,
+		coalesce(g.logo, e.logo) as logo,
+		coalesce(g.website_url, e.website_url) as website_url,
+		g.category,
+		e.confidence_score,
+		e.brandfetch_id,
+		e.full_response,
+		g.fields as provenance
+	from enriched_merchants e
+	left join golden_merchants g on g.transaction_cache = e.transaction_cache
+	where e.transaction_cache = $1
+`
+
+// recordHistory closes a row's open merchant_history version and opens a
+// new one when what it serves has changed. Both versions share the same
+// timestamp, so there is no gap or overlap between them.
+func recordHistory(ctx context.Context, db dbtx, transactionCache string) error {
+	err := pgx.BeginFunc(ctx, db, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, `
+			with cur as (`+servedColumns+`)
+			update merchant_history h set valid_to = now()
+			from cur
+			where h.transaction_cache = cur.transaction_cache
+			  and h.valid_to is null
+			  and (h.brand_name, h.legal_name, h.abn, h.acn, h.head_office_address,
+			       h.logo, h.website_url, h.category, h.brandfetch_id, h.full_response)
+			      is distinct from
+			      (cur.brand_name, cur.legal_name, cur.abn, cur.acn, cur.head_office_address,
+			       cur.logo, cur.website_url, cur.category, cur.brandfetch_id, cur.full_response)
+		`, transactionCache)
+		if err != nil {
+			return err
+		}
+		// A concurrent writer may have opened the same version first
+		_, err = tx.Exec(ctx, `
+			with cur as (`+servedColumns+`)
+			insert into merchant_history (
+				transaction_cache, version, brand_name, legal_name, abn, acn, head_office_address,
+				logo, website_url, category, confidence_score, brandfetch_id, full_response, provenance, valid_from
+			)
+			select
+				c.transaction_cache,
+				coalesce((select max(version) from merchant_history where transaction_cache = $1), 0) + 1,
+				c.brand_name, c.legal_name, c.abn, c.acn, c.head_office_address,
+				c.logo, c.website_url, c.category, c.confidence_score, c.brandfetch_id, c.full_response, c.provenance,
+				now()
+			from cur c
+			where not exists (select 1 from merchant_history where transaction_cache = $1 and valid_to is null)
+			on conflict do nothing
+		`, transactionCache)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("record history for %s: %w", transactionCache, err)
+	}
+	return nil
+}
+
+const versionColumns = `
+	version,
+	transaction_cache,
+	coalesce(brand_name, ''),
+	coalesce(legal_name, ''),
+	coalesce(abn, ''),
+	coalesce(acn, ''),
+	coalesce(website_url, ''),
+	coalesce(logo, ''),
+	coalesce(category, ''),
+	coalesce(head_office_address, ''),
+	coalesce(confidence_score, 0),
+	coalesce(brandfetch_id, ''),
+	coalesce(provenance::text, ''),
+	valid_from,
+	valid_to
+`
+
+func scanVersion(row pgx.Row) (merchantVersion, error) {
+	var (
+		v    merchantVersion
+		prov string
+	)
+	err := row.Scan(&v.Version, &v.Descriptor, &v.BrandName, &v.LegalName, &v.ABN, &v.ACN, &v.Website, &v.Logo,
+		&v.Category, &v.HeadOffice, &v.ConfidenceScore, &v.BrandfetchID, &prov, &v.ValidFrom, &v.ValidTo)
+	if prov != "" {
+		v.Provenance = json.RawMessage(prov)
+	}
+	v.Source = "history"
+	return v, err
+}
+
+// historyKey finds whose history a descriptor refers to: its own row if
+// it has one, otherwise the latest row normalised to the same merchant key.
+func historyKey(ctx context.Context, pool *pgxpool.Pool, raw string) (string, error) {
+	var tc string
+	err := pool.QueryRow(ctx, `select transaction_cache from merchant_history where transaction_cache = $1 limit 1`, raw).Scan(&tc)
+	if err == nil || !errors.Is(err, pgx.ErrNoRows) {
+		return tc, err
+	}
+
+	key := descriptor.Normalise(raw).Key
+	if key == "" {
+		return "", errNotCached
+	}
+	err = pool.QueryRow(ctx, `
+		select h.transaction_cache
+		from raw_transactions r
+		join merchant_history h on h.transaction_cache = r.description
+		where r.merchant_key = $1
+		order by h.valid_from desc
+		limit 1
+	`, key).Scan(&tc)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", errNotCached
+	}
+	return tc, err
+}
+
+// merchantHistory returns every version of a row, oldest first.
+func merchantHistory(ctx context.Context, pool *pgxpool.Pool, transactionCache string) ([]merchantVersion, error) {
+	rows, err := pool.Query(ctx, `
+		select `+versionColumns+`
+		from merchant_history
+		where transaction_cache = $1
+		order by version
+	`, transactionCache)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []merchantVersion
+	for rows.Next() {
+		v, err := scanVersion(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+	return out, rows.Err()
+}
+
+// merchantAsOf returns the version of a descriptor's merchant that was
+// current at t.
+func merchantAsOf(ctx context.Context, pool *pgxpool.Pool, raw string, t time.Time) (merchantVersion, error) {
+	tc, err := historyKey(ctx, pool, raw)
+	if err != nil {
+		return merchantVersion{}, err
+	}
+	v, err := scanVersion(pool.QueryRow(ctx, `
+		select `+versionColumns+`
+		from merchant_history
+		where transaction_cache = $1
+		  and valid_from <= $2
+		  and (valid_to is null or valid_to > $2)
+	`, tc, t))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return merchantVersion{}, errNotCached
+	}
+	return v, err
+}
+
+// versionPair picks two versions of a history to compare. Zero numbers
+// default to the latest version and the one before it; version 0 is the
+// empty merchant before the first.
+func versionPair(history []merchantVersion, from, to int) (merchantVersion, merchantVersion, error) {
+	if len(history) == 0 {
+		return merchantVersion{}, merchantVersion{}, errNotCached
+	}
+	if to == 0 {
+		to = history[len(history)-1].Version
+	}
+	if from == 0 {
+		from = to - 1
+	}
+	find := func(n int) (merchantVersion, bool) {
+		if n == 0 {
+			return merchantVersion{}, true
+		}
+		for _, v := range history {
+			if v.Version == n {
+				return v, true
+			}
+		}
+		return merchantVersion{}, false
+	}
+	a, ok := find(from)
+	if !ok {
+		return merchantVersion{}, merchantVersion{}, fmt.Errorf("no version %d", from)
+	}
+	b, ok := find(to)
+	if !ok {
+		return merchantVersion{}, merchantVersion{}, fmt.Errorf("no version %d", to)
+	}
+	return a, b, nil
+}
+
+// historyFields are the fields a diff compares, in the order it lists them.
+var historyFields = []provenance.Field{
+	provenance.BrandName,
+	provenance.LegalName,
+	provenance.ABN,
+	provenance.ACN,
+	provenance.Website,
+	provenance.Logo,
+	provenance.Category,
+	provenance.HeadOffice,
+}
+
+func (m merchantView) values() map[provenance.Field]string {
+	return map[provenance.Field]string{
+		provenance.BrandName:  m.BrandName,
+		provenance.LegalName:  m.LegalName,
+		provenance.ABN:        m.ABN,
+		provenance.ACN:        m.ACN,
+		provenance.Website:    m.Website,
+		provenance.Logo:       m.Logo,
+		provenance.Category:   m.Category,
+		provenance.HeadOffice: m.HeadOffice,
+	}
+}
+
+// diffVersions lists the fields that differ between a and b, blanked
+// fields included.
+func diffVersions(a, b merchantVersion) []fieldChange {
+	old, new := a.values(), b.values()
+	var out []fieldChange
+	for _, f := range historyFields {
+		if old[f] != new[f] {
+			out = append(out, fieldChange{Field: f, Old: old[f], New: new[f]})
+		}
+	}
+	return out
+}
+
+// parseAsOf accepts an RFC 3339 time or a plain date, read as midnight UTC.
+func parseAsOf(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q, want 2006-01-02 or RFC 3339", s)
+	}
+	return t, nil
+}
+
+// runHistory handles `brandfetch history list|show|diff`.
+func runHistory(ctx context.Context, pool *pgxpool.Pool, args []string) error {
+	usage := errors.New(`usage:
+  brandfetch history list <description>
+  brandfetch history show <description> [-at 2026-01-31]
+  brandfetch history diff <description> [-from n] [-to n]`)
+	if len(args) < 2 {
+		return usage
+	}
+
+	fs := flag.NewFlagSet("history "+args[0], flag.ContinueOnError)
+	at := fs.String("at", "", "show the version current at this time (default now)")
+	from := fs.Int("from", 0, "older version (default the one before -to)")
+	to := fs.Int("to", 0, "newer version (default the latest)")
+	if err := fs.Parse(args[2:]); err != nil {
+		return err
+	}
+	raw := args[1]
+
+	switch args[0] {
+	case "list":
+		tc, err := historyKey(ctx, pool, raw)
+		if err != nil {
+			return historyErr(raw, err)
+		}
+		history, err := merchantHistory(ctx, pool, tc)
+		if err != nil {
+			return err
+		}
+		for _, v := range history {
+			fmt.Printf("v%d  %s  %s  %s\n", v.Version, v.ValidFrom.Format(time.RFC3339), validTo(v), orNone(v.BrandName))
+		}
+	case "show":
+		t := time.Now()
+		if *at != "" {
+			var err error
+			if t, err = parseAsOf(*at); err != nil {
+				return err
+			}
+		}
+		v, err := merchantAsOf(ctx, pool, raw, t)
+		if err != nil {
+			return historyErr(raw, err)
+		}
+		fmt.Printf("%s v%d (%s to %s)\n", v.Descriptor, v.Version, v.ValidFrom.Format(time.RFC3339), validTo(v))
+		if v.BrandName == "" {
+			fmt.Println("    (no match)")
+		}
+		values := v.values()
+		for _, f := range historyFields {
+			if values[f] != "" {
+				fmt.Printf("    %-20s %s\n", f, values[f])
+			}
+		}
+	case "diff":
+		tc, err := historyKey(ctx, pool, raw)
+		if err != nil {
+			return historyErr(raw, err)
+		}
+		history, err := merchantHistory(ctx, pool, tc)
+		if err != nil {
+			return err
+		}
+		a, b, err := versionPair(history, *from, *to)
+		if err != nil {
+			return historyErr(raw, err)
+		}
+		changes := diffVersions(a, b)
+		fmt.Printf("%s v%d -> v%d\n", tc, a.Version, b.Version)
+		if len(changes) == 0 {
+			fmt.Println("    no field changes")
+		}
+		for _, c := range changes {
+			fmt.Printf("    %-20s %q -> %q\n", c.Field, c.Old, c.New)
+		}
+	default:
+		return fmt.Errorf("unknown history command %q", args[0])
+	}
+	return nil
+}
+
+func historyErr(raw string, err error) error {
+	if errors.Is(err, errNotCached) {
+		return fmt.Errorf("no history for %s", raw)
+	}
+	return err
+}
+
+func validTo(v merchantVersion) string {
+	if v.ValidTo == nil {
+		return "current"
+	}
+	return v.ValidTo.Format(time.RFC3339)
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "(no match)"
+	}
+	return s
+}
+
+// versionNumber reads an optional version number from a query parameter.
+func versionNumber(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid version %q", s)
+	}
+	return n, nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"merchantcache/provenance"
+)
+
+func TestDiffVersions(t *testing.T) {
+	v1 := merchantVersion{Version: 1, merchantView: merchantView{BrandName: "Coles", Website: "https://coles.com.au", Logo: "https://cdn/c.png"}}
+	v2 := merchantVersion{Version: 2, merchantView: merchantView{BrandName: "Coles Local", Website: "https://coles.com.au", ABN: "45004189708"}}
+	tests := []struct {
+		name string
+		a, b merchantVersion
+		want []fieldChange
+	}{
+		{
+			name: "changed, added and blanked fields in historyFields order",
+			a:    v1,
+			b:    v2,
+			want: []fieldChange{
+				{Field: provenance.BrandName, Old: "Coles", New: "Coles Local"},
+				{Field: provenance.ABN, Old: "", New: "45004189708"},
+				{Field: provenance.Logo, Old: "https://cdn/c.png", New: ""},
+			},
+		},
+		{
+			name: "from the empty merchant before version 1",
+			a:    merchantVersion{},
+			b:    merchantVersion{Version: 1, merchantView: merchantView{BrandName: "Coles"}},
+			want: []fieldChange{{Field: provenance.BrandName, Old: "", New: "Coles"}},
+		},
+		{name: "no change", a: v1, b: v1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := diffVersions(tt.a, tt.b); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("diff = %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVersionPair(t *testing.T) {
+	history := []merchantVersion{{Version: 1}, {Version: 2}, {Version: 3}}
+	tests := []struct {
+		name             string
+		from, to         int
+		wantFrom, wantTo int
+		wantErr          bool
+	}{
+		{name: "latest change by default", wantFrom: 2, wantTo: 3},
+		{name: "to given", to: 2, wantFrom: 1, wantTo: 2},
+		{name: "first version against nothing", to: 1, wantFrom: 0, wantTo: 1},
+		{name: "both given", from: 1, to: 3, wantFrom: 1, wantTo: 3},
+		{name: "unknown version", from: 1, to: 9, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b, err := versionPair(history, tt.from, tt.to)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("got %d..%d, want an error", a.Version, b.Version)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if a.Version != tt.wantFrom || b.Version != tt.wantTo {
+				t.Errorf("pair = %d..%d, want %d..%d", a.Version, b.Version, tt.wantFrom, tt.wantTo)
+			}
+		})
+	}
+	if _, _, err := versionPair(nil, 0, 0); !errors.Is(err, errNotCached) {
+		t.Errorf("empty history err = %v, want errNotCached", err)
+	}
+}
+
+func TestParseAsOf(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    time.Time
+		wantErr bool
+	}{
+		{in: "2026-01-31", want: time.Date(2026, 1, 31, 0, 0, 0, 0, time.UTC)},
+		{in: "2026-01-31T09:30:00+11:00", want: time.Date(2026, 1, 30, 22, 30, 0, 0, time.UTC)},
+		{in: "31/01/2026", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseAsOf(tt.in)
+		if (err != nil) != tt.wantErr || !got.Equal(tt.want) {
+			t.Errorf("parseAsOf(%q) = %v, %v", tt.in, got, err)
+		}
+	}
+}
+
+func TestMerchantAsOf(t *testing.T) {
+	pool := testPool(t)
+	ctx := context.Background()
+	const desc = "COLES 0455 SYDNEY"
+
+	for _, brand := range []string{"Coles", "Coles Local"} {
+		if err := upsertEnriched(ctx, pool, EnrichedRow{TransactionCache: desc, BrandName: brand, FullResponse: []byte(`null`)}); err != nil {
+			t.Fatal(err)
+		}
+		if err := recordHistory(ctx, pool, desc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Pin the versions to known times: v1 for [t1, t2), v2 from t2 on
+	t1 := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	t2 := time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC)
+	if _, err := pool.Exec(ctx, `
+		update merchant_history
+		set valid_from = case version when 1 then $2::timestamptz else $3::timestamptz end,
+		    valid_to = case version when 1 then $3::timestamptz end
+		where transaction_cache = $1
+	`, desc, t1, t2); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		at      time.Time
+		want    int
+		wantErr error
+	}{
+		{name: "before the first version", at: t1.Add(-time.Second), wantErr: errNotCached},
+		{name: "at valid_from", at: t1, want: 1},
+		{name: "just before valid_to", at: t2.Add(-time.Microsecond), want: 1},
+		{name: "at valid_to", at: t2, want: 2},
+		{name: "open version", at: time.Now(), want: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := merchantAsOf(ctx, pool, desc, tt.at)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("err = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v.Version != tt.want {
+				t.Errorf("version = %d, want %d", v.Version, tt.want)
+			}
+		})
+	}
+
+	// The diff endpoint reports the brand change between the two
+	rec := httptest.NewRecorder()
+	(&server{pool: pool}).routes().ServeHTTP(rec, httptest.NewRequest("GET", "/merchants/history/diff?descriptor="+url.QueryEscape(desc), nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("diff status = %d: %s", rec.Code, rec.Body)
+	}
+	var diff struct {
+		From, To int
+		Changes  []fieldChange
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &diff); err != nil {
+		t.Fatal(err)
+	}
+	want := []fieldChange{{Field: provenance.BrandName, Old: "Coles", New: "Coles Local"}}
+	if diff.From != 1 || diff.To != 2 || !reflect.DeepEqual(diff.Changes, want) {
+		t.Errorf("diff = %+v, want 1..2 %+v", diff, want)
+	}
+}
@@ -5,11 +5,12 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 
-	"github.com/joho/godotenv"
-
-	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/joho/godotenv"
 )
 
 func main() {
@@ -18,11 +19,80 @@ func main() {
 		log.Println("Warning: .env file not found or couldn't be loaded")
 	}
 
-	ctx := context.Background()
-	cfg, err := loadConfig()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	cmd, args := "", []string(nil)
+	if len(os.Args) > 1 {
+		cmd, args = os.Args[1], os.Args[2:]
+	}
+
+	var err error
+	switch cmd {
+	case "":
+		err = runEnrich(ctx)
+	case "migrate":
+		// Only needs the database, not a current schema
+		err = withDB(ctx, false, func(ctx context.Context, pool *pgxpool.Pool) error {
+			return runMigrate(ctx, pool, args)
+		})
+	case "merge":
+		err = withDB(ctx, true, runMerge)
+	case "review":
+		err = withDB(ctx, true, func(ctx context.Context, pool *pgxpool.Pool) error {
+			return runReview(ctx, pool, args)
+		})
+	case "history":
+		err = withDB(ctx, true, func(ctx context.Context, pool *pgxpool.Pool) error {
+			return runHistory(ctx, pool, args)
+		})
+	case "serve":
+		err = withDB(ctx, true, runServe)
+	case "refresh":
+		err = withDB(ctx, true, func(ctx context.Context, pool *pgxpool.Pool) error {
+			return runRefresh(ctx, pool, args)
+		})
+	case "abn-monitor":
+		err = withDB(ctx, true, func(ctx context.Context, pool *pgxpool.Pool) error {
+			return runABNMonitor(ctx, pool, args)
+		})
+	case "abr-backfill":
+		err = withDB(ctx, true, runABRBackfill)
+	case "regress":
+		err = runRegress(ctx, args)
+	default:
+		err = fmt.Errorf("unknown command %q\n\n%s", cmd, usage)
+	}
 	if err != nil {
 		exitErr(err)
 	}
+}
+
+// usage lists the subcommands. With none, brandfetch enriches the
+// transactions file through the work queue.
+const usage = `usage: brandfetch [command] [flags]
+
+  (none)                      enrich TRANSACTIONS_FILE through the work queue
+  migrate up|down [n]|status  apply, roll back or list schema migrations
+  merge                       rebuild every golden record from stored provenance
+  review list|accept|reject|set
+                              work through the review queue
+  history list|show|diff      look at past versions of a merchant
+  serve                       answer merchant lookups over HTTP until stopped
+  refresh [-budget n] [-every d]
+                              re-check stale rows
+  abn-monitor [-budget n] [-every d]
+                              watch stored ABNs for status and name changes
+  abr-backfill                fill the ABR columns for rows matched earlier
+  regress [-record] [-update] replay recorded API responses through the
+                              lookups and compare with the snapshots`
+
+// runEnrich seeds the queue from the transactions file and drains it.
+func runEnrich(ctx context.Context) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
 
 	// Debug: Show first 50 chars of DATABASE_URL (for troubleshooting)
 	dbURLpreview := cfg.DatabaseURL
@@ -31,49 +101,119 @@ func main() {
 	}
 	fmt.Printf("DEBUG: Using DATABASE_URL: %s\n", dbURLpreview)
 
-	pgxCfg, err := pgxpool.ParseConfig(cfg.DatabaseURL)
+	pool, err := connectDB(ctx, cfg.DatabaseURL)
 	if err != nil {
-		exitErr(fmt.Errorf("parse db config: %w", err))
-	}
-	pgxCfg.ConnConfig.DefaultQueryExecMode = pgx.QueryExecModeSimpleProtocol
-	pool, err := pgxpool.NewWithConfig(ctx, pgxCfg)
-	if err != nil {
-		exitErr(fmt.Errorf("connect db: %w", err))
+		return err
 	}
 	defer pool.Close()
 
+	if err := checkSchema(ctx, pool); err != nil {
+		return err
+	}
+
 	transactions, err := loadTransactions(cfg.TransactionsFilePath)
 	if err != nil {
-		exitErr(err)
+		return err
 	}
 	if len(transactions) == 0 {
-		exitErr(errors.New("no transactions found to process"))
+		return errors.New("no transactions found to process")
 	}
 
 	if err := seedRawTransactions(ctx, pool, transactions); err != nil {
-		exitErr(fmt.Errorf("seed raw: %w", err))
+		return fmt.Errorf("seed raw: %w", err)
+	}
+
+	// Any number of enrichers can drain the queue side by side
+	q := newQueue(pool, cfg.LeaseDuration, cfg.MaxAttempts)
+	reaped, err := q.reapExpired(ctx)
+	if err != nil {
+		return fmt.Errorf("reap leases: %w", err)
+	}
+	if reaped > 0 {
+		fmt.Printf("Recovered %d rows with expired leases\n", reaped)
 	}
 
-	rawRows, err := fetchPending(ctx, pool, transactions)
+	pc := newProviderCache(pool)
+	ps, closeProviders, err := newProviders(ctx, cfg, cacheWrapper(pc))
 	if err != nil {
-		exitErr(fmt.Errorf("fetch pending: %w", err))
+		return err
 	}
-	if len(rawRows) == 0 {
-		fmt.Println("Nothing to process (all provided lines already processed).")
-		return
+	defer closeProviders()
+	fmt.Printf("Providers: %s\n", ps)
+	if ps.entity.Empty() {
+		fmt.Println("Entity lookups disabled: set ABR_GUID or ABR_INDEX_DATABASE_URL to fill ABN and head office fields")
 	}
 
-	matches, misses, err := enrich(ctx, pool, rawRows, cfg)
+	stats, err := enrich(ctx, pool, q, ps, cfg)
 	if err != nil {
-		exitErr(fmt.Errorf("enrich: %w", err))
+		return fmt.Errorf("enrich: %w", err)
 	}
 
-	if err := cleanupNulls(ctx, pool); err != nil {
-		exitErr(fmt.Errorf("cleanup: %w", err))
+	openReviews, err := countOpenReviews(ctx, pool)
+	if err != nil {
+		return fmt.Errorf("count reviews: %w", err)
 	}
 
 	fmt.Println("\n--- Summary ---")
-	fmt.Printf("Matched: %d\n", matches)
-	fmt.Printf("No match: %d\n", misses)
+	fmt.Printf("Matched: %d\n", stats.Matches)
+	fmt.Printf("No match: %d\n", stats.Misses)
+	if stats.Retried > 0 {
+		fmt.Printf("Retrying later (transient errors): %d\n", stats.Retried)
+	}
+	if stats.Failed > 0 {
+		fmt.Printf("Dead-lettered (status = 'failed'): %d\n", stats.Failed)
+	}
+	if stats.Matches+stats.Misses+stats.Retried+stats.Failed == 0 {
+		fmt.Println("Nothing to process (queue is empty).")
+	}
+	if openReviews > 0 {
+		fmt.Printf("Awaiting review: %d (brandfetch review list)\n", openReviews)
+	}
+	printCacheStats(pc)
 	fmt.Println("Check Postgres table 'enriched_merchants' for results.")
+	return nil
+}
+
+// withDB connects to DATABASE_URL for subcommands that need nothing else,
+// checking the schema is current first when checkMigrations is set.
+func withDB(ctx context.Context, checkMigrations bool, fn func(context.Context, *pgxpool.Pool) error) error {
+	dbURL := os.Getenv("DATABASE_URL")
+	if dbURL == "" {
+		return errors.New("DATABASE_URL is required")
+	}
+	pool, err := connectDB(ctx, dbURL)
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+
+	if checkMigrations {
+		if err := checkSchema(ctx, pool); err != nil {
+			return err
+		}
+	}
+	return fn(ctx, pool)
+}
+
+func runABRBackfill(ctx context.Context, pool *pgxpool.Pool) error {
+	rules, err := loadMergeRules()
+	if err != nil {
+		return err
+	}
+
+	cfg := configFromEnv()
+	pc := newProviderCache(pool)
+	ps, closeProviders, err := newProviders(ctx, cfg, cacheWrapper(pc))
+	if err != nil {
+		return err
+	}
+	defer closeProviders()
+	if ps.entity.Empty() {
+		return errors.New("the entity chain has no providers; set ABR_GUID or ABR_INDEX_DATABASE_URL")
+	}
+
+	stats, err := backfillABR(ctx, pool, ps, rules, cfg.Workers)
+	fmt.Printf("ABR backfill: %d found, %d not found, %d failed\n", stats.Found, stats.Missed, stats.Failed)
+	printCacheStats(pc)
+	return err
 }
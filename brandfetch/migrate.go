@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockID is the pg_advisory_xact_lock key each migration
+// transaction takes, so two processes never apply the same migration at
+// once. A transaction-scoped lock is used because a session lock is not
+// held across transactions behind a transaction pooler such as Supabase's.
+const migrationLockID = 7_413_902_551
+
+// migration is one numbered schema change, read from
+// migrations/NNNN_name.up.sql and its matching .down.sql.
+type migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// appliedMigration is a row of schema_migrations.
+type appliedMigration struct {
+	Version   int64
+	Name      string
+	AppliedAt time.Time
+}
+
+var migrationName = regexp.MustCompile(`^(\d+)_([a-z0-9_]+)\.(up|down)\.sql$`)
+
+// loadMigrations reads the embedded migrations in version order. Every
+// migration needs both an up and a down file.
+func loadMigrations() ([]migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int64]*migration{}
+	for _, e := range entries {
+		m := migrationName.FindStringSubmatch(e.Name())
+		if m == nil {
+			return nil, fmt.Errorf("migration %s: name must look like 0001_name.up.sql", e.Name())
+		}
+		version, _ := strconv.ParseInt(m[1], 10, 64)
+		body, err := migrationFiles.ReadFile("migrations/" + e.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		mig, ok := byVersion[version]
+		if !ok {
+			mig = &migration{Version: version, Name: m[2]}
+			byVersion[version] = mig
+		}
+		if mig.Name != m[2] {
+			return nil, fmt.Errorf("migration %d has two names: %s and %s", version, mig.Name, m[2])
+		}
+		if m[3] == "up" {
+			mig.Up = string(body)
+		} else {
+			mig.Down = string(body)
+		}
+	}
+
+	out := make([]migration, 0, len(byVersion))
+	for _, mig := range byVersion {
+		if mig.Up == "" || mig.Down == "" {
+			return nil, fmt.Errorf("migration %04d_%s needs both up and down files", mig.Version, mig.Name)
+		}
+		out = append(out, *mig)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Version < out[j].Version })
+	return out, nil
+}
+
+// migrator applies migrations over a single connection. Every change runs
+// in a transaction holding the migration lock.
+type migrator struct {
+	conn       *pgxpool.Conn
+	migrations []migration
+}
+
+// withMigrator runs fn with schema_migrations in place.
+func withMigrator(ctx context.Context, pool *pgxpool.Pool, fn func(*migrator) error) error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+
+	conn, err := pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	err = lockedTx(ctx, conn, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, `
+			create table if not exists schema_migrations (
+			  version bigint primary key,
+			  name text not null,
+			  applied_at timestamp with time zone not null default now()
+			)
+		`)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("create schema_migrations: %w", err)
+	}
+
+	return fn(&migrator{conn: conn, migrations: migrations})
+}
+
+// lockedTx runs fn in a transaction that first takes the migration lock.
+func lockedTx(ctx context.Context, conn *pgxpool.Conn, fn func(pgx.Tx) error) error {
+	return pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, `select pg_advisory_xact_lock($1)`, migrationLockID); err != nil {
+			return fmt.Errorf("take migration lock: %w", err)
+		}
+		return fn(tx)
+	})
+}
+
+// isApplied reports whether version is recorded in schema_migrations, as
+// seen inside tx after taking the lock.
+func isApplied(ctx context.Context, tx pgx.Tx, version int64) (bool, error) {
+	var ok bool
+	err := tx.QueryRow(ctx, `select exists (select 1 from schema_migrations where version = $1)`, version).Scan(&ok)
+	return ok, err
+}
+
+func (m *migrator) applied(ctx context.Context) (map[int64]appliedMigration, error) {
+	rows, err := m.conn.Query(ctx, `select version, name, applied_at from schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := map[int64]appliedMigration{}
+	for rows.Next() {
+		var a appliedMigration
+		if err := rows.Scan(&a.Version, &a.Name, &a.AppliedAt); err != nil {
+			return nil, err
+		}
+		out[a.Version] = a
+	}
+	return out, rows.Err()
+}
+
+// up applies every pending migration in order, each in its own
+// transaction, and returns how many ran. A migration another process
+// applied while this one waited for the lock is skipped.
+func (m *migrator) up(ctx context.Context) (int, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, mig := range m.migrations {
+		if _, ok := applied[mig.Version]; ok {
+			continue
+		}
+		ran := false
+		err := lockedTx(ctx, m.conn, func(tx pgx.Tx) error {
+			if done, err := isApplied(ctx, tx, mig.Version); err != nil || done {
+				return err
+			}
+			if _, err := tx.Exec(ctx, mig.Up); err != nil {
+				return err
+			}
+			_, err := tx.Exec(ctx, `insert into schema_migrations (version, name) values ($1, $2)`, mig.Version, mig.Name)
+			ran = err == nil
+			return err
+		})
+		if err != nil {
+			return n, fmt.Errorf("migration %04d_%s up: %w", mig.Version, mig.Name, err)
+		}
+		if ran {
+			fmt.Printf("✓ applied %04d_%s\n", mig.Version, mig.Name)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// down reverts the latest steps applied migrations, newest first.
+func (m *migrator) down(ctx context.Context, steps int) (int, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for i := len(m.migrations) - 1; i >= 0 && n < steps; i-- {
+		mig := m.migrations[i]
+		if _, ok := applied[mig.Version]; !ok {
+			continue
+		}
+		ran := false
+		err := lockedTx(ctx, m.conn, func(tx pgx.Tx) error {
+			if done, err := isApplied(ctx, tx, mig.Version); err != nil || !done {
+				return err
+			}
+			if _, err := tx.Exec(ctx, mig.Down); err != nil {
+				return err
+			}
+			_, err := tx.Exec(ctx, `delete from schema_migrations where version = $1`, mig.Version)
+			ran = err == nil
+			return err
+		})
+		if err != nil {
+			return n, fmt.Errorf("migration %04d_%s down: %w", mig.Version, mig.Name, err)
+		}
+		if ran {
+			fmt.Printf("✓ reverted %04d_%s\n", mig.Version, mig.Name)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// pending returns the migrations not yet applied.
+func (m *migrator) pending(ctx context.Context) ([]migration, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var out []migration
+	for _, mig := range m.migrations {
+		if _, ok := applied[mig.Version]; !ok {
+			out = append(out, mig)
+		}
+	}
+	return out, nil
+}
+
+func (m *migrator) status(ctx context.Context) error {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return err
+	}
+
+	known := map[int64]bool{}
+	for _, mig := range m.migrations {
+		known[mig.Version] = true
+		if a, ok := applied[mig.Version]; ok {
+			fmt.Printf("  ✓ %04d_%-30s applied %s\n", mig.Version, mig.Name, a.AppliedAt.Format(time.RFC3339))
+		} else {
+			fmt.Printf("  • %04d_%-30s pending\n", mig.Version, mig.Name)
+		}
+	}
+	// Applied by a newer binary than this one
+	for v, a := range applied {
+		if !known[v] {
+			fmt.Printf("  ? %04d_%-30s applied %s, unknown to this build\n", v, a.Name, a.AppliedAt.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// runMigrate handles `brandfetch migrate up|down [n]|status`.
+func runMigrate(ctx context.Context, pool *pgxpool.Pool, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: brandfetch migrate up | down [n] | status")
+	}
+
+	return withMigrator(ctx, pool, func(m *migrator) error {
+		switch args[0] {
+		case "up":
+			n, err := m.up(ctx)
+			if err != nil {
+				return err
+			}
+			if n == 0 {
+				fmt.Println("Schema is up to date.")
+			}
+			return nil
+		case "down":
+			steps := 1
+			if len(args) > 1 {
+				s, err := strconv.Atoi(args[1])
+				if err != nil || s < 1 {
+					return fmt.Errorf("migrate down: step count must be a positive number, got %q", args[1])
+				}
+				steps = s
+			}
+			n, err := m.down(ctx, steps)
+			if err != nil {
+				return err
+			}
+			if n == 0 {
+				fmt.Println("Nothing to revert.")
+			}
+			return nil
+		case "status":
+			return m.status(ctx)
+		}
+		return fmt.Errorf("unknown migrate command %q", args[0])
+	})
+}
+
+// checkSchema fails when migrations are pending, so the enricher never
+// runs against a schema older than its queries expect.
+func checkSchema(ctx context.Context, pool *pgxpool.Pool) error {
+	return withMigrator(ctx, pool, func(m *migrator) error {
+		pending, err := m.pending(ctx)
+		if err != nil {
+			return err
+		}
+		if len(pending) > 0 {
+			return fmt.Errorf("database schema is behind by %d migration(s), starting with %04d_%s; run `brandfetch migrate up`",
+				len(pending), pending[0].Version, pending[0].Name)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, m := range migrations {
+		if m.Version != int64(i+1) {
+			t.Errorf("migration %d is version %d; versions must run 1, 2, 3...", i, m.Version)
+		}
+		if strings.TrimSpace(m.Up) == "" || strings.TrimSpace(m.Down) == "" {
+			t.Errorf("migration %04d_%s has an empty up or down", m.Version, m.Name)
+		}
+	}
+}
+
+func migrateUp(t *testing.T, ctx context.Context, m *migrator) int {
+	t.Helper()
+	n, err := m.up(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestMigrateRoundTrip(t *testing.T) {
+	pool := testSchema(t)
+	ctx := context.Background()
+	total := len(must(loadMigrations()))
+
+	err := withMigrator(ctx, pool, func(m *migrator) error {
+		if n := migrateUp(t, ctx, m); n != total {
+			t.Errorf("up applied %d of %d", n, total)
+		}
+		if n, err := m.down(ctx, total); err != nil || n != total {
+			t.Fatalf("down reverted %d of %d: %v", n, total, err)
+		}
+		if n := migrateUp(t, ctx, m); n != total {
+			t.Errorf("second up applied %d of %d", n, total)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrateConcurrent(t *testing.T) {
+	pool := testSchema(t)
+	ctx := context.Background()
+
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		total int
+	)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := withMigrator(ctx, pool, func(m *migrator) error {
+				n, err := m.up(ctx)
+				mu.Lock()
+				total += n
+				mu.Unlock()
+				return err
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if want := len(must(loadMigrations())); total != want {
+		t.Errorf("three migrators applied %d migrations between them, want %d", total, want)
+	}
+}
+
+func TestMigrateLegacyLabels(t *testing.T) {
+	pool := testSchema(t)
+	ctx := context.Background()
+
+	// A table from before transaction_cache was the key
+	if _, err := pool.Exec(ctx, `
+		create table enriched_merchants (
+		  id uuid primary key default gen_random_uuid(),
+		  raw_transaction_label text,
+		  transaction_cache text,
+		  brand_name text
+		);
+		insert into enriched_merchants (raw_transaction_label, transaction_cache, brand_name)
+		values ('WOOLWORTHS 1234', null, 'Woolworths'), ('COLES 55', 'COLES 55', 'Coles');
+	`); err != nil {
+		t.Fatal(err)
+	}
+
+	err := withMigrator(ctx, pool, func(m *migrator) error {
+		migrations := m.migrations
+		m.migrations = migrations[:2]
+		migrateUp(t, ctx, m)
+
+		var cache string
+		if err := pool.QueryRow(ctx, `select transaction_cache from enriched_merchants where brand_name = 'Woolworths'`).Scan(&cache); err != nil || cache != "WOOLWORTHS 1234" {
+			t.Errorf("after up transaction_cache = %q, %v", cache, err)
+		}
+
+		if _, err := m.down(ctx, 1); err != nil {
+			t.Fatal(err)
+		}
+		rows, err := pool.Query(ctx, `select raw_transaction_label, transaction_cache from enriched_merchants order by brand_name`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		var got []string
+		for rows.Next() {
+			var label, cache *string
+			if err := rows.Scan(&label, &cache); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, deref(label)+"|"+deref(cache))
+		}
+		if strings.Join(got, ",") != "COLES 55|COLES 55,WOOLWORTHS 1234|" {
+			t.Errorf("after down (label|cache) = %v", got)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func must[T any](v T, err error) T {
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
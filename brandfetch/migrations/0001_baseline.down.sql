@@ -0,0 +1,2 @@
+drop table if exists enriched_merchants;
+drop table if exists raw_transactions;
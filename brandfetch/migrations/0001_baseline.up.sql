@@ -0,0 +1,31 @@
+-- Baseline schema. Databases created from the old schema.sql already have
+-- these tables, so everything here is create-if-not-exists.
+
+-- Base table: raw incoming transaction strings
+create table if not exists raw_transactions (
+  id uuid primary key default gen_random_uuid(),
+  description text not null unique,
+  processed boolean default false,
+  created_at timestamp with time zone default now()
+);
+
+-- Enriched “sheet” table (single source of truth)
+create table if not exists enriched_merchants (
+  id uuid primary key default gen_random_uuid(),
+  transaction_cache text, -- copy of raw description, used as unique key
+  brand_name text,
+  legal_name text,
+  logo text,
+  anzsic_class_code text,
+  abn_head_office text,
+  acn_head_office text,
+  head_office_address text,
+  website_url text,
+  bpay_biller_code text,
+  mcc_code_test text,
+  wemoney_category text,
+  confidence_score float,
+  brandfetch_id text,
+  full_response jsonb,
+  created_at timestamp with time zone default now()
+);
@@ -0,0 +1,19 @@
+alter table enriched_merchants drop constraint if exists enriched_merchants_transaction_cache_key;
+alter table enriched_merchants alter column transaction_cache drop not null;
+
+-- Restore raw_transaction_label, and the empty transaction_cache values the
+-- up migration filled from it, on tables that had the old column
+do $$
+begin
+  if to_regclass('enriched_merchants_0002_labels') is not null then
+    alter table enriched_merchants add column raw_transaction_label text;
+
+    update enriched_merchants e
+    set raw_transaction_label = l.raw_transaction_label,
+        transaction_cache = case when l.cache_was_null then null else e.transaction_cache end
+    from enriched_merchants_0002_labels l
+    where l.id = e.id;
+
+    drop table enriched_merchants_0002_labels;
+  end if;
+end $$;
@@ -0,0 +1,28 @@
+-- Older tables keyed enriched rows on raw_transaction_label. Move the values
+-- into transaction_cache, drop the old column and make transaction_cache the
+-- unique, required key. The old column's values, and which rows had no
+-- transaction_cache of their own, are kept in enriched_merchants_0002_labels
+-- so the down migration can put them back.
+alter table enriched_merchants add column if not exists transaction_cache text;
+
+do $$
+begin
+  if exists (
+    select 1 from information_schema.columns
+    where table_schema = current_schema()
+      and table_name = 'enriched_merchants'
+      and column_name = 'raw_transaction_label'
+  ) then
+    create table enriched_merchants_0002_labels as
+      select id, raw_transaction_label, transaction_cache is null as cache_was_null
+      from enriched_merchants;
+
+    update enriched_merchants
+    set transaction_cache = coalesce(transaction_cache, raw_transaction_label);
+    alter table enriched_merchants drop column raw_transaction_label;
+  end if;
+end $$;
+
+alter table enriched_merchants alter column transaction_cache set not null;
+alter table enriched_merchants drop constraint if exists enriched_merchants_transaction_cache_key;
+alter table enriched_merchants add constraint enriched_merchants_transaction_cache_key unique (transaction_cache);
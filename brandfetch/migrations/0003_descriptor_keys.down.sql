@@ -0,0 +1,4 @@
+alter table raw_transactions drop column if exists location_country;
+alter table raw_transactions drop column if exists location_state;
+alter table raw_transactions drop column if exists location_city;
+alter table raw_transactions drop column if exists merchant_key;
@@ -0,0 +1,5 @@
+-- Normalised descriptor stored alongside the raw text
+alter table raw_transactions add column if not exists merchant_key text;
+alter table raw_transactions add column if not exists location_city text;
+alter table raw_transactions add column if not exists location_state text;
+alter table raw_transactions add column if not exists location_country text;
@@ -0,0 +1,7 @@
+drop index if exists raw_transactions_claim_idx;
+alter table raw_transactions drop column if exists next_attempt_at;
+alter table raw_transactions drop column if exists locked_until;
+alter table raw_transactions drop column if exists locked_by;
+alter table raw_transactions drop column if exists last_error;
+alter table raw_transactions drop column if exists attempts;
+alter table raw_transactions drop column if exists status;
@@ -0,0 +1,14 @@
+-- raw_transactions as a work queue: pending -> in_progress -> done, or
+-- failed (dead letter) once a row runs out of attempts
+alter table raw_transactions add column if not exists status text not null default 'pending'
+  check (status in ('pending', 'in_progress', 'done', 'failed'));
+alter table raw_transactions add column if not exists attempts integer not null default 0;
+alter table raw_transactions add column if not exists last_error text;
+alter table raw_transactions add column if not exists locked_by text;
+alter table raw_transactions add column if not exists locked_until timestamp with time zone;
+alter table raw_transactions add column if not exists next_attempt_at timestamp with time zone;
+
+update raw_transactions set status = 'done' where processed and status = 'pending';
+
+create index if not exists raw_transactions_claim_idx
+  on raw_transactions (status, next_attempt_at, created_at);
@@ -0,0 +1,5 @@
+alter table enriched_merchants drop column if exists abr_checked_at;
+alter table enriched_merchants drop column if exists head_office_confidence;
+alter table enriched_merchants drop column if exists acn_confidence;
+alter table enriched_merchants drop column if exists abn_confidence;
+alter table enriched_merchants drop column if exists legal_name_confidence;
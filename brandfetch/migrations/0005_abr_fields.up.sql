@@ -0,0 +1,7 @@
+-- Per-field confidence (0-100) for the columns filled by the ABR stage, and
+-- when the stage last looked at the row
+alter table enriched_merchants add column if not exists legal_name_confidence float;
+alter table enriched_merchants add column if not exists abn_confidence float;
+alter table enriched_merchants add column if not exists acn_confidence float;
+alter table enriched_merchants add column if not exists head_office_confidence float;
+alter table enriched_merchants add column if not exists abr_checked_at timestamp with time zone;
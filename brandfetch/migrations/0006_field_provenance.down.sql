@@ -0,0 +1,2 @@
+drop view if exists current_field_provenance;
+drop table if exists field_provenance;
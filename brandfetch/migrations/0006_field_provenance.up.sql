@@ -0,0 +1,22 @@
+-- Where each enriched field came from: one row per transaction, field and source,
+-- replaced whenever that source is fetched again
+create table if not exists field_provenance (
+  id bigserial primary key,
+  transaction_cache text not null,
+  field text not null,
+  value text not null,
+  source text not null,
+  confidence float not null,
+  evidence jsonb,
+  fetched_at timestamp with time zone not null default now(),
+  unique (transaction_cache, field, source)
+);
+
+create index if not exists field_provenance_field_idx on field_provenance (field, source);
+
+-- The most confident value per row and field, newest first on ties
+create or replace view current_field_provenance as
+select distinct on (transaction_cache, field)
+  transaction_cache, field, value, source, confidence, evidence, fetched_at
+from field_provenance
+order by transaction_cache, field, confidence desc, fetched_at desc;
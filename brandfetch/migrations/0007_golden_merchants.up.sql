@@ -0,0 +1,17 @@
+-- One reconciled record per transaction, merged from field_provenance by
+-- the survivorship rules. fields holds each winner's provenance and losers
+-- the candidates that lost, for audit.
+create table if not exists golden_merchants (
+  transaction_cache text primary key,
+  brand_name text,
+  legal_name text,
+  abn text,
+  acn text,
+  head_office_address text,
+  logo text,
+  website_url text,
+  category text,
+  fields jsonb not null default '{}',
+  losers jsonb not null default '{}',
+  merged_at timestamp with time zone not null default now()
+);
@@ -0,0 +1,2 @@
+drop table if exists review_queue;
+drop table if exists manual_overrides;
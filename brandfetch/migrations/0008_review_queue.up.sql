@@ -0,0 +1,30 @@
+-- Values set by hand. They are never touched by enrichment and always win
+-- the golden merge; an empty value blanks the field on purpose.
+create table if not exists manual_overrides (
+  transaction_cache text not null,
+  field text not null,
+  value text not null,
+  set_by text,
+  note text,
+  set_at timestamp with time zone not null default now(),
+  primary key (transaction_cache, field)
+);
+
+-- Misses and low-confidence matches waiting for someone to accept, reject
+-- or override them. candidates is the golden record at the time, losers
+-- included.
+create table if not exists review_queue (
+  id bigserial primary key,
+  transaction_cache text not null unique,
+  reason text not null check (reason in ('no_match', 'low_confidence')),
+  status text not null default 'open'
+    check (status in ('open', 'accepted', 'rejected', 'overridden')),
+  confidence float,
+  candidates jsonb not null default '{}',
+  created_at timestamp with time zone not null default now(),
+  updated_at timestamp with time zone not null default now(),
+  resolved_by text,
+  resolved_at timestamp with time zone
+);
+
+create index if not exists review_queue_status_idx on review_queue (status, created_at);
@@ -0,0 +1,15 @@
+-- Provider responses behind the in-memory cache. not_found rows remember
+-- that a provider had nothing so the lookup is not repeated until they
+-- expire.
+create table if not exists provider_cache (
+  provider text not null,
+  key text not null,
+  status integer not null,
+  header jsonb,
+  body bytea not null,
+  not_found boolean not null default false,
+  fetched_at timestamp with time zone not null,
+  primary key (provider, key)
+);
+
+create index if not exists provider_cache_fetched_idx on provider_cache (provider, fetched_at);
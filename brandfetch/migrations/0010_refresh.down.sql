@@ -0,0 +1,2 @@
+drop table if exists refresh_changes;
+alter table enriched_merchants drop column if exists last_verified_at;
@@ -0,0 +1,14 @@
+-- When refresh last confirmed a row against the providers
+alter table enriched_merchants add column if not exists last_verified_at timestamp with time zone;
+
+-- Every value refresh found had changed
+create table if not exists refresh_changes (
+  id bigserial primary key,
+  transaction_cache text not null,
+  field text not null,
+  old_value text,
+  new_value text,
+  changed_at timestamp with time zone not null default now()
+);
+
+create index if not exists refresh_changes_row_idx on refresh_changes (transaction_cache, changed_at);
@@ -0,0 +1,54 @@
+-- Every version of each merchant as served: golden values over the raw
+-- enriched_merchants columns. A version is current from valid_from until
+-- valid_to; the open one has no valid_to. provenance is the golden
+-- record's winners at the time, which explains why a value was chosen.
+create table if not exists merchant_history (
+  id bigserial primary key,
+  transaction_cache text not null,
+  version integer not null,
+  brand_name text,
+  legal_name text,
+  abn text,
+  acn text,
+  head_office_address text,
+  logo text,
+  website_url text,
+  category text,
+  confidence_score float,
+  brandfetch_id text,
+  full_response jsonb,
+  provenance jsonb,
+  valid_from timestamp with time zone not null default now(),
+  valid_to timestamp with time zone,
+  unique (transaction_cache, version),
+  check (valid_to is null or valid_to >= valid_from)
+);
+
+create unique index if not exists merchant_history_open_idx
+  on merchant_history (transaction_cache) where valid_to is null;
+create index if not exists merchant_history_as_of_idx
+  on merchant_history (transaction_cache, valid_from);
+
+-- Rows enriched before history was kept start with what they hold now
+insert into merchant_history (
+  transaction_cache, version, brand_name, legal_name, abn, acn, head_office_address,
+  logo, website_url, category, confidence_score, brandfetch_id, full_response, provenance, valid_from
+)
+select
+  e.transaction_cache, 1,
+  coalesce(g.brand_name, e.brand_name),
+  coalesce(g.legal_name, e.legal_name),
+  coalesce(g.abn, e.abn_head_office),
+  coalesce(g.acn, e.acn_head_office),
+  coalesce(g.head_office_address, e.head_office_address),
+  coalesce(g.logo, e.logo),
+  coalesce(g.website_url, e.website_url),
+  g.category,
+  e.confidence_score,
+  e.brandfetch_id,
+  e.full_response,
+  g.fields,
+  coalesce(g.merged_at, e.created_at, now())
+from enriched_merchants e
+left join golden_merchants g on g.transaction_cache = e.transaction_cache
+where not exists (select 1 from merchant_history h where h.transaction_cache = e.transaction_cache);
@@ -0,0 +1,2 @@
+drop table if exists abn_events;
+drop table if exists abn_status;
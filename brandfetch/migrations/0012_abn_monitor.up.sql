@@ -0,0 +1,26 @@
+-- What the ABN monitor last saw for each stored ABN
+create table if not exists abn_status (
+  abn text primary key,
+  status text,
+  legal_name text,
+  gst_registered boolean not null default false,
+  state text,
+  postcode text,
+  checked_at timestamp with time zone not null default now()
+);
+
+-- Every change the monitor found. notified_at stays null until a notifier
+-- has taken the event, so failed deliveries are retried on the next run.
+create table if not exists abn_events (
+  id bigserial primary key,
+  abn text not null,
+  kind text not null,
+  old_value text,
+  new_value text,
+  merchants text[] not null default '{}',
+  detected_at timestamp with time zone not null default now(),
+  notified_at timestamp with time zone
+);
+
+create index if not exists abn_events_abn_idx on abn_events (abn, detected_at);
+create index if not exists abn_events_pending_idx on abn_events (id) where notified_at is null;
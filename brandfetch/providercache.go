@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"merchantcache/abn/abr"
+	"merchantcache/cache"
+	"merchantcache/ratelimit"
+)
+
+const (
+	providerBrandfetch = "brandfetch"
+	providerABR        = "abr"
+	providerGoogle     = "google"
+)
+
+// newProviderCache builds the response cache shared by every provider
+// client, with CACHE_SIZE entries in memory in front of provider_cache. It
+// returns nil when CACHE_DISABLED=true.
+func newProviderCache(pool *pgxpool.Pool) *cache.Cache {
+	if os.Getenv("CACHE_DISABLED") == "true" {
+		return nil
+	}
+	return cache.New(getenvInt("CACHE_SIZE", 10000), cache.NewPGStore(pool))
+}
+
+// cachePolicy reads a provider's lifetimes from CACHE_<PROVIDER>_TTL,
+// CACHE_<PROVIDER>_NOT_FOUND_TTL and CACHE_<PROVIDER>_STALE, as Go
+// durations such as 168h.
+func cachePolicy(provider string) cache.Policy {
+	p := cache.DefaultPolicy()
+	prefix := "CACHE_" + strings.ToUpper(provider) + "_"
+	p.TTL = getenvDuration(prefix+"TTL", p.TTL)
+	p.NotFoundTTL = getenvDuration(prefix+"NOT_FOUND_TTL", p.NotFoundTTL)
+	p.StaleFor = getenvDuration(prefix+"STALE", p.StaleFor)
+	return p
+}
+
+// withCache puts c in front of base for provider. Credentials are kept out
+// of the cache keys. A nil c leaves base as it is.
+func withCache(base http.RoundTripper, c *cache.Cache, provider string) http.RoundTripper {
+	if c == nil {
+		return base
+	}
+	t := cache.NewTransport(base, c, provider, cachePolicy(provider))
+	switch provider {
+	case providerBrandfetch:
+		t.SecretParams = []string{"c"}
+		// Search answers an unknown name with an empty list
+		t.NotFound = func(_ int, body []byte) bool {
+			return bytes.Equal(bytes.TrimSpace(body), []byte("[]"))
+		}
+	case providerABR:
+		t.SecretParams = []string{"authenticationGuid", "guid"}
+		// Exceptions, such as an unrecognised GUID, come back as 200s; only
+		// "no record" ones are answers worth keeping
+		t.Failed = func(_ int, body []byte) bool {
+			err := abr.ResponseError(body)
+			return err != nil && !errors.Is(err, abr.ErrABNNotFound)
+		}
+		t.NotFound = func(_ int, body []byte) bool {
+			return errors.Is(abr.ResponseError(body), abr.ErrABNNotFound)
+		}
+	case providerGoogle:
+		t.SecretParams = []string{"key"}
+		t.NotFound = func(_ int, body []byte) bool {
+			return !bytes.Contains(body, []byte(`"items"`))
+		}
+	}
+	return t
+}
+
+// transportWrapper puts extra layers, such as the cache, in front of a
+// provider's rate-limited transport.
+type transportWrapper func(base http.RoundTripper, provider string) http.RoundTripper
+
+// cacheWrapper answers from c before the rate limit, so hits are free.
+func cacheWrapper(c *cache.Cache) transportWrapper {
+	return func(base http.RoundTripper, provider string) http.RoundTripper {
+		return withCache(base, c, provider)
+	}
+}
+
+// brandfetchClient is the rate-limited Brandfetch client, wrapped by wrap.
+func brandfetchClient(cfg Config, wrap transportWrapper) *http.Client {
+	return &http.Client{
+		Transport: wrap(ratelimit.NewTransport(http.DefaultTransport, ratelimit.New(cfg.RatePerSecond, 1)).WithTimeout(cfg.Timeout), providerBrandfetch),
+	}
+}
+
+func printCacheStats(c *cache.Cache) {
+	if c == nil {
+		return
+	}
+	stats := c.Stats()
+	providers := make([]string, 0, len(stats))
+	for p := range stats {
+		providers = append(providers, p)
+	}
+	sort.Strings(providers)
+	for _, p := range providers {
+		fmt.Printf("Cache %s: %s\n", p, stats[p])
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"merchantcache/cache"
+)
+
+const abrExceptionBody = `<ABRPayloadSearchResults><response><exception>
+<exceptionDescription>%s</exceptionDescription><exceptionCode>%s</exceptionCode>
+</exception></response></ABRPayloadSearchResults>`
+
+func TestABRCacheClassifier(t *testing.T) {
+	bodies := map[string]string{
+		"88000014675": `<ABRPayloadSearchResults><response><businessEntity202001>
+<ABN><identifierValue>88000014675</identifierValue><isCurrentIndicator>Y</isCurrentIndicator></ABN>
+</businessEntity202001></response></ABRPayloadSearchResults>`,
+		"51824753556": fmt.Sprintf(abrExceptionBody, "No records found", "WEBSERVICES"),
+		"53004085616": fmt.Sprintf(abrExceptionBody, "The GUID entered is not recognised as a Registered Party", "WEBSERVICES"),
+		"33051775556": "<html>Service Unavailable</html>",
+	}
+	var (
+		mu    sync.Mutex
+		calls = map[string]int{}
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		abn := r.URL.Query().Get("searchString")
+		mu.Lock()
+		calls[abn]++
+		mu.Unlock()
+		io.WriteString(w, bodies[abn])
+	}))
+	defer srv.Close()
+
+	c := cache.New(100, nil)
+	client := &http.Client{Transport: withCache(http.DefaultTransport, c, providerABR)}
+	for i := 0; i < 2; i++ {
+		for abn := range bodies {
+			resp, err := client.Get(srv.URL + "/SearchByABNv202001?searchString=" + abn + "&authenticationGuid=secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+		}
+	}
+
+	for abn, want := range map[string]int{
+		"88000014675": 1, // a record is cached
+		"51824753556": 1, // so is "no record"
+		"53004085616": 2, // a bad GUID is not
+		"33051775556": 2, // nor is something that is not ABR XML
+	} {
+		if calls[abn] != want {
+			t.Errorf("%s went upstream %d times, want %d", abn, calls[abn], want)
+		}
+	}
+	if s := c.Stats()[providerABR]; s.Hits != 1 || s.NegativeHits != 1 {
+		t.Errorf("stats = %+v", s)
+	}
+}
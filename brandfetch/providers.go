@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"merchantcache/abn/abr"
+	"merchantcache/abn/config"
+	"merchantcache/abn/pipeline"
+	"merchantcache/descriptor"
+	"merchantcache/provenance"
+	"merchantcache/provider"
+)
+
+// The chains enrichment asks: brand providers work from the descriptor,
+// entity providers from the brand the first chain found, and address
+// providers from the entity for its head office. The entity and address
+// chains are the ones abngooglemain asks.
+const (
+	chainBrand   = "brand"
+	chainEntity  = pipeline.ChainEntity
+	chainAddress = pipeline.ChainAddress
+)
+
+// providerSet is the enrichment pipeline's chains.
+type providerSet struct {
+	brand   provider.Chain
+	entity  provider.Chain
+	address provider.Chain
+}
+
+func (ps *providerSet) String() string {
+	names := func(c provider.Chain) string {
+		if c.Empty() {
+			return "none"
+		}
+		out := make([]string, len(c.Providers))
+		for i, p := range c.Providers {
+			out[i] = p.Name()
+		}
+		sep := " → "
+		if c.Mode == provider.All {
+			sep = " + "
+		}
+		return strings.Join(out, sep)
+	}
+	return fmt.Sprintf("brand %s; entity %s; address %s", names(ps.brand), names(ps.entity), names(ps.address))
+}
+
+// defaultProviderConfig asks Brandfetch for the brand and, when abrCfg
+// has the ABR web service or bulk index, the ABR for the entity and, with
+// Google credentials too, Google for the head office.
+func defaultProviderConfig(abrCfg config.Config) provider.Config {
+	cfg := provider.Config{Chains: map[string]provider.ChainConfig{
+		chainBrand: {Providers: []string{providerBrandfetch}},
+	}}
+	if abrCfg.ABRGuid != "" || abrCfg.ABRIndexEnabled() {
+		head := abrCfg.GoogleAPIKey != "" && abrCfg.GoogleSearchEngineID != ""
+		for name, chain := range pipeline.DefaultConfig(head).Chains {
+			cfg.Chains[name] = chain
+		}
+	}
+	return cfg
+}
+
+// loadProviderConfig reads the providers file named by PROVIDERS_FILE over
+// the defaults.
+func loadProviderConfig(abrCfg config.Config) (provider.Config, error) {
+	path := os.Getenv("PROVIDERS_FILE")
+	if path == "" {
+		return defaultProviderConfig(abrCfg), nil
+	}
+	return provider.LoadConfig(path, defaultProviderConfig(abrCfg))
+}
+
+// newProviders builds the brand, entity and address chains as the
+// environment configures them. The returned func releases what the
+// providers hold.
+func newProviders(ctx context.Context, cfg Config, wrap transportWrapper) (*providerSet, func(), error) {
+	// The abr and google types are configured from the abngooglemain
+	// environment, as that command's own are
+	abrCfg := config.LoadFromEnv()
+	pcfg, err := loadProviderConfig(abrCfg)
+	if err != nil {
+		return nil, func() {}, err
+	}
+	return buildProviders(ctx, cfg, abrCfg, pcfg, wrap)
+}
+
+// buildProviders builds the chains pcfg lists. The built-in brandfetch,
+// abr and google types are configured from cfg and abrCfg and send their
+// requests through wrap; csv providers are read from disk.
+func buildProviders(ctx context.Context, cfg Config, abrCfg config.Config, pcfg provider.Config, wrap transportWrapper) (*providerSet, func(), error) {
+	var closers []func()
+	closeAll := func() {
+		for _, c := range closers {
+			c()
+		}
+	}
+
+	reg := provider.NewRegistry()
+	// Settings: country_tld overrides COUNTRY_TLD_PREFERENCE
+	reg.Register(providerBrandfetch, func(name string, s provider.Settings) (provider.Provider, error) {
+		c := cfg
+		c.CountryTLDPreference = s.String("country_tld", cfg.CountryTLDPreference)
+		return &brandfetchProvider{name: name, client: brandfetchClient(c, wrap), cfg: c}, nil
+	})
+	reg.Register(providerABR, func(name string, _ provider.Settings) (provider.Provider, error) {
+		if abrCfg.ABRGuid == "" && !abrCfg.ABRIndexEnabled() {
+			return nil, errors.New("ABR_GUID or ABR_INDEX_DATABASE_URL is required")
+		}
+		client, closeClient, err := newABRClient(ctx, abrCfg, wrap)
+		closers = append(closers, closeClient)
+		if err != nil {
+			return nil, err
+		}
+		return pipeline.NewABRProvider(name, client), nil
+	})
+	reg.Register(providerGoogle, func(name string, _ provider.Settings) (provider.Provider, error) {
+		client, err := newGoogleClient(abrCfg, wrap)
+		if err != nil {
+			return nil, err
+		}
+		return pipeline.NewGoogleProvider(name, client), nil
+	})
+
+	brand, err := reg.Chain(pcfg, chainBrand)
+	if err != nil {
+		closeAll()
+		return nil, func() {}, err
+	}
+	if brand.Empty() {
+		closeAll()
+		return nil, func() {}, errors.New("the brand chain has no providers")
+	}
+	entity, err := reg.Chain(pcfg, chainEntity)
+	if err != nil {
+		closeAll()
+		return nil, func() {}, err
+	}
+	address, err := reg.Chain(pcfg, chainAddress)
+	if err != nil {
+		closeAll()
+		return nil, func() {}, err
+	}
+	return &providerSet{brand: brand, entity: entity, address: address}, closeAll, nil
+}
+
+// brandfetchProvider searches Brandfetch for the names in a descriptor and
+// fetches the profile of the brand it finds.
+type brandfetchProvider struct {
+	name   string
+	client *http.Client
+	cfg    Config
+}
+
+func (p *brandfetchProvider) Name() string { return p.name }
+
+func (p *brandfetchProvider) Lookup(ctx context.Context, q provider.Query) ([]provider.Candidate, error) {
+	d := descriptor.Descriptor{Raw: q.Descriptor, Parts: q.Names}
+	hit, err := searchDescriptor(ctx, p.client, d, p.cfg)
+	if err != nil {
+		return nil, err
+	}
+	if hit == nil {
+		return nil, nil
+	}
+
+	profile, err := fetchBrandProfile(ctx, p.client, hit.Domain, p.cfg)
+	if err != nil {
+		if abortRow(ctx, err) {
+			return nil, err
+		}
+		// The search hit is still worth keeping
+		fmt.Printf("%s: profile error: %v\n", q.Descriptor, err)
+	}
+
+	choice := pickProfile(profile, hit)
+	return []provider.Candidate{{
+		Provider:   p.name,
+		ID:         choice.ID,
+		Confidence: choice.QualityScore * 100,
+		Records:    brandProvenance(choice, profile, q.Descriptor, p.cfg.BrandfetchClientID),
+		Raw:        rawJSON(profile, hit),
+	}}, nil
+}
+
+// brandRow fills the enriched columns from a brand candidate.
+// brandfetch_id is only set for Brandfetch's own candidates.
+func brandRow(desc string, c provider.Candidate) rowResult {
+	website := c.Value(provenance.Website)
+	row := EnrichedRow{
+		TransactionCache: desc,
+		BrandName:        c.Value(provenance.BrandName),
+		WebsiteURL:       website,
+		Logo:             c.Value(provenance.Logo),
+		ConfidenceScore:  c.Confidence / 100,
+		FullResponse:     c.Raw,
+	}
+	if c.Provider == providerBrandfetch {
+		row.BrandfetchID = c.ID
+	}
+	if abn, err := abr.ParseABN(c.Value(provenance.ABN)); err == nil {
+		row.ABN = abn
+	}
+	if acn, err := abr.ParseACN(c.Value(provenance.ACN)); err == nil {
+		row.ACN = acn
+	}
+	if row.FullResponse == nil {
+		row.FullResponse = json.RawMessage(`null`)
+	}
+	return rowResult{
+		Row:        row,
+		Domain:     domainOf(website),
+		Matched:    row.BrandName != "",
+		Provenance: c.Records,
+	}
+}
+
+// entityFields reads the ABR columns from an entity candidate, whichever
+// provider it came from.
+func entityFields(c provider.Candidate) abrFields {
+	abn, _ := abr.ParseABN(c.Value(provenance.ABN))
+	acn, _ := abr.ParseACN(c.Value(provenance.ACN))
+	if !abn.Valid() {
+		abn = ""
+	}
+	if !acn.Valid() {
+		acn = ""
+	}
+	return abrFields{
+		LegalName:            c.Value(provenance.LegalName),
+		LegalNameConfidence:  confidenceOf(c.Records, provenance.LegalName),
+		ABN:                  abn,
+		ABNConfidence:        confidenceOf(c.Records, provenance.ABN),
+		ACN:                  acn,
+		ACNConfidence:        confidenceOf(c.Records, provenance.ACN),
+		HeadOffice:           c.Value(provenance.HeadOffice),
+		HeadOfficeConfidence: confidenceOf(c.Records, provenance.HeadOffice),
+		Provenance:           c.Records,
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Row states in the raw_transactions work queue are pending, in_progress,
+// done and failed. Failed is the dead-letter state: rows land there once
+// they run out of attempts and are never claimed again without manual
+// intervention.
+const (
+	statusPending = "pending"
+	statusFailed  = "failed"
+)
+
+// errLeaseLost is returned when a worker updates a row it no longer holds
+// because its lease ran out and another worker claimed the row.
+var errLeaseLost = errors.New("lease lost to another worker")
+
+// queue hands raw_transactions rows to workers. Rows are claimed with
+// FOR UPDATE SKIP LOCKED under a lease, so any number of enrichers can
+// drain the same table without working on the same row. A worker renews
+// its lease while it works, so only rows whose worker died or hung are
+// reclaimed.
+type queue struct {
+	pool        *pgxpool.Pool
+	workerID    string
+	lease       time.Duration
+	maxAttempts int
+}
+
+func newQueue(pool *pgxpool.Pool, lease time.Duration, maxAttempts int) *queue {
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	if lease <= 0 {
+		lease = 5 * time.Minute
+	}
+	return &queue{
+		pool:        pool,
+		workerID:    workerID(),
+		lease:       lease,
+		maxAttempts: maxAttempts,
+	}
+}
+
+// workerID identifies this process in locked_by.
+func workerID() string {
+	host, _ := os.Hostname()
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(b))
+}
+
+// reapExpired returns rows whose lease ran out, because their worker died
+// or hung, to pending, or dead-letters them if that was their last attempt.
+// claim takes over expired rows with attempts to spare by itself, so this
+// mostly matters for the dead-lettering.
+func (q *queue) reapExpired(ctx context.Context) (int64, error) {
+	tag, err := q.pool.Exec(ctx, `
+		update raw_transactions
+		set status = case when attempts >= $1 then 'failed' else 'pending' end,
+		    last_error = 'lease expired (held by ' || coalesce(locked_by, 'unknown') || ')',
+		    locked_by = null,
+		    locked_until = null
+		where status = 'in_progress'
+		  and locked_until < now()
+	`, q.maxAttempts)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// claim leases the oldest row that is due: a pending row, or one whose
+// lease expired with attempts to spare. ok is false when there is nothing
+// left to claim right now. Expired rows on their last attempt are left for
+// reapExpired to dead-letter.
+func (q *queue) claim(ctx context.Context) (tx RawTransaction, ok bool, err error) {
+	err = q.pool.QueryRow(ctx, `
+		with next as (
+			select id
+			from raw_transactions
+			where (status = 'pending' and (next_attempt_at is null or next_attempt_at <= now()))
+			   or (status = 'in_progress' and locked_until < now() and attempts < $3)
+			order by created_at
+			limit 1
+			for update skip locked
+		)
+		update raw_transactions r
+		set status = 'in_progress',
+		    attempts = r.attempts + 1,
+		    locked_by = $1,
+		    locked_until = now() + make_interval(secs => $2)
+		from next
+		where r.id = next.id
+		returning r.id, r.description, coalesce(r.location_state, ''), r.attempts
+	`, q.workerID, q.lease.Seconds(), q.maxAttempts).Scan(&tx.ID, &tx.Description, &tx.LocationState, &tx.Attempts)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return RawTransaction{}, false, nil
+	}
+	if err != nil {
+		return RawTransaction{}, false, err
+	}
+	return tx, true, nil
+}
+
+// claimDescription leases the row for one description, whatever its state,
+// unless another worker holds a live lease on it. It is for lookups that
+// need an answer now rather than when the row comes due.
+func (q *queue) claimDescription(ctx context.Context, description string) (tx RawTransaction, ok bool, err error) {
+	err = q.pool.QueryRow(ctx, `
+		with target as (
+			select id
+			from raw_transactions
+			where description = $3
+			  and (status <> 'in_progress' or locked_until < now())
+			for update skip locked
+		)
+		update raw_transactions r
+		set status = 'in_progress',
+		    attempts = r.attempts + 1,
+		    locked_by = $1,
+		    locked_until = now() + make_interval(secs => $2)
+		from target
+		where r.id = target.id
+		returning r.id, r.description, coalesce(r.location_state, ''), r.attempts
+	`, q.workerID, q.lease.Seconds(), description).Scan(&tx.ID, &tx.Description, &tx.LocationState, &tx.Attempts)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return RawTransaction{}, false, nil
+	}
+	if err != nil {
+		return RawTransaction{}, false, err
+	}
+	return tx, true, nil
+}
+
+// renew extends the lease on a claimed row by another q.lease.
+func (q *queue) renew(ctx context.Context, tx RawTransaction) error {
+	tag, err := q.pool.Exec(ctx, `
+		update raw_transactions
+		set locked_until = now() + make_interval(secs => $3)
+		where id = $1
+		  and locked_by = $2
+		  and status = 'in_progress'
+	`, tx.ID, q.workerID, q.lease.Seconds())
+	return leaseHeld(tag, err)
+}
+
+// keepLease renews the lease on tx every third of q.lease until the
+// returned func is called, so slow lookups with many retries are not
+// reclaimed part way through. Renewal stops early if the lease is lost.
+func (q *queue) keepLease(ctx context.Context, tx RawTransaction) (stop func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(q.lease / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if err := q.renew(ctx, tx); err != nil {
+				if ctx.Err() == nil {
+					fmt.Printf("%s: lease renewal failed: %v\n", tx.Description, err)
+				}
+				if errors.Is(err, errLeaseLost) {
+					return
+				}
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// leaseHeld turns an update that matched no row into errLeaseLost.
+func leaseHeld(tag pgconn.CommandTag, err error) error {
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errLeaseLost
+	}
+	return nil
+}
+
+// complete marks a claimed row done. It only touches the row while this
+// worker still holds the lease, and returns errLeaseLost otherwise.
+func (q *queue) complete(ctx context.Context, tx RawTransaction) error {
+	tag, err := q.pool.Exec(ctx, `
+		update raw_transactions
+		set status = 'done',
+		    processed = true,
+		    last_error = null,
+		    locked_by = null,
+		    locked_until = null,
+		    next_attempt_at = null
+		where id = $1
+		  and locked_by = $2
+	`, tx.ID, q.workerID)
+	return leaseHeld(tag, err)
+}
+
+// retry records a failed attempt. The row goes back to pending after an
+// exponential backoff, or to the dead-letter state once it has used every
+// attempt. It reports whether the row was dead-lettered, and returns
+// errLeaseLost if another worker has the row now.
+func (q *queue) retry(ctx context.Context, tx RawTransaction, cause error) (bool, error) {
+	dead := tx.Attempts >= q.maxAttempts
+	status := statusPending
+	if dead {
+		status = statusFailed
+	}
+	tag, err := q.pool.Exec(ctx, `
+		update raw_transactions
+		set status = $3,
+		    last_error = $4,
+		    locked_by = null,
+		    locked_until = null,
+		    next_attempt_at = now() + make_interval(secs => $5)
+		where id = $1
+		  and locked_by = $2
+	`, tx.ID, q.workerID, status, cause.Error(), retryDelay(tx.Attempts).Seconds())
+	return dead, leaseHeld(tag, err)
+}
+
+// release gives a claimed row back without counting the attempt, for rows
+// abandoned because the run was stopped.
+func (q *queue) release(ctx context.Context, tx RawTransaction) error {
+	tag, err := q.pool.Exec(ctx, `
+		update raw_transactions
+		set status = 'pending',
+		    attempts = greatest(attempts - 1, 0),
+		    locked_by = null,
+		    locked_until = null
+		where id = $1
+		  and locked_by = $2
+	`, tx.ID, q.workerID)
+	return leaseHeld(tag, err)
+}
+
+// retryDelay is how long a row waits after its nth failed attempt: one
+// minute, doubling, capped at six hours.
+func retryDelay(attempts int) time.Duration {
+	const (
+		first = time.Minute
+		limit = 6 * time.Hour
+	)
+	if attempts < 1 {
+		attempts = 1
+	}
+	d := first << (attempts - 1)
+	if d <= 0 || d > limit {
+		return limit
+	}
+	return d
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// testPool migrates a throwaway schema in the database named by
+// BRANDFETCH_TEST_DATABASE_URL, and skips the test when it is not set.
+func testPool(t *testing.T) *pgxpool.Pool {
+	t.Helper()
+	pool := testSchema(t)
+	if err := withMigrator(context.Background(), pool, func(m *migrator) error {
+		_, err := m.up(context.Background())
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return pool
+}
+
+// testSchema is testPool without the migrations.
+func testSchema(t *testing.T) *pgxpool.Pool {
+	t.Helper()
+	url := os.Getenv("BRANDFETCH_TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("set BRANDFETCH_TEST_DATABASE_URL to run the database tests against Postgres")
+	}
+	ctx := context.Background()
+
+	admin, err := pgx.Connect(ctx, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := fmt.Sprintf("brandfetch_test_%d", time.Now().UnixNano())
+	if _, err := admin.Exec(ctx, "create schema "+schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		admin.Exec(context.Background(), "drop schema "+schema+" cascade")
+		admin.Close(context.Background())
+	})
+
+	cfg, err := pgxpool.ParseConfig(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ConnConfig.RuntimeParams["search_path"] = schema + ", public"
+	pool, err := pgxpool.NewWithConfig(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(pool.Close)
+	return pool
+}
+
+func TestRetryDelay(t *testing.T) {
+	for attempts, want := range map[int]time.Duration{
+		0:  time.Minute,
+		1:  time.Minute,
+		2:  2 * time.Minute,
+		5:  16 * time.Minute,
+		10: 6 * time.Hour,
+		80: 6 * time.Hour,
+	} {
+		if got := retryDelay(attempts); got != want {
+			t.Errorf("retryDelay(%d) = %v, want %v", attempts, got, want)
+		}
+	}
+}
+
+func TestQueueLeases(t *testing.T) {
+	pool := testPool(t)
+	ctx := context.Background()
+	if err := seedRawTransactions(ctx, pool, []string{"SQ *SUSHI HUB MELB"}); err != nil {
+		t.Fatal(err)
+	}
+	expire := func() {
+		t.Helper()
+		if _, err := pool.Exec(ctx, `update raw_transactions set locked_until = now() - interval '1 second'`); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	first := newQueue(pool, time.Minute, 3)
+	second := newQueue(pool, time.Minute, 3)
+
+	tx, ok, err := first.claim(ctx)
+	if err != nil || !ok || tx.Attempts != 1 {
+		t.Fatalf("first claim = %+v, %v, %v", tx, ok, err)
+	}
+	if _, ok, err := second.claim(ctx); err != nil || ok {
+		t.Fatalf("claimed a leased row: %v, %v", ok, err)
+	}
+	if err := first.renew(ctx, tx); err != nil {
+		t.Errorf("renew = %v", err)
+	}
+
+	// The first worker hangs until its lease runs out
+	expire()
+	taken, ok, err := second.claim(ctx)
+	if err != nil || !ok || taken.ID != tx.ID || taken.Attempts != 2 {
+		t.Fatalf("claim of an expired lease = %+v, %v, %v", taken, ok, err)
+	}
+	if err := first.complete(ctx, tx); !errors.Is(err, errLeaseLost) {
+		t.Errorf("complete after losing the lease = %v", err)
+	}
+	if err := first.renew(ctx, tx); !errors.Is(err, errLeaseLost) {
+		t.Errorf("renew after losing the lease = %v", err)
+	}
+	if _, err := first.retry(ctx, tx, errors.New("boom")); !errors.Is(err, errLeaseLost) {
+		t.Errorf("retry after losing the lease = %v", err)
+	}
+	if err := first.release(ctx, tx); !errors.Is(err, errLeaseLost) {
+		t.Errorf("release after losing the lease = %v", err)
+	}
+
+	// The last attempt is dead-lettered by the reaper rather than claimed
+	expire()
+	if _, err := pool.Exec(ctx, `update raw_transactions set attempts = 3`); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := first.claim(ctx); err != nil || ok {
+		t.Fatalf("claimed an expired row with no attempts left: %v, %v", ok, err)
+	}
+	if n, err := first.reapExpired(ctx); err != nil || n != 1 {
+		t.Fatalf("reapExpired = %d, %v", n, err)
+	}
+	var status string
+	if err := pool.QueryRow(ctx, `select status from raw_transactions`).Scan(&status); err != nil || status != statusFailed {
+		t.Errorf("status = %q, %v; want failed", status, err)
+	}
+}
+
+func TestQueueKeepLease(t *testing.T) {
+	pool := testPool(t)
+	ctx := context.Background()
+	if err := seedRawTransactions(ctx, pool, []string{"PAYPAL *SPOTIFY"}); err != nil {
+		t.Fatal(err)
+	}
+
+	q := newQueue(pool, 300*time.Millisecond, 3)
+	tx, ok, err := q.claim(ctx)
+	if err != nil || !ok {
+		t.Fatalf("claim = %v, %v", ok, err)
+	}
+
+	// A slow lookup outlives several leases without being reclaimed
+	stop := q.keepLease(ctx, tx)
+	time.Sleep(time.Second)
+	if _, ok, err := newQueue(pool, time.Minute, 3).claim(ctx); err != nil || ok {
+		t.Errorf("another worker claimed a row under a renewed lease: %v, %v", ok, err)
+	}
+	stop()
+	if err := q.complete(ctx, tx); err != nil {
+		t.Errorf("complete = %v", err)
+	}
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"merchantcache/provenance"
+	"merchantcache/ratelimit"
+)
+
+// freshnessPolicy is how long each field's value is trusted before refresh
+// asks the providers again.
+type freshnessPolicy map[provenance.Field]time.Duration
+
+// loadFreshnessPolicy gives brand fields 30 days and legal entity fields
+// 90, each overridable with REFRESH_MAX_AGE_<FIELD>, e.g.
+// REFRESH_MAX_AGE_ABN=720h.
+func loadFreshnessPolicy() freshnessPolicy {
+	const (
+		brand  = 30 * 24 * time.Hour
+		entity = 90 * 24 * time.Hour
+	)
+	p := freshnessPolicy{
+		provenance.BrandName:  brand,
+		provenance.Website:    brand,
+		provenance.Logo:       brand,
+		provenance.Category:   brand,
+		provenance.LegalName:  entity,
+		provenance.ABN:        entity,
+		provenance.ACN:        entity,
+		provenance.HeadOffice: entity,
+	}
+	for field, d := range p {
+		p[field] = getenvDuration("REFRESH_MAX_AGE_"+strings.ToUpper(string(field)), d)
+	}
+	return p
+}
+
+func (p freshnessPolicy) shortest() time.Duration {
+	var shortest time.Duration
+	for _, d := range p {
+		if shortest == 0 || d < shortest {
+			shortest = d
+		}
+	}
+	return shortest
+}
+
+// refreshStats counts how each refreshed row ended. Lost rows no longer
+// match anything and were left as they were, apart from being marked
+// verified.
+type refreshStats struct {
+	Checked   int
+	Changed   int
+	Unchanged int
+	Lost      int
+	Failed    int
+	APICalls  int
+}
+
+// How a refreshed row ended.
+const (
+	refreshChanged   = "changed"
+	refreshUnchanged = "unchanged"
+	refreshLost      = "lost"
+)
+
+// refreshColumns are the enriched_merchants columns refresh compares.
+var refreshColumns = []struct {
+	field  provenance.Field
+	column string
+}{
+	{provenance.BrandName, "brand_name"},
+	{provenance.Website, "website_url"},
+	{provenance.Logo, "logo"},
+	{provenance.LegalName, "legal_name"},
+	{provenance.ABN, "abn_head_office"},
+	{provenance.ACN, "acn_head_office"},
+	{provenance.HeadOffice, "head_office_address"},
+}
+
+// fetchStaleRows returns up to limit rows holding a field older than the
+// policy allows, oldest first, skipping rows verified since. Rows enriched
+// before provenance was recorded are judged by when they were last
+// verified.
+func fetchStaleRows(ctx context.Context, pool *pgxpool.Pool, policy freshnessPolicy, limit int) ([]RawTransaction, error) {
+	fields := make([]string, 0, len(policy))
+	maxAges := make([]float64, 0, len(policy))
+	for f, d := range policy {
+		fields = append(fields, string(f))
+		maxAges = append(maxAges, d.Seconds())
+	}
+
+	rows, err := pool.Query(ctx, `
+		with policy as (
+			select * from unnest($1::text[], $2::float8[]) as p(field, max_age)
+		),
+		stale as (
+			select p.transaction_cache, min(p.fetched_at) as oldest
+			from field_provenance p
+			join policy on policy.field = p.field
+			left join enriched_merchants e on e.transaction_cache = p.transaction_cache
+			where p.source <> 'manual'
+			  and p.fetched_at < now() - make_interval(secs => policy.max_age)
+			  and coalesce(e.last_verified_at, p.fetched_at) < now() - make_interval(secs => policy.max_age)
+			group by p.transaction_cache
+			union all
+			select e.transaction_cache, coalesce(e.last_verified_at, e.created_at)
+			from enriched_merchants e
+			where coalesce(e.last_verified_at, e.created_at) < now() - make_interval(secs => $3)
+			  and not exists (select 1 from field_provenance p where p.transaction_cache = e.transaction_cache)
+		)
+		select s.transaction_cache, coalesce(r.location_state, '')
+		from stale s
+		left join raw_transactions r on r.description = s.transaction_cache
+		order by s.oldest
+		limit $4
+	`, fields, maxAges, policy.shortest().Seconds(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []RawTransaction
+	for rows.Next() {
+		var tx RawTransaction
+		if err := rows.Scan(&tx.Description, &tx.LocationState); err != nil {
+			return nil, err
+		}
+		out = append(out, tx)
+	}
+	return out, rows.Err()
+}
+
+func currentValues(ctx context.Context, pool *pgxpool.Pool, transactionCache string) (map[provenance.Field]string, error) {
+	cols := make([]string, len(refreshColumns))
+	vals := make([]string, len(refreshColumns))
+	dest := make([]any, len(refreshColumns))
+	for i, c := range refreshColumns {
+		cols[i] = "coalesce(" + c.column + ", '')"
+		dest[i] = &vals[i]
+	}
+	err := pool.QueryRow(ctx, `select `+strings.Join(cols, ", ")+` from enriched_merchants where transaction_cache = $1`,
+		transactionCache).Scan(dest...)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[provenance.Field]string, len(refreshColumns))
+	for i, c := range refreshColumns {
+		out[c.field] = vals[i]
+	}
+	return out, nil
+}
+
+// resolvedValues lists what a fresh lookup found, by field. Fields the
+// lookup had nothing for are left out rather than blanked.
+func resolvedValues(r rowResult) map[provenance.Field]string {
+	out := map[provenance.Field]string{
+		provenance.BrandName: r.Row.BrandName,
+		provenance.Website:   r.Row.WebsiteURL,
+		provenance.Logo:      r.Row.Logo,
+	}
+	if r.ABR != nil && !r.ABR.ABN.IsZero() {
+		out[provenance.LegalName] = r.ABR.LegalName
+		out[provenance.ABN] = r.ABR.ABN.String()
+		if !r.ABR.ACN.IsZero() {
+			out[provenance.ACN] = r.ABR.ACN.String()
+		}
+		out[provenance.HeadOffice] = r.ABR.HeadOffice
+	}
+	for f, v := range out {
+		if v == "" {
+			delete(out, f)
+		}
+	}
+	return out
+}
+
+// resultSources lists the sources a lookup's values came from.
+func resultSources(r rowResult) []provenance.Source {
+	records := r.Provenance
+	if r.ABR != nil {
+		records = append(append([]provenance.Record(nil), records...), r.ABR.Provenance...)
+	}
+	var out []provenance.Source
+	seen := map[provenance.Source]bool{}
+	for _, rec := range records {
+		if !seen[rec.Source] {
+			seen[rec.Source] = true
+			out = append(out, rec.Source)
+		}
+	}
+	return out
+}
+
+type fieldChange struct {
+	Field provenance.Field `json:"field"`
+	Old   string           `json:"old"`
+	New   string           `json:"new"`
+}
+
+func diffValues(old, new map[provenance.Field]string) []fieldChange {
+	var out []fieldChange
+	for _, c := range refreshColumns {
+		if v, ok := new[c.field]; ok && v != old[c.field] {
+			out = append(out, fieldChange{Field: c.field, Old: old[c.field], New: v})
+		}
+	}
+	return out
+}
+
+func recordChanges(ctx context.Context, pool *pgxpool.Pool, transactionCache string, changes []fieldChange) error {
+	for _, c := range changes {
+		_, err := pool.Exec(ctx, `
+			insert into refresh_changes (transaction_cache, field, old_value, new_value)
+			values ($1, $2, $3, $4)
+		`, transactionCache, string(c.Field), nullIfEmpty(c.Old), nullIfEmpty(c.New))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// refresher re-runs enrichment for stale rows. Its providers skip the
+// response cache, since the point is to ask them again, and share one
+// request budget.
+type refresher struct {
+	pool      *pgxpool.Pool
+	providers *providerSet
+	cfg       Config
+}
+
+// refreshRow looks a row up again and writes it only when a value changed.
+// Unchanged rows, and rows that no longer match, just have their
+// verification time bumped. A lookup the budget cut short fails with
+// ratelimit.ErrBudgetSpent and leaves the row for the next run.
+func (r *refresher) refreshRow(ctx context.Context, tx RawTransaction) (string, error) {
+	desc := tx.Description
+	current, err := currentValues(ctx, r.pool, desc)
+	if err != nil {
+		return "", err
+	}
+
+	res, err := resolveRow(ctx, r.providers, tx)
+	if err != nil {
+		return "", err
+	}
+
+	outcome := refreshUnchanged
+	switch changes := diffValues(current, resolvedValues(res)); {
+	case !res.Matched:
+		fmt.Printf("%s: no longer matched, kept as is\n", desc)
+		outcome = refreshLost
+	case len(changes) > 0:
+		if _, err := writeRow(ctx, r.pool, res, r.cfg); err != nil {
+			return "", err
+		}
+		if err := recordChanges(ctx, r.pool, desc, changes); err != nil {
+			return "", err
+		}
+		for _, c := range changes {
+			fmt.Printf("%s: %s %q -> %q\n", desc, c.Field, c.Old, c.New)
+		}
+		outcome = refreshChanged
+	default:
+		if err := provenance.Touch(ctx, r.pool, desc, resultSources(res)); err != nil {
+			return "", err
+		}
+	}
+
+	if _, err := r.pool.Exec(ctx, `update enriched_merchants set last_verified_at = now() where transaction_cache = $1`, desc); err != nil {
+		return "", err
+	}
+	return outcome, nil
+}
+
+// refreshOnce refreshes the stalest rows until none are left or the
+// budget of provider API calls is spent.
+func refreshOnce(ctx context.Context, pool *pgxpool.Pool, cfg Config, policy freshnessPolicy, budget int) (refreshStats, error) {
+	b := ratelimit.NewBudget(budget)
+	wrap := func(base http.RoundTripper, _ string) http.RoundTripper {
+		return ratelimit.NewBudgetTransport(base, b)
+	}
+	ps, closeProviders, err := newProviders(ctx, cfg, wrap)
+	if err != nil {
+		return refreshStats{}, err
+	}
+	defer closeProviders()
+	r := &refresher{pool: pool, providers: ps, cfg: cfg}
+
+	// Every row costs at least one call, so the budget also caps the rows
+	limit := budget
+	if limit <= 0 {
+		limit = 1000
+	}
+	rows, err := fetchStaleRows(ctx, pool, policy, limit)
+	if err != nil {
+		return refreshStats{}, fmt.Errorf("find stale rows: %w", err)
+	}
+
+	workers := cfg.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	var (
+		mu       sync.Mutex
+		stats    refreshStats
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	jobs := make(chan RawTransaction)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for tx := range jobs {
+				outcome, err := r.refreshRow(ctx, tx)
+
+				mu.Lock()
+				switch {
+				case err == nil:
+					stats.Checked++
+					switch outcome {
+					case refreshChanged:
+						stats.Changed++
+					case refreshUnchanged:
+						stats.Unchanged++
+					case refreshLost:
+						stats.Lost++
+					}
+				case errors.Is(err, ratelimit.ErrBudgetSpent), ctx.Err() != nil:
+				case abortRow(ctx, err):
+					stats.Failed++
+					fmt.Printf("%s: refresh failed, will retry next run (%v)\n", tx.Description, err)
+				default:
+					if firstErr == nil {
+						firstErr = err
+						cancel()
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+dispatch:
+	for _, tx := range rows {
+		if b.Spent() {
+			break
+		}
+		select {
+		case jobs <- tx:
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	stats.APICalls = b.Used()
+	return stats, firstErr
+}
+
+// runRefresh handles `brandfetch refresh [-budget n] [-every d]`. Without
+// -every it makes one pass; with it, it keeps refreshing on that interval
+// until stopped.
+func runRefresh(ctx context.Context, pool *pgxpool.Pool, args []string) error {
+	fs := flag.NewFlagSet("refresh", flag.ContinueOnError)
+	every := fs.Duration("every", 0, "keep running, refreshing on this interval")
+	budget := fs.Int("budget", getenvInt("REFRESH_BUDGET", 1000), "most provider API calls per pass; 0 for no limit")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	policy := loadFreshnessPolicy()
+
+	pass := func() error {
+		stats, err := refreshOnce(ctx, pool, cfg, policy, *budget)
+		fmt.Printf("Refresh: %d checked, %d changed, %d unchanged, %d no longer matched, %d failed; %d API calls",
+			stats.Checked, stats.Changed, stats.Unchanged, stats.Lost, stats.Failed, stats.APICalls)
+		if *budget > 0 {
+			fmt.Printf(" of %d", *budget)
+		}
+		fmt.Println()
+		return err
+	}
+
+	if *every <= 0 {
+		return pass()
+	}
+
+	ticker := time.NewTicker(*every)
+	defer ticker.Stop()
+	for {
+		if err := pass(); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			fmt.Printf("Refresh pass failed: %v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
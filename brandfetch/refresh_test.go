@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"merchantcache/provenance"
+)
+
+func TestFetchStaleRowsSkipsVerified(t *testing.T) {
+	pool := testPool(t)
+	ctx := context.Background()
+	const desc = "SQ *SUSHI HUB MELB"
+
+	if err := upsertEnriched(ctx, pool, EnrichedRow{TransactionCache: desc, BrandName: "Sushi Hub", FullResponse: []byte(`null`)}); err != nil {
+		t.Fatal(err)
+	}
+	old := provenance.New(provenance.BrandName, "Sushi Hub", provenance.SourceBrandfetch, 80, nil)
+	old.FetchedAt = time.Now().Add(-60 * 24 * time.Hour)
+	if err := provenance.Save(ctx, pool, desc, []provenance.Record{old}); err != nil {
+		t.Fatal(err)
+	}
+
+	policy := freshnessPolicy{provenance.BrandName: 30 * 24 * time.Hour}
+	stale := func() int {
+		t.Helper()
+		rows, err := fetchStaleRows(ctx, pool, policy, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(rows)
+	}
+	if n := stale(); n != 1 {
+		t.Fatalf("%d stale rows, want 1", n)
+	}
+	// A refresh that found nothing any more still counts as a check
+	if _, err := pool.Exec(ctx, `update enriched_merchants set last_verified_at = now()`); err != nil {
+		t.Fatal(err)
+	}
+	if n := stale(); n != 0 {
+		t.Errorf("%d stale rows after verifying, want 0", n)
+	}
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"merchantcache/abn/config"
+	"merchantcache/abn/data"
+	"merchantcache/abn/merchants"
+	"merchantcache/abn/pipeline"
+	"merchantcache/cassette"
+	"merchantcache/provider"
+)
+
+// regressABREndpoint is the ABR web service the cassettes are recorded
+// against, whatever ABR_ENDPOINT says.
+const regressABREndpoint = "https://abr.business.gov.au/abrxmlsearch/AbrXmlSearch.asmx/ABRSearchByNameSimpleProtocol"
+
+// regressConfig is what regress builds its clients from: the environment,
+// but with only the built-in chains against the web services. In replay
+// missing credentials are set to cassette.Redacted, so the clients can be
+// built without real ones. secrets are the credentials it holds, which
+// are scrubbed from fixtures and snapshots.
+func regressConfig(mode cassette.Mode) (cfg Config, abrCfg config.Config, pcfg provider.Config, secrets []string) {
+	cfg = configFromEnv()
+	abrCfg = config.LoadFromEnv()
+	abrCfg.ABRIndexDatabaseURL = ""
+	abrCfg.ABREndpoint = regressABREndpoint
+	if mode == cassette.Replay {
+		// A missing fixture is not worth waiting out
+		cfg.MaxRetries = 0
+	}
+
+	for _, v := range []*string{
+		&cfg.BrandfetchAPIKey,
+		&cfg.BrandfetchClientID,
+		&abrCfg.ABRGuid,
+		&abrCfg.GoogleAPIKey,
+		&abrCfg.GoogleSearchEngineID,
+	} {
+		if mode == cassette.Replay && *v == "" {
+			*v = cassette.Redacted
+		}
+		if *v != "" {
+			secrets = append(secrets, *v)
+		}
+	}
+	return cfg, abrCfg, defaultProviderConfig(abrCfg), secrets
+}
+
+// regressRow is the snapshot of one resolved transaction.
+type regressRow struct {
+	Descriptor   string  `json:"descriptor"`
+	BrandName    string  `json:"brand_name,omitempty"`
+	Website      string  `json:"website_url,omitempty"`
+	Logo         string  `json:"logo,omitempty"`
+	BrandfetchID string  `json:"brandfetch_id,omitempty"`
+	Confidence   float64 `json:"confidence"`
+	LegalName    string  `json:"legal_name,omitempty"`
+	ABN          string  `json:"abn,omitempty"`
+	ACN          string  `json:"acn,omitempty"`
+	HeadOffice   string  `json:"head_office,omitempty"`
+	Error        string  `json:"error,omitempty"`
+}
+
+// regressMerchant is the snapshot of one default merchant's ABN and head
+// office lookup.
+type regressMerchant struct {
+	Name       string  `json:"merchant_name"`
+	ABN        string  `json:"abn,omitempty"`
+	ACN        string  `json:"acn,omitempty"`
+	LegalName  string  `json:"legal_name,omitempty"`
+	State      string  `json:"state,omitempty"`
+	Score      string  `json:"score,omitempty"`
+	Verified   bool    `json:"verified"`
+	Confidence float64 `json:"confidence"`
+	HeadOffice string  `json:"head_office_address,omitempty"`
+	Postcode   string  `json:"head_office_postcode,omitempty"`
+	GoogleABN  string  `json:"google_abn,omitempty"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// runRegress resolves every descriptor in the transactions file through
+// the Brandfetch and ABR chains, and the default merchants through the ABN
+// pipeline, with every request served from the cassettes under -dir. The
+// results are compared with the snapshots there. -record sends the
+// requests for real and saves their responses; -update rewrites the
+// snapshots. Nothing touches the database.
+func runRegress(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("regress", flag.ContinueOnError)
+	record := fs.Bool("record", false, "call the real APIs and save their responses as cassettes")
+	update := fs.Bool("update", false, "rewrite the snapshots from this run instead of comparing")
+	dir := fs.String("dir", "testdata", "directory holding cassettes/ and the snapshots")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	mode := cassette.Replay
+	if *record {
+		mode = cassette.Record
+	}
+	cfg, abrCfg, pcfg, secrets := regressConfig(mode)
+	if cfg.BrandfetchAPIKey == "" || cfg.BrandfetchClientID == "" {
+		return errors.New("BRANDFETCH_API_KEY and BRANDFETCH_CLIENT_ID are required with -record")
+	}
+
+	// Every client gets its own cassette over its own rate limit
+	var tapes []*cassette.Transport
+	wrap := func(base http.RoundTripper, _ string) http.RoundTripper {
+		t := cassette.New(base, filepath.Join(*dir, "cassettes"), mode)
+		tapes = append(tapes, t)
+		return t
+	}
+	ps, closeProviders, err := buildProviders(ctx, cfg, abrCfg, pcfg, wrap)
+	if err != nil {
+		return err
+	}
+	defer closeProviders()
+	if ps.entity.Empty() {
+		return errors.New("ABR_GUID is required with -record")
+	}
+	scrub := func(s string) string {
+		for _, v := range secrets {
+			if len(v) >= 6 {
+				s = strings.ReplaceAll(s, v, cassette.Redacted)
+			}
+		}
+		return s
+	}
+
+	descs, err := loadTransactions(cfg.TransactionsFilePath)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Resolving %d transactions (%s, %s)\n", len(descs), mode, ps)
+	rows := make([]regressRow, len(descs))
+	var (
+		wg   sync.WaitGroup
+		jobs = make(chan int)
+	)
+	for w := 0; w < max(cfg.Workers, 1); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				r, err := resolveRow(ctx, ps, RawTransaction{Description: descs[i]})
+				rows[i] = snapshotRow(descs[i], r, err, scrub)
+			}
+		}()
+	}
+dispatch:
+	for i := range descs {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	names := abrCfg.GetMerchants()
+	fmt.Printf("Looking up %d default merchants\n", len(names))
+	found := map[string]regressMerchant{}
+	err = pipeline.NewRunner(ps.entity, ps.address, cfg.Workers).Run(ctx, merchants.FromNames(names), func(res data.Result) {
+		found[res.MerchantName] = snapshotMerchant(res, scrub)
+	})
+	var runErr *pipeline.RunError
+	if errors.As(err, &runErr) {
+		for _, f := range runErr.Failures {
+			found[f.Merchant.Name] = regressMerchant{Name: f.Merchant.Name, Error: scrub(f.Err.Error())}
+		}
+	} else if err != nil {
+		return err
+	}
+	list := make([]regressMerchant, len(names))
+	for i, name := range names {
+		m, ok := found[name]
+		if !ok {
+			m = regressMerchant{Name: name, Error: "no result"}
+		}
+		list[i] = m
+	}
+
+	// Results from missing fixtures are not worth comparing or keeping
+	if err := regressMissing(tapes); err != nil {
+		return err
+	}
+
+	txPath := filepath.Join(*dir, "regress", "transactions.json")
+	merchantsPath := filepath.Join(*dir, "regress", "merchants.json")
+	if *update {
+		if err := writeSnapshot(txPath, rows); err != nil {
+			return err
+		}
+		if err := writeSnapshot(merchantsPath, list); err != nil {
+			return err
+		}
+		fmt.Printf("Updated %s and %s\n", txPath, merchantsPath)
+		return nil
+	}
+
+	failed := 0
+	n, err := compareSnapshot(txPath, rows, func(r regressRow) string { return r.Descriptor })
+	if err != nil {
+		return err
+	}
+	failed += n
+	n, err = compareSnapshot(merchantsPath, list, func(m regressMerchant) string { return m.Name })
+	if err != nil {
+		return err
+	}
+	failed += n
+	if failed > 0 {
+		return fmt.Errorf("%d results differ from the snapshots; run brandfetch regress -update if the change is intended", failed)
+	}
+	fmt.Printf("Regress: %d transactions and %d merchants match the snapshots\n", len(rows), len(list))
+	return nil
+}
+
+// regressMissing fails when replay had no fixture for some request, which
+// means the cassettes need recording again.
+func regressMissing(tapes []*cassette.Transport) error {
+	seen := map[string]bool{}
+	var missing []string
+	for _, t := range tapes {
+		for _, m := range t.Missing() {
+			if !seen[m] {
+				seen[m] = true
+				missing = append(missing, m)
+			}
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	sort.Strings(missing)
+	for _, m := range missing {
+		fmt.Printf("  no fixture: %s\n", m)
+	}
+	return fmt.Errorf("%d requests have no fixture; run brandfetch regress -record", len(missing))
+}
+
+func snapshotRow(desc string, r rowResult, err error, scrub func(string) string) regressRow {
+	if err != nil {
+		return regressRow{Descriptor: desc, Error: scrub(err.Error())}
+	}
+	row := regressRow{
+		Descriptor:   desc,
+		BrandName:    r.Row.BrandName,
+		Website:      r.Row.WebsiteURL,
+		Logo:         scrub(r.Row.Logo),
+		BrandfetchID: r.Row.BrandfetchID,
+		Confidence:   round2(r.Row.ConfidenceScore),
+	}
+	if r.ABR != nil {
+		row.LegalName = r.ABR.LegalName
+		row.ABN = string(r.ABR.ABN)
+		row.ACN = string(r.ABR.ACN)
+		row.HeadOffice = r.ABR.HeadOffice
+	}
+	return row
+}
+
+func snapshotMerchant(res data.Result, scrub func(string) string) regressMerchant {
+	return regressMerchant{
+		Name:       res.MerchantName,
+		ABN:        string(res.ABN),
+		ACN:        string(res.ACN),
+		LegalName:  res.LegalName,
+		State:      res.State,
+		Score:      res.Score,
+		Verified:   res.Verified,
+		Confidence: round2(res.Confidence),
+		HeadOffice: scrub(res.Address),
+		Postcode:   res.Postcode,
+		GoogleABN:  string(res.GoogleABN),
+	}
+}
+
+func round2(f float64) float64 {
+	return math.Round(f*100) / 100
+}
+
+func writeSnapshot(path string, v any) error {
+	raw, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(raw, '\n'), 0o644)
+}
+
+// compareSnapshot prints every entry of got that differs from the snapshot
+// at path, field by field, and returns how many did.
+func compareSnapshot[T comparable](path string, got []T, key func(T) string) (int, error) {
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, fmt.Errorf("no snapshot at %s; run brandfetch regress -update", path)
+	}
+	if err != nil {
+		return 0, err
+	}
+	var want []T
+	if err := json.Unmarshal(raw, &want); err != nil {
+		return 0, fmt.Errorf("parse snapshot %s: %w", path, err)
+	}
+	wantBy := make(map[string]T, len(want))
+	for _, w := range want {
+		wantBy[key(w)] = w
+	}
+
+	failed := 0
+	seen := map[string]bool{}
+	for _, g := range got {
+		k := key(g)
+		seen[k] = true
+		w, ok := wantBy[k]
+		if !ok {
+			fmt.Printf("%s: %s is not in the snapshot\n", filepath.Base(path), k)
+			failed++
+			continue
+		}
+		if w == g {
+			continue
+		}
+		failed++
+		fmt.Printf("%s: %s changed\n", filepath.Base(path), k)
+		for _, line := range snapshotDiff(w, g) {
+			fmt.Printf("  %s\n", line)
+		}
+	}
+	for _, w := range want {
+		if !seen[key(w)] {
+			fmt.Printf("%s: %s is no longer looked up\n", filepath.Base(path), key(w))
+			failed++
+		}
+	}
+	return failed, nil
+}
+
+// snapshotDiff lists the JSON fields that differ between two entries.
+func snapshotDiff(old, new any) []string {
+	fields := func(v any) map[string]any {
+		m := map[string]any{}
+		raw, _ := json.Marshal(v)
+		json.Unmarshal(raw, &m)
+		return m
+	}
+	o, n := fields(old), fields(new)
+	keys := map[string]bool{}
+	for k := range o {
+		keys[k] = true
+	}
+	for k := range n {
+		keys[k] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+
+	str := func(v any) string {
+		if v == nil || v == "" {
+			return "(none)"
+		}
+		return fmt.Sprint(v)
+	}
+	var out []string
+	for _, k := range sorted {
+		if str(o[k]) != str(n[k]) {
+			out = append(out, fmt.Sprintf("%s: %s -> %s", k, str(o[k]), str(n[k])))
+		}
+	}
+	return out
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"merchantcache/cassette"
+)
+
+// TestRegress replays testdata/cassettes through the brand, entity and
+// address chains and the ABN pipeline, and compares the results with the
+// snapshots in testdata/regress. It runs offline and needs no credentials,
+// but only once they have been recorded against the live services with
+// brandfetch regress -record -update; until then it is skipped.
+func TestRegress(t *testing.T) {
+	for _, path := range []string{
+		filepath.Join("testdata", "cassettes"),
+		filepath.Join("testdata", "regress", "transactions.json"),
+		filepath.Join("testdata", "regress", "merchants.json"),
+	} {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			t.Skipf("no %s; record it with brandfetch regress -record -update and real credentials", path)
+		}
+	}
+
+	// Whatever else the environment holds would change what is requested
+	// or how it is ranked
+	for _, key := range []string{
+		"ABR_MATCH_THRESHOLD",
+		"TRANSACTIONS_FILE",
+		"COUNTRY_TLD_PREFERENCE",
+		"BRANDFETCH_API_KEY",
+		"BRANDFETCH_CLIENT_ID",
+		"ABR_GUID",
+		"GOOGLE_API_KEY",
+		"GOOGLE_SEARCH_ENGINE_ID",
+	} {
+		t.Setenv(key, "")
+	}
+
+	if err := runRegress(context.Background(), []string{"-dir", "testdata"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRegressConfig(t *testing.T) {
+	t.Setenv("PROVIDERS_FILE", filepath.Join(t.TempDir(), "providers.json"))
+	t.Setenv("ABR_INDEX_DATABASE_URL", "postgres://localhost/abr")
+	t.Setenv("ABR_ENDPOINT", "http://localhost:8080/ABRSearchByName")
+	t.Setenv("BRANDFETCH_API_KEY", "bf-key-123456")
+	t.Setenv("BRANDFETCH_CLIENT_ID", "")
+	t.Setenv("ABR_GUID", "")
+	t.Setenv("GOOGLE_API_KEY", "")
+	t.Setenv("GOOGLE_SEARCH_ENGINE_ID", "")
+
+	cfg, abrCfg, pcfg, secrets := regressConfig(cassette.Replay)
+	if abrCfg.ABRIndexEnabled() || abrCfg.ABREndpoint != regressABREndpoint {
+		t.Errorf("abr index %q, endpoint %q, want the web service the cassettes hold", abrCfg.ABRIndexDatabaseURL, abrCfg.ABREndpoint)
+	}
+	if cfg.BrandfetchClientID != cassette.Redacted || abrCfg.ABRGuid != cassette.Redacted {
+		t.Errorf("missing credentials = %q, %q, want them redacted", cfg.BrandfetchClientID, abrCfg.ABRGuid)
+	}
+	if cfg.MaxRetries != 0 {
+		t.Errorf("replay retries %d times", cfg.MaxRetries)
+	}
+	if want := defaultProviderConfig(abrCfg); !reflect.DeepEqual(pcfg, want) {
+		t.Errorf("providers = %+v, want the built-in chains", pcfg)
+	}
+	if secrets[0] != "bf-key-123456" {
+		t.Errorf("secrets = %v, want the real key scrubbed", secrets)
+	}
+
+	// The environment is left as it was
+	for key, want := range map[string]string{
+		"ABR_INDEX_DATABASE_URL": "postgres://localhost/abr",
+		"ABR_ENDPOINT":           "http://localhost:8080/ABRSearchByName",
+		"ABR_GUID":               "",
+	} {
+		if got := os.Getenv(key); got != want {
+			t.Errorf("%s = %q after regressConfig, want %q", key, got, want)
+		}
+	}
+}
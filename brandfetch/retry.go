@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"merchantcache/ratelimit"
+)
+
+// retryBackoff spaces out retries of 429s, 5xxs and network errors.
+var retryBackoff = ratelimit.Backoff{Base: 1 * time.Second, Max: 60 * time.Second}
+
+// transientError marks a failure that may succeed later: a 429, a 5xx or a
+// network error that outlasted every retry. Rows that hit one stay pending.
+type transientError struct {
+	err error
+}
+
+func (e *transientError) Error() string { return e.err.Error() }
+func (e *transientError) Unwrap() error { return e.err }
+
+func isTransient(err error) bool {
+	var t *transientError
+	return errors.As(err, &t)
+}
+
+// statusError is a non-200 response from the Brandfetch API.
+type statusError struct {
+	api    string
+	status int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s status %d", e.api, e.status)
+}
+
+// getWithRetry sends GET requests built by newReq until one returns 200,
+// retrying 429s, 5xxs and network errors up to maxRetries times. Waits
+// honour Retry-After and otherwise back off exponentially. The caller must
+// close the returned body.
+func getWithRetry(ctx context.Context, client *http.Client, api string, maxRetries int, newReq func() (*http.Request, error)) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := newReq()
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := client.Do(req)
+		var wait time.Duration
+		switch {
+		case err != nil:
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if errors.Is(err, ratelimit.ErrBudgetSpent) {
+				return nil, err
+			}
+			err = &transientError{fmt.Errorf("%s request: %w", api, err)}
+		case resp.StatusCode == http.StatusOK:
+			return resp, nil
+		case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+			wait = retryBackoff.RetryAfter(resp.Header.Get("Retry-After"))
+			resp.Body.Close()
+			err = &transientError{&statusError{api: api, status: resp.StatusCode}}
+		default:
+			resp.Body.Close()
+			return nil, &statusError{api: api, status: resp.StatusCode}
+		}
+
+		if attempt >= maxRetries {
+			return nil, err
+		}
+		if wait == 0 {
+			wait = retryBackoff.Delay(attempt)
+		}
+		fmt.Printf("  %v; retry %d/%d in %s\n", err, attempt+1, maxRetries, wait)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"merchantcache/abn/abr"
+	"merchantcache/merge"
+	"merchantcache/provenance"
+)
+
+const (
+	reviewNoMatch       = "no_match"
+	reviewLowConfidence = "low_confidence"
+)
+
+// overrideColumns maps the fields that can be overridden to their
+// enriched_merchants column.
+var overrideColumns = map[provenance.Field]string{
+	provenance.BrandName: "brand_name",
+	provenance.Website:   "website_url",
+	provenance.Logo:      "logo",
+	provenance.ABN:       "abn_head_office",
+	provenance.LegalName: "legal_name",
+}
+
+// reviewItem is an open row of review_queue.
+type reviewItem struct {
+	ID               int64
+	TransactionCache string
+	Reason           string
+	Confidence       float64
+	CreatedAt        time.Time
+	Golden           merge.Golden
+}
+
+// loadOverrides returns the manual overrides for a row as provenance
+// records, so the golden merge ranks them above every provider.
+func loadOverrides(ctx context.Context, db dbtx, transactionCache string) ([]provenance.Record, error) {
+	rows, err := db.Query(ctx, `
+		select field, value, coalesce(set_by, ''), coalesce(note, ''), set_at
+		from manual_overrides
+		where transaction_cache = $1
+	`, transactionCache)
+	if err != nil {
+		return nil, fmt.Errorf("load overrides for %s: %w", transactionCache, err)
+	}
+	defer rows.Close()
+
+	var out []provenance.Record
+	for rows.Next() {
+		var (
+			field, value, setBy, note string
+			setAt                     time.Time
+		)
+		if err := rows.Scan(&field, &value, &setBy, &note, &setAt); err != nil {
+			return nil, err
+		}
+		r := provenance.New(provenance.Field(field), value, provenance.SourceManual, 100, map[string]string{"set_by": setBy, "note": note})
+		r.FetchedAt = setAt
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+// applyOverrides copies a row's manual overrides over whatever enrichment
+// just wrote to enriched_merchants.
+func applyOverrides(ctx context.Context, db dbtx, transactionCache string, overrides []provenance.Record) error {
+	for _, o := range overrides {
+		column, ok := overrideColumns[o.Field]
+		if !ok {
+			continue
+		}
+		_, err := db.Exec(ctx, `update enriched_merchants set `+column+` = $2 where transaction_cache = $1`,
+			transactionCache, nullIfEmpty(o.Value))
+		if err != nil {
+			return fmt.Errorf("apply %s override for %s: %w", o.Field, transactionCache, err)
+		}
+	}
+	return nil
+}
+
+// triage queues a row for review when its golden record has no brand or a
+// brand below threshold, and drops a still open item once a later run is
+// confident. Rows with a manual brand are never queued.
+func triage(ctx context.Context, db dbtx, g merge.Golden, threshold float64) (queued bool, err error) {
+	brand, ok := g.Fields[provenance.BrandName]
+	if ok && brand.Source == provenance.SourceManual {
+		return false, nil
+	}
+
+	var reason string
+	switch {
+	case !ok || brand.Value == "":
+		reason = reviewNoMatch
+	case brand.Confidence < threshold:
+		reason = reviewLowConfidence
+	default:
+		_, err := db.Exec(ctx, `delete from review_queue where transaction_cache = $1 and status = 'open'`, g.Key)
+		return false, err
+	}
+
+	candidates, err := json.Marshal(g)
+	if err != nil {
+		return false, err
+	}
+	_, err = db.Exec(ctx, `
+		insert into review_queue (transaction_cache, reason, confidence, candidates)
+		values ($1, $2, $3, $4::jsonb)
+		on conflict (transaction_cache) do update set
+			reason = excluded.reason,
+			confidence = excluded.confidence,
+			candidates = excluded.candidates,
+			updated_at = now()
+		where review_queue.status = 'open'
+	`, g.Key, reason, brand.Confidence, string(candidates))
+	if err != nil {
+		return false, fmt.Errorf("queue %s for review: %w", g.Key, err)
+	}
+	return true, nil
+}
+
+func countOpenReviews(ctx context.Context, pool *pgxpool.Pool) (int, error) {
+	var n int
+	err := pool.QueryRow(ctx, `select count(*) from review_queue where status = 'open'`).Scan(&n)
+	return n, err
+}
+
+func listReviews(ctx context.Context, pool *pgxpool.Pool, limit int) ([]reviewItem, error) {
+	rows, err := pool.Query(ctx, `
+		select id, transaction_cache, reason, coalesce(confidence, 0), created_at, candidates::text
+		from review_queue
+		where status = 'open'
+		order by created_at, id
+		limit $1
+	`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []reviewItem
+	for rows.Next() {
+		var (
+			it         reviewItem
+			candidates string
+		)
+		if err := rows.Scan(&it.ID, &it.TransactionCache, &it.Reason, &it.Confidence, &it.CreatedAt, &candidates); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(candidates), &it.Golden); err != nil {
+			return nil, fmt.Errorf("review %d: bad candidates: %w", it.ID, err)
+		}
+		out = append(out, it)
+	}
+	return out, rows.Err()
+}
+
+// reviewTarget resolves a review id or a raw description to the
+// transaction it refers to.
+func reviewTarget(ctx context.Context, pool *pgxpool.Pool, ref string) (string, error) {
+	id, err := strconv.ParseInt(ref, 10, 64)
+	if err != nil {
+		return ref, nil
+	}
+	var desc string
+	err = pool.QueryRow(ctx, `select transaction_cache from review_queue where id = $1`, id).Scan(&desc)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", fmt.Errorf("no review item %d", id)
+	}
+	return desc, err
+}
+
+// setOverrides stores values for a row by hand and closes its review item
+// with status.
+func setOverrides(ctx context.Context, pool *pgxpool.Pool, transactionCache string, values map[provenance.Field]string, setBy, note, status string) error {
+	err := pgx.BeginFunc(ctx, pool, func(tx pgx.Tx) error {
+		for field, value := range values {
+			_, err := tx.Exec(ctx, `
+				insert into manual_overrides (transaction_cache, field, value, set_by, note)
+				values ($1, $2, $3, $4, $5)
+				on conflict (transaction_cache, field) do update set
+					value = excluded.value,
+					set_by = excluded.set_by,
+					note = excluded.note,
+					set_at = now()
+			`, transactionCache, string(field), value, nullIfEmpty(setBy), nullIfEmpty(note))
+			if err != nil {
+				return err
+			}
+		}
+		_, err := tx.Exec(ctx, `
+			update review_queue
+			set status = $2, resolved_by = $3, resolved_at = now(), updated_at = now()
+			where transaction_cache = $1
+		`, transactionCache, status, nullIfEmpty(setBy))
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("save overrides for %s: %w", transactionCache, err)
+	}
+	return nil
+}
+
+// runReview handles `brandfetch review list|accept|reject|set`.
+func runReview(ctx context.Context, pool *pgxpool.Pool, args []string) error {
+	usage := errors.New(`usage:
+  brandfetch review list [-n 50]
+  brandfetch review accept <id|description> [-by name] [-note text]
+  brandfetch review reject <id|description> [-by name] [-note text]
+  brandfetch review set <id|description> [-brand name] [-domain example.com.au] [-abn 12345678901] [-by name] [-note text]`)
+	if len(args) == 0 {
+		return usage
+	}
+
+	fs := flag.NewFlagSet("review "+args[0], flag.ContinueOnError)
+	limit := fs.Int("n", 50, "how many open items to list")
+	by := fs.String("by", os.Getenv("USER"), "who is making the change")
+	note := fs.String("note", "", "why")
+	brand := fs.String("brand", "", "brand name")
+	domain := fs.String("domain", "", "brand domain")
+	abn := fs.String("abn", "", "ABN")
+
+	if args[0] == "list" {
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		return printReviews(ctx, pool, *limit)
+	}
+
+	if len(args) < 2 {
+		return usage
+	}
+	if err := fs.Parse(args[2:]); err != nil {
+		return err
+	}
+	desc, err := reviewTarget(ctx, pool, args[1])
+	if err != nil {
+		return err
+	}
+	rules, err := loadMergeRules()
+	if err != nil {
+		return err
+	}
+
+	values := map[provenance.Field]string{}
+	var status string
+	switch args[0] {
+	case "accept":
+		// Pin the current automated choices so later runs cannot change them
+		g, err := mergeGolden(ctx, pool, rules, desc)
+		if err != nil {
+			return err
+		}
+		for field := range overrideColumns {
+			if v := g.Value(field); v != "" {
+				values[field] = v
+			}
+		}
+		if values[provenance.BrandName] == "" {
+			return fmt.Errorf("%s has no brand to accept; use review set", desc)
+		}
+		status = "accepted"
+	case "reject":
+		// Blank the brand on purpose so it is neither served nor re-queued
+		values[provenance.BrandName] = ""
+		values[provenance.Website] = ""
+		values[provenance.Logo] = ""
+		status = "rejected"
+	case "set":
+		if *brand == "" && *domain == "" && *abn == "" {
+			return errors.New("review set needs at least one of -brand, -domain or -abn")
+		}
+		if *brand != "" {
+			values[provenance.BrandName] = strings.TrimSpace(*brand)
+		}
+		if *domain != "" {
+			d := domainOf(*domain)
+			values[provenance.Website] = domainToURL(d)
+			if clientID := os.Getenv("BRANDFETCH_CLIENT_ID"); clientID != "" {
+				values[provenance.Logo] = logoURL(d, clientID)
+			}
+		}
+		if *abn != "" {
+			parsed, err := abr.ParseABN(*abn)
+			if err != nil || !parsed.Valid() {
+				return fmt.Errorf("invalid ABN %q", *abn)
+			}
+			values[provenance.ABN] = parsed.String()
+		}
+		status = "overridden"
+	default:
+		return fmt.Errorf("unknown review command %q", args[0])
+	}
+
+	if err := setOverrides(ctx, pool, desc, values, *by, *note, status); err != nil {
+		return err
+	}
+	overrides, err := loadOverrides(ctx, pool, desc)
+	if err != nil {
+		return err
+	}
+	if err := applyOverrides(ctx, pool, desc, overrides); err != nil {
+		return err
+	}
+	if _, err := mergeGolden(ctx, pool, rules, desc); err != nil {
+		return err
+	}
+	fmt.Printf("✓ %s: %s\n", desc, status)
+	return nil
+}
+
+func printReviews(ctx context.Context, pool *pgxpool.Pool, limit int) error {
+	items, err := listReviews(ctx, pool, limit)
+	if err != nil {
+		return err
+	}
+	if len(items) == 0 {
+		fmt.Println("Nothing to review.")
+		return nil
+	}
+	for _, it := range items {
+		fmt.Printf("#%d  %s  [%s, %.0f%%]\n", it.ID, it.TransactionCache, it.Reason, it.Confidence)
+		for _, field := range []provenance.Field{provenance.BrandName, provenance.Website, provenance.LegalName, provenance.ABN} {
+			if r, ok := it.Golden.Fields[field]; ok && r.Value != "" {
+				fmt.Printf("    %-12s %s (%s, %.0f%%)\n", field, r.Value, r.Source, r.Confidence)
+			}
+			for _, l := range it.Golden.Losers[field] {
+				fmt.Printf("    %-12s • %s (%s, %.0f%%)\n", "", l.Value, l.Source, l.Confidence)
+			}
+		}
+	}
+	return nil
+}
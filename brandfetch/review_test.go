@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"merchantcache/merge"
+	"merchantcache/provenance"
+)
+
+// queueForReview writes a row whose only brand is below threshold and
+// settles it, returning its review id.
+func queueForReview(t *testing.T, pool *pgxpool.Pool, desc, brand string) int64 {
+	t.Helper()
+	ctx := context.Background()
+	if err := upsertEnriched(ctx, pool, EnrichedRow{TransactionCache: desc, BrandName: brand, FullResponse: []byte(`null`)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := provenance.Save(ctx, pool, desc, []provenance.Record{
+		provenance.New(provenance.BrandName, brand, provenance.SourceBrandfetch, 40, nil),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	queued, err := settleRow(ctx, pool, Config{MergeRules: merge.DefaultRules(), ReviewThreshold: 60}, desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !queued {
+		t.Fatalf("%s not queued for review", desc)
+	}
+	var id int64
+	if err := pool.QueryRow(ctx, `select id from review_queue where transaction_cache = $1`, desc).Scan(&id); err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func reviewStatus(t *testing.T, pool *pgxpool.Pool, desc string) string {
+	t.Helper()
+	var status string
+	if err := pool.QueryRow(context.Background(), `select status from review_queue where transaction_cache = $1`, desc).Scan(&status); err != nil {
+		t.Fatal(err)
+	}
+	return status
+}
+
+func TestTriage(t *testing.T) {
+	pool := testPool(t)
+	ctx := context.Background()
+
+	golden := func(brand string, confidence float64) merge.Golden {
+		g := merge.Golden{Key: "KMART 1042", Fields: map[provenance.Field]provenance.Record{}}
+		if brand != "" {
+			g.Fields[provenance.BrandName] = provenance.Record{Field: provenance.BrandName, Value: brand, Source: provenance.SourceBrandfetch, Confidence: confidence}
+		}
+		return g
+	}
+	tests := []struct {
+		name       string
+		g          merge.Golden
+		wantQueued bool
+		wantReason string
+	}{
+		{name: "no brand", g: golden("", 0), wantQueued: true, wantReason: reviewNoMatch},
+		{name: "low confidence", g: golden("Kmart", 30), wantQueued: true, wantReason: reviewLowConfidence},
+		{name: "confident drops the open item", g: golden("Kmart", 90)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queued, err := triage(ctx, pool, tt.g, 60)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if queued != tt.wantQueued {
+				t.Errorf("queued = %v, want %v", queued, tt.wantQueued)
+			}
+			items, err := listReviews(ctx, pool, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch {
+			case !tt.wantQueued && len(items) != 0:
+				t.Errorf("open items %+v, want none", items)
+			case tt.wantQueued && (len(items) != 1 || items[0].Reason != tt.wantReason):
+				t.Errorf("open items %+v, want one %s", items, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestReviewAccept(t *testing.T) {
+	pool := testPool(t)
+	ctx := context.Background()
+	t.Setenv("MERGE_RULES_FILE", "")
+	const desc = "KMART 1042 BONDI"
+	id := queueForReview(t, pool, desc, "Kmart")
+
+	if err := runReview(ctx, pool, []string{"accept", strconv.FormatInt(id, 10), "-by", "ana"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := reviewStatus(t, pool, desc); got != "accepted" {
+		t.Errorf("status = %q, want accepted", got)
+	}
+	var brand, setBy string
+	err := pool.QueryRow(ctx, `select value, set_by from manual_overrides where transaction_cache = $1 and field = 'brand_name'`, desc).Scan(&brand, &setBy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if brand != "Kmart" || setBy != "ana" {
+		t.Errorf("override = %q by %q", brand, setBy)
+	}
+
+	// The pinned brand keeps the row out of the queue on later runs
+	queued, err := settleRow(ctx, pool, Config{MergeRules: merge.DefaultRules(), ReviewThreshold: 60}, desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := countOpenReviews(ctx, pool); queued || n != 0 {
+		t.Errorf("requeued after accept: queued %v, %d open", queued, n)
+	}
+}
+
+func TestReviewReject(t *testing.T) {
+	pool := testPool(t)
+	ctx := context.Background()
+	t.Setenv("MERGE_RULES_FILE", "")
+	const desc = "SQ *MARKET STALL"
+	queueForReview(t, pool, desc, "Market Stall Co")
+
+	if err := runReview(ctx, pool, []string{"reject", desc}); err != nil {
+		t.Fatal(err)
+	}
+	if got := reviewStatus(t, pool, desc); got != "rejected" {
+		t.Errorf("status = %q, want rejected", got)
+	}
+	var enriched, golden *string
+	if err := pool.QueryRow(ctx, `select brand_name from enriched_merchants where transaction_cache = $1`, desc).Scan(&enriched); err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.QueryRow(ctx, `select brand_name from golden_merchants where transaction_cache = $1`, desc).Scan(&golden); err != nil {
+		t.Fatal(err)
+	}
+	if enriched != nil || golden != nil {
+		t.Errorf("brand after reject: enriched %v, golden %v, want both blank", enriched, golden)
+	}
+}
+
+func TestReviewAcceptWithoutBrand(t *testing.T) {
+	pool := testPool(t)
+	ctx := context.Background()
+	t.Setenv("MERGE_RULES_FILE", "")
+	const desc = "EFTPOS 5521"
+	if _, err := triage(ctx, pool, merge.Golden{Key: desc}, 60); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runReview(ctx, pool, []string{"accept", desc}); err == nil {
+		t.Fatal("accepted a row with no brand")
+	}
+	if got := reviewStatus(t, pool, desc); got != "open" {
+		t.Errorf("status = %q, want it left open", got)
+	}
+}
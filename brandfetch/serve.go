@@ -0,0 +1,506 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"merchantcache/abn/abr"
+	"merchantcache/coalesce"
+	"merchantcache/descriptor"
+)
+
+// maxBatch caps how many descriptors one POST /merchants/batch may ask for.
+const maxBatch = 100
+
+// merchantView is what the lookup service returns for a merchant. Golden
+// record values win over the raw enriched_merchants columns.
+type merchantView struct {
+	Descriptor string `json:"descriptor,omitempty"`
+	BrandName  string `json:"brand_name"`
+	LegalName  string `json:"legal_name,omitempty"`
+	ABN        string `json:"abn,omitempty"`
+	ACN        string `json:"acn,omitempty"`
+	Website    string `json:"website,omitempty"`
+	Logo       string `json:"logo,omitempty"`
+	Category   string `json:"category,omitempty"`
+	HeadOffice string `json:"head_office_address,omitempty"`
+	Source     string `json:"source"` // "cache", or "enriched" when looked up for this request
+}
+
+const merchantColumns = `
+	e.transaction_cache,
+	coalesce(g.brand_name, e.brand_name, ''),
+	coalesce(g.legal_name, e.legal_name, ''),
+	coalesce(g.abn, e.abn_head_office, ''),
+	coalesce(g.acn, e.acn_head_office, ''),
+	coalesce(g.website_url, e.website_url, ''),
+	coalesce(g.logo, e.logo, ''),
+	coalesce(g.category, ''),
+	coalesce(g.head_office_address, e.head_office_address, '')
+`
+
+func scanMerchant(row pgx.Row) (merchantView, error) {
+	var m merchantView
+	err := row.Scan(&m.Descriptor, &m.BrandName, &m.LegalName, &m.ABN, &m.ACN, &m.Website, &m.Logo, &m.Category, &m.HeadOffice)
+	m.Source = "cache"
+	return m, err
+}
+
+// errNotCached means the cache has nothing for a descriptor yet.
+var errNotCached = errors.New("not cached")
+
+// errNoMatch means the descriptor was looked up before and nothing matched.
+var errNoMatch = errors.New("no match")
+
+// server answers merchant lookups from enriched_merchants and, when an
+// enricher is configured, fills misses inline.
+type server struct {
+	pool     *pgxpool.Pool
+	enricher *inlineEnricher
+}
+
+// cached finds a descriptor's merchant: its own row first, then any row
+// whose descriptor normalised to the same merchant key.
+func (s *server) cached(ctx context.Context, raw string) (merchantView, error) {
+	m, err := scanMerchant(s.pool.QueryRow(ctx, `
+		select `+merchantColumns+`
+		from enriched_merchants e
+		left join golden_merchants g on g.transaction_cache = e.transaction_cache
+		where e.transaction_cache = $1
+	`, raw))
+	if err == nil {
+		if m.BrandName == "" {
+			return merchantView{}, errNoMatch
+		}
+		return m, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return merchantView{}, err
+	}
+
+	key := descriptor.Normalise(raw).Key
+	if key == "" {
+		return merchantView{}, errNotCached
+	}
+	m, err = scanMerchant(s.pool.QueryRow(ctx, `
+		select `+merchantColumns+`
+		from raw_transactions r
+		join enriched_merchants e on e.transaction_cache = r.description
+		left join golden_merchants g on g.transaction_cache = e.transaction_cache
+		where r.merchant_key = $1
+		  and coalesce(g.brand_name, e.brand_name) is not null
+		order by e.created_at desc
+		limit 1
+	`, key))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return merchantView{}, errNotCached
+	}
+	return m, err
+}
+
+// lookup answers from the cache, enriching inline on a miss when allowed.
+func (s *server) lookup(ctx context.Context, raw string, allowEnrich bool) (merchantView, error) {
+	m, err := s.cached(ctx, raw)
+	if !errors.Is(err, errNotCached) || !allowEnrich || s.enricher == nil {
+		return m, err
+	}
+
+	if err := s.enricher.enrich(ctx, raw); err != nil {
+		return merchantView{}, err
+	}
+	m, err = s.cached(ctx, raw)
+	if err == nil {
+		m.Source = "enriched"
+	}
+	return m, err
+}
+
+func (s *server) byABN(ctx context.Context, abn abr.ABN) (merchantView, error) {
+	m, err := scanMerchant(s.pool.QueryRow(ctx, `
+		select `+merchantColumns+`
+		from enriched_merchants e
+		left join golden_merchants g on g.transaction_cache = e.transaction_cache
+		where coalesce(g.abn, e.abn_head_office) = $1
+		  and coalesce(g.brand_name, e.brand_name) is not null
+		order by e.created_at desc
+		limit 1
+	`, abn.String()))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return merchantView{}, errNotCached
+	}
+	return m, err
+}
+
+func (s *server) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /merchants/lookup", s.handleLookup)
+	mux.HandleFunc("GET /merchants/history", s.handleHistory)
+	mux.HandleFunc("GET /merchants/history/diff", s.handleHistoryDiff)
+	mux.HandleFunc("GET /merchants/{abn}", s.handleABN)
+	mux.HandleFunc("POST /merchants/batch", s.handleBatch)
+	mux.HandleFunc("GET /healthz", s.handleHealth)
+	return mux
+}
+
+// handleLookup serves GET /merchants/lookup?descriptor=...; enrich=false
+// answers from the cache only, and as_of=<time> answers from history with
+// the version current then.
+func (s *server) handleLookup(w http.ResponseWriter, r *http.Request) {
+	raw := strings.TrimSpace(r.URL.Query().Get("descriptor"))
+	if raw == "" {
+		writeError(w, http.StatusBadRequest, "descriptor is required")
+		return
+	}
+	if asOf := r.URL.Query().Get("as_of"); asOf != "" {
+		t, err := parseAsOf(asOf)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		v, err := merchantAsOf(r.Context(), s.pool, raw, t)
+		if err == nil && v.BrandName == "" {
+			err = errNoMatch
+		}
+		if err != nil {
+			writeLookupError(w, raw, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, v)
+		return
+	}
+	m, err := s.lookup(r.Context(), raw, r.URL.Query().Get("enrich") != "false")
+	if err != nil {
+		writeLookupError(w, raw, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, m)
+}
+
+// handleABN serves GET /merchants/{abn}. ABNs are only answered from the
+// cache.
+func (s *server) handleABN(w http.ResponseWriter, r *http.Request) {
+	abn, err := abr.ParseABN(r.PathValue("abn"))
+	if err != nil || !abn.Valid() {
+		writeError(w, http.StatusBadRequest, "invalid ABN")
+		return
+	}
+	m, err := s.byABN(r.Context(), abn)
+	if err != nil {
+		writeLookupError(w, abn.String(), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, m)
+}
+
+// handleHistory serves GET /merchants/history?descriptor=..., every
+// version of the merchant oldest first.
+func (s *server) handleHistory(w http.ResponseWriter, r *http.Request) {
+	raw := strings.TrimSpace(r.URL.Query().Get("descriptor"))
+	if raw == "" {
+		writeError(w, http.StatusBadRequest, "descriptor is required")
+		return
+	}
+	tc, err := historyKey(r.Context(), s.pool, raw)
+	if err != nil {
+		writeLookupError(w, raw, err)
+		return
+	}
+	history, err := merchantHistory(r.Context(), s.pool, tc)
+	if err != nil {
+		writeLookupError(w, raw, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"descriptor": tc, "versions": history})
+}
+
+// handleHistoryDiff serves GET /merchants/history/diff?descriptor=...
+// with optional from and to version numbers, by default the latest change.
+func (s *server) handleHistoryDiff(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	raw := strings.TrimSpace(q.Get("descriptor"))
+	if raw == "" {
+		writeError(w, http.StatusBadRequest, "descriptor is required")
+		return
+	}
+	from, err := versionNumber(q.Get("from"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	to, err := versionNumber(q.Get("to"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	tc, err := historyKey(r.Context(), s.pool, raw)
+	if err != nil {
+		writeLookupError(w, raw, err)
+		return
+	}
+	history, err := merchantHistory(r.Context(), s.pool, tc)
+	if err != nil {
+		writeLookupError(w, raw, err)
+		return
+	}
+	a, b, err := versionPair(history, from, to)
+	if err != nil {
+		if errors.Is(err, errNotCached) {
+			writeLookupError(w, raw, err)
+		} else {
+			writeError(w, http.StatusNotFound, err.Error())
+		}
+		return
+	}
+	changes := diffVersions(a, b)
+	if changes == nil {
+		changes = []fieldChange{}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"descriptor": tc,
+		"from":       a.Version,
+		"to":         b.Version,
+		"changes":    changes,
+	})
+}
+
+type batchRequest struct {
+	Descriptors []string `json:"descriptors"`
+	Enrich      *bool    `json:"enrich,omitempty"`
+}
+
+type batchResult struct {
+	Descriptor string        `json:"descriptor"`
+	Merchant   *merchantView `json:"merchant,omitempty"`
+	Error      string        `json:"error,omitempty"`
+}
+
+// handleBatch serves POST /merchants/batch with {"descriptors": [...]}.
+// Results come back in request order; a miss is reported per descriptor
+// rather than failing the batch.
+func (s *server) handleBatch(w http.ResponseWriter, r *http.Request) {
+	var req batchRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	if len(req.Descriptors) == 0 {
+		writeError(w, http.StatusBadRequest, "descriptors is required")
+		return
+	}
+	if len(req.Descriptors) > maxBatch {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("at most %d descriptors per batch", maxBatch))
+		return
+	}
+	allowEnrich := req.Enrich == nil || *req.Enrich
+
+	workers := 4
+	if s.enricher != nil {
+		workers = s.enricher.cfg.Workers
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	results := make([]batchResult, len(req.Descriptors))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				raw := strings.TrimSpace(req.Descriptors[i])
+				results[i].Descriptor = raw
+				m, err := s.lookup(r.Context(), raw, allowEnrich)
+				if err != nil {
+					results[i].Error = lookupErrorText(err)
+					continue
+				}
+				results[i].Merchant = &m
+			}
+		}()
+	}
+	for i := range req.Descriptors {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	writeJSON(w, http.StatusOK, map[string]any{"results": results})
+}
+
+func (s *server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if err := s.pool.Ping(r.Context()); err != nil {
+		writeError(w, http.StatusServiceUnavailable, "database unavailable")
+		return
+	}
+	body := map[string]any{"status": "ok", "enrich_on_miss": s.enricher != nil}
+	if s.enricher != nil {
+		body["enrichments_in_flight"] = s.enricher.flights.InFlight()
+	}
+	writeJSON(w, http.StatusOK, body)
+}
+
+func lookupErrorText(err error) string {
+	switch {
+	case errors.Is(err, errNotCached):
+		return "not found"
+	case errors.Is(err, errNoMatch):
+		return "no match"
+	case errors.Is(err, errEnrichBusy):
+		return "being enriched, try again shortly"
+	case isTransient(err):
+		return "upstream unavailable, try again later"
+	}
+	return "lookup failed"
+}
+
+func writeLookupError(w http.ResponseWriter, key string, err error) {
+	switch {
+	case errors.Is(err, errNotCached), errors.Is(err, errNoMatch):
+		writeError(w, http.StatusNotFound, lookupErrorText(err))
+	case errors.Is(err, errEnrichBusy):
+		writeError(w, http.StatusAccepted, lookupErrorText(err))
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		writeError(w, http.StatusGatewayTimeout, "lookup timed out")
+	case isTransient(err):
+		writeError(w, http.StatusBadGateway, lookupErrorText(err))
+	default:
+		log.Printf("lookup %s: %v", key, err)
+		writeError(w, http.StatusInternalServerError, lookupErrorText(err))
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+// errEnrichBusy means another process holds the descriptor's queue row.
+var errEnrichBusy = errors.New("descriptor is being enriched elsewhere")
+
+// inlineEnricher runs the normal enrichment for one descriptor on a cache
+// miss. Concurrent misses for the same descriptor share one run.
+type inlineEnricher struct {
+	pool      *pgxpool.Pool
+	providers *providerSet
+	queue     *queue
+	cfg       Config
+	flights   coalesce.Group[string, struct{}]
+}
+
+func newInlineEnricher(pool *pgxpool.Pool, ps *providerSet, cfg Config) *inlineEnricher {
+	return &inlineEnricher{
+		pool:      pool,
+		providers: ps,
+		queue:     newQueue(pool, cfg.LeaseDuration, cfg.MaxAttempts),
+		cfg:       cfg,
+	}
+}
+
+// enrich seeds the descriptor into the work queue, claims it and enriches
+// it like a batch worker would, so the queue never picks it up twice.
+func (e *inlineEnricher) enrich(ctx context.Context, raw string) error {
+	_, err, _ := e.flights.Do(ctx, raw, func() (struct{}, error) {
+		// Outlive the caller that started it: others may be waiting too
+		runCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), e.cfg.LeaseDuration)
+		defer cancel()
+		return struct{}{}, e.run(runCtx, raw)
+	})
+	return err
+}
+
+func (e *inlineEnricher) run(ctx context.Context, raw string) error {
+	if err := seedRawTransactions(ctx, e.pool, []string{raw}); err != nil {
+		return err
+	}
+	tx, ok, err := e.queue.claimDescription(ctx, raw)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errEnrichBusy
+	}
+
+	stop := e.queue.keepLease(ctx, tx)
+	_, err = enrichOne(ctx, e.pool, e.providers, tx, e.cfg)
+	stop()
+	switch {
+	case err == nil:
+		// The row is written even if another worker took the lease meanwhile
+		if err := e.queue.complete(ctx, tx); err != nil && !errors.Is(err, errLeaseLost) {
+			return err
+		}
+		return nil
+	case isTransient(err):
+		if _, qerr := e.queue.retry(ctx, tx, err); qerr != nil {
+			return qerr
+		}
+		return err
+	default:
+		if rerr := e.queue.release(context.WithoutCancel(ctx), tx); rerr != nil {
+			log.Printf("%s: release failed: %v", raw, rerr)
+		}
+		return err
+	}
+}
+
+// runServe handles `brandfetch serve`. SERVE_ADDR sets the listen address
+// and SERVE_ENRICH_ON_MISS=true fills misses inline, which needs the
+// Brandfetch credentials.
+func runServe(ctx context.Context, pool *pgxpool.Pool) error {
+	s := &server{pool: pool}
+
+	if os.Getenv("SERVE_ENRICH_ON_MISS") == "true" {
+		cfg, err := loadConfig()
+		if err != nil {
+			return err
+		}
+		ps, closeProviders, err := newProviders(ctx, cfg, cacheWrapper(newProviderCache(pool)))
+		if err != nil {
+			return err
+		}
+		defer closeProviders()
+		fmt.Printf("Providers: %s\n", ps)
+		s.enricher = newInlineEnricher(pool, ps, cfg)
+	}
+
+	srv := &http.Server{
+		Addr:              getenvDefault("SERVE_ADDR", ":8080"),
+		Handler:           s.routes(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		fmt.Printf("Serving merchant lookups on %s (enrich on miss: %t)\n", srv.Addr, s.enricher != nil)
+		errc <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	return srv.Shutdown(shutdownCtx)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServeBadRequests(t *testing.T) {
+	var tooMany []string
+	for i := 0; i <= maxBatch; i++ {
+		tooMany = append(tooMany, fmt.Sprintf("WOOLWORTHS %04d", i))
+	}
+	batch, err := json.Marshal(batchRequest{Descriptors: tooMany})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		method  string
+		target  string
+		body    string
+		wantErr string
+	}{
+		{name: "missing descriptor", method: "GET", target: "/merchants/lookup", wantErr: "descriptor is required"},
+		{name: "blank descriptor", method: "GET", target: "/merchants/lookup?descriptor=%20%20", wantErr: "descriptor is required"},
+		{name: "bad as_of", method: "GET", target: "/merchants/lookup?descriptor=COLES&as_of=last+tuesday", wantErr: `invalid time "last tuesday"`},
+		{name: "abn not a number", method: "GET", target: "/merchants/woolworths", wantErr: "invalid ABN"},
+		{name: "abn bad checksum", method: "GET", target: "/merchants/88000014676", wantErr: "invalid ABN"},
+		{name: "history missing descriptor", method: "GET", target: "/merchants/history", wantErr: "descriptor is required"},
+		{name: "diff bad version", method: "GET", target: "/merchants/history/diff?descriptor=COLES&from=first", wantErr: "version"},
+		{name: "batch not json", method: "POST", target: "/merchants/batch", body: "descriptors=COLES", wantErr: "invalid JSON body"},
+		{name: "batch empty", method: "POST", target: "/merchants/batch", body: `{"descriptors": []}`, wantErr: "descriptors is required"},
+		{name: "batch over maxBatch", method: "POST", target: "/merchants/batch", body: string(batch), wantErr: fmt.Sprintf("at most %d descriptors", maxBatch)},
+	}
+	// Every request here is turned away before the database is needed
+	h := (&server{}).routes()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body)))
+			if rec.Code != http.StatusBadRequest {
+				t.Fatalf("status = %d, want 400 (%s)", rec.Code, rec.Body)
+			}
+			var body struct {
+				Error string `json:"error"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatalf("body %s: %v", rec.Body, err)
+			}
+			if !strings.Contains(body.Error, tt.wantErr) {
+				t.Errorf("error = %q, want one mentioning %q", body.Error, tt.wantErr)
+			}
+		})
+	}
+}
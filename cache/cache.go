@@ -0,0 +1,210 @@
+// Package cache keeps provider responses in an in-memory LRU in front of a
+// persistent store, so repeated lookups skip the upstream call. Entries
+// live for a per-provider TTL, "not found" answers for a shorter one, and
+// expired entries can still be served while a refresh runs in the
+// background.
+package cache
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Entry is one cached answer. NotFound entries record that the provider
+// had nothing, so the lookup is not repeated until they expire.
+type Entry struct {
+	Status    int
+	Header    map[string]string
+	Body      []byte
+	NotFound  bool
+	FetchedAt time.Time
+}
+
+// Store persists entries beyond the life of the process.
+type Store interface {
+	Get(ctx context.Context, provider, key string) (Entry, bool, error)
+	Put(ctx context.Context, provider, key string, e Entry) error
+}
+
+// Policy is how long a provider's entries stay usable. Entries are fresh
+// for TTL (NotFoundTTL for not-found answers) and may then be served stale
+// for StaleFor more while they are refreshed.
+type Policy struct {
+	TTL         time.Duration
+	NotFoundTTL time.Duration
+	StaleFor    time.Duration
+}
+
+// DefaultPolicy keeps answers for a week and misses for a day.
+func DefaultPolicy() Policy {
+	return Policy{
+		TTL:         7 * 24 * time.Hour,
+		NotFoundTTL: 24 * time.Hour,
+		StaleFor:    24 * time.Hour,
+	}
+}
+
+func (p Policy) ttl(e Entry) time.Duration {
+	if e.NotFound {
+		return p.NotFoundTTL
+	}
+	return p.TTL
+}
+
+// Stats counts how lookups for one provider were answered.
+type Stats struct {
+	Hits         int64 // fresh answers
+	NegativeHits int64 // fresh "not found" answers
+	StaleHits    int64 // expired answers served while refreshing
+	Misses       int64 // lookups that went upstream
+	Refreshes    int64 // background refreshes started
+	Errors       int64 // store failures; the lookup carried on without it
+}
+
+func (s Stats) String() string {
+	return fmt.Sprintf("%d hits (%d negative), %d stale, %d misses", s.Hits+s.NegativeHits, s.NegativeHits, s.StaleHits, s.Misses)
+}
+
+type counters struct {
+	hits, negativeHits, staleHits, misses, refreshes, errors atomic.Int64
+}
+
+// Cache is safe for concurrent use. A nil store keeps entries in memory
+// only.
+type Cache struct {
+	store Store
+
+	mu    sync.Mutex
+	size  int
+	order *list.List // front is most recently used
+	items map[string]*list.Element
+	stats map[string]*counters
+}
+
+type item struct {
+	key   string
+	entry Entry
+}
+
+// New returns a cache holding up to size entries in memory in front of
+// store.
+func New(size int, store Store) *Cache {
+	if size < 1 {
+		size = 1
+	}
+	return &Cache{
+		store: store,
+		size:  size,
+		order: list.New(),
+		items: map[string]*list.Element{},
+		stats: map[string]*counters{},
+	}
+}
+
+// Lookup returns the entry for provider and key, from memory or the store.
+func (c *Cache) Lookup(ctx context.Context, provider, key string) (Entry, bool) {
+	id := provider + "\x00" + key
+
+	c.mu.Lock()
+	if el, ok := c.items[id]; ok {
+		c.order.MoveToFront(el)
+		e := el.Value.(*item).entry
+		c.mu.Unlock()
+		return e, true
+	}
+	c.mu.Unlock()
+
+	if c.store == nil {
+		return Entry{}, false
+	}
+	e, ok, err := c.store.Get(ctx, provider, key)
+	if err != nil {
+		c.counters(provider).errors.Add(1)
+		return Entry{}, false
+	}
+	if ok {
+		c.remember(id, e)
+	}
+	return e, ok
+}
+
+// Save records an entry in memory and in the store.
+func (c *Cache) Save(ctx context.Context, provider, key string, e Entry) {
+	c.remember(provider+"\x00"+key, e)
+	if c.store == nil {
+		return
+	}
+	if err := c.store.Put(ctx, provider, key, e); err != nil {
+		c.counters(provider).errors.Add(1)
+	}
+}
+
+func (c *Cache) remember(id string, e Entry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[id]; ok {
+		el.Value.(*item).entry = e
+		c.order.MoveToFront(el)
+		return
+	}
+	c.items[id] = c.order.PushFront(&item{key: id, entry: e})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*item).key)
+	}
+}
+
+func (c *Cache) counters(provider string) *counters {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.stats[provider]
+	if !ok {
+		s = &counters{}
+		c.stats[provider] = s
+	}
+	return s
+}
+
+// Stats returns the counts so far for each provider that was looked up.
+func (c *Cache) Stats() map[string]Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make(map[string]Stats, len(c.stats))
+	for provider, s := range c.stats {
+		out[provider] = Stats{
+			Hits:         s.hits.Load(),
+			NegativeHits: s.negativeHits.Load(),
+			StaleHits:    s.staleHits.Load(),
+			Misses:       s.misses.Load(),
+			Refreshes:    s.refreshes.Load(),
+			Errors:       s.errors.Load(),
+		}
+	}
+	return out
+}
+
+// freshness says how an entry fetched at fetchedAt may be used now.
+type freshness int
+
+const (
+	fresh freshness = iota
+	stale
+	expired
+)
+
+func (p Policy) freshness(e Entry, now time.Time) freshness {
+	age := now.Sub(e.FetchedAt)
+	switch ttl := p.ttl(e); {
+	case age < ttl:
+		return fresh
+	case age < ttl+p.StaleFor:
+		return stale
+	}
+	return expired
+}
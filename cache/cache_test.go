@@ -0,0 +1,123 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memStore is a Store backed by a map.
+type memStore struct {
+	mu      sync.Mutex
+	entries map[string]Entry
+	err     error
+}
+
+func (s *memStore) Get(ctx context.Context, provider, key string) (Entry, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return Entry{}, false, s.err
+	}
+	e, ok := s.entries[provider+"/"+key]
+	return e, ok, nil
+}
+
+func (s *memStore) Put(ctx context.Context, provider, key string, e Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	if s.entries == nil {
+		s.entries = map[string]Entry{}
+	}
+	s.entries[provider+"/"+key] = e
+	return nil
+}
+
+func TestLRUEviction(t *testing.T) {
+	ctx := context.Background()
+	c := New(2, nil)
+	c.Save(ctx, "abr", "woolworths", Entry{Status: 200, Body: []byte("w")})
+	c.Save(ctx, "abr", "coles", Entry{Status: 200, Body: []byte("c")})
+
+	// Using woolworths makes coles the least recently used
+	if _, ok := c.Lookup(ctx, "abr", "woolworths"); !ok {
+		t.Fatal("woolworths missing")
+	}
+	c.Save(ctx, "abr", "kmart", Entry{Status: 200, Body: []byte("k")})
+
+	for key, want := range map[string]bool{"woolworths": true, "coles": false, "kmart": true} {
+		if _, ok := c.Lookup(ctx, "abr", key); ok != want {
+			t.Errorf("%s cached = %v, want %v", key, ok, want)
+		}
+	}
+}
+
+func TestLRUKeysByProvider(t *testing.T) {
+	ctx := context.Background()
+	c := New(10, nil)
+	c.Save(ctx, "abr", "coles", Entry{Body: []byte("abr")})
+	c.Save(ctx, "google", "coles", Entry{Body: []byte("google")})
+	c.Save(ctx, "abr", "coles", Entry{Body: []byte("abr again")})
+
+	for provider, want := range map[string]string{"abr": "abr again", "google": "google"} {
+		e, ok := c.Lookup(ctx, provider, "coles")
+		if !ok || string(e.Body) != want {
+			t.Errorf("%s = %q, %v, want %q", provider, e.Body, ok, want)
+		}
+	}
+}
+
+func TestLookupFallsBackToStore(t *testing.T) {
+	ctx := context.Background()
+	store := &memStore{}
+	New(1, store).Save(ctx, "brandfetch", "coles.com.au", Entry{Status: 200, Body: []byte("brand")})
+
+	// A new process starts with an empty LRU but the same store
+	c := New(1, store)
+	e, ok := c.Lookup(ctx, "brandfetch", "coles.com.au")
+	if !ok || string(e.Body) != "brand" {
+		t.Fatalf("lookup = %q, %v", e.Body, ok)
+	}
+	store.err = errors.New("store down")
+	if _, ok := c.Lookup(ctx, "brandfetch", "coles.com.au"); !ok {
+		t.Error("entry read from the store was not kept in memory")
+	}
+	if _, ok := c.Lookup(ctx, "brandfetch", "kmart.com.au"); ok {
+		t.Error("hit for a key the store could not be asked about")
+	}
+	if n := c.Stats()["brandfetch"].Errors; n != 1 {
+		t.Errorf("%d store errors counted, want 1", n)
+	}
+}
+
+func TestFreshness(t *testing.T) {
+	p := Policy{TTL: 7 * 24 * time.Hour, NotFoundTTL: 24 * time.Hour, StaleFor: 12 * time.Hour}
+	now := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		age      time.Duration
+		notFound bool
+		want     freshness
+	}{
+		{name: "new answer", age: time.Minute, want: fresh},
+		{name: "answer just inside ttl", age: 7*24*time.Hour - time.Second, want: fresh},
+		{name: "answer at ttl", age: 7 * 24 * time.Hour, want: stale},
+		{name: "answer past stale window", age: 7*24*time.Hour + 12*time.Hour, want: expired},
+		{name: "not found inside its ttl", age: 23 * time.Hour, notFound: true, want: fresh},
+		{name: "not found past its ttl", age: 25 * time.Hour, notFound: true, want: stale},
+		{name: "not found long gone", age: 3 * 24 * time.Hour, notFound: true, want: expired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := Entry{NotFound: tt.notFound, FetchedAt: now.Add(-tt.age)}
+			if got := p.freshness(e, now); got != tt.want {
+				t.Errorf("freshness = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// PGStore keeps entries in the provider_cache table.
+type PGStore struct {
+	pool *pgxpool.Pool
+}
+
+func NewPGStore(pool *pgxpool.Pool) *PGStore {
+	return &PGStore{pool: pool}
+}
+
+func (s *PGStore) Get(ctx context.Context, provider, key string) (Entry, bool, error) {
+	var (
+		e      Entry
+		header []byte
+	)
+	err := s.pool.QueryRow(ctx, `
+		select status, header, body, not_found, fetched_at
+		from provider_cache
+		where provider = $1 and key = $2
+	`, provider, key).Scan(&e.Status, &header, &e.Body, &e.NotFound, &e.FetchedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return Entry{}, false, nil
+	}
+	if err != nil {
+		return Entry{}, false, err
+	}
+	if len(header) > 0 {
+		if err := json.Unmarshal(header, &e.Header); err != nil {
+			return Entry{}, false, err
+		}
+	}
+	return e, true, nil
+}
+
+func (s *PGStore) Put(ctx context.Context, provider, key string, e Entry) error {
+	header, err := json.Marshal(e.Header)
+	if err != nil {
+		return err
+	}
+	_, err = s.pool.Exec(ctx, `
+		insert into provider_cache (provider, key, status, header, body, not_found, fetched_at)
+		values ($1, $2, $3, $4::jsonb, $5, $6, $7)
+		on conflict (provider, key) do update set
+			status = excluded.status,
+			header = excluded.header,
+			body = excluded.body,
+			not_found = excluded.not_found,
+			fetched_at = excluded.fetched_at
+	`, provider, key, e.Status, string(header), e.Body, e.NotFound, e.FetchedAt)
+	return err
+}
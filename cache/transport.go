@@ -0,0 +1,212 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"merchantcache/coalesce"
+)
+
+// refreshTimeout bounds upstream fetches that no caller's deadline covers,
+// such as background refreshes.
+const refreshTimeout = 30 * time.Second
+
+// Transport answers GET requests from a Cache and sends the rest to Base.
+// Only 200 responses and answers NotFound recognises are cached; errors,
+// 429s, 5xx responses and 200s Failed rejects always reach the caller
+// uncached. Concurrent
+// misses for the same URL share one upstream request.
+type Transport struct {
+	Base     http.RoundTripper
+	Cache    *Cache
+	Provider string
+	Policy   Policy
+
+	// NotFound reports whether a response means the provider has nothing
+	// for the request. A 404 always does.
+	NotFound func(status int, body []byte) bool
+
+	// Failed reports whether a 200 response is really an error, for
+	// providers that only report failures in the body. Those responses
+	// reach the caller uncached.
+	Failed func(status int, body []byte) bool
+
+	// SecretParams are query parameters, such as API keys, left out of the
+	// cache key.
+	SecretParams []string
+
+	flights coalesce.Group[string, Entry]
+}
+
+// NewTransport wraps base (http.DefaultTransport when nil) with c, caching
+// provider's answers under policy.
+func NewTransport(base http.RoundTripper, c *Cache, provider string, policy Policy) *Transport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &Transport{Base: base, Cache: c, Provider: provider, Policy: policy}
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet || t.Cache == nil {
+		return t.Base.RoundTrip(req)
+	}
+
+	ctx := req.Context()
+	key := t.key(req.URL)
+	stats := t.Cache.counters(t.Provider)
+
+	if e, ok := t.Cache.Lookup(ctx, t.Provider, key); ok {
+		switch t.Policy.freshness(e, time.Now()) {
+		case fresh:
+			if e.NotFound {
+				stats.negativeHits.Add(1)
+			} else {
+				stats.hits.Add(1)
+			}
+			return e.response(req), nil
+		case stale:
+			stats.staleHits.Add(1)
+			t.refresh(req, key)
+			return e.response(req), nil
+		}
+	}
+
+	stats.misses.Add(1)
+	e, err, _ := t.flights.Do(ctx, key, func() (Entry, error) {
+		// Other callers may join this fetch, so it must not stop when the
+		// first one gives up; it keeps that caller's deadline though
+		fetchCtx, cancel := detach(ctx)
+		defer cancel()
+		return t.fetch(req.Clone(fetchCtx), key)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return e.response(req), nil
+}
+
+// refresh re-fetches a stale entry in the background. Refreshes of the same
+// key are coalesced with each other and with foreground misses.
+func (t *Transport) refresh(req *http.Request, key string) {
+	t.Cache.counters(t.Provider).refreshes.Add(1)
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(req.Context()), refreshTimeout)
+	bg := req.Clone(ctx)
+	go func() {
+		defer cancel()
+		t.flights.Do(ctx, key, func() (Entry, error) {
+			return t.fetch(bg, key)
+		})
+	}()
+}
+
+// fetch sends req upstream and caches the answer when it is cacheable.
+// Uncacheable responses are still returned to the caller as they are.
+func (t *Transport) fetch(req *http.Request, key string) (Entry, error) {
+	resp, err := t.Base.RoundTrip(req)
+	if err != nil {
+		return Entry{}, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	e := Entry{
+		Status:    resp.StatusCode,
+		Header:    map[string]string{},
+		Body:      body,
+		FetchedAt: time.Now().UTC(),
+	}
+	for _, h := range []string{"Content-Type", "Retry-After"} {
+		if v := resp.Header.Get(h); v != "" {
+			e.Header[h] = v
+		}
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		e.NotFound = true
+	case resp.StatusCode == http.StatusOK && t.Failed != nil && t.Failed(resp.StatusCode, body):
+		return e, nil
+	case resp.StatusCode == http.StatusOK:
+		e.NotFound = t.NotFound != nil && t.NotFound(resp.StatusCode, body)
+	default:
+		return e, nil
+	}
+	t.Cache.Save(context.WithoutCancel(req.Context()), t.Provider, key, e)
+	return e, nil
+}
+
+// detach returns a context that outlives ctx's cancellation but not its
+// deadline, or refreshTimeout when it has none.
+func detach(ctx context.Context) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(refreshTimeout)
+	}
+	return context.WithDeadline(context.WithoutCancel(ctx), deadline)
+}
+
+// key is the request URL with secret parameters removed and the rest
+// sorted, so the same lookup always maps to the same entry.
+func (t *Transport) key(u *url.URL) string {
+	q := u.Query()
+	for _, p := range t.SecretParams {
+		q.Del(p)
+	}
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(u.Host)
+	b.WriteString(u.EscapedPath())
+	for i, k := range keys {
+		if i == 0 {
+			b.WriteByte('?')
+		} else {
+			b.WriteByte('&')
+		}
+		vals := q[k]
+		sort.Strings(vals)
+		for j, v := range vals {
+			if j > 0 {
+				b.WriteByte('&')
+			}
+			b.WriteString(url.QueryEscape(k))
+			b.WriteByte('=')
+			b.WriteString(url.QueryEscape(v))
+		}
+	}
+	return b.String()
+}
+
+func (e Entry) response(req *http.Request) *http.Response {
+	h := http.Header{}
+	for k, v := range e.Header {
+		h.Set(k, v)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", e.Status, http.StatusText(e.Status)),
+		StatusCode:    e.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        h,
+		Body:          io.NopCloser(bytes.NewReader(e.Body)),
+		ContentLength: int64(len(e.Body)),
+		Request:       req,
+	}
+}
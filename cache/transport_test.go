@@ -0,0 +1,169 @@
+package cache
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// upstream answers each path with a fixed status and body and counts the
+// requests it sees.
+type upstream struct {
+	*httptest.Server
+	hits atomic.Int32
+}
+
+func newUpstream(t *testing.T) *upstream {
+	u := &upstream{}
+	u.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u.hits.Add(1)
+		switch r.URL.Path {
+		case "/found":
+			io.WriteString(w, `{"name":"Coles"}`)
+		case "/missing":
+			http.NotFound(w, r)
+		case "/empty":
+			io.WriteString(w, `{"results":[]}`)
+		case "/failed":
+			io.WriteString(w, `{"exception":"guid not recognised"}`)
+		case "/limited":
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	t.Cleanup(u.Close)
+	return u
+}
+
+func (u *upstream) get(t *testing.T, client *http.Client, path string) (int, string) {
+	t.Helper()
+	resp, err := client.Get(u.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func newTestTransport(c *Cache) *Transport {
+	tr := NewTransport(nil, c, "abr", DefaultPolicy())
+	tr.NotFound = func(status int, body []byte) bool { return strings.Contains(string(body), `"results":[]`) }
+	tr.Failed = func(status int, body []byte) bool { return strings.Contains(string(body), `"exception"`) }
+	tr.SecretParams = []string{"guid"}
+	return tr
+}
+
+func TestTransportCaches(t *testing.T) {
+	tests := []struct {
+		path         string
+		wantStatus   int
+		wantCached   bool
+		wantNotFound bool
+	}{
+		{path: "/found", wantStatus: 200, wantCached: true},
+		{path: "/missing", wantStatus: 404, wantCached: true, wantNotFound: true},
+		{path: "/empty", wantStatus: 200, wantCached: true, wantNotFound: true},
+		// Failures are not answers and are asked again every time
+		{path: "/failed", wantStatus: 200},
+		{path: "/limited", wantStatus: 429},
+		{path: "/broken", wantStatus: 500},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			up := newUpstream(t)
+			c := New(10, nil)
+			client := &http.Client{Transport: newTestTransport(c)}
+
+			for i := 0; i < 2; i++ {
+				if status, _ := up.get(t, client, tt.path); status != tt.wantStatus {
+					t.Fatalf("status = %d, want %d", status, tt.wantStatus)
+				}
+			}
+			wantHits := int32(2)
+			if tt.wantCached {
+				wantHits = 1
+			}
+			if n := up.hits.Load(); n != wantHits {
+				t.Errorf("upstream asked %d times, want %d", n, wantHits)
+			}
+
+			stats := c.Stats()["abr"]
+			if tt.wantCached && tt.wantNotFound != (stats.NegativeHits == 1) {
+				t.Errorf("stats %+v, want a negative hit = %v", stats, tt.wantNotFound)
+			}
+		})
+	}
+}
+
+func TestTransportKeyIgnoresSecrets(t *testing.T) {
+	up := newUpstream(t)
+	client := &http.Client{Transport: newTestTransport(New(10, nil))}
+
+	up.get(t, client, "/found?name=coles&guid=secret-1&state=NSW")
+	// Another GUID and parameter order is still the same lookup
+	up.get(t, client, "/found?state=NSW&guid=secret-2&name=coles")
+	if n := up.hits.Load(); n != 1 {
+		t.Errorf("upstream asked %d times, want 1", n)
+	}
+	up.get(t, client, "/found?name=woolworths&guid=secret-1&state=NSW")
+	if n := up.hits.Load(); n != 2 {
+		t.Errorf("upstream asked %d times, want 2 after a new name", n)
+	}
+}
+
+func TestTransportExpiry(t *testing.T) {
+	up := newUpstream(t)
+	c := New(10, nil)
+	tr := newTestTransport(c)
+	tr.Policy = Policy{TTL: time.Hour, NotFoundTTL: time.Minute}
+	client := &http.Client{Transport: tr}
+
+	key := tr.key(mustParse(t, up.URL+"/missing"))
+	c.Save(context.Background(), "abr", key, Entry{Status: 404, NotFound: true, FetchedAt: time.Now().Add(-30 * time.Second)})
+	up.get(t, client, "/missing")
+	if n := up.hits.Load(); n != 0 {
+		t.Fatalf("upstream asked %d times for a fresh negative entry", n)
+	}
+
+	// Past its shorter TTL, with no stale window, the miss is asked again
+	c.Save(context.Background(), "abr", key, Entry{Status: 404, NotFound: true, FetchedAt: time.Now().Add(-2 * time.Minute)})
+	up.get(t, client, "/missing")
+	if n := up.hits.Load(); n != 1 {
+		t.Errorf("upstream asked %d times, want 1 after expiry", n)
+	}
+}
+
+func TestTransportPassesOtherMethods(t *testing.T) {
+	up := newUpstream(t)
+	client := &http.Client{Transport: newTestTransport(New(10, nil))}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Post(up.URL+"/found", "application/json", strings.NewReader(`{}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if n := up.hits.Load(); n != 2 {
+		t.Errorf("upstream asked %d times, want every POST sent", n)
+	}
+}
+
+func mustParse(t *testing.T, raw string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
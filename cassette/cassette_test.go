@@ -0,0 +1,81 @@
+package cassette
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRecordReplay(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		// Echo the credentials, as the ABR does with authenticationGuid
+		io.WriteString(w, "guid="+r.URL.Query().Get("authenticationGuid")+" auth="+r.Header.Get("Authorization"))
+	}))
+	defer srv.Close()
+	dir := t.TempDir()
+
+	get := func(mode Mode, guid, token string) (string, error) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/search?name=Woolworths&authenticationGuid="+guid, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := (&http.Client{Transport: New(nil, dir, mode)}).Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	const (
+		guid  = "secret-guid-123"
+		token = "bf-token-abc789"
+	)
+	if _, err := get(Record, guid, token); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*", "*.json"))
+	if len(files) != 1 {
+		t.Fatalf("recorded %v, want one fixture", files)
+	}
+	raw, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{guid, token} {
+		if strings.Contains(string(raw), secret) {
+			t.Errorf("fixture holds %s:\n%s", secret, raw)
+		}
+	}
+
+	// Replay matches without the credentials and never goes upstream
+	body, err := get(Replay, "other-guid-456", "other-token-012")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "guid=REDACTED auth=REDACTED"; body != want {
+		t.Errorf("replayed %q, want %q", body, want)
+	}
+	if calls != 1 {
+		t.Errorf("server called %d times, want 1", calls)
+	}
+}
+
+func TestReplayMissing(t *testing.T) {
+	tr := New(nil, t.TempDir(), Replay)
+	req, _ := http.NewRequest(http.MethodGet, "https://api.brandfetch.io/v2/search/coles?c=client-id-789", nil)
+	if _, err := tr.RoundTrip(req); !errors.Is(err, ErrNoFixture) {
+		t.Errorf("err = %v, want ErrNoFixture", err)
+	}
+	missing := tr.Missing()
+	if len(missing) != 1 || missing[0] != "GET https://api.brandfetch.io/v2/search/coles?c=REDACTED" {
+		t.Errorf("missing = %v", missing)
+	}
+}
@@ -0,0 +1,65 @@
+// Command abnbulk loads the ABN Bulk Extract XML files from a local
+// directory into the Postgres index used for offline ABR lookups.
+//
+// Usage:
+//
+//	abnbulk [dir]
+//
+// The directory defaults to ABR_BULK_DIR and the database to
+// ABR_INDEX_DATABASE_URL. Re-run it after each weekly publication; files
+// and records that have not changed are skipped.
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/joho/godotenv"
+
+	"merchantcache/abn/bulk"
+	"merchantcache/abn/config"
+)
+
+func main() {
+	_ = godotenv.Load()
+
+	cfg := config.LoadFromEnv()
+
+	dir := cfg.ABRBulkDir
+	if len(os.Args) > 1 {
+		dir = os.Args[1]
+	}
+	if dir == "" {
+		log.Fatal("no extract directory: pass one as an argument or set ABR_BULK_DIR")
+	}
+	if cfg.ABRIndexDatabaseURL == "" {
+		log.Fatal("ABR_INDEX_DATABASE_URL is required")
+	}
+
+	ctx := context.Background()
+	pool, err := pgxpool.New(ctx, cfg.ABRIndexDatabaseURL)
+	if err != nil {
+		log.Fatalf("connect db: %v", err)
+	}
+	defer pool.Close()
+
+	index := bulk.NewIndex(pool)
+	if err := index.EnsureSchema(ctx); err != nil {
+		log.Fatalf("create index schema: %v", err)
+	}
+
+	start := time.Now()
+	stats, err := index.Ingest(ctx, dir)
+	fmt.Printf("Files ingested:  %d\n", stats.Files)
+	fmt.Printf("Files unchanged: %d\n", stats.SkippedFiles)
+	fmt.Printf("Records read:    %d\n", stats.Records)
+	fmt.Printf("Records updated: %d\n", stats.Updated)
+	fmt.Printf("Elapsed:         %s\n", time.Since(start).Round(time.Second))
+	if err != nil {
+		log.Fatalf("ingest: %v", err)
+	}
+}
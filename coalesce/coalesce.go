@@ -0,0 +1,70 @@
+// Package coalesce collapses concurrent calls for the same key into one, so
+// a burst of identical cache misses costs a single upstream lookup.
+package coalesce
+
+import (
+	"context"
+	"sync"
+)
+
+// Group runs at most one call per key at a time. The zero value is ready
+// to use.
+type Group[K comparable, V any] struct {
+	mu    sync.Mutex
+	calls map[K]*call[V]
+}
+
+type call[V any] struct {
+	done chan struct{}
+	val  V
+	err  error
+	dups int
+}
+
+// Do runs fn for key unless a call for key is already in flight, in which
+// case it waits for that call's result instead. shared reports whether the
+// result went to more than one caller.
+//
+// fn is not tied to any caller's ctx: a caller that gives up only stops
+// waiting, and the call carries on for the others. fn should bound its own
+// work.
+func (g *Group[K, V]) Do(ctx context.Context, key K, fn func() (V, error)) (v V, err error, shared bool) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = map[K]*call[V]{}
+	}
+	c, ok := g.calls[key]
+	if ok {
+		c.dups++
+	} else {
+		c = &call[V]{done: make(chan struct{})}
+		g.calls[key] = c
+		go g.run(key, c, fn)
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.val, c.err, ok || c.dups > 0
+	case <-ctx.Done():
+		var zero V
+		return zero, ctx.Err(), ok
+	}
+}
+
+func (g *Group[K, V]) run(key K, c *call[V], fn func() (V, error)) {
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(c.done)
+	}()
+	c.val, c.err = fn()
+}
+
+// InFlight reports how many keys have a call running.
+func (g *Group[K, V]) InFlight() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.calls)
+}
@@ -0,0 +1,151 @@
+package coalesce
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitInFlight waits until g has n keys running.
+func waitInFlight[K comparable, V any](t *testing.T, g *Group[K, V], n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for g.InFlight() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d calls in flight, want %d", g.InFlight(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDoSharesOneFlight(t *testing.T) {
+	var (
+		g       Group[string, int]
+		calls   atomic.Int32
+		release = make(chan struct{})
+	)
+	fn := func() (int, error) {
+		calls.Add(1)
+		<-release
+		return 42, nil
+	}
+
+	const callers = 10
+	type result struct {
+		v      int
+		err    error
+		shared bool
+	}
+	results := make(chan result, callers)
+	var started sync.WaitGroup
+	started.Add(callers)
+	for i := 0; i < callers; i++ {
+		go func() {
+			started.Done()
+			v, err, shared := g.Do(context.Background(), "woolworths", fn)
+			results <- result{v, err, shared}
+		}()
+	}
+	started.Wait()
+	waitInFlight(t, &g, 1)
+	// Give the other callers time to join the flight before it lands
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+
+	for i := 0; i < callers; i++ {
+		r := <-results
+		if r.v != 42 || r.err != nil || !r.shared {
+			t.Errorf("caller got %d, %v, shared %v", r.v, r.err, r.shared)
+		}
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("fn ran %d times, want 1", n)
+	}
+	if n := g.InFlight(); n != 0 {
+		t.Errorf("%d calls still in flight", n)
+	}
+}
+
+func TestDoErrorReachesEveryWaiter(t *testing.T) {
+	var (
+		g       Group[string, int]
+		release = make(chan struct{})
+		boom    = errors.New("abr unavailable")
+	)
+	fn := func() (int, error) {
+		<-release
+		return 0, boom
+	}
+
+	const callers = 5
+	errs := make(chan error, callers)
+	for i := 0; i < callers; i++ {
+		go func() {
+			_, err, _ := g.Do(context.Background(), "coles", fn)
+			errs <- err
+		}()
+	}
+	waitInFlight(t, &g, 1)
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+
+	for i := 0; i < callers; i++ {
+		if err := <-errs; !errors.Is(err, boom) {
+			t.Errorf("waiter got %v, want %v", err, boom)
+		}
+	}
+
+	// A failed call is not remembered; the next caller runs fn again
+	v, err, shared := g.Do(context.Background(), "coles", func() (int, error) { return 7, nil })
+	if v != 7 || err != nil || shared {
+		t.Errorf("after the error got %d, %v, shared %v", v, err, shared)
+	}
+}
+
+func TestDoSeparateKeys(t *testing.T) {
+	var g Group[string, string]
+	for _, key := range []string{"kmart", "target"} {
+		v, err, shared := g.Do(context.Background(), key, func() (string, error) { return key, nil })
+		if v != key || err != nil || shared {
+			t.Errorf("Do(%s) = %q, %v, shared %v", key, v, err, shared)
+		}
+	}
+}
+
+func TestDoCallerGivesUp(t *testing.T) {
+	var (
+		g       Group[string, int]
+		release = make(chan struct{})
+	)
+	fn := func() (int, error) {
+		<-release
+		return 1, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err, _ := g.Do(ctx, "bigw", fn)
+		done <- err
+	}()
+	waitInFlight(t, &g, 1)
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled caller got %v", err)
+	}
+
+	// The call carries on for a caller still waiting
+	got := make(chan int, 1)
+	go func() {
+		v, _, _ := g.Do(context.Background(), "bigw", fn)
+		got <- v
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	if v := <-got; v != 1 {
+		t.Errorf("remaining caller got %d", v)
+	}
+}
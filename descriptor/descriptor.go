@@ -0,0 +1,155 @@
+// Package descriptor cleans bank transaction descriptors such as
+// "SQ *SUSHI HUB MELB" down to the merchant they name, so brand and ABN
+// searches see "Sushi Hub" rather than the processor prefix and location
+// tail the bank added.
+package descriptor
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Descriptor is a cleaned transaction descriptor.
+type Descriptor struct {
+	// Raw is the descriptor exactly as the bank supplied it.
+	Raw string `json:"raw"`
+
+	// Key is the canonical merchant key: lower case letters, digits and
+	// single spaces, e.g. "sushi hub". It is empty when nothing is left
+	// after cleaning.
+	Key string `json:"key"`
+
+	// Name is the cleaned merchant name for display and searching.
+	Name string `json:"name"`
+
+	// Parts holds every merchant named by a composite descriptor such as
+	// "Coles Express / Shell Reddy Express", cleaned, in order. Name is
+	// always Parts[0].
+	Parts []string `json:"parts,omitempty"`
+
+	// Processor is the payment processor whose prefix was stripped, e.g.
+	// "Square" or "PayPal".
+	Processor string `json:"processor,omitempty"`
+
+	// Location hints taken from the descriptor's tail.
+	City    string `json:"city,omitempty"`
+	State   string `json:"state,omitempty"`
+	Country string `json:"country,omitempty"`
+}
+
+// Rule rewrites the working text of one descriptor part and may record
+// hints on d. Rules run in order; each sees the output of the last.
+type Rule func(text string, d *Descriptor) string
+
+// Normaliser applies a rule set to descriptors. It is safe for concurrent
+// use.
+type Normaliser struct {
+	rules []Rule
+}
+
+// New returns a Normaliser that applies rules in order. Pass
+// append(DefaultRules(), extra...) to extend the default set.
+func New(rules ...Rule) *Normaliser {
+	return &Normaliser{rules: rules}
+}
+
+var defaultNormaliser = New(DefaultRules()...)
+
+// Normalise cleans raw with the default rules.
+func Normalise(raw string) Descriptor {
+	return defaultNormaliser.Normalise(raw)
+}
+
+// compositeSeparator splits descriptors naming more than one merchant. A
+// slash needs surrounding spaces so dates like 12/03 are not split.
+var compositeSeparator = regexp.MustCompile(`\s+/\s+|\s*\|\s*`)
+
+// Normalise splits raw into its merchant parts, runs every rule over each
+// part and derives the canonical key from the first part left non-empty.
+func (n *Normaliser) Normalise(raw string) Descriptor {
+	d := Descriptor{Raw: raw}
+
+	for _, part := range compositeSeparator.Split(raw, -1) {
+		text := collapseSpaces(part)
+		for _, rule := range n.rules {
+			text = collapseSpaces(rule(text, &d))
+			if text == "" {
+				break
+			}
+		}
+		text = strings.Trim(text, " -*#:,.")
+		if text == "" {
+			continue
+		}
+		d.Parts = append(d.Parts, displayName(text))
+	}
+
+	if len(d.Parts) > 0 {
+		d.Name = d.Parts[0]
+		d.Key = Key(d.Name)
+	}
+	return d
+}
+
+// Key reduces a merchant name to its canonical key: lower case, with
+// apostrophes dropped, other punctuation turned into spaces and runs of
+// spaces collapsed. "McDonald's" and "MCDONALDS" share the key "mcdonalds".
+func Key(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		switch {
+		case r == '\'' || r == '’':
+			continue
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			b.WriteRune(r)
+		default:
+			b.WriteRune(' ')
+		}
+	}
+	return collapseSpaces(b.String())
+}
+
+// displayName title-cases descriptors the bank shouted in capitals and
+// leaves mixed-case names as they are. Short words without vowels are kept
+// as acronyms, so "BP" and "KFC" stay in capitals.
+func displayName(s string) string {
+	if strings.ToUpper(s) != s {
+		return s
+	}
+	words := strings.Fields(s)
+	for i, w := range words {
+		if isAcronym(w) {
+			continue
+		}
+		runes := []rune(strings.ToLower(w))
+		upper := true
+		for j, r := range runes {
+			if upper && unicode.IsLetter(r) {
+				runes[j] = unicode.ToUpper(r)
+			}
+			// Capitalise after a hyphen too, as in "7-Eleven"
+			upper = r == '-'
+		}
+		words[i] = string(runes)
+	}
+	return strings.Join(words, " ")
+}
+
+func isAcronym(w string) bool {
+	letters := 0
+	for _, r := range w {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+		if strings.ContainsRune("AEIOU", r) {
+			return false
+		}
+	}
+	return letters > 0 && letters <= 4
+}
+
+func collapseSpaces(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
@@ -0,0 +1,86 @@
+package descriptor
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNormalise(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want Descriptor
+	}{
+		{
+			raw:  "BP - Transaction",
+			want: Descriptor{Key: "bp", Name: "BP", Parts: []string{"BP"}},
+		},
+		{
+			raw: "SQ *SUSHI HUB MELB",
+			want: Descriptor{Key: "sushi hub", Name: "Sushi Hub", Parts: []string{"Sushi Hub"},
+				Processor: "Square", City: "Melbourne", State: "VIC", Country: "AU"},
+		},
+		{
+			raw:  "PAYPAL *SPOTIFY",
+			want: Descriptor{Key: "spotify", Name: "Spotify", Parts: []string{"Spotify"}, Processor: "PayPal"},
+		},
+		{
+			raw:  "Coles Express / Shell Reddy Express",
+			want: Descriptor{Key: "coles express", Name: "Coles Express", Parts: []string{"Coles Express", "Shell Reddy Express"}},
+		},
+		{
+			raw: "WOOLWORTHS 1234 SYDNEY NSW AU",
+			want: Descriptor{Key: "woolworths", Name: "Woolworths", Parts: []string{"Woolworths"},
+				City: "Sydney", State: "NSW", Country: "AU"},
+		},
+		{
+			raw: "TST* BAKERS DELIGHT 0423 ADELAIDE SA",
+			want: Descriptor{Key: "bakers delight", Name: "Bakers Delight", Parts: []string{"Bakers Delight"},
+				Processor: "Toast", City: "Adelaide", State: "SA", Country: "AU"},
+		},
+		{
+			raw:  "UBER *EATS HELP.UBER.COM",
+			want: Descriptor{Key: "uber eats", Name: "Uber Eats", Parts: []string{"Uber Eats"}},
+		},
+		{
+			// A date's slash does not split the descriptor
+			raw:  "Visa Purchase 12/03 NETFLIX.COM",
+			want: Descriptor{Key: "netflix com", Name: "Netflix.com", Parts: []string{"Netflix.com"}},
+		},
+		{
+			raw:  "   ",
+			want: Descriptor{},
+		},
+	}
+	for _, tt := range tests {
+		got := Normalise(tt.raw)
+		tt.want.Raw = tt.raw
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Normalise(%q) =\n  %+v\nwant\n  %+v", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestKey(t *testing.T) {
+	tests := []struct{ name, want string }{
+		{"McDonald's", "mcdonalds"},
+		{"MCDONALDS", "mcdonalds"},
+		{"JB Hi-Fi", "jb hi fi"},
+		{"  Sushi   Hub ", "sushi hub"},
+		{"7-Eleven", "7 eleven"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := Key(tt.name); got != tt.want {
+			t.Errorf("Key(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNewExtendsRules(t *testing.T) {
+	// A custom rule runs after the defaults
+	suffix := func(text string, _ *Descriptor) string { return text + " Pty" }
+	got := New(append(DefaultRules(), suffix)...).Normalise("PAYPAL *SPOTIFY")
+	if got.Key != "spotify pty" || got.Processor != "PayPal" {
+		t.Errorf("extended Normalise = %+v", got)
+	}
+}
@@ -0,0 +1,238 @@
+package descriptor
+
+import (
+	"regexp"
+	"strings"
+)
+
+// DefaultRules returns the rule set used by Normalise. The order matters:
+// processor prefixes come off first, then dates, card numbers and
+// references, then banking boilerplate, and the location tail last so it
+// is read from what remains.
+func DefaultRules() []Rule {
+	return []Rule{
+		ProcessorPrefix("Square", `SQ|SQU|SQUARE`, false),
+		ProcessorPrefix("PayPal", `PAYPAL|PP`, false),
+		ProcessorPrefix("Zeller", `ZLR|ZELLER`, false),
+		ProcessorPrefix("Lightspeed", `LS`, true),
+		ProcessorPrefix("Toast", `TST`, false),
+		ProcessorPrefix("Shopify", `SP|SHOPIFY`, false),
+		Strip(datePattern),
+		Strip(cardPattern),
+		Strip(referencePattern),
+		Strip(terminalPattern),
+		Strip(boilerplatePrefix),
+		Strip(boilerplateSuffix),
+		WebAddress,
+		Strip(strayAsterisk),
+		LocationTail,
+	}
+}
+
+// ProcessorPrefix strips a payment processor's prefix, written as the code
+// followed by "*" (e.g. "SQ *", "PAYPAL*"), and records name as the
+// processor. codes is a regexp alternation of prefix codes. With bare set
+// the code is also stripped when followed only by a space, as Lightspeed
+// writes "LS THE BAKERY", but only when it is in capitals.
+func ProcessorPrefix(name, codes string, bare bool) Rule {
+	re := regexp.MustCompile(`(?i)^(?:` + codes + `)\s*\*\s*|^(?:` + codes + `)\s+`)
+	return func(text string, d *Descriptor) string {
+		loc := re.FindStringIndex(text)
+		if loc == nil || loc[1] == len(text) {
+			return text
+		}
+		if !strings.Contains(text[:loc[1]], "*") && (!bare || !looksLikePrefix(text[:loc[1]])) {
+			return text
+		}
+		if d.Processor == "" {
+			d.Processor = name
+		}
+		return text[loc[1]:]
+	}
+}
+
+// looksLikePrefix reports whether a processor code given without "*" was
+// written in capitals, as bank feeds do.
+func looksLikePrefix(prefix string) bool {
+	p := strings.TrimSpace(prefix)
+	return len(p) >= 2 && strings.ToUpper(p) == p
+}
+
+// Strip removes every match of pattern.
+func Strip(pattern *regexp.Regexp) Rule {
+	return func(text string, _ *Descriptor) string {
+		return pattern.ReplaceAllString(text, " ")
+	}
+}
+
+var (
+	datePattern = regexp.MustCompile(`(?i)` +
+		`\bvalue\s+date:?\s*|` +
+		`\b\d{4}-\d{2}-\d{2}\b|` +
+		`\b\d{1,2}[/.-]\d{1,2}(?:[/.-]\d{2,4})?\b|` +
+		`\b\d{1,2}\s?(?:jan|feb|mar|apr|may|jun|jul|aug|sep|oct|nov|dec)[a-z]*(?:\s?\d{2,4})?\b|` +
+		`\b\d{1,2}:\d{2}(?::\d{2})?(?:\s?[ap]m)?\b`)
+
+	cardPattern = regexp.MustCompile(`(?i)` +
+		`\b(?:card|crd)\s*(?:no\.?\s*)?(?:x+|\*+)?\d{4}\b|` +
+		`(?:\bx{2,}|\*{2,})\d{4}\b|` +
+		`\b\d{4}(?:x{4,}|\*{4,})\w*`)
+
+	referencePattern = regexp.MustCompile(`(?i)` +
+		`\b(?:ref|reference|receipt|rcpt|inv|invoice|auth|txn|trn|order)\b(?:\s*(?:no\.?|number))?[\s:#.]*[a-z0-9-]*\d[a-z0-9-]*|` +
+		`#\s*[a-z0-9-]+`)
+
+	// terminalPattern drops store, terminal and sequence numbers: all-digit
+	// tokens of four or more digits, and tokens mixing letters with at least
+	// four digits ("T123456", "AU0042173").
+	terminalPattern = regexp.MustCompile(`(?i)\b\d{4,}\b|\b[a-z]*\d[a-z]*(?:\d[a-z]*){3,}\b`)
+
+	boilerplatePrefix = regexp.MustCompile(`(?i)^(?:` +
+		`(?:visa|mastercard|eftpos|debit card|credit card|card)?\s*(?:purchase|payment)|` +
+		`direct debit|pos(?:\s+w/d)?|eftpos|contactless|tap and go|` +
+		`(?:online|international)\s+(?:purchase|transaction)` +
+		`)\b[\s:-]*`)
+
+	boilerplateSuffix = regexp.MustCompile(`(?i)[\s-]*\b(?:` +
+		`transaction|purchase|payment|pos|eftpos|contactless|tap and go|` +
+		`card purchase|visa purchase|recurring|subscription` +
+		`)\s*$`)
+)
+
+// strayAsterisk matches "*" left inside a name by processors that join
+// merchant and product, as in "UBER *EATS".
+var strayAsterisk = regexp.MustCompile(`\s*\*+\s*`)
+
+var webAddress = regexp.MustCompile(`(?i)^(?:https?://)?(?:www\.)?([a-z0-9-]+(?:\.[a-z0-9-]+)*\.(?:com|net|org|io|co|au|nz|uk|tv|me|app))(?:/\S*)?$`)
+
+// WebAddress keeps a leading web address as the merchant name, minus any
+// path ("Apple.com/bill" becomes "Apple.com"), and drops web addresses that
+// follow a name, which are usually support sites ("UBER EATS HELP.UBER.COM").
+func WebAddress(text string, _ *Descriptor) string {
+	words := strings.Fields(text)
+	out := words[:0]
+	for i, w := range words {
+		m := webAddress.FindStringSubmatch(w)
+		if m == nil {
+			out = append(out, w)
+			continue
+		}
+		if i == 0 {
+			out = append(out, m[1])
+		}
+	}
+	return strings.Join(out, " ")
+}
+
+// states are the state and territory codes banks put at the end of
+// descriptors.
+var states = map[string]string{
+	"NSW": "NSW", "VIC": "VIC", "QLD": "QLD", "WA": "WA", "SA": "SA",
+	"TAS": "TAS", "ACT": "ACT", "NT": "NT",
+}
+
+// countries are country codes and names found at the end of descriptors,
+// mapped to their ISO 3166 alpha-2 code.
+var countries = map[string]string{
+	"AU": "AU", "AUS": "AU", "AUSTRALIA": "AU",
+	"NZ": "NZ", "NZL": "NZ",
+	"US": "US", "USA": "US",
+	"GB": "GB", "GBR": "GB", "UK": "GB",
+	"IE": "IE", "IRL": "IE",
+	"SG": "SG", "SGP": "SG",
+	"NL": "NL", "NLD": "NL",
+	"LU": "LU", "LUX": "LU",
+}
+
+type city struct {
+	name  string
+	state string
+}
+
+// cities maps the city names and abbreviations found in descriptor tails
+// to the city and its state. Multi-word names are listed with single
+// spaces.
+var cities = map[string]city{
+	"SYDNEY": {"Sydney", "NSW"}, "SYD": {"Sydney", "NSW"},
+	"MELBOURNE": {"Melbourne", "VIC"}, "MELB": {"Melbourne", "VIC"}, "MEL": {"Melbourne", "VIC"},
+	"BRISBANE": {"Brisbane", "QLD"}, "BRIS": {"Brisbane", "QLD"}, "BNE": {"Brisbane", "QLD"},
+	"PERTH": {"Perth", "WA"}, "PER": {"Perth", "WA"},
+	"ADELAIDE": {"Adelaide", "SA"}, "ADEL": {"Adelaide", "SA"}, "ADL": {"Adelaide", "SA"},
+	"HOBART": {"Hobart", "TAS"}, "HBA": {"Hobart", "TAS"},
+	"CANBERRA": {"Canberra", "ACT"}, "CBR": {"Canberra", "ACT"},
+	"DARWIN": {"Darwin", "NT"}, "DRW": {"Darwin", "NT"},
+	"GOLD COAST":       {"Gold Coast", "QLD"},
+	"SUNSHINE COAST":   {"Sunshine Coast", "QLD"},
+	"NEWCASTLE":        {"Newcastle", "NSW"},
+	"WOLLONGONG":       {"Wollongong", "NSW"},
+	"GEELONG":          {"Geelong", "VIC"},
+	"PARRAMATTA":       {"Parramatta", "NSW"},
+	"CHATSWOOD":        {"Chatswood", "NSW"},
+	"BONDI JUNCTION":   {"Bondi Junction", "NSW"},
+	"NORTH SYDNEY":     {"North Sydney", "NSW"},
+	"SOUTH YARRA":      {"South Yarra", "VIC"},
+	"FORTITUDE VALLEY": {"Fortitude Valley", "QLD"},
+	"TOWNSVILLE":       {"Townsville", "QLD"},
+	"CAIRNS":           {"Cairns", "QLD"},
+	"LAUNCESTON":       {"Launceston", "TAS"},
+	"FREMANTLE":        {"Fremantle", "WA"},
+}
+
+// LocationTail strips trailing country, state and city tokens, recording
+// them as location hints. At least one word of the merchant name is always
+// kept, so a merchant called "Perth Mint" or just "Sydney" survives.
+func LocationTail(text string, d *Descriptor) string {
+	words := strings.Fields(text)
+
+	for len(words) > 1 {
+		last := strings.ToUpper(strings.Trim(words[len(words)-1], ",.-"))
+
+		if code, ok := countries[last]; ok {
+			if d.Country == "" {
+				d.Country = code
+			}
+			words = words[:len(words)-1]
+			continue
+		}
+		if state, ok := states[last]; ok {
+			if d.State == "" {
+				d.State = state
+			}
+			if d.Country == "" {
+				d.Country = "AU"
+			}
+			words = words[:len(words)-1]
+			continue
+		}
+		if n, c := cityTail(words); n > 0 {
+			if d.City == "" {
+				d.City = c.name
+			}
+			if d.State == "" {
+				d.State = c.state
+			}
+			if d.Country == "" {
+				d.Country = "AU"
+			}
+			words = words[:len(words)-n]
+			continue
+		}
+		break
+	}
+	return strings.Join(words, " ")
+}
+
+// cityTail returns how many trailing words of words name a known city, and
+// the city, preferring the longest match and never consuming every word.
+func cityTail(words []string) (int, city) {
+	for n := 2; n >= 1; n-- {
+		if len(words) <= n {
+			continue
+		}
+		tail := strings.ToUpper(strings.Trim(strings.Join(words[len(words)-n:], " "), ",.-"))
+		if c, ok := cities[tail]; ok {
+			return n, c
+		}
+	}
+	return 0, city{}
+}
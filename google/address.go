@@ -0,0 +1,236 @@
+package google
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Address is an Australian street address parsed from search result text.
+type Address struct {
+	Unit         string  `json:"unit,omitempty"`
+	StreetNumber string  `json:"street_number"`
+	StreetName   string  `json:"street_name"`
+	StreetType   string  `json:"street_type"`
+	Suburb       string  `json:"suburb"`
+	State        string  `json:"state"`
+	Postcode     string  `json:"postcode"`
+	Confidence   float64 `json:"confidence"`
+}
+
+// IsZero reports whether no address was found.
+func (a Address) IsZero() bool {
+	return a.StreetName == "" && a.Postcode == ""
+}
+
+// String formats the address on one line, e.g.
+// "Level 5, 1 Woolworths Way, Bella Vista NSW 2153".
+func (a Address) String() string {
+	if a.IsZero() {
+		return ""
+	}
+	street := strings.Join(strings.Fields(a.StreetNumber+" "+a.StreetName+" "+a.StreetType), " ")
+	parts := []string{}
+	if a.Unit != "" {
+		parts = append(parts, a.Unit)
+	}
+	parts = append(parts, street, strings.Join(strings.Fields(a.Suburb+" "+a.State+" "+a.Postcode), " "))
+	return strings.Join(parts, ", ")
+}
+
+// streetTypes maps accepted street type spellings to their full name.
+var streetTypes = map[string]string{
+	"street": "Street", "st": "Street",
+	"road": "Road", "rd": "Road",
+	"avenue": "Avenue", "ave": "Avenue", "av": "Avenue",
+	"drive": "Drive", "dr": "Drive",
+	"way":    "Way",
+	"parade": "Parade", "pde": "Parade",
+	"place": "Place", "pl": "Place",
+	"boulevard": "Boulevard", "blvd": "Boulevard",
+	"lane": "Lane", "ln": "Lane",
+	"highway": "Highway", "hwy": "Highway",
+	"court": "Court", "ct": "Court",
+	"crescent": "Crescent", "cres": "Crescent",
+	"terrace": "Terrace", "tce": "Terrace",
+	"circuit": "Circuit", "cct": "Circuit",
+	"close": "Close", "cl": "Close",
+	"esplanade": "Esplanade", "esp": "Esplanade",
+	"square": "Square", "sq": "Square",
+	"promenade": "Promenade",
+	"quay":      "Quay",
+}
+
+var addressRegex = regexp.MustCompile(`(?i)` +
+	`(?:\b(?P<unit>(?:level|lvl|suite|unit|shop|floor|tower)\s+\d+[a-z]?)\s*,?\s*|\b(?P<slash>(?:(?:shop|unit|suite)\s+)?\d+[a-z]?)/)?` +
+	`\b(?P<number>\d+[a-z]?(?:\s*-\s*\d+[a-z]?)?)\s+` +
+	`(?P<name>[a-z][a-z'\-]*(?:\s+[a-z][a-z'\-]*){0,3}?)\s+` +
+	`(?P<type>` + streetTypePattern() + `)\b\.?\s*,?\s+` +
+	`(?P<suburb>[a-z][a-z'\-]*(?:\s+[a-z][a-z'\-]*){0,3}?)\s*,?\s+` +
+	`(?P<state>NSW|VIC|QLD|WA|SA|TAS|ACT|NT)\b\.?\s*,?\s*` +
+	`(?P<postcode>\d{4})\b`)
+
+// headOfficeHint matches wording that suggests an address is the head
+// office rather than a store or branch.
+var headOfficeHint = regexp.MustCompile(`(?i)head\s*office|headquarter|registered\s+office|corporate\s+office|\bHQ\b`)
+
+func streetTypePattern() string {
+	// Longest spellings first so "st" does not win over "street"
+	types := make([]string, 0, len(streetTypes))
+	for t := range streetTypes {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool {
+		if len(types[i]) != len(types[j]) {
+			return len(types[i]) > len(types[j])
+		}
+		return types[i] < types[j]
+	})
+	return strings.Join(types, "|")
+}
+
+// ValidPostcode reports whether postcode falls inside the ranges Australia
+// Post allocates to state.
+func ValidPostcode(state, postcode string) bool {
+	if len(postcode) != 4 {
+		return false
+	}
+	pc, err := strconv.Atoi(postcode)
+	if err != nil {
+		return false
+	}
+
+	in := func(lo, hi int) bool { return pc >= lo && pc <= hi }
+	switch strings.ToUpper(state) {
+	case "NSW":
+		return in(1000, 2599) || in(2619, 2899) || in(2921, 2999)
+	case "ACT":
+		return in(200, 299) || in(2600, 2618) || in(2900, 2920)
+	case "VIC":
+		return in(3000, 3999) || in(8000, 8999)
+	case "QLD":
+		return in(4000, 4999) || in(9000, 9999)
+	case "SA":
+		return in(5000, 5999)
+	case "WA":
+		return in(6000, 6797) || in(6800, 6999)
+	case "TAS":
+		return in(7000, 7999)
+	case "NT":
+		return in(800, 999)
+	}
+	return false
+}
+
+// ExtractAddresses finds every Australian street address in text. Each
+// address is scored on its own: a postcode that matches the state and
+// nearby "head office" wording raise the confidence.
+func ExtractAddresses(text string) []Address {
+	text = strings.Join(strings.Fields(text), " ")
+
+	var out []Address
+	for _, m := range addressRegex.FindAllStringSubmatchIndex(text, -1) {
+		group := func(name string) string {
+			idx := addressRegex.SubexpIndex(name)
+			if m[2*idx] < 0 {
+				return ""
+			}
+			return strings.TrimSpace(text[m[2*idx]:m[2*idx+1]])
+		}
+
+		addr := Address{
+			Unit:         titleCase(group("unit")),
+			StreetNumber: strings.ReplaceAll(strings.ToUpper(group("number")), " ", ""),
+			StreetName:   titleCase(group("name")),
+			StreetType:   streetTypes[strings.ToLower(group("type"))],
+			Suburb:       titleCase(group("suburb")),
+			State:        strings.ToUpper(group("state")),
+			Postcode:     group("postcode"),
+		}
+		if slash := group("slash"); slash != "" {
+			if strings.IndexFunc(slash, unicode.IsLetter) == 0 {
+				addr.Unit = titleCase(slash)
+			} else {
+				addr.Unit = "Unit " + strings.ToUpper(slash)
+			}
+		}
+
+		addr.Confidence = 50
+		if ValidPostcode(addr.State, addr.Postcode) {
+			addr.Confidence += 30
+		} else {
+			addr.Confidence -= 30
+		}
+
+		// Look for head office wording in the 80 characters before the match
+		from := m[0] - 80
+		if from < 0 {
+			from = 0
+		}
+		if headOfficeHint.MatchString(text[from:m[1]]) {
+			addr.Confidence += 20
+		}
+
+		out = append(out, addr)
+	}
+	return out
+}
+
+// BestAddress picks the most likely head office address across all search
+// results. Addresses repeated in several results gain confidence, and
+// addresses whose postcode does not belong to their state are never chosen.
+func BestAddress(results []SearchResult) (Address, bool) {
+	type tally struct {
+		addr  Address
+		count int
+	}
+	seen := map[string]*tally{}
+	var order []string
+
+	for _, r := range results {
+		for _, addr := range ExtractAddresses(r.Title + " . " + r.Snippet) {
+			if !ValidPostcode(addr.State, addr.Postcode) {
+				continue
+			}
+			key := strings.ToLower(addr.String())
+			if t, ok := seen[key]; ok {
+				t.count++
+				if addr.Confidence > t.addr.Confidence {
+					t.addr.Confidence = addr.Confidence
+				}
+				continue
+			}
+			seen[key] = &tally{addr: addr, count: 1}
+			order = append(order, key)
+		}
+	}
+
+	var best Address
+	found := false
+	for _, key := range order {
+		t := seen[key]
+		addr := t.addr
+		addr.Confidence += float64(t.count-1) * 10
+		if addr.Confidence > 100 {
+			addr.Confidence = 100
+		}
+		if !found || addr.Confidence > best.Confidence {
+			best = addr
+			found = true
+		}
+	}
+	return best, found
+}
+
+func titleCase(s string) string {
+	words := strings.Fields(strings.ToLower(s))
+	for i, w := range words {
+		if w == "" {
+			continue
+		}
+		words[i] = strings.ToUpper(w[:1]) + w[1:]
+	}
+	return strings.Join(words, " ")
+}
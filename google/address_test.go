@@ -0,0 +1,126 @@
+package google
+
+import "testing"
+
+func TestValidPostcode(t *testing.T) {
+	tests := []struct {
+		state, postcode string
+		want            bool
+	}{
+		{"NSW", "2000", true},
+		{"NSW", "2153", true},
+		{"nsw", "2600", false}, // Canberra
+		{"ACT", "2600", true},
+		{"ACT", "0200", true},
+		{"ACT", "2913", true},
+		{"NSW", "2913", false},
+		{"VIC", "3000", true},
+		{"VIC", "8001", true},
+		{"QLD", "4000", true},
+		{"QLD", "9726", true},
+		{"SA", "5000", true},
+		{"WA", "6000", true},
+		{"WA", "6798", false}, // Christmas Island
+		{"TAS", "7000", true},
+		{"NT", "0800", true},
+		{"NT", "800", false},
+		{"VIC", "2000", false},
+		{"XX", "2000", false},
+		{"NSW", "20OO", false},
+	}
+	for _, tt := range tests {
+		if got := ValidPostcode(tt.state, tt.postcode); got != tt.want {
+			t.Errorf("ValidPostcode(%q, %q) = %v, want %v", tt.state, tt.postcode, got, tt.want)
+		}
+	}
+}
+
+func TestExtractAddresses(t *testing.T) {
+	tests := []struct {
+		text string
+		want []Address
+	}{
+		{
+			text: "Woolworths Group head office is at 1 Woolworths Way, Bella Vista NSW 2153. Open 24/7.",
+			want: []Address{{StreetNumber: "1", StreetName: "Woolworths", StreetType: "Way", Suburb: "Bella Vista", State: "NSW", Postcode: "2153", Confidence: 100}},
+		},
+		{
+			text: "Coles Supermarkets Australia Pty Ltd, 800 Toorak Road, Hawthorn East VIC 3123",
+			want: []Address{{StreetNumber: "800", StreetName: "Toorak", StreetType: "Road", Suburb: "Hawthorn East", State: "VIC", Postcode: "3123", Confidence: 80}},
+		},
+		{
+			text: "Registered office: Level 6, 2 Southbank Blvd, Southbank VIC 3006",
+			want: []Address{{Unit: "Level 6", StreetNumber: "2", StreetName: "Southbank", StreetType: "Boulevard", Suburb: "Southbank", State: "VIC", Postcode: "3006", Confidence: 100}},
+		},
+		{
+			text: "Shop 3/45-47 Murray St, Hobart TAS 7000",
+			want: []Address{{Unit: "Shop 3", StreetNumber: "45-47", StreetName: "Murray", StreetType: "Street", Suburb: "Hobart", State: "TAS", Postcode: "7000", Confidence: 80}},
+		},
+		{
+			text: "12A/100 Queen St Brisbane City QLD 4000",
+			want: []Address{{Unit: "Unit 12A", StreetNumber: "100", StreetName: "Queen", StreetType: "Street", Suburb: "Brisbane City", State: "QLD", Postcode: "4000", Confidence: 80}},
+		},
+		{
+			// Sydney postcode with a Victorian state
+			text: "1 Martin Place, Sydney VIC 2000",
+			want: []Address{{StreetNumber: "1", StreetName: "Martin", StreetType: "Place", Suburb: "Sydney", State: "VIC", Postcode: "2000", Confidence: 20}},
+		},
+		{
+			text: "Call 1300 767 969 or visit us in Bella Vista NSW 2153",
+		},
+	}
+	for _, tt := range tests {
+		got := ExtractAddresses(tt.text)
+		if len(got) != len(tt.want) {
+			t.Errorf("ExtractAddresses(%q) = %+v, want %+v", tt.text, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("ExtractAddresses(%q)[%d] = %+v, want %+v", tt.text, i, got[i], tt.want[i])
+			}
+		}
+	}
+}
+
+func TestAddressString(t *testing.T) {
+	a := Address{Unit: "Level 5", StreetNumber: "1", StreetName: "Woolworths", StreetType: "Way", Suburb: "Bella Vista", State: "NSW", Postcode: "2153"}
+	if got := a.String(); got != "Level 5, 1 Woolworths Way, Bella Vista NSW 2153" {
+		t.Errorf("String() = %q", got)
+	}
+	if got := (Address{}).String(); got != "" {
+		t.Errorf("zero address = %q", got)
+	}
+}
+
+func TestBestAddress(t *testing.T) {
+	results := []SearchResult{
+		// A store, an invalid postcode and the head office
+		{Title: "Woolworths Town Hall", Snippet: "Woolworths Metro, 492 George St, Sydney NSW 2000. Open 6am to midnight."},
+		{Title: "Woolworths Group", Snippet: "Head office: 1 Woolworths Way, Bella Vista VIC 2153"},
+		{Title: "Woolworths Group Limited", Snippet: "Head office 1 Woolworths Way, Bella Vista NSW 2153"},
+		{Title: "Contact us", Snippet: "Write to 1 Woolworths Way Bella Vista NSW 2153"},
+	}
+	addr, ok := BestAddress(results)
+	if !ok || addr.String() != "1 Woolworths Way, Bella Vista NSW 2153" || addr.Confidence != 100 {
+		t.Errorf("BestAddress = %q (%.0f), %v", addr, addr.Confidence, ok)
+	}
+
+	// Repeats add confidence to an otherwise equal address
+	results = []SearchResult{
+		{Snippet: "800 Toorak Road, Hawthorn East VIC 3123"},
+		{Snippet: "Visit 492 George Street Sydney NSW 2000"},
+		{Snippet: "Coles, 800 Toorak Rd, Hawthorn East VIC 3123"},
+	}
+	addr, ok = BestAddress(results)
+	if !ok || addr.String() != "800 Toorak Road, Hawthorn East VIC 3123" || addr.Confidence != 90 {
+		t.Errorf("BestAddress = %q (%.0f), %v", addr, addr.Confidence, ok)
+	}
+
+	if _, ok := BestAddress([]SearchResult{{Snippet: "1 Martin Place, Sydney VIC 2000"}}); ok {
+		t.Error("BestAddress chose an address whose postcode is outside its state")
+	}
+	if _, ok := BestAddress(nil); ok {
+		t.Error("BestAddress found an address in no results")
+	}
+}
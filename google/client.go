@@ -1,7 +1,9 @@
 package google
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -9,6 +11,9 @@ import (
 	"regexp"
 	"strings"
 	"time"
+
+	"merchantcache/abn/abr"
+	"merchantcache/provenance"
 )
 
 type Client struct {
@@ -18,6 +23,25 @@ type Client struct {
 	clientID       string
 	clientSecret   string
 	baseURL        string
+	httpClient     *http.Client
+}
+
+// Option configures optional Client behaviour.
+type Option func(*Client)
+
+// WithHTTPClient makes the client send requests through hc, so one
+// http.Client can be shared between API clients or pointed at a stub server.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = hc
+	}
+}
+
+// WithBaseURL overrides the Custom Search endpoint.
+func WithBaseURL(baseURL string) Option {
+	return func(c *Client) {
+		c.baseURL = baseURL
+	}
 }
 
 type SearchResult struct {
@@ -30,6 +54,34 @@ type SearchResponse struct {
 	Items []SearchResult `json:"items"`
 }
 
+// Verification is the outcome of checking an ABN and legal name against
+// search results.
+type Verification struct {
+	Verified   bool    `json:"verified"`
+	Confidence float64 `json:"confidence"`
+}
+
+// HeadOffice is the head office found while verifying an ABN. Address is
+// the formatted form of Details.
+type HeadOffice struct {
+	Address string  `json:"address"`
+	Details Address `json:"details"`
+}
+
+// GoogleFound is what the search results confirmed about the entity.
+type GoogleFound struct {
+	ABN       abr.ABN `json:"abn"`
+	LegalName string  `json:"legal_name"`
+}
+
+// EnrichResult is returned by VerifyAndEnrich. HeadOffice and GoogleFound
+// are nil unless the ABN was verified.
+type EnrichResult struct {
+	Verification Verification `json:"verification"`
+	HeadOffice   *HeadOffice  `json:"head_office,omitempty"`
+	GoogleFound  *GoogleFound `json:"google_found,omitempty"`
+}
+
 type MerchantInfo struct {
 	LegalName   string
 	ABN         string
@@ -40,22 +92,31 @@ type MerchantInfo struct {
 	Confidence  float64
 }
 
-func NewClient(apiKey, searchEngineID, clientID, clientSecret string, timeout int) (*Client, error) {
+func NewClient(apiKey, searchEngineID, clientID, clientSecret string, timeout int, opts ...Option) (*Client, error) {
 	if apiKey == "" || searchEngineID == "" {
 		return nil, fmt.Errorf("incomplete credentials")
 	}
 
-	return &Client{
+	c := &Client{
 		apiKey:         apiKey,
 		searchEngineID: searchEngineID,
 		timeout:        timeout,
 		clientID:       clientID,
 		clientSecret:   clientSecret,
 		baseURL:        "https://www.googleapis.com/customsearch/v1",
-	}, nil
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.httpClient == nil {
+		c.httpClient = &http.Client{
+			Timeout: time.Duration(timeout) * time.Second,
+		}
+	}
+	return c, nil
 }
 
-func (c *Client) Search(query string, numResults int) ([]SearchResult, error) {
+func (c *Client) Search(ctx context.Context, query string, numResults int) ([]SearchResult, error) {
 	if numResults > 10 {
 		numResults = 10
 	}
@@ -66,11 +127,12 @@ func (c *Client) Search(query string, numResults int) ([]SearchResult, error) {
 	params.Set("cx", c.searchEngineID)
 	params.Set("num", fmt.Sprintf("%d", numResults))
 
-	client := &http.Client{
-		Timeout: time.Duration(c.timeout) * time.Second,
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
 	}
 
-	resp, err := client.Get(c.baseURL + "?" + params.Encode())
+	resp, err := c.httpClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -81,6 +143,10 @@ func (c *Client) Search(query string, numResults int) ([]SearchResult, error) {
 		return nil, err
 	}
 
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("custom search returned %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
 	var searchResp SearchResponse
 	err = json.Unmarshal(body, &searchResp)
 	if err != nil {
@@ -91,10 +157,10 @@ func (c *Client) Search(query string, numResults int) ([]SearchResult, error) {
 }
 
 // ExtractMerchantInfo extracts merchant legal name, state, and postcode from Google search results
-func (c *Client) ExtractMerchantInfo(merchantName string) (MerchantInfo, error) {
+func (c *Client) ExtractMerchantInfo(ctx context.Context, merchantName string) (MerchantInfo, error) {
 	// Search for merchant information
 	query := fmt.Sprintf("%s Australia legal name headquarters address", merchantName)
-	results, err := c.Search(query, 10)
+	results, err := c.Search(ctx, query, 10)
 	if err != nil || len(results) == 0 {
 		return MerchantInfo{}, err
 	}
@@ -189,6 +255,33 @@ func (c *Client) ExtractMerchantInfo(merchantName string) (MerchantInfo, error)
 	return info, nil
 }
 
+// Provenance describes the fields ExtractMerchantInfo found for
+// merchantName, so they can be merged with other providers. A legal name
+// that is just the merchant name echoed back is left out.
+func (m MerchantInfo) Provenance(merchantName string) []provenance.Record {
+	evidence := map[string]any{
+		"method":        "merchant_info_search",
+		"merchant_name": merchantName,
+		"state":         m.State,
+		"postcode":      m.Postcode,
+	}
+
+	var records []provenance.Record
+	if m.LegalName != "" && m.LegalName != merchantName {
+		records = append(records, provenance.New(provenance.LegalName, m.LegalName, provenance.SourceGoogle, m.Confidence, evidence))
+	}
+	if abn, err := abr.ParseABN(m.ABN); err == nil && abn.Valid() {
+		records = append(records, provenance.New(provenance.ABN, abn.String(), provenance.SourceGoogle, m.Confidence, evidence))
+	}
+	if acn, err := abr.ParseACN(m.ACN); err == nil && acn.Valid() {
+		records = append(records, provenance.New(provenance.ACN, acn.String(), provenance.SourceGoogle, m.Confidence, evidence))
+	}
+	if m.HeadOffice != "" {
+		records = append(records, provenance.New(provenance.HeadOffice, m.HeadOffice, provenance.SourceGoogle, m.Confidence, evidence))
+	}
+	return records
+}
+
 func min(a, b int) int {
 	if a < b {
 		return a
@@ -196,28 +289,20 @@ func min(a, b int) int {
 	return b
 }
 
-func (c *Client) VerifyAndEnrich(abn, legalName, state string) (map[string]interface{}, error) {
-	// Clean ABN
-	abnClean := regexp.MustCompile(`\D`).ReplaceAllString(abn, "")
-	if len(abnClean) != 11 {
-		return map[string]interface{}{
-			"verification": map[string]interface{}{
-				"verified": false,
-				"confidence": 0,
-			},
-		}, nil
+func (c *Client) VerifyAndEnrich(ctx context.Context, abn, legalName, state string) (EnrichResult, error) {
+	parsed, err := abr.ParseABN(abn)
+	if err != nil {
+		return EnrichResult{}, nil
 	}
 
+	abnClean := parsed.String()
+	found := &GoogleFound{ABN: parsed, LegalName: legalName}
+
 	// Primary verification
 	query := fmt.Sprintf("ABN %s %s Australia", abnClean, legalName)
-	results, err := c.Search(query, 5)
+	results, err := c.Search(ctx, query, 5)
 	if err != nil {
-		return map[string]interface{}{
-			"verification": map[string]interface{}{
-				"verified": false,
-				"confidence": 0,
-			},
-		}, nil
+		return EnrichResult{}, err
 	}
 
 	if len(results) > 0 {
@@ -225,7 +310,7 @@ func (c *Client) VerifyAndEnrich(abn, legalName, state string) (map[string]inter
 		nameMatches := 0
 
 		for _, r := range results {
-			if strings.Contains(r.Snippet, abnClean) {
+			if containsABN(r.Snippet, parsed) {
 				abnMatches++
 			}
 			if strings.Contains(strings.ToLower(r.Snippet), strings.ToLower(legalName)) {
@@ -235,69 +320,51 @@ func (c *Client) VerifyAndEnrich(abn, legalName, state string) (map[string]inter
 
 		confidence := (float64(abnMatches)*0.6 + float64(nameMatches)*0.4) / float64(len(results)) * 100
 		if confidence >= 50 {
-			// Extract address from first result
-			address := c.extractAddress(results[0])
-
-			return map[string]interface{}{
-				"verification": map[string]interface{}{
-					"verified": true,
-					"confidence": confidence,
-				},
-				"head_office": map[string]interface{}{
-					"address": address,
-				},
-				"google_found": map[string]interface{}{
-					"abn": abnClean,
-					"legal_name": legalName,
-				},
+			return EnrichResult{
+				Verification: Verification{Verified: true, Confidence: confidence},
+				HeadOffice:   headOffice(results),
+				GoogleFound:  found,
 			}, nil
 		}
 	}
 
 	// Fallback: Try just the ABN
-	fallbackResults, err := c.Search(fmt.Sprintf("ABN %s", abnClean), 3)
-	if err == nil && len(fallbackResults) > 0 {
-		return map[string]interface{}{
-			"verification": map[string]interface{}{
-				"verified": true,
-				"confidence": 40,
-			},
-			"head_office": map[string]interface{}{
-				"address": c.extractAddress(fallbackResults[0]),
-			},
-			"google_found": map[string]interface{}{
-				"abn": abnClean,
-				"legal_name": legalName,
-			},
+	fallbackResults, err := c.Search(ctx, fmt.Sprintf("ABN %s", abnClean), 3)
+	if err != nil {
+		return EnrichResult{}, err
+	}
+	if len(fallbackResults) > 0 {
+		return EnrichResult{
+			Verification: Verification{Verified: true, Confidence: 40},
+			HeadOffice:   headOffice(fallbackResults),
+			GoogleFound:  found,
 		}, nil
 	}
 
-	return map[string]interface{}{
-		"verification": map[string]interface{}{
-			"verified": false,
-			"confidence": 0,
-		},
-	}, nil
+	return EnrichResult{}, nil
 }
 
-func (c *Client) extractAddress(result SearchResult) string {
-	// Simple extraction of address patterns from snippet
-	snippet := result.Snippet
+// containsABN reports whether text mentions the ABN in either canonical or
+// spaced display form.
+func containsABN(text string, abn abr.ABN) bool {
+	return strings.Contains(text, abn.String()) || strings.Contains(text, abn.Format())
+}
 
-	// Remove common phrases
-	snippet = strings.TrimSpace(snippet)
-	if len(snippet) > 200 {
-		snippet = snippet[:200]
+// headOffice returns the best address across results, or nil if none of
+// them contain one.
+func headOffice(results []SearchResult) *HeadOffice {
+	addr, ok := BestAddress(results)
+	if !ok {
+		return nil
 	}
-
-	return snippet
+	return &HeadOffice{Address: addr.String(), Details: addr}
 }
 
 // FindLegalName searches for the correct legal business name
-func (c *Client) FindLegalName(businessName string) (string, error) {
+func (c *Client) FindLegalName(ctx context.Context, businessName string) (string, error) {
 	// First try to get the ABN lookup page directly
 	query := fmt.Sprintf("site:abr.business.gov.au %s", businessName)
-	results, err := c.Search(query, 3)
+	results, err := c.Search(ctx, query, 3)
 	if err != nil {
 		return businessName, nil
 	}
@@ -315,16 +382,17 @@ func (c *Client) FindLegalName(businessName string) (string, error) {
 }
 
 // VerifyAndGetAddress verifies ABN and gets address
-func (c *Client) VerifyAndGetAddress(abn, legalName string) (bool, float64, string) {
-	// Clean ABN
-	abnClean := regexp.MustCompile(`\D`).ReplaceAllString(abn, "")
-	if len(abnClean) != 11 {
+func (c *Client) VerifyAndGetAddress(ctx context.Context, abn, legalName string) (bool, float64, string) {
+	parsed, err := abr.ParseABN(abn)
+	if err != nil {
 		return false, 0, ""
 	}
 
+	abnClean := parsed.String()
+
 	// Search for ABN + legal name verification
 	query := fmt.Sprintf("ABN %s %s Australia head office address", abnClean, legalName)
-	results, err := c.Search(query, 5)
+	results, err := c.Search(ctx, query, 5)
 	if err != nil || len(results) == 0 {
 		return false, 0, ""
 	}
@@ -334,7 +402,7 @@ func (c *Client) VerifyAndGetAddress(abn, legalName string) (bool, float64, stri
 	nameMatches := 0
 
 	for _, r := range results {
-		if strings.Contains(r.Snippet, abnClean) {
+		if containsABN(r.Snippet, parsed) {
 			abnMatches++
 		}
 		if strings.Contains(strings.ToLower(r.Snippet), strings.ToLower(legalName)) {
@@ -343,41 +411,53 @@ func (c *Client) VerifyAndGetAddress(abn, legalName string) (bool, float64, stri
 	}
 
 	confidence := (float64(abnMatches)*0.6 + float64(nameMatches)*0.4) / float64(len(results)) * 100
-	address := c.extractAddress(results[0])
+	addr, _ := BestAddress(results)
 
 	verified := confidence >= 40
-	return verified, confidence, address
+	return verified, confidence, addr.String()
 }
-// SearchHeadOfficeAddress searches for the head office address of a merchant
-func (c *Client) SearchHeadOfficeAddress(merchantName string, legalName string) (string, error) {
-	// Search for head office/headquarters address
-	query := fmt.Sprintf("%s head office headquarters address Australia", merchantName)
-	results, err := c.Search(query, 5)
-	if err != nil {
-		return "", err
+
+// ErrNoAddress is returned by the address searches when the search worked
+// but turned up no address, as opposed to the search itself failing.
+var ErrNoAddress = errors.New("no address found")
+
+// SearchHeadOfficeAddress searches for the head office address of a merchant,
+// falling back to the legal name when the merchant name finds no address.
+func (c *Client) SearchHeadOfficeAddress(ctx context.Context, merchantName string, legalName string) (Address, error) {
+	queries := []string{fmt.Sprintf("%s head office headquarters address Australia", merchantName)}
+	if legalName != "" && !strings.EqualFold(legalName, merchantName) {
+		queries = append(queries, fmt.Sprintf("%s head office address Australia", legalName))
 	}
 
-	if len(results) == 0 {
-		return "", fmt.Errorf("no results found")
+	for _, query := range queries {
+		results, err := c.Search(ctx, query, 5)
+		if err != nil {
+			return Address{}, err
+		}
+		if addr, ok := BestAddress(results); ok {
+			return addr, nil
+		}
 	}
 
-	// Extract address from the first result
-	address := c.extractAddress(results[0])
-	if address != "" {
-		return address, nil
+	return Address{}, ErrNoAddress
+}
+
+// SearchSiteAddress looks for a head office address on the merchant's own
+// website, which is more reliable than a general search when the site is
+// known.
+func (c *Client) SearchSiteAddress(ctx context.Context, website string) (Address, error) {
+	domain := strings.TrimPrefix(strings.TrimPrefix(website, "https://"), "http://")
+	domain = strings.TrimPrefix(strings.TrimSuffix(domain, "/"), "www.")
+	if domain == "" {
+		return Address{}, fmt.Errorf("no website given: %w", ErrNoAddress)
 	}
 
-	// Try alternative search with legal name
-	query = fmt.Sprintf("%s head office address Australia", legalName)
-	results, err = c.Search(query, 5)
+	results, err := c.Search(ctx, fmt.Sprintf("site:%s head office address", domain), 5)
 	if err != nil {
-		return "", err
+		return Address{}, err
 	}
-
-	if len(results) == 0 {
-		return "", fmt.Errorf("no results found")
+	if addr, ok := BestAddress(results); ok {
+		return addr, nil
 	}
-
-	address = c.extractAddress(results[0])
-	return address, nil
-}
\ No newline at end of file
+	return Address{}, ErrNoAddress
+}
@@ -0,0 +1,157 @@
+package google
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// stubSearch serves Custom Search responses keyed by the q parameter. A
+// query with no entry gets an empty result list; one listed in failing
+// gets that status.
+type stubSearch struct {
+	results map[string][]SearchResult
+	failing map[string]int
+	queries []string
+}
+
+func (s *stubSearch) client(t *testing.T) *Client {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("key") != "key" || q.Get("cx") != "cx" {
+			http.Error(w, "bad credentials", http.StatusForbidden)
+			return
+		}
+		s.queries = append(s.queries, q.Get("q"))
+		if status, ok := s.failing[q.Get("q")]; ok {
+			http.Error(w, `{"error": {"message": "quota"}}`, status)
+			return
+		}
+		json.NewEncoder(w).Encode(SearchResponse{Items: s.results[q.Get("q")]})
+	}))
+	t.Cleanup(srv.Close)
+
+	c, err := NewClient("key", "cx", "", "", 5, WithHTTPClient(srv.Client()), WithBaseURL(srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+const woolworthsSnippet = "Woolworths Group Limited ABN 88 000 014 675. Head office: 1 Woolworths Way, Bella Vista NSW 2153."
+
+func TestSearch(t *testing.T) {
+	stub := &stubSearch{
+		results: map[string][]SearchResult{"woolworths": {{Title: "Woolworths", Link: "https://www.woolworths.com.au/"}}},
+		failing: map[string]int{"quota": http.StatusTooManyRequests},
+	}
+	c := stub.client(t)
+	ctx := context.Background()
+
+	results, err := c.Search(ctx, "woolworths", 20)
+	if err != nil || len(results) != 1 || results[0].Link != "https://www.woolworths.com.au/" {
+		t.Errorf("Search = %+v, %v", results, err)
+	}
+	if _, err := c.Search(ctx, "quota", 5); err == nil || !strings.Contains(err.Error(), "429") {
+		t.Errorf("429 gave %v, want an error with the status", err)
+	}
+}
+
+func TestVerifyAndEnrich(t *testing.T) {
+	const primary = "ABN 88000014675 Woolworths Group Limited Australia"
+	const fallback = "ABN 88000014675"
+
+	tests := []struct {
+		name       string
+		abn        string
+		results    map[string][]SearchResult
+		failing    map[string]int
+		verified   bool
+		confidence float64
+		address    string
+		wantErr    bool
+	}{
+		{
+			name:       "primary",
+			abn:        "88 000 014 675",
+			results:    map[string][]SearchResult{primary: {{Title: "Woolworths Group", Snippet: woolworthsSnippet}}},
+			verified:   true,
+			confidence: 100,
+			address:    "1 Woolworths Way, Bella Vista NSW 2153",
+		},
+		{
+			name:       "fallback",
+			abn:        "88000014675",
+			results:    map[string][]SearchResult{fallback: {{Title: "ABN Lookup", Snippet: "88 000 014 675 Active"}}},
+			verified:   true,
+			confidence: 40,
+		},
+		{
+			name: "no results",
+			abn:  "88000014675",
+		},
+		{
+			name: "invalid abn",
+			abn:  "88000014676",
+		},
+		{
+			name:    "primary rate limited",
+			abn:     "88000014675",
+			failing: map[string]int{primary: http.StatusTooManyRequests},
+			wantErr: true,
+		},
+		{
+			name:    "fallback unavailable",
+			abn:     "88000014675",
+			failing: map[string]int{fallback: http.StatusServiceUnavailable},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := &stubSearch{results: tt.results, failing: tt.failing}
+			got, err := stub.client(t).VerifyAndEnrich(context.Background(), tt.abn, "Woolworths Group Limited", "NSW")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if got.Verification.Verified != tt.verified || got.Verification.Confidence != tt.confidence {
+				t.Errorf("verification = %+v, want verified %v at %.0f", got.Verification, tt.verified, tt.confidence)
+			}
+			if tt.verified && (got.GoogleFound == nil || got.GoogleFound.ABN != "88000014675") {
+				t.Errorf("google found = %+v", got.GoogleFound)
+			}
+			var address string
+			if got.HeadOffice != nil {
+				address = got.HeadOffice.Address
+			}
+			if address != tt.address {
+				t.Errorf("head office = %q, want %q", address, tt.address)
+			}
+		})
+	}
+}
+
+func TestSearchHeadOfficeAddress(t *testing.T) {
+	stub := &stubSearch{results: map[string][]SearchResult{
+		"Woolworths Group Limited head office address Australia": {{Snippet: woolworthsSnippet}},
+	}}
+	c := stub.client(t)
+
+	// The merchant name finds nothing, so the legal name is tried
+	addr, err := c.SearchHeadOfficeAddress(context.Background(), "Woolies", "Woolworths Group Limited")
+	if err != nil || addr.String() != "1 Woolworths Way, Bella Vista NSW 2153" {
+		t.Errorf("address = %q, %v", addr, err)
+	}
+	if len(stub.queries) != 2 {
+		t.Errorf("sent %d queries, want 2: %q", len(stub.queries), stub.queries)
+	}
+
+	stub.queries = nil
+	if _, err := c.SearchHeadOfficeAddress(context.Background(), "Woolies", "woolies"); err == nil || len(stub.queries) != 1 {
+		t.Errorf("same-name search = %v after %d queries, want one failed query", err, len(stub.queries))
+	}
+}
@@ -0,0 +1,210 @@
+// Package merge reconciles what Brandfetch, the ABR and Google say about a
+// merchant into one golden record. Every provider's value arrives as a
+// provenance.Record; survivorship rules pick one winner per field and the
+// rest are kept as losers for audit.
+package merge
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+
+	"merchantcache/provenance"
+)
+
+// Strategy is how a field's winner is chosen among the providers that
+// supplied a value.
+type Strategy string
+
+const (
+	// Priority takes the first source in the rule's priority list that has
+	// a value, breaking ties by confidence.
+	Priority Strategy = "priority"
+	// MostRecent takes the most recently fetched value.
+	MostRecent Strategy = "most_recent"
+	// HighestConfidence takes the most confident value, newest first on
+	// ties.
+	HighestConfidence Strategy = "highest_confidence"
+)
+
+// Rule is the survivorship rule for one field. Sources missing from
+// Priority rank after every listed source. Manual overrides win whatever
+// the strategy.
+type Rule struct {
+	Strategy Strategy            `json:"strategy"`
+	Priority []provenance.Source `json:"priority,omitempty"`
+}
+
+// Rules holds a rule per field and a default for fields without one.
+type Rules struct {
+	Default Rule                      `json:"default"`
+	Fields  map[provenance.Field]Rule `json:"fields"`
+}
+
+// DefaultRules trusts Brandfetch for the brand, the ABR for the legal
+// entity, and whichever provider is most confident about the head office.
+func DefaultRules() Rules {
+	brand := Rule{Strategy: Priority, Priority: []provenance.Source{provenance.SourceBrandfetch, provenance.SourceGoogle, provenance.SourceABR}}
+	entity := Rule{Strategy: Priority, Priority: []provenance.Source{provenance.SourceABR, provenance.SourceGoogle, provenance.SourceBrandfetch}}
+	return Rules{
+		Default: Rule{Strategy: HighestConfidence},
+		Fields: map[provenance.Field]Rule{
+			provenance.BrandName:  brand,
+			provenance.Website:    brand,
+			provenance.Logo:       brand,
+			provenance.Category:   brand,
+			provenance.LegalName:  entity,
+			provenance.ABN:        entity,
+			provenance.ACN:        entity,
+			provenance.HeadOffice: {Strategy: HighestConfidence},
+		},
+	}
+}
+
+// LoadRules reads rules from a JSON file shaped like Rules, e.g.
+//
+//	{"default": {"strategy": "highest_confidence"},
+//	 "fields": {"legal_name": {"strategy": "priority", "priority": ["abr", "google"]}}}
+//
+// Fields the file leaves out keep their DefaultRules rule.
+func LoadRules(path string) (Rules, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return Rules{}, fmt.Errorf("read merge rules: %w", err)
+	}
+	var file Rules
+	if err := json.Unmarshal(raw, &file); err != nil {
+		return Rules{}, fmt.Errorf("parse merge rules %s: %w", path, err)
+	}
+
+	rules := DefaultRules()
+	if file.Default.Strategy != "" {
+		rules.Default = file.Default
+	}
+	for field, rule := range file.Fields {
+		rules.Fields[field] = rule
+	}
+	if err := rules.Validate(); err != nil {
+		return Rules{}, fmt.Errorf("merge rules %s: %w", path, err)
+	}
+	return rules, nil
+}
+
+// Validate checks every rule names a known strategy.
+func (r Rules) Validate() error {
+	check := func(name string, rule Rule) error {
+		switch rule.Strategy {
+		case Priority, MostRecent, HighestConfidence:
+			return nil
+		}
+		return fmt.Errorf("%s: unknown strategy %q", name, rule.Strategy)
+	}
+	if err := check("default", r.Default); err != nil {
+		return err
+	}
+	for field, rule := range r.Fields {
+		if err := check(string(field), rule); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rule returns the rule for field.
+func (r Rules) Rule(field provenance.Field) Rule {
+	if rule, ok := r.Fields[field]; ok {
+		return rule
+	}
+	return r.Default
+}
+
+// Golden is the merged record for one merchant. Fields holds each field's
+// winning value and Losers every other candidate, best first.
+type Golden struct {
+	Key    string                                   `json:"key"`
+	Fields map[provenance.Field]provenance.Record   `json:"fields"`
+	Losers map[provenance.Field][]provenance.Record `json:"losers,omitempty"`
+}
+
+// Value returns the winning value for field, or "" when no provider had one
+// or it was blanked by hand.
+func (g Golden) Value(field provenance.Field) string {
+	return g.Fields[field].Value
+}
+
+// Merge picks a winner per field from candidates. Provider candidates
+// without a value are ignored; an empty manual override wins and blanks
+// the field.
+func (r Rules) Merge(key string, candidates []provenance.Record) Golden {
+	byField := map[provenance.Field][]provenance.Record{}
+	for _, c := range candidates {
+		if c.Value == "" && c.Source != provenance.SourceManual {
+			continue
+		}
+		byField[c.Field] = append(byField[c.Field], c)
+	}
+
+	g := Golden{
+		Key:    key,
+		Fields: map[provenance.Field]provenance.Record{},
+		Losers: map[provenance.Field][]provenance.Record{},
+	}
+	for field, recs := range byField {
+		ranked := r.Rule(field).rank(recs)
+		g.Fields[field] = ranked[0]
+		if len(ranked) > 1 {
+			g.Losers[field] = ranked[1:]
+		}
+	}
+	return g
+}
+
+// rank orders recs best first under the rule.
+func (rule Rule) rank(recs []provenance.Record) []provenance.Record {
+	ranked := append([]provenance.Record(nil), recs...)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		a, b := ranked[i], ranked[j]
+
+		// Manual overrides always win, the newest first
+		am, bm := a.Source == provenance.SourceManual, b.Source == provenance.SourceManual
+		if am != bm {
+			return am
+		}
+		if am {
+			return a.FetchedAt.After(b.FetchedAt)
+		}
+
+		switch rule.Strategy {
+		case Priority:
+			if pa, pb := rule.priority(a.Source), rule.priority(b.Source); pa != pb {
+				return pa < pb
+			}
+			return higherConfidence(a, b)
+		case MostRecent:
+			if !a.FetchedAt.Equal(b.FetchedAt) {
+				return a.FetchedAt.After(b.FetchedAt)
+			}
+			return a.Confidence > b.Confidence
+		default:
+			return higherConfidence(a, b)
+		}
+	})
+	return ranked
+}
+
+func (rule Rule) priority(source provenance.Source) int {
+	for i, s := range rule.Priority {
+		if s == source {
+			return i
+		}
+	}
+	return len(rule.Priority)
+}
+
+func higherConfidence(a, b provenance.Record) bool {
+	if a.Confidence != b.Confidence {
+		return a.Confidence > b.Confidence
+	}
+	return a.FetchedAt.After(b.FetchedAt)
+}
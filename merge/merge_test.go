@@ -0,0 +1,217 @@
+package merge
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"merchantcache/provenance"
+)
+
+var (
+	t0 = time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	t1 = t0.Add(time.Hour)
+	t2 = t0.Add(2 * time.Hour)
+)
+
+func rec(source provenance.Source, value string, confidence float64, at time.Time) provenance.Record {
+	return provenance.Record{Field: provenance.BrandName, Value: value, Source: source, Confidence: confidence, FetchedAt: at}
+}
+
+func TestRank(t *testing.T) {
+	var (
+		bf     = provenance.SourceBrandfetch
+		abr    = provenance.SourceABR
+		google = provenance.SourceGoogle
+		manual = provenance.SourceManual
+	)
+	tests := []struct {
+		name string
+		rule Rule
+		recs []provenance.Record
+		want []string
+	}{
+		{
+			name: "priority order over confidence",
+			rule: Rule{Strategy: Priority, Priority: []provenance.Source{abr, google, bf}},
+			recs: []provenance.Record{rec(bf, "bf", 99, t0), rec(google, "google", 50, t0), rec(abr, "abr", 10, t0)},
+			want: []string{"abr", "google", "bf"},
+		},
+		{
+			name: "unlisted sources rank last",
+			rule: Rule{Strategy: Priority, Priority: []provenance.Source{google}},
+			recs: []provenance.Record{rec(bf, "bf", 99, t0), rec(abr, "abr", 80, t0), rec(google, "google", 10, t0)},
+			want: []string{"google", "bf", "abr"},
+		},
+		{
+			name: "priority ties broken by confidence",
+			rule: Rule{Strategy: Priority, Priority: []provenance.Source{abr}},
+			recs: []provenance.Record{rec(abr, "low", 40, t0), rec(abr, "high", 90, t0)},
+			want: []string{"high", "low"},
+		},
+		{
+			name: "most recent",
+			rule: Rule{Strategy: MostRecent},
+			recs: []provenance.Record{rec(bf, "old", 99, t0), rec(google, "new", 10, t2), rec(abr, "mid", 50, t1)},
+			want: []string{"new", "mid", "old"},
+		},
+		{
+			name: "most recent ties broken by confidence",
+			rule: Rule{Strategy: MostRecent},
+			recs: []provenance.Record{rec(bf, "low", 40, t1), rec(google, "high", 90, t1)},
+			want: []string{"high", "low"},
+		},
+		{
+			name: "highest confidence",
+			rule: Rule{Strategy: HighestConfidence},
+			recs: []provenance.Record{rec(bf, "mid", 50, t2), rec(google, "high", 90, t0), rec(abr, "low", 10, t1)},
+			want: []string{"high", "mid", "low"},
+		},
+		{
+			name: "highest confidence ties broken by recency",
+			rule: Rule{Strategy: HighestConfidence},
+			recs: []provenance.Record{rec(bf, "old", 80, t0), rec(google, "new", 80, t2)},
+			want: []string{"new", "old"},
+		},
+		{
+			name: "manual beats every strategy, newest first",
+			rule: Rule{Strategy: Priority, Priority: []provenance.Source{abr}},
+			recs: []provenance.Record{rec(abr, "abr", 100, t2), rec(manual, "first", 0, t0), rec(manual, "second", 0, t1)},
+			want: []string{"second", "first", "abr"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, r := range tt.rule.rank(tt.recs) {
+				got = append(got, r.Value)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("rank = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMerge(t *testing.T) {
+	candidates := []provenance.Record{
+		{Field: provenance.BrandName, Value: "Coles", Source: provenance.SourceBrandfetch, Confidence: 70, FetchedAt: t0},
+		{Field: provenance.BrandName, Value: "Coles Supermarkets", Source: provenance.SourceGoogle, Confidence: 90, FetchedAt: t0},
+		{Field: provenance.LegalName, Value: "COLES SUPERMARKETS AUSTRALIA PTY LTD", Source: provenance.SourceABR, Confidence: 99, FetchedAt: t0},
+		{Field: provenance.LegalName, Value: "Coles Group", Source: provenance.SourceGoogle, Confidence: 60, FetchedAt: t0},
+		{Field: provenance.Logo, Value: "", Source: provenance.SourceBrandfetch, Confidence: 80, FetchedAt: t0},
+		{Field: provenance.Website, Value: "coles.com.au", Source: provenance.SourceBrandfetch, Confidence: 80, FetchedAt: t0},
+		{Field: provenance.Website, Value: "", Source: provenance.SourceManual, FetchedAt: t1},
+	}
+	g := DefaultRules().Merge("coles", candidates)
+
+	tests := []struct {
+		field      provenance.Field
+		want       string
+		wantSource provenance.Source
+		wantLosers int
+	}{
+		{field: provenance.BrandName, want: "Coles", wantSource: provenance.SourceBrandfetch, wantLosers: 1},
+		{field: provenance.LegalName, want: "COLES SUPERMARKETS AUSTRALIA PTY LTD", wantSource: provenance.SourceABR, wantLosers: 1},
+		// A blank manual override wins and blanks the field
+		{field: provenance.Website, want: "", wantSource: provenance.SourceManual, wantLosers: 1},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.field), func(t *testing.T) {
+			won, ok := g.Fields[tt.field]
+			if !ok {
+				t.Fatalf("no winner for %s", tt.field)
+			}
+			if won.Value != tt.want || won.Source != tt.wantSource {
+				t.Errorf("winner = %q from %s, want %q from %s", won.Value, won.Source, tt.want, tt.wantSource)
+			}
+			if n := len(g.Losers[tt.field]); n != tt.wantLosers {
+				t.Errorf("%d losers, want %d", n, tt.wantLosers)
+			}
+		})
+	}
+
+	// A provider with no value is not a candidate at all
+	if _, ok := g.Fields[provenance.Logo]; ok {
+		t.Errorf("logo merged from a blank provider value: %+v", g.Fields[provenance.Logo])
+	}
+	if g.Key != "coles" {
+		t.Errorf("key = %q", g.Key)
+	}
+}
+
+func TestLoadRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		check   func(t *testing.T, r Rules)
+		wantErr string
+	}{
+		{
+			name: "overrides merge over defaults",
+			file: `{"fields": {"legal_name": {"strategy": "priority", "priority": ["google", "abr"]}}}`,
+			check: func(t *testing.T, r Rules) {
+				want := Rule{Strategy: Priority, Priority: []provenance.Source{provenance.SourceGoogle, provenance.SourceABR}}
+				if got := r.Rule(provenance.LegalName); !reflect.DeepEqual(got, want) {
+					t.Errorf("legal_name rule = %+v, want %+v", got, want)
+				}
+				defaults := DefaultRules()
+				if got := r.Rule(provenance.BrandName); !reflect.DeepEqual(got, defaults.Rule(provenance.BrandName)) {
+					t.Errorf("brand_name rule = %+v, want the default", got)
+				}
+				if !reflect.DeepEqual(r.Default, defaults.Default) {
+					t.Errorf("default rule = %+v, want %+v", r.Default, defaults.Default)
+				}
+			},
+		},
+		{
+			name: "default replaced",
+			file: `{"default": {"strategy": "most_recent"}}`,
+			check: func(t *testing.T, r Rules) {
+				if r.Default.Strategy != MostRecent {
+					t.Errorf("default strategy = %q", r.Default.Strategy)
+				}
+				if got := r.Rule(provenance.HeadOffice).Strategy; got != HighestConfidence {
+					t.Errorf("head office strategy = %q, want the default rule's", got)
+				}
+			},
+		},
+		{
+			name:    "unknown field strategy",
+			file:    `{"fields": {"abn": {"strategy": "loudest"}}}`,
+			wantErr: `abn: unknown strategy "loudest"`,
+		},
+		{
+			name:    "unknown default strategy",
+			file:    `{"default": {"strategy": "newest"}}`,
+			wantErr: `default: unknown strategy "newest"`,
+		},
+		{
+			name:    "invalid json",
+			file:    `{"fields": `,
+			wantErr: "parse merge rules",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "rules.json")
+			if err := os.WriteFile(path, []byte(tt.file), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			rules, err := LoadRules(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("err = %v, want one mentioning %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, rules)
+		})
+	}
+}
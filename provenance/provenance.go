@@ -0,0 +1,208 @@
+// Package provenance records where each enriched merchant field came from:
+// the provider that supplied it, when, the evidence it was based on and how
+// confident we are in it. Records are stored one row per field and source
+// in the field_provenance table so consumers can trust or discard fields
+// individually.
+package provenance
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// DB is the part of a connection the store needs. *pgxpool.Pool and pgx.Tx
+// both satisfy it, so records can be saved alongside the row they describe.
+type DB interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	SendBatch(ctx context.Context, b *pgx.Batch) pgx.BatchResults
+}
+
+// Field names an enriched merchant field. The values match the
+// enriched_merchants columns where one exists.
+type Field string
+
+const (
+	BrandName  Field = "brand_name"
+	LegalName  Field = "legal_name"
+	ABN        Field = "abn"
+	ACN        Field = "acn"
+	HeadOffice Field = "head_office_address"
+	Logo       Field = "logo"
+	Website    Field = "website_url"
+	Category   Field = "category"
+)
+
+// Source names the provider a value came from.
+type Source string
+
+const (
+	SourceBrandfetch Source = "brandfetch"
+	SourceABR        Source = "abr"
+	SourceGoogle     Source = "google"
+	SourceManual     Source = "manual"
+)
+
+// Record is one provider's value for one field. Confidence is 0 to 100.
+// Evidence is whatever the provider returned that the value was taken
+// from, kept small enough to read at a glance.
+type Record struct {
+	Field      Field           `json:"field"`
+	Value      string          `json:"value"`
+	Source     Source          `json:"source"`
+	Confidence float64         `json:"confidence"`
+	FetchedAt  time.Time       `json:"fetched_at"`
+	Evidence   json.RawMessage `json:"evidence,omitempty"`
+}
+
+// New builds a record fetched now. evidence is marshalled to JSON; a nil
+// evidence is left out.
+func New(field Field, value string, source Source, confidence float64, evidence any) Record {
+	r := Record{
+		Field:      field,
+		Value:      value,
+		Source:     source,
+		Confidence: clamp(confidence),
+		FetchedAt:  time.Now().UTC(),
+	}
+	if evidence != nil {
+		if raw, err := json.Marshal(evidence); err == nil {
+			r.Evidence = raw
+		}
+	}
+	return r
+}
+
+// Find returns the record for field with the highest confidence.
+func Find(records []Record, field Field) (Record, bool) {
+	var (
+		best  Record
+		found bool
+	)
+	for _, r := range records {
+		if r.Field != field {
+			continue
+		}
+		if !found || r.Confidence > best.Confidence {
+			best, found = r, true
+		}
+	}
+	return best, found
+}
+
+// Save stores records for the enriched row keyed by transactionCache. A
+// field keeps one row per source; saving again replaces that source's
+// earlier values, and drops the fields it no longer supplies. Records
+// without a value are skipped.
+func Save(ctx context.Context, db DB, transactionCache string, records []Record) error {
+	var sources []Source
+	fields := map[Source][]string{}
+	for _, r := range records {
+		if _, ok := fields[r.Source]; !ok {
+			sources = append(sources, r.Source)
+			fields[r.Source] = []string{}
+		}
+		if r.Value != "" {
+			fields[r.Source] = append(fields[r.Source], string(r.Field))
+		}
+	}
+
+	batch := &pgx.Batch{}
+	for _, s := range sources {
+		batch.Queue(`
+			delete from field_provenance
+			where transaction_cache = $1
+			  and source = $2
+			  and field <> all($3)
+		`, transactionCache, string(s), fields[s])
+	}
+	for _, r := range records {
+		if r.Value == "" {
+			continue
+		}
+		var evidence any
+		if len(r.Evidence) > 0 {
+			evidence = string(r.Evidence)
+		}
+		batch.Queue(`
+			insert into field_provenance (transaction_cache, field, value, source, confidence, evidence, fetched_at)
+			values ($1, $2, $3, $4, $5, $6::jsonb, $7)
+			on conflict (transaction_cache, field, source) do update set
+				value = excluded.value,
+				confidence = excluded.confidence,
+				evidence = excluded.evidence,
+				fetched_at = excluded.fetched_at
+		`, transactionCache, string(r.Field), r.Value, string(r.Source), r.Confidence, evidence, r.FetchedAt)
+	}
+	if batch.Len() == 0 {
+		return nil
+	}
+	if err := db.SendBatch(ctx, batch).Close(); err != nil {
+		return fmt.Errorf("save provenance for %s: %w", transactionCache, err)
+	}
+	return nil
+}
+
+// Touch marks the row's values from sources as fetched now, for when a
+// provider was asked again and gave the same answer.
+func Touch(ctx context.Context, db DB, transactionCache string, sources []Source) error {
+	names := make([]string, len(sources))
+	for i, s := range sources {
+		names[i] = string(s)
+	}
+	_, err := db.Exec(ctx, `
+		update field_provenance
+		set fetched_at = now()
+		where transaction_cache = $1
+		  and source = any($2)
+	`, transactionCache, names)
+	if err != nil {
+		return fmt.Errorf("touch provenance for %s: %w", transactionCache, err)
+	}
+	return nil
+}
+
+// Load returns every stored record for the enriched row keyed by
+// transactionCache.
+func Load(ctx context.Context, db DB, transactionCache string) ([]Record, error) {
+	rows, err := db.Query(ctx, `
+		select field, value, source, confidence, coalesce(evidence::text, ''), fetched_at
+		from field_provenance
+		where transaction_cache = $1
+	`, transactionCache)
+	if err != nil {
+		return nil, fmt.Errorf("load provenance for %s: %w", transactionCache, err)
+	}
+	defer rows.Close()
+
+	var out []Record
+	for rows.Next() {
+		var (
+			r        Record
+			evidence string
+		)
+		if err := rows.Scan(&r.Field, &r.Value, &r.Source, &r.Confidence, &evidence, &r.FetchedAt); err != nil {
+			return nil, err
+		}
+		if evidence != "" {
+			r.Evidence = json.RawMessage(evidence)
+		}
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+func clamp(confidence float64) float64 {
+	switch {
+	case confidence < 0:
+		return 0
+	case confidence > 100:
+		return 100
+	}
+	return confidence
+}
@@ -0,0 +1,142 @@
+package provenance
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+)
+
+func TestNewClampsConfidence(t *testing.T) {
+	tests := []struct {
+		in, want float64
+	}{
+		{-5, 0},
+		{0, 0},
+		{42.5, 42.5},
+		{100, 100},
+		{140, 100},
+	}
+	for _, tt := range tests {
+		if got := New(ABN, "51824753556", SourceABR, tt.in, nil).Confidence; got != tt.want {
+			t.Errorf("New confidence %v = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestNewEvidence(t *testing.T) {
+	r := New(Logo, "https://cdn/logo.png", SourceBrandfetch, 80, map[string]string{"domain": "coles.com.au"})
+	if string(r.Evidence) != `{"domain":"coles.com.au"}` {
+		t.Errorf("evidence = %s", r.Evidence)
+	}
+	if r := New(Logo, "https://cdn/logo.png", SourceBrandfetch, 80, nil); r.Evidence != nil {
+		t.Errorf("nil evidence stored as %s", r.Evidence)
+	}
+}
+
+func TestFind(t *testing.T) {
+	records := []Record{
+		{Field: BrandName, Value: "Coles", Source: SourceBrandfetch, Confidence: 70},
+		{Field: LegalName, Value: "COLES SUPERMARKETS AUSTRALIA PTY LTD", Source: SourceABR, Confidence: 99},
+		{Field: BrandName, Value: "Coles Supermarkets", Source: SourceGoogle, Confidence: 85},
+		{Field: BrandName, Value: "coles", Source: SourceABR, Confidence: 85},
+	}
+	tests := []struct {
+		name   string
+		field  Field
+		want   string
+		wantOK bool
+	}{
+		{name: "highest confidence wins", field: BrandName, want: "Coles Supermarkets", wantOK: true},
+		{name: "single record", field: LegalName, want: "COLES SUPERMARKETS AUSTRALIA PTY LTD", wantOK: true},
+		{name: "missing field", field: Logo},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := Find(records, tt.field)
+			if ok != tt.wantOK || got.Value != tt.want {
+				t.Errorf("Find(%s) = %q, %v, want %q, %v", tt.field, got.Value, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+// batchDB records the batch Save sends instead of running it.
+type batchDB struct {
+	DB
+	batch *pgx.Batch
+}
+
+func (d *batchDB) SendBatch(ctx context.Context, b *pgx.Batch) pgx.BatchResults {
+	d.batch = b
+	return closedResults{}
+}
+
+type closedResults struct{ pgx.BatchResults }
+
+func (closedResults) Close() error { return nil }
+
+func TestSaveDropsStaleFields(t *testing.T) {
+	db := &batchDB{}
+	records := []Record{
+		New(BrandName, "Coles", SourceBrandfetch, 80, nil),
+		New(Logo, "", SourceBrandfetch, 80, nil),
+		New(ABN, "45004189708", SourceABR, 99, nil),
+	}
+	if err := Save(context.Background(), db, "coles", records); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		deletes = map[string][]string{}
+		inserts []string
+	)
+	for _, q := range db.batch.QueuedQueries {
+		switch {
+		case strings.Contains(q.SQL, "delete from field_provenance"):
+			deletes[q.Arguments[1].(string)] = q.Arguments[2].([]string)
+		case strings.Contains(q.SQL, "insert into field_provenance"):
+			inserts = append(inserts, q.Arguments[3].(string)+"/"+q.Arguments[1].(string))
+		default:
+			t.Errorf("unexpected query %s", q.SQL)
+		}
+	}
+
+	// Each source keeps only the fields it supplied a value for this time,
+	// so the blank logo is dropped rather than kept from an earlier save
+	wantDeletes := map[string][]string{
+		"brandfetch": {"brand_name"},
+		"abr":        {"abn"},
+	}
+	if !reflect.DeepEqual(deletes, wantDeletes) {
+		t.Errorf("deletes keep %v, want %v", deletes, wantDeletes)
+	}
+	if want := []string{"brandfetch/brand_name", "abr/abn"}; !reflect.DeepEqual(inserts, want) {
+		t.Errorf("inserts = %v, want %v", inserts, want)
+	}
+}
+
+func TestSaveSourceWithNoValues(t *testing.T) {
+	db := &batchDB{}
+	if err := Save(context.Background(), db, "coles", []Record{New(Website, "", SourceGoogle, 60, nil)}); err != nil {
+		t.Fatal(err)
+	}
+	if n := db.batch.Len(); n != 1 {
+		t.Fatalf("queued %d queries, want the one delete", n)
+	}
+	if fields := db.batch.QueuedQueries[0].Arguments[2].([]string); len(fields) != 0 {
+		t.Errorf("delete keeps %v, want every google field dropped", fields)
+	}
+}
+
+func TestSaveNothing(t *testing.T) {
+	db := &batchDB{}
+	if err := Save(context.Background(), db, "coles", nil); err != nil {
+		t.Fatal(err)
+	}
+	if db.batch != nil {
+		t.Error("sent a batch for no records")
+	}
+}
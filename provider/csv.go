@@ -0,0 +1,149 @@
+package provider
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"merchantcache/descriptor"
+	"merchantcache/provenance"
+)
+
+// csvFields are the columns a CSV provider reads values from, named after
+// the provenance fields.
+var csvFields = []provenance.Field{
+	provenance.BrandName,
+	provenance.LegalName,
+	provenance.ABN,
+	provenance.ACN,
+	provenance.HeadOffice,
+	provenance.Logo,
+	provenance.Website,
+	provenance.Category,
+}
+
+// CSV answers from a local file of known merchants. The file has a header
+// row with a match column, the merchant name or descriptor to recognise,
+// any of the field columns (brand_name, website_url, abn, ...) and an
+// optional confidence column. A row matches when its match column has the
+// same merchant key as the descriptor, one of its names or the brand.
+type CSV struct {
+	name       string
+	confidence float64
+	rows       map[string][]csvRow // by merchant key
+}
+
+type csvRow struct {
+	values     map[provenance.Field]string
+	confidence float64
+	line       int
+}
+
+// NewCSVFromSettings builds a CSV provider from its path setting. Rows
+// without a confidence get the confidence setting, 95 by default.
+func NewCSVFromSettings(name string, s Settings) (Provider, error) {
+	path := s.String("path", "")
+	if path == "" {
+		return nil, errors.New("csv provider needs a path setting")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return NewCSV(name, f, s.Float("confidence", 95))
+}
+
+// NewCSV reads a known merchants file from r.
+func NewCSV(name string, r io.Reader, confidence float64) (*CSV, error) {
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("read header: %w", err)
+	}
+	cols := map[string]int{}
+	for i, h := range header {
+		cols[strings.ToLower(strings.TrimSpace(h))] = i
+	}
+	matchCol, ok := cols["match"]
+	if !ok {
+		return nil, errors.New("no match column")
+	}
+
+	p := &CSV{name: name, confidence: confidence, rows: map[string][]csvRow{}}
+	for line := 2; ; line++ {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		key := descriptor.Key(rec[matchCol])
+		if key == "" {
+			continue
+		}
+		row := csvRow{values: map[provenance.Field]string{}, confidence: confidence, line: line}
+		for _, f := range csvFields {
+			if i, ok := cols[string(f)]; ok && i < len(rec) {
+				if v := strings.TrimSpace(rec[i]); v != "" {
+					row.values[f] = v
+				}
+			}
+		}
+		if i, ok := cols["confidence"]; ok && i < len(rec) {
+			if c, err := strconv.ParseFloat(strings.TrimSpace(rec[i]), 64); err == nil {
+				row.confidence = c
+			}
+		}
+		p.rows[key] = append(p.rows[key], row)
+	}
+	return p, nil
+}
+
+func (p *CSV) Name() string { return p.name }
+
+// Lookup returns the rows matching the query, first by the descriptor's
+// own key, then its names, then the brand.
+func (p *CSV) Lookup(_ context.Context, q Query) ([]Candidate, error) {
+	keys := []string{descriptor.Normalise(q.Descriptor).Key}
+	for _, n := range q.Names {
+		keys = append(keys, descriptor.Key(n))
+	}
+	keys = append(keys, descriptor.Key(q.Brand))
+
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		rows := p.rows[key]
+		if len(rows) == 0 {
+			continue
+		}
+		out := make([]Candidate, 0, len(rows))
+		for _, row := range rows {
+			out = append(out, p.candidate(key, row))
+		}
+		return out, nil
+	}
+	return nil, nil
+}
+
+func (p *CSV) candidate(key string, row csvRow) Candidate {
+	evidence := map[string]any{"match": key, "line": row.line}
+	c := Candidate{Provider: p.name, Confidence: row.confidence}
+	for _, f := range csvFields {
+		if v, ok := row.values[f]; ok {
+			c.Records = append(c.Records, provenance.New(f, v, provenance.Source(p.name), row.confidence, evidence))
+		}
+	}
+	c.Raw, _ = json.Marshal(row.values)
+	return c
+}
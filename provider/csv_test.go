@@ -0,0 +1,84 @@
+package provider
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"merchantcache/provenance"
+)
+
+const knownMerchants = `match, brand_name, website_url, abn, confidence
+Woolworths, Woolworths, https://woolworths.com.au, 88000014675,
+Big W, Big W, https://bigw.com.au, 88000014675, 80
+, Nameless, https://example.com.au, ,
+`
+
+func TestNewCSV(t *testing.T) {
+	p, err := NewCSV("known", strings.NewReader(knownMerchants), 95)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(p.rows); n != 2 {
+		t.Errorf("%d merchant keys, want 2 with the blank match skipped", n)
+	}
+
+	for _, tt := range []struct{ name, header string }{
+		{"no match column", "brand_name,website_url\n"},
+		{"empty file", ""},
+	} {
+		if _, err := NewCSV("known", strings.NewReader(tt.header), 95); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
+
+func TestCSVLookup(t *testing.T) {
+	p, err := NewCSV("known", strings.NewReader(knownMerchants), 95)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name           string
+		q              Query
+		wantBrand      string
+		wantConfidence float64
+	}{
+		{name: "by name", q: Query{Descriptor: "EFTPOS 0001", Names: []string{"Big W"}}, wantBrand: "Big W", wantConfidence: 80},
+		{name: "by brand", q: Query{Descriptor: "EFTPOS 0001", Brand: "woolworths"}, wantBrand: "Woolworths", wantConfidence: 95},
+		{name: "no match", q: Query{Descriptor: "EFTPOS 0001", Names: []string{"Kmart"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cands, err := p.Lookup(context.Background(), tt.q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantBrand == "" {
+				if len(cands) != 0 {
+					t.Errorf("candidates %+v, want none", cands)
+				}
+				return
+			}
+			if len(cands) != 1 {
+				t.Fatalf("%d candidates, want 1", len(cands))
+			}
+			c := cands[0]
+			if c.Provider != "known" || c.Confidence != tt.wantConfidence || c.Value(provenance.BrandName) != tt.wantBrand {
+				t.Errorf("candidate = %+v", c)
+			}
+			if c.Value(provenance.ABN) != "88000014675" {
+				t.Errorf("abn = %q", c.Value(provenance.ABN))
+			}
+			if r, _ := provenance.Find(c.Records, provenance.Website); r.Source != "known" || r.Confidence != tt.wantConfidence {
+				t.Errorf("website record = %+v", r)
+			}
+		})
+	}
+}
+
+func TestNewCSVFromSettings(t *testing.T) {
+	if _, err := NewCSVFromSettings("known", Settings{}); err == nil || !strings.Contains(err.Error(), "path") {
+		t.Errorf("err = %v, want a missing path", err)
+	}
+}
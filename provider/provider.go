@@ -0,0 +1,300 @@
+// Package provider puts every enrichment source behind one interface. A
+// Provider answers a Query with Candidates, each carrying its field values
+// as provenance records, a confidence and the raw payload it was built
+// from. Providers are built by name from a Registry and asked in the order
+// a Chain gives, so a new source only has to implement Provider and be
+// listed in the providers file.
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"merchantcache/provenance"
+)
+
+// Query is what a provider is asked about. Brand providers work from the
+// descriptor, entity providers from the brand an earlier chain found, and
+// address providers from the entity.
+type Query struct {
+	Descriptor string   // raw transaction description
+	Names      []string // merchant names the descriptor was normalised to
+	Brand      string
+	Website    string
+	State      string
+	ABN        string // a known ABN, looked up directly when set
+	LegalName  string // the entity an entity chain found, for address lookups
+}
+
+// Candidate is one answer from a provider. Confidence is 0 to 100, like
+// the records' own confidences.
+type Candidate struct {
+	Provider   string
+	ID         string // the provider's own identifier, if it has one
+	Confidence float64
+	Records    []provenance.Record
+	Raw        json.RawMessage
+}
+
+// Value returns the candidate's most confident value for field, or "".
+func (c Candidate) Value(field provenance.Field) string {
+	r, _ := provenance.Find(c.Records, field)
+	return r.Value
+}
+
+// Provider looks merchants up in one source. Lookup returns no candidates
+// and no error when the source has nothing for the query.
+type Provider interface {
+	Name() string
+	Lookup(ctx context.Context, q Query) ([]Candidate, error)
+}
+
+// Settings are a provider's options from the providers file.
+type Settings map[string]string
+
+// String returns the setting for key, or def when it is not set.
+func (s Settings) String(key, def string) string {
+	if v, ok := s[key]; ok && v != "" {
+		return v
+	}
+	return def
+}
+
+// Float returns the setting for key as a number, or def when it is not
+// set or not a number.
+func (s Settings) Float(key string, def float64) float64 {
+	if v, err := strconv.ParseFloat(s[key], 64); err == nil {
+		return v
+	}
+	return def
+}
+
+// Bool returns the setting for key, or def when it is not set.
+func (s Settings) Bool(key string, def bool) bool {
+	if v, err := strconv.ParseBool(s[key]); err == nil {
+		return v
+	}
+	return def
+}
+
+// Factory builds a provider called name from its settings.
+type Factory func(name string, settings Settings) (Provider, error)
+
+// Registry maps provider types to the factories that build them.
+type Registry struct {
+	factories map[string]Factory
+}
+
+// NewRegistry returns a registry that knows the csv type.
+func NewRegistry() *Registry {
+	r := &Registry{factories: map[string]Factory{}}
+	r.Register("csv", NewCSVFromSettings)
+	return r
+}
+
+// Register adds or replaces the factory for a provider type.
+func (r *Registry) Register(typ string, f Factory) {
+	r.factories[typ] = f
+}
+
+// Types lists the registered provider types, sorted.
+func (r *Registry) Types() []string {
+	out := make([]string, 0, len(r.factories))
+	for t := range r.factories {
+		out = append(out, t)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Build makes the provider called name as the config describes it.
+func (r *Registry) Build(cfg Config, name string) (Provider, error) {
+	spec := cfg.Spec(name)
+	f, ok := r.factories[spec.Type]
+	if !ok {
+		return nil, fmt.Errorf("provider %s: unknown type %q, want one of %s", name, spec.Type, strings.Join(r.Types(), ", "))
+	}
+	p, err := f(name, spec.Settings)
+	if err != nil {
+		return nil, fmt.Errorf("provider %s: %w", name, err)
+	}
+	return p, nil
+}
+
+// Chain builds the named chain from cfg, with fresh providers. A chain cfg
+// leaves out is empty.
+func (r *Registry) Chain(cfg Config, chain string) (Chain, error) {
+	cc, ok := cfg.Chains[chain]
+	if !ok {
+		return Chain{Name: chain}, nil
+	}
+	c := Chain{Name: chain, Mode: cc.Mode}
+	for _, name := range cc.Providers {
+		p, err := r.Build(cfg, name)
+		if err != nil {
+			return Chain{}, err
+		}
+		c.Providers = append(c.Providers, p)
+	}
+	return c, nil
+}
+
+// Spec is how the providers file describes one provider. Type defaults to
+// the provider's own name, so built-in providers need no entry.
+type Spec struct {
+	Type     string   `json:"type"`
+	Settings Settings `json:"settings,omitempty"`
+}
+
+// Config is the providers file: the providers by name and the chains that
+// order them, e.g.
+//
+//	{"providers": {"known": {"type": "csv", "settings": {"path": "known.csv"}}},
+//	 "chains": {"brand": ["known", "brandfetch"], "entity": ["abr"], "address": ["google"]}}
+type Config struct {
+	Providers map[string]Spec        `json:"providers,omitempty"`
+	Chains    map[string]ChainConfig `json:"chains"`
+}
+
+// Spec returns the spec for the provider called name.
+func (c Config) Spec(name string) Spec {
+	s := c.Providers[name]
+	if s.Type == "" {
+		s.Type = name
+	}
+	return s
+}
+
+// LoadConfig reads a providers file. Chains it leaves out keep the ones
+// in def.
+func LoadConfig(path string, def Config) (Config, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, fmt.Errorf("read providers: %w", err)
+	}
+	var file Config
+	if err := json.Unmarshal(raw, &file); err != nil {
+		return Config{}, fmt.Errorf("parse providers %s: %w", path, err)
+	}
+
+	out := Config{Providers: map[string]Spec{}, Chains: map[string]ChainConfig{}}
+	for name, s := range def.Providers {
+		out.Providers[name] = s
+	}
+	for name, s := range file.Providers {
+		out.Providers[name] = s
+	}
+	for name, c := range def.Chains {
+		out.Chains[name] = c
+	}
+	for name, c := range file.Chains {
+		out.Chains[name] = c
+	}
+	return out, out.Validate()
+}
+
+// Validate checks the chain modes.
+func (c Config) Validate() error {
+	for name, cc := range c.Chains {
+		switch cc.Mode {
+		case "", Fallback, All:
+		default:
+			return fmt.Errorf("chain %s: unknown mode %q", name, cc.Mode)
+		}
+	}
+	return nil
+}
+
+// Mode is how a chain combines its providers.
+type Mode string
+
+const (
+	// Fallback asks each provider in order and stops at the first that
+	// answers.
+	Fallback Mode = "fallback"
+	// All asks every provider and ranks their candidates together, most
+	// confident first.
+	All Mode = "all"
+)
+
+// ChainConfig lists a chain's providers in order. In the providers file it
+// is either a plain list, which falls back in order, or
+// {"mode": "all", "providers": [...]}.
+type ChainConfig struct {
+	Mode      Mode     `json:"mode,omitempty"`
+	Providers []string `json:"providers"`
+}
+
+func (c *ChainConfig) UnmarshalJSON(b []byte) error {
+	var list []string
+	if err := json.Unmarshal(b, &list); err == nil {
+		*c = ChainConfig{Providers: list}
+		return nil
+	}
+	type plain ChainConfig
+	return json.Unmarshal(b, (*plain)(c))
+}
+
+// Chain asks its providers in order.
+type Chain struct {
+	Name      string
+	Mode      Mode
+	Providers []Provider
+}
+
+// Empty reports whether the chain has no providers to ask.
+func (c Chain) Empty() bool {
+	return len(c.Providers) == 0
+}
+
+// Lookup asks the chain's providers. A provider that fails is passed over;
+// its error is only returned, joined with the others, when no provider
+// answered. A cancelled ctx stops the chain at once.
+func (c Chain) Lookup(ctx context.Context, q Query) ([]Candidate, error) {
+	var (
+		out  []Candidate
+		errs []error
+	)
+	for _, p := range c.Providers {
+		cands, err := p.Lookup(ctx, q)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", p.Name(), err))
+			continue
+		}
+		for i := range cands {
+			if cands[i].Provider == "" {
+				cands[i].Provider = p.Name()
+			}
+		}
+		out = append(out, cands...)
+		if len(out) > 0 && c.Mode != All {
+			break
+		}
+	}
+	if len(out) == 0 {
+		return nil, errors.Join(errs...)
+	}
+	if c.Mode == All {
+		sort.SliceStable(out, func(i, j int) bool { return out[i].Confidence > out[j].Confidence })
+	}
+	return out, nil
+}
+
+// Best returns the chain's best candidate for q, and false when no
+// provider had one.
+func (c Chain) Best(ctx context.Context, q Query) (Candidate, bool, error) {
+	cands, err := c.Lookup(ctx, q)
+	if err != nil || len(cands) == 0 {
+		return Candidate{}, false, err
+	}
+	return cands[0], true, nil
+}
@@ -0,0 +1,230 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fake answers every query with its candidates or its error, counting the
+// calls it gets.
+type fake struct {
+	name  string
+	cands []Candidate
+	err   error
+	calls int
+}
+
+func (f *fake) Name() string { return f.name }
+
+func (f *fake) Lookup(context.Context, Query) ([]Candidate, error) {
+	f.calls++
+	return f.cands, f.err
+}
+
+func answers(name string, confidences ...float64) *fake {
+	f := &fake{name: name}
+	for _, c := range confidences {
+		f.cands = append(f.cands, Candidate{Confidence: c})
+	}
+	return f
+}
+
+func TestChainLookup(t *testing.T) {
+	errDown := errors.New("service down")
+	failing := func(name string) *fake { return &fake{name: name, err: errDown} }
+
+	tests := []struct {
+		name      string
+		mode      Mode
+		providers []*fake
+		want      []string // provider of each candidate, in order
+		wantCalls []int
+		wantErr   bool
+	}{
+		{
+			name:      "fallback stops at the first answer",
+			providers: []*fake{answers("known", 90), answers("brandfetch", 80)},
+			want:      []string{"known"},
+			wantCalls: []int{1, 0},
+		},
+		{
+			name:      "fallback passes over a miss",
+			providers: []*fake{answers("known"), answers("brandfetch", 80), answers("google", 70)},
+			want:      []string{"brandfetch"},
+			wantCalls: []int{1, 1, 0},
+		},
+		{
+			name:      "fallback passes over an error",
+			providers: []*fake{failing("brandfetch"), answers("google", 70)},
+			want:      []string{"google"},
+			wantCalls: []int{1, 1},
+		},
+		{
+			name:      "every provider misses",
+			providers: []*fake{answers("known"), answers("brandfetch")},
+			wantCalls: []int{1, 1},
+		},
+		{
+			name:      "a miss after an error is still an error",
+			providers: []*fake{failing("brandfetch"), answers("google")},
+			wantCalls: []int{1, 1},
+			wantErr:   true,
+		},
+		{
+			name:      "all asks everyone and ranks by confidence",
+			mode:      All,
+			providers: []*fake{answers("known", 60), failing("brandfetch"), answers("google", 95, 40)},
+			want:      []string{"google", "known", "google"},
+			wantCalls: []int{1, 1, 1},
+		},
+		{name: "empty chain"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Chain{Name: "brand", Mode: tt.mode}
+			for _, p := range tt.providers {
+				c.Providers = append(c.Providers, p)
+			}
+			cands, err := c.Lookup(context.Background(), Query{Descriptor: "WOOLWORTHS 1234"})
+			if tt.wantErr {
+				if !errors.Is(err, errDown) || !strings.Contains(err.Error(), "brandfetch: service down") {
+					t.Errorf("err = %v, want the provider's error", err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, c := range cands {
+				got = append(got, c.Provider)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("candidates from %v, want %v", got, tt.want)
+			}
+			for i, p := range tt.providers {
+				if p.calls != tt.wantCalls[i] {
+					t.Errorf("%s asked %d times, want %d", p.name, p.calls, tt.wantCalls[i])
+				}
+			}
+		})
+	}
+}
+
+func TestChainBest(t *testing.T) {
+	c := Chain{Mode: All, Providers: []Provider{answers("known", 60), answers("google", 95)}}
+	best, ok, err := c.Best(context.Background(), Query{})
+	if err != nil || !ok || best.Provider != "google" {
+		t.Errorf("Best = %+v, %v, %v", best, ok, err)
+	}
+	if _, ok, err := (Chain{}).Best(context.Background(), Query{}); ok || err != nil {
+		t.Errorf("empty chain Best = %v, %v", ok, err)
+	}
+}
+
+func TestChainCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	second := answers("google", 70)
+	c := Chain{Providers: []Provider{&fake{name: "brandfetch", err: context.Canceled}, second}}
+	if _, err := c.Lookup(ctx, Query{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want context.Canceled", err)
+	}
+	if second.calls != 0 {
+		t.Error("chain carried on after ctx was cancelled")
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	def := Config{Chains: map[string]ChainConfig{
+		"brand":  {Providers: []string{"brandfetch"}},
+		"entity": {Providers: []string{"abr"}},
+	}}
+	tests := []struct {
+		name    string
+		file    string
+		want    Config
+		wantErr string
+	}{
+		{
+			name: "plain lists and modes over the defaults",
+			file: `{"providers": {"known": {"type": "csv", "settings": {"path": "known.csv"}}},
+			        "chains": {"brand": ["known", "brandfetch"], "address": {"mode": "all", "providers": ["google", "abr"]}}}`,
+			want: Config{
+				Providers: map[string]Spec{"known": {Type: "csv", Settings: Settings{"path": "known.csv"}}},
+				Chains: map[string]ChainConfig{
+					"brand":   {Providers: []string{"known", "brandfetch"}},
+					"entity":  {Providers: []string{"abr"}},
+					"address": {Mode: All, Providers: []string{"google", "abr"}},
+				},
+			},
+		},
+		{
+			name:    "unknown mode",
+			file:    `{"chains": {"brand": {"mode": "race", "providers": ["brandfetch"]}}}`,
+			wantErr: `chain brand: unknown mode "race"`,
+		},
+		{
+			name:    "invalid json",
+			file:    `{"chains": [`,
+			wantErr: "parse providers",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "providers.json")
+			if err := os.WriteFile(path, []byte(tt.file), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := LoadConfig(path, def)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("err = %v, want one mentioning %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("config = %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegistryChain(t *testing.T) {
+	r := NewRegistry()
+	r.Register("stub", func(name string, s Settings) (Provider, error) {
+		return answers(name, s.Float("confidence", 50)), nil
+	})
+	cfg := Config{
+		Providers: map[string]Spec{"known": {Type: "stub", Settings: Settings{"confidence": "80"}}},
+		Chains:    map[string]ChainConfig{"brand": {Providers: []string{"known", "stub"}}},
+	}
+
+	c, err := r.Chain(cfg, "brand")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, p := range c.Providers {
+		names = append(names, p.Name())
+	}
+	// stub has no entry, so it is built from the type of the same name
+	if !reflect.DeepEqual(names, []string{"known", "stub"}) {
+		t.Errorf("providers = %v", names)
+	}
+	if c, err := r.Chain(cfg, "address"); err != nil || !c.Empty() {
+		t.Errorf("missing chain = %+v, %v, want it empty", c, err)
+	}
+
+	cfg.Chains["entity"] = ChainConfig{Providers: []string{"abr"}}
+	if _, err := r.Chain(cfg, "entity"); err == nil || !strings.Contains(err.Error(), `unknown type "abr"`) {
+		t.Errorf("err = %v, want an unknown type", err)
+	}
+}
@@ -0,0 +1,43 @@
+package ratelimit
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Backoff spaces out retries of a failed request: the wait starts at Base
+// and doubles per attempt, capped at Max.
+type Backoff struct {
+	Base time.Duration
+	Max  time.Duration
+}
+
+// Delay returns the wait before retry number attempt, counting from 0.
+func (b Backoff) Delay(attempt int) time.Duration {
+	d := b.Base << attempt
+	if d <= 0 || d > b.Max {
+		return b.Max
+	}
+	return d
+}
+
+// RetryAfter reads a Retry-After header given in seconds or as an HTTP
+// date, capped at Max. It returns 0 when the header is missing or unusable,
+// so the caller falls back to Delay.
+func (b Backoff) RetryAfter(v string) time.Duration {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+		return min(time.Duration(secs)*time.Second, b.Max)
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return min(d, b.Max)
+		}
+	}
+	return 0
+}
@@ -0,0 +1,40 @@
+package ratelimit
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	b := Backoff{Base: 500 * time.Millisecond, Max: 30 * time.Second}
+	for attempt, want := range []time.Duration{500 * time.Millisecond, time.Second, 2 * time.Second} {
+		if got := b.Delay(attempt); got != want {
+			t.Errorf("Delay(%d) = %v, want %v", attempt, got, want)
+		}
+	}
+	if got := b.Delay(10); got != 30*time.Second {
+		t.Errorf("Delay(10) = %v, want the cap", got)
+	}
+	if got := b.Delay(100); got != 30*time.Second {
+		t.Errorf("Delay(100) = %v, want the cap on overflow", got)
+	}
+
+	for v, want := range map[string]time.Duration{
+		"":                              0,
+		"7":                             7 * time.Second,
+		" 120 ":                         30 * time.Second,
+		"0":                             0,
+		"-1":                            0,
+		"soon":                          0,
+		"Wed, 21 Oct 2015 07:28:00 GMT": 0,
+	} {
+		if got := b.RetryAfter(v); got != want {
+			t.Errorf("RetryAfter(%q) = %v, want %v", v, got, want)
+		}
+	}
+	future := time.Now().Add(10 * time.Second).UTC().Format(http.TimeFormat)
+	if got := b.RetryAfter(future); got < 8*time.Second || got > 10*time.Second {
+		t.Errorf("RetryAfter(%q) = %v", future, got)
+	}
+}
@@ -0,0 +1,79 @@
+package ratelimit
+
+import (
+	"errors"
+	"net/http"
+	"sync/atomic"
+)
+
+// ErrBudgetSpent is returned for requests made after a Budget ran out.
+var ErrBudgetSpent = errors.New("request budget spent")
+
+// Budget caps the number of requests a run may make. A nil Budget or one
+// with a non-positive limit never runs out.
+type Budget struct {
+	limit int64
+	used  atomic.Int64
+}
+
+// NewBudget returns a Budget allowing limit requests.
+func NewBudget(limit int) *Budget {
+	return &Budget{limit: int64(limit)}
+}
+
+// Take uses one request from the budget, reporting false when none are
+// left.
+func (b *Budget) Take() bool {
+	if b == nil || b.limit <= 0 {
+		return true
+	}
+	if b.used.Add(1) > b.limit {
+		b.used.Add(-1)
+		return false
+	}
+	return true
+}
+
+// Limit returns how many requests the budget allows, 0 or less meaning no
+// limit.
+func (b *Budget) Limit() int {
+	if b == nil {
+		return 0
+	}
+	return int(b.limit)
+}
+
+// Used returns how many requests have been made.
+func (b *Budget) Used() int {
+	if b == nil {
+		return 0
+	}
+	return int(b.used.Load())
+}
+
+// Spent reports whether the budget has run out.
+func (b *Budget) Spent() bool {
+	return b != nil && b.limit > 0 && b.used.Load() >= b.limit
+}
+
+// BudgetTransport takes from a Budget before handing each request to Base,
+// failing with ErrBudgetSpent once it is empty.
+type BudgetTransport struct {
+	Base   http.RoundTripper
+	Budget *Budget
+}
+
+// NewBudgetTransport wraps base (http.DefaultTransport when nil) with b.
+func NewBudgetTransport(base http.RoundTripper, b *Budget) *BudgetTransport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &BudgetTransport{Base: base, Budget: b}
+}
+
+func (t *BudgetTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.Budget.Take() {
+		return nil, ErrBudgetSpent
+	}
+	return t.Base.RoundTrip(req)
+}
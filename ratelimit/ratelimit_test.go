@@ -0,0 +1,64 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLimiterWait(t *testing.T) {
+	l := New(20, 2)
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		if err := l.Wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Two from the burst, then two at 50ms each
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("4 tokens at 20/s with a burst of 2 took %v", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := New(0.001, 1).Wait(ctx); err != nil {
+		t.Errorf("first token = %v, want it from the burst", err)
+	}
+	l = New(0.001, 1)
+	l.Wait(context.Background())
+	if err := l.Wait(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled wait = %v", err)
+	}
+}
+
+func TestTransportTimeoutStartsAfterWait(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(300 * time.Millisecond)
+		}
+		io.WriteString(w, "ok")
+	}))
+	defer srv.Close()
+
+	// After the first, each request queues 100ms for a token, twice the timeout
+	client := &http.Client{Transport: NewTransport(srv.Client().Transport, New(10, 1)).WithTimeout(50 * time.Millisecond)}
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || string(body) != "ok" {
+			t.Fatalf("request %d body = %q, %v", i, body, err)
+		}
+	}
+
+	if _, err := client.Get(srv.URL + "/slow"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("slow request = %v, want the per-request deadline", err)
+	}
+}